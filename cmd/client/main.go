@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	"termchat/internal"
 	"termchat/internal/app"
@@ -18,6 +20,9 @@ func main() {
 	help := flag.Bool("help", false, "Show help and keyboard shortcuts")
 	serverJoinURL := flag.String("server", defaultServer, "WebSocket join URL (e.g., ws://localhost:8080/join)")
 	username := flag.String("user", defaultUser, "default username for login prompts")
+	printURL := flag.Bool("print-url", false, "print the websocket, API and exists URLs for the room and exit")
+	connectTimeout := flag.Duration("connect-timeout", envDurationOrDefault("TERMCHAT_CONNECT_TIMEOUT", 0), "how long joining a room may take before retrying (0 for the default of 10s)")
+	nameWidth := flag.Int("name-width", envIntOrDefault("TERMCHAT_NAME_WIDTH", 0), "cells a username may take in lists and chat before it is cut with an ellipsis (0 for the default of 20)")
 	flag.Parse()
 
 	// Handle help flag
@@ -50,9 +55,21 @@ func main() {
 	}
 
 	cfg := app.ClientConfig{
-		ServerURL: *serverJoinURL,
-		RoomKey:   roomKey,
-		Username:  *username,
+		ServerURL:      *serverJoinURL,
+		RoomKey:        roomKey,
+		Username:       *username,
+		ConnectTimeout: *connectTimeout,
+		NameWidth:      *nameWidth,
+	}
+
+	if *printURL {
+		urls, err := app.ConnectionURLs(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Print(urls)
+		os.Exit(0)
 	}
 
 	if err := app.RunClient(cfg); err != nil {
@@ -68,6 +85,26 @@ func envOrDefault(key, fallback string) string {
 	return fallback
 }
 
+func envIntOrDefault(key string, fallback int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+		fmt.Fprintf(os.Stderr, "ignoring invalid %s=%q\n", key, value)
+	}
+	return fallback
+}
+
+func envDurationOrDefault(key string, fallback time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			return parsed
+		}
+		fmt.Fprintf(os.Stderr, "ignoring invalid %s=%q\n", key, value)
+	}
+	return fallback
+}
+
 func showHelp() {
 	fmt.Printf("termchat v%s - Terminal-based chat application\n\n", internal.Version)
 	
@@ -76,6 +113,7 @@ func showHelp() {
 	fmt.Println("  termchat --help              Show this help message")
 	fmt.Println("  termchat --version           Show version information")
 	fmt.Println("  termchat --update            Update to the latest version")
+	fmt.Println("  termchat --print-url <room>  Print the URLs used for a room and exit")
 	fmt.Println()
 	
 	fmt.Println("AUTHENTICATION SCREEN:")
@@ -88,7 +126,11 @@ func showHelp() {
 	fmt.Println("  ↑ / ↓      Navigate friend list")
 	fmt.Println("  Enter      Start chat with selected friend")
 	fmt.Println("  A          Add a friend")
-	fmt.Println("  I          View incoming friend requests")
+	fmt.Println("  X          Remove the selected friend (press twice to confirm)")
+	fmt.Println("  K          Block the selected friend (press twice to confirm)")
+	fmt.Println("  Shift+K    List blocked users; U unblocks the selected one")
+	fmt.Println("  B          Bulk import friends from a list or file")
+	fmt.Println("  I          View incoming friend requests (K blocks the sender)")
 	fmt.Println("  O          View outgoing friend requests")
 	fmt.Println("  M          Manually join a room by code")
 	fmt.Println("  N          Create a new room")
@@ -107,6 +149,9 @@ func showHelp() {
 	fmt.Println("CHAT SCREEN:")
 	fmt.Println("  Esc        Leave chat room")
 	fmt.Println("  Enter      Send message")
+	fmt.Println("  ↑          Edit your last message (empty input)")
+	fmt.Println("  Alt+↑ / ↓  Recall previously sent lines")
+	fmt.Println("  Tab        Complete a /command or @name (again for the next match)")
 	fmt.Println("  Ctrl+C     Force quit")
 	fmt.Println()
 	
@@ -114,7 +159,16 @@ func showHelp() {
 	fmt.Println("  /upload           Open file picker to select and upload a file")
 	fmt.Println("  /upload <path>    Upload a specific file")
 	fmt.Println("  /download <file>  Download a file from the room")
-	fmt.Println("  /leave            Exit the current chat room")
+	fmt.Println("  /edit [id] <text> Edit your last message, or the one tagged with that #id")
+	fmt.Println("  /delete           Delete your last message")
+	fmt.Println("  /delete <file>    Delete a file you uploaded")
+	fmt.Println("  /me <action>      Send an action, e.g. /me waves → * alice waves")
+	fmt.Println("  /react <emoji>    React to the latest message or file (Ctrl+R cycles reactions)")
+	fmt.Println("  /leave            Exit the current chat room (/quit and /exit also work)")
+	fmt.Println("  /clear            Clear the chat screen without leaving the room")
+	fmt.Println("  /clear messages   Clear chat messages but keep system notices")
+	fmt.Println("  /help             List these commands in the chat")
+	fmt.Println("  Anything else starting with / is rejected as an unknown command")
 	fmt.Println()
 	
 	fmt.Println("FILE PICKER:")
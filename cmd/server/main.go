@@ -6,7 +6,9 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
 	"termchat/internal/app"
 )
@@ -15,12 +17,44 @@ func main() {
 	addr := flag.String("addr", envOrDefault("TERMCHAT_ADDR", ":8080"), "server listen address")
 	path := flag.String("path", envOrDefault("TERMCHAT_PATH", "/join"), "websocket join path")
 	dbPath := flag.String("db", envOrDefault("TERMCHAT_DB_PATH", app.DefaultDBPath()), "sqlite database path")
+	persistFiles := flag.Bool("persist-files", false, "keep group room files after the room empties")
+	maxRoomBytes := flag.Int64("max-room-bytes", int64(envIntOrDefault("TERMCHAT_MAX_ROOM_BYTES", 0)), "total size in bytes of the files one room may hold (0 for no limit)")
+	maxRoomSize := flag.Int("max-room-size", envIntOrDefault("TERMCHAT_MAX_ROOM_SIZE", 0), "connections one room may hold at once (0 for no limit)")
+	auditLog := flag.Bool("audit-log", false, "record logins, signups and other account security events for /admin/audit")
+	auditFile := flag.String("audit-file", envOrDefault("TERMCHAT_AUDIT_FILE", ""), "also append audit events to this file as JSON lines (turns on --audit-log)")
+	tlsCert := flag.String("tls-cert", envOrDefault("TERMCHAT_TLS_CERT", ""), "TLS certificate file to serve https and wss:// directly (needs --tls-key)")
+	tlsKey := flag.String("tls-key", envOrDefault("TERMCHAT_TLS_KEY", ""), "TLS private key file for --tls-cert")
+	allowedOrigins := flag.String("allowed-origins", envOrDefault("TERMCHAT_ALLOWED_ORIGINS", ""), "comma-separated browser origins allowed to open websockets, * wildcards allowed (default any)")
+	reservedUsernames := flag.String("reserved-usernames", envOrDefault("TERMCHAT_RESERVED_USERNAMES", ""), "comma-separated usernames nobody can sign up with (default admin,system,server)")
+	historyLimit := flag.Int("history-limit", envIntOrDefault("TERMCHAT_HISTORY_LIMIT", 0), "messages replayed to clients joining a room (0 for the default of 50, -1 to disable)")
+	adminToken := flag.String("admin-token", envOrDefault("TERMCHAT_ADMIN_TOKEN", ""), "bearer token for the operator endpoints under /admin (prefer setting TERMCHAT_ADMIN_TOKEN)")
+	region := flag.String("region", envOrDefault("TERMCHAT_REGION", app.DefaultRegion()), "relay name reported by /ping (defaults to the Fly.io region)")
+	rateLimitWindow := flag.Duration("rate-limit-window", envDurationOrDefault("TERMCHAT_RATE_LIMIT_WINDOW", 0), "window for the per-connection message rate limit; 0 for the default of 3s")
+	rateLimitBurst := flag.Int("rate-limit-burst", envIntOrDefault("TERMCHAT_RATE_LIMIT_BURST", 0), "messages a connection may send per rate limit window; 0 for the default of 5")
+	idleRoomTimeout := flag.Duration("idle-room-timeout", envDurationOrDefault("TERMCHAT_IDLE_ROOM_TIMEOUT", 0), "how long an empty room lingers before it's torn down; 0 for the default of 10m, negative to disable")
+	bcryptCost := flag.Int("bcrypt-cost", envIntOrDefault("TERMCHAT_BCRYPT_COST", 0), "bcrypt work factor for password hashes, 4-31; 0 for the default of 10")
 	flag.Parse()
 
 	serverCfg := app.ServerConfig{
-		Addr:   *addr,
-		Path:   app.NormalizeJoinPath(*path),
-		DBPath: *dbPath,
+		Addr:              *addr,
+		Path:              app.NormalizeJoinPath(*path),
+		DBPath:            *dbPath,
+		PersistFiles:      *persistFiles,
+		MaxRoomBytes:      *maxRoomBytes,
+		MaxRoomSize:       *maxRoomSize,
+		ReservedUsernames: app.ParseList(*reservedUsernames),
+		HistoryLimit:      *historyLimit,
+		AdminToken:        *adminToken,
+		Region:            *region,
+		RateLimitWindow:   *rateLimitWindow,
+		RateLimitBurst:    *rateLimitBurst,
+		AuditLog:          *auditLog,
+		AuditFile:         *auditFile,
+		TLSCertFile:       *tlsCert,
+		TLSKeyFile:        *tlsKey,
+		AllowedOrigins:    app.ParseList(*allowedOrigins),
+		IdleRoomTimeout:   *idleRoomTimeout,
+		BcryptCost:        *bcryptCost,
 	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
@@ -43,3 +77,23 @@ func envOrDefault(key, fallback string) string {
 	}
 	return fallback
 }
+
+func envIntOrDefault(key string, fallback int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+		log.Printf("ignoring invalid %s=%q", key, value)
+	}
+	return fallback
+}
+
+func envDurationOrDefault(key string, fallback time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			return parsed
+		}
+		log.Printf("ignoring invalid %s=%q", key, value)
+	}
+	return fallback
+}
@@ -1,19 +1,24 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"golang.org/x/term"
+
 	"termchat/internal/app"
 )
 
@@ -21,6 +26,10 @@ const (
 	modeServer = "server"
 	modeClient = "client"
 	modeLocal  = "local"
+	modeLogin  = "login"
+	modeLogout = "logout"
+	modeSignup = "signup"
+	modeTail   = "tail"
 )
 
 func main() {
@@ -32,6 +41,27 @@ func main() {
 	serverURL := flagSet.String("server-url", envOrDefault("TERMCHAT_SERVER", "wss://termchat-server-al.fly.dev/join"), "server websocket URL (client mode)")
 	username := flagSet.String("user", envOrDefault("TERMCHAT_USER", ""), "default username for login prompts")
 	quiet := flagSet.Bool("quiet", false, "suppress informational logs")
+	verbose := flagSet.Bool("verbose", false, "also log routine housekeeping such as expired session sweeps (server mode)")
+	persistFiles := flagSet.Bool("persist-files", false, "keep group room files after the room empties (server mode)")
+	maxRoomBytes := flagSet.Int64("max-room-bytes", int64(envIntOrDefault("TERMCHAT_MAX_ROOM_BYTES", 0)), "total size in bytes of the files one room may hold (server mode; 0 for no limit)")
+	maxRoomSize := flagSet.Int("max-room-size", envIntOrDefault("TERMCHAT_MAX_ROOM_SIZE", 0), "connections one room may hold at once (server mode; 0 for no limit)")
+	auditLog := flagSet.Bool("audit-log", false, "record logins, signups and other account security events for /admin/audit (server mode)")
+	auditFile := flagSet.String("audit-file", envOrDefault("TERMCHAT_AUDIT_FILE", ""), "also append audit events to this file as JSON lines (server mode; turns on --audit-log)")
+	tlsCert := flagSet.String("tls-cert", envOrDefault("TERMCHAT_TLS_CERT", ""), "TLS certificate file to serve https and wss:// directly (server mode; needs --tls-key)")
+	tlsKey := flagSet.String("tls-key", envOrDefault("TERMCHAT_TLS_KEY", ""), "TLS private key file for --tls-cert")
+	passwordStdin := flagSet.Bool("password-stdin", false, "read the password from stdin (login and signup modes)")
+	allowedOrigins := flagSet.String("allowed-origins", envOrDefault("TERMCHAT_ALLOWED_ORIGINS", ""), "comma-separated browser origins allowed to open websockets, * wildcards allowed (server mode; default any)")
+	reservedUsernames := flagSet.String("reserved-usernames", envOrDefault("TERMCHAT_RESERVED_USERNAMES", ""), "comma-separated usernames nobody can sign up with (server mode)")
+	historyLimit := flagSet.Int("history-limit", envIntOrDefault("TERMCHAT_HISTORY_LIMIT", 0), "messages replayed to clients joining a room (0 for the default of 50, -1 to disable)")
+	adminToken := flagSet.String("admin-token", envOrDefault("TERMCHAT_ADMIN_TOKEN", ""), "bearer token for the operator endpoints under /admin (server mode)")
+	region := flagSet.String("region", envOrDefault("TERMCHAT_REGION", app.DefaultRegion()), "relay name reported by /ping (server mode; defaults to the Fly.io region)")
+	rateLimitWindow := flagSet.Duration("rate-limit-window", envDurationOrDefault("TERMCHAT_RATE_LIMIT_WINDOW", 0), "window for the per-connection message rate limit (server mode); 0 for the default of 3s")
+	rateLimitBurst := flagSet.Int("rate-limit-burst", envIntOrDefault("TERMCHAT_RATE_LIMIT_BURST", 0), "messages a connection may send per rate limit window (server mode); 0 for the default of 5")
+	idleRoomTimeout := flagSet.Duration("idle-room-timeout", envDurationOrDefault("TERMCHAT_IDLE_ROOM_TIMEOUT", 0), "how long an empty room lingers before it's torn down (server mode); 0 for the default of 10m, negative to disable")
+	bcryptCost := flagSet.Int("bcrypt-cost", envIntOrDefault("TERMCHAT_BCRYPT_COST", 0), "bcrypt work factor for password hashes, 4-31 (server mode); 0 for the default of 10")
+	printURL := flagSet.Bool("print-url", false, "print the websocket, API and exists URLs for the room and exit (client mode)")
+	connectTimeout := flagSet.Duration("connect-timeout", envDurationOrDefault("TERMCHAT_CONNECT_TIMEOUT", 0), "how long joining a room may take before retrying (client mode; 0 for the default of 10s)")
+	nameWidth := flagSet.Int("name-width", envIntOrDefault("TERMCHAT_NAME_WIDTH", 0), "cells a username may take in lists and chat before it is cut with an ellipsis (client mode; 0 for the default of 20)")
 	flagSet.Parse(args)
 
 	roomKey := ""
@@ -40,18 +70,37 @@ func main() {
 	}
 
 	serverCfg := app.ServerConfig{
-		Addr:   *addr,
-		Path:   app.NormalizeJoinPath(*path),
-		DBPath: *db,
+		Addr:              *addr,
+		Path:              app.NormalizeJoinPath(*path),
+		DBPath:            *db,
+		PersistFiles:      *persistFiles,
+		MaxRoomBytes:      *maxRoomBytes,
+		MaxRoomSize:       *maxRoomSize,
+		ReservedUsernames: app.ParseList(*reservedUsernames),
+		HistoryLimit:      *historyLimit,
+		AdminToken:        *adminToken,
+		Region:            *region,
+		RateLimitWindow:   *rateLimitWindow,
+		RateLimitBurst:    *rateLimitBurst,
+		AuditLog:          *auditLog,
+		AuditFile:         *auditFile,
+		TLSCertFile:       *tlsCert,
+		TLSKeyFile:        *tlsKey,
+		AllowedOrigins:    app.ParseList(*allowedOrigins),
+		IdleRoomTimeout:   *idleRoomTimeout,
+		BcryptCost:        *bcryptCost,
+		Verbose:           *verbose,
 	}
 	if serverCfg.DBPath == "" {
 		serverCfg.DBPath = app.DefaultDBPath()
 	}
 
 	clientCfg := app.ClientConfig{
-		ServerURL: *serverURL,
-		Username:  *username,
-		RoomKey:   roomKey,
+		ServerURL:      *serverURL,
+		Username:       *username,
+		RoomKey:        roomKey,
+		ConnectTimeout: *connectTimeout,
+		NameWidth:      *nameWidth,
 	}
 
 	infof := func(format string, args ...interface{}) {
@@ -70,8 +119,20 @@ func main() {
 		err = runServerMode(ctx, serverCfg, infof)
 	case modeLocal:
 		err = runLocalMode(ctx, serverCfg, clientCfg, infof)
+	case modeLogin:
+		err = runLoginMode(clientCfg, *passwordStdin)
+	case modeLogout:
+		err = runLogoutMode(clientCfg)
+	case modeSignup:
+		err = runSignupMode(clientCfg, *passwordStdin)
+	case modeTail:
+		err = runTailMode(ctx, clientCfg, flagSet.Args())
 	default:
-		err = runClientMode(clientCfg)
+		if *printURL {
+			err = runPrintURLMode(clientCfg)
+		} else {
+			err = runClientMode(clientCfg)
+		}
 	}
 
 	if err != nil && !errors.Is(err, context.Canceled) {
@@ -96,7 +157,102 @@ func runClientMode(cfg app.ClientConfig) error {
 	return app.RunClient(cfg)
 }
 
+// runPrintURLMode prints the URLs the client would connect to, so they can be
+// tried by hand with websocat or curl
+func runPrintURLMode(cfg app.ClientConfig) error {
+	urls, err := app.ConnectionURLs(cfg)
+	if err != nil {
+		return fmt.Errorf("print-url: %w", err)
+	}
+	fmt.Print(urls)
+	return nil
+}
+
+// runLoginMode saves a session without opening the TUI. The password comes
+// from stdin or a no-echo prompt, never from the command line where ps shows it.
+func runLoginMode(cfg app.ClientConfig, passwordStdin bool) error {
+	if cfg.Username == "" {
+		return errors.New("login requires --user or TERMCHAT_USER")
+	}
+	password, err := readPassword(passwordStdin)
+	if err != nil {
+		return err
+	}
+	if err := app.Login(cfg, password); err != nil {
+		return err
+	}
+	fmt.Printf("Logged in as %s\n", cfg.Username)
+	return nil
+}
+
+// runSignupMode creates an account and saves its session, for provisioning
+// scripts. The password is read the same way as in login mode.
+func runSignupMode(cfg app.ClientConfig, passwordStdin bool) error {
+	if cfg.Username == "" {
+		return errors.New("signup requires --user or TERMCHAT_USER")
+	}
+	password, err := readPassword(passwordStdin)
+	if err != nil {
+		return err
+	}
+	if err := app.Signup(cfg, password); err != nil {
+		return err
+	}
+	fmt.Printf("Signed up and logged in as %s\n", cfg.Username)
+	return nil
+}
+
+func readPassword(fromStdin bool) (string, error) {
+	switch {
+	case fromStdin:
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", fmt.Errorf("read password: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	case term.IsTerminal(int(os.Stdin.Fd())):
+		fmt.Fprint(os.Stderr, "Password: ")
+		raw, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("read password: %w", err)
+		}
+		return string(raw), nil
+	default:
+		return "", errors.New("stdin is not a terminal; use --password-stdin")
+	}
+}
+
+// runTailMode prints the chat in one or more rooms to stdout until
+// interrupted, e.g. to keep a log of several rooms in one file
+func runTailMode(ctx context.Context, cfg app.ClientConfig, rooms []string) error {
+	if len(rooms) == 0 {
+		return errors.New("tail requires at least one room")
+	}
+	return app.Tail(ctx, cfg, rooms, os.Stdout)
+}
+
+// runLogoutMode always clears the local session; a failed server call is only
+// reported as a warning since the token is gone from this machine either way.
+func runLogoutMode(cfg app.ClientConfig) error {
+	username, serverErr, err := app.Logout(cfg)
+	if err != nil {
+		return fmt.Errorf("remove session: %w", err)
+	}
+	if serverErr != nil {
+		fmt.Fprintf(os.Stderr, "termchat: warning: server logout failed: %v\n", serverErr)
+	}
+	if username == "" {
+		fmt.Println("Not logged in")
+		return nil
+	}
+	fmt.Printf("Logged out %s\n", username)
+	return nil
+}
+
 func runLocalMode(ctx context.Context, serverCfg app.ServerConfig, clientCfg app.ClientConfig, infof func(string, ...interface{})) error {
+	// The bundled client talks plain ws:// to its own loopback server
+	serverCfg.TLSCertFile, serverCfg.TLSKeyFile = "", ""
 	if err := os.MkdirAll(filepath.Dir(serverCfg.DBPath), 0o700); err != nil {
 		return fmt.Errorf("create data dir: %w", err)
 	}
@@ -151,7 +307,7 @@ func parseMode(args []string) (string, []string) {
 		return modeClient, args
 	}
 	switch strings.ToLower(args[0]) {
-	case modeServer, modeClient, modeLocal:
+	case modeServer, modeClient, modeLocal, modeLogin, modeLogout, modeSignup, modeTail:
 		return strings.ToLower(args[0]), args[1:]
 	case "auto": // backward compatibility
 		return modeLocal, args[1:]
@@ -173,6 +329,26 @@ func envOrDefault(key, fallback string) string {
 	return fallback
 }
 
+func envIntOrDefault(key string, fallback int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+		log.Printf("ignoring invalid %s=%q", key, value)
+	}
+	return fallback
+}
+
+func envDurationOrDefault(key string, fallback time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			return parsed
+		}
+		log.Printf("ignoring invalid %s=%q", key, value)
+	}
+	return fallback
+}
+
 func stopServer(handle *app.ServerHandle) {
 	if handle == nil {
 		return
@@ -1,15 +1,70 @@
 package app
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"os"
 
 	intrnl "termchat/internal"
 )
 
-// RunClient launches the Bubble Tea TUI with the provided configuration.
+// ErrServerUnreachable means no server answered at cfg.ServerURL. RunClient
+// warns about it rather than failing.
+var ErrServerUnreachable = intrnl.ErrServerUnreachable
+
+// RunClient launches the Bubble Tea TUI with the provided configuration. It
+// checks that the server is reachable first, and if it isn't, warns and
+// starts anyway so the cached friends list can still be shown.
 func RunClient(cfg ClientConfig) error {
 	if cfg.ServerURL == "" {
 		return errors.New("server URL is required")
 	}
-	return intrnl.RunClient(cfg.ServerURL, cfg.RoomKey, cfg.Username)
+	if err := intrnl.CheckServer(cfg.ServerURL); errors.Is(err, ErrServerUnreachable) {
+		fmt.Fprintf(os.Stderr, "warning: %v\nThe server may be down or retired; showing cached lists until it answers. Set TERMCHAT_SERVER or pass a server URL to use another.\n", err)
+	} else if err != nil {
+		return err
+	}
+	return intrnl.RunClientWithOptions(cfg.ServerURL, cfg.RoomKey, cfg.Username, intrnl.ClientOptions{ConnectTimeout: cfg.ConnectTimeout, NameWidth: cfg.NameWidth})
+}
+
+// ConnectionURLs describes the URLs the client would use for cfg.RoomKey,
+// without contacting the server.
+func ConnectionURLs(cfg ClientConfig) (string, error) {
+	if cfg.ServerURL == "" {
+		return "", errors.New("server URL is required")
+	}
+	return intrnl.ConnectionURLs(cfg.ServerURL, cfg.RoomKey)
+}
+
+// Logout revokes the stored session and removes it from disk. It returns the
+// username that was logged out, if any, and any error revoking it server-side.
+func Logout(cfg ClientConfig) (username string, serverErr error, err error) {
+	return intrnl.Logout(cfg.ServerURL)
+}
+
+// Login signs in non-interactively and stores the session for later runs.
+func Login(cfg ClientConfig, password string) error {
+	if cfg.ServerURL == "" {
+		return errors.New("server URL is required")
+	}
+	return intrnl.Login(cfg.ServerURL, cfg.Username, password)
+}
+
+// Signup creates an account non-interactively and stores its session.
+func Signup(cfg ClientConfig, password string) error {
+	if cfg.ServerURL == "" {
+		return errors.New("server URL is required")
+	}
+	return intrnl.Signup(cfg.ServerURL, cfg.Username, password)
+}
+
+// Tail follows rooms with the stored session, writing their chat to out as
+// plain text until ctx is done.
+func Tail(ctx context.Context, cfg ClientConfig, rooms []string, out io.Writer) error {
+	if cfg.ServerURL == "" {
+		return errors.New("server URL is required")
+	}
+	return intrnl.Tail(ctx, cfg.ServerURL, rooms, out)
 }
@@ -4,6 +4,8 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"time"
 )
 
 // ServerConfig defines how the HTTP/WebSocket backend should run.
@@ -13,6 +15,53 @@ type ServerConfig struct {
 	DBPath      string
 	UploadDir   string // Base directory for file uploads (e.g., /data/uploads)
 	MaxFileSize int64  // Maximum file size in bytes (default: 10MB)
+	// MaxRoomBytes caps the total size of one room's files. Zero means no
+	// cap.
+	MaxRoomBytes int64
+	// MaxRoomSize caps how many connections one room holds. Zero means no
+	// cap.
+	MaxRoomSize int
+	// PersistFiles keeps group room files after the room empties so they are
+	// still there when people rejoin. DM files are always ephemeral.
+	PersistFiles bool
+	// ReservedUsernames can't be taken at signup. Nil keeps the server defaults
+	// (admin, system, server).
+	ReservedUsernames []string
+	// HistoryLimit is how many recent messages a client is sent when it joins
+	// a room. Zero keeps the default of 50; negative disables replay.
+	HistoryLimit int
+	// AdminToken enables the operator endpoints under /admin for requests
+	// bearing it. Empty leaves them off.
+	AdminToken string
+	// Region is reported by /ping so clients can show which relay they use.
+	Region string
+	// RateLimitWindow and RateLimitBurst cap how many messages one connection
+	// may send per window. Zero keeps the default of 5 every 3s.
+	RateLimitWindow time.Duration
+	RateLimitBurst  int
+	// AuditLog records account security events (logins, signups, password
+	// changes, ...) for operators to read from /admin/audit.
+	AuditLog bool
+	// AuditFile, when set, also appends each audit event to this file as a
+	// JSON line and turns AuditLog on.
+	AuditFile string
+	// TLSCertFile and TLSKeyFile serve HTTPS and wss:// directly when both are
+	// set. Leave both empty to serve plain HTTP, e.g. behind a proxy.
+	TLSCertFile string
+	TLSKeyFile  string
+	// AllowedOrigins lists the browser origins allowed to open websockets,
+	// e.g. https://chat.example.com or https://*.example.com. Empty allows
+	// any origin, which is fine for local development.
+	AllowedOrigins []string
+	// BcryptCost is the password hashing work factor, 4-31. Zero keeps
+	// bcrypt's default of 10.
+	BcryptCost int
+	// Verbose logs routine housekeeping, such as how many expired sessions
+	// each sweep removed.
+	Verbose bool
+	// IdleRoomTimeout tears down rooms left empty this long. Zero keeps the
+	// default of 10m; negative never reaps them.
+	IdleRoomTimeout time.Duration
 }
 
 // ClientConfig defines the parameters the TUI client needs.
@@ -20,6 +69,21 @@ type ClientConfig struct {
 	ServerURL string
 	Username  string
 	RoomKey   string
+	// ConnectTimeout bounds joining a room's websocket. Zero keeps the
+	// default of 10s.
+	ConnectTimeout time.Duration
+	// NameWidth caps the cells a username takes on screen. Zero keeps the
+	// default of 20.
+	NameWidth int
+}
+
+// DefaultRegion names the relay after the Fly.io region it runs in, or
+// returns "" elsewhere.
+func DefaultRegion() string {
+	if region := os.Getenv("FLY_REGION"); region != "" {
+		return "fly-" + region
+	}
+	return ""
 }
 
 // DefaultDBPath returns a per-user data path for the bundled SQLite file.
@@ -70,6 +134,18 @@ func DefaultUploadDir() string {
 	return filepath.Join(".", ".termchat", "uploads")
 }
 
+// ParseList splits a comma-separated flag value such as the reserved
+// usernames, returning nil for an empty value so the server defaults apply.
+func ParseList(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
 // NormalizeJoinPath guarantees the websocket join path starts with '/' and
 // falls back to /join when empty.
 func NormalizeJoinPath(path string) string {
@@ -2,8 +2,10 @@ package app
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -12,6 +14,8 @@ import (
 	"strings"
 	"time"
 
+	"golang.org/x/crypto/bcrypt"
+
 	intrnl "termchat/internal"
 	"termchat/internal/storage"
 )
@@ -20,7 +24,7 @@ import (
 type ServerHandle struct {
 	addr   string
 	server *http.Server
-	store  *storage.Store
+	app    *intrnl.Server
 	done   chan struct{}
 	err    error
 }
@@ -40,7 +44,11 @@ func (h *ServerHandle) Stop(ctx context.Context) error {
 		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 	}
-	return h.server.Shutdown(ctx)
+	err := h.server.Shutdown(ctx)
+	if appErr := h.app.Shutdown(ctx); err == nil {
+		err = appErr
+	}
+	return err
 }
 
 // Wait blocks until the server exits.
@@ -59,6 +67,20 @@ func RunServer(ctx context.Context, cfg ServerConfig) (*ServerHandle, error) {
 		return nil, errors.New("database path is required")
 	}
 	cfg.Path = NormalizeJoinPath(cfg.Path)
+	if cfg.BcryptCost != 0 && (cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost) {
+		return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, errors.New("TLS needs both a certificate and a key file")
+	}
+	var tlsConfig *tls.Config
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
 
 	// Set defaults for file upload config
 	if cfg.UploadDir == "" {
@@ -85,8 +107,33 @@ func RunServer(ctx context.Context, cfg ServerConfig) (*ServerHandle, error) {
 		_ = store.Close()
 		return nil, fmt.Errorf("migrate: %w", err)
 	}
+	var auditFile *os.File
+	if cfg.AuditFile != "" {
+		auditFile, err = os.OpenFile(cfg.AuditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			_ = store.Close()
+			return nil, fmt.Errorf("open audit file: %w", err)
+		}
+	}
 
-	server := intrnl.NewServerWithConfig(store, cfg.UploadDir, cfg.MaxFileSize)
+	server := intrnl.NewServerWithOptions(store, intrnl.ServerOptions{
+		UploadDir:         cfg.UploadDir,
+		MaxFileSize:       cfg.MaxFileSize,
+		MaxRoomBytes:      cfg.MaxRoomBytes,
+		MaxRoomSize:       cfg.MaxRoomSize,
+		PersistFiles:      cfg.PersistFiles,
+		ReservedUsernames: cfg.ReservedUsernames,
+		HistoryLimit:      cfg.HistoryLimit,
+		AdminToken:        cfg.AdminToken,
+		Region:            cfg.Region,
+		RateLimitWindow:   cfg.RateLimitWindow,
+		RateLimitBurst:    cfg.RateLimitBurst,
+		AuditLog:          cfg.AuditLog,
+		AuditWriter:       auditWriter(auditFile),
+		AllowedOrigins:    cfg.AllowedOrigins,
+		IdleRoomTimeout:   cfg.IdleRoomTimeout,
+		BcryptCost:        cfg.BcryptCost,
+	})
 	mux := http.NewServeMux()
 	registerHandlers(mux, cfg.Path, server)
 
@@ -98,13 +145,19 @@ func RunServer(ctx context.Context, cfg ServerConfig) (*ServerHandle, error) {
 	listener, err := net.Listen("tcp", cfg.Addr)
 	if err != nil {
 		_ = store.Close()
+		if auditFile != nil {
+			_ = auditFile.Close()
+		}
 		return nil, fmt.Errorf("listen: %w", err)
 	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
 
 	handle := &ServerHandle{
 		addr:   listener.Addr().String(),
 		server: httpServer,
-		store:  store,
+		app:    server,
 		done:   make(chan struct{}),
 	}
 
@@ -118,20 +171,74 @@ func RunServer(ctx context.Context, cfg ServerConfig) (*ServerHandle, error) {
 		if err := httpServer.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Printf("server shutdown error: %v", err)
 		}
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("store close error: %v", err)
+		}
 	}()
 
 	go handle.serve(listener)
+	if auditFile != nil {
+		go func() {
+			<-handle.done
+			_ = auditFile.Close()
+		}()
+	}
+	go server.ReapIdleRooms(handle.done)
+	go server.ExpireUploads(handle.done)
+	go sweepExpiredSessions(ctx, store, handle.done, cfg.Verbose)
 
 	return handle, nil
 }
 
+// auditWriter keeps a nil file from becoming a non-nil io.Writer
+func auditWriter(file *os.File) io.Writer {
+	if file == nil {
+		return nil
+	}
+	return file
+}
+
+// sessionSweepInterval is how often expired sessions are cleared out
+const sessionSweepInterval = time.Hour
+
+// sweepExpiredSessions deletes expired sessions every sessionSweepInterval
+// until ctx is cancelled or the server stops, logging how many went only when
+// verbose.
+func sweepExpiredSessions(ctx context.Context, store *storage.Store, done <-chan struct{}, verbose bool) {
+	var cancelled <-chan struct{}
+	if ctx != nil {
+		cancelled = ctx.Done()
+	}
+	ticker := time.NewTicker(sessionSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			removed, err := store.DeleteExpiredSessions(context.Background(), now)
+			if err != nil {
+				log.Printf("sweep expired sessions: %v", err)
+			} else if removed > 0 && verbose {
+				log.Printf("removed %d expired session(s)", removed)
+			}
+		case <-cancelled:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
 func (h *ServerHandle) serve(listener net.Listener) {
 	defer close(h.done)
 	err := h.server.Serve(listener)
 	if errors.Is(err, http.ErrServerClosed) {
 		err = nil
 	}
-	if err := h.store.Close(); err != nil {
+	// Stop and ctx cancellation shut the rooms down themselves; this covers the
+	// listener failing on its own and waits for whichever got there first
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.app.Shutdown(shutdownCtx); err != nil {
 		log.Printf("store close error: %v", err)
 	}
 	h.err = err
@@ -142,8 +249,12 @@ func registerHandlers(mux *http.ServeMux, wsPath string, server *intrnl.Server)
 	mux.HandleFunc("/signup", server.HandleSignup)
 	mux.HandleFunc("/login", server.HandleLogin)
 	mux.HandleFunc("/logout", server.HandleLogout)
+	mux.HandleFunc("/logout-all", server.HandleLogoutAll)
+	mux.HandleFunc("/bootstrap", server.HandleBootstrap)
 	mux.HandleFunc("/friends", server.HandleFriends)
 	mux.HandleFunc("/friends/", server.HandleAddFriend)
+	mux.HandleFunc("/blocks", server.HandleBlock)
+	mux.HandleFunc("/blocks/", server.HandleBlock)
 	mux.HandleFunc("/friend-requests", server.HandleFriendRequests)
 	mux.HandleFunc("/friend-requests/", func(w http.ResponseWriter, r *http.Request) {
 		trimmed := strings.TrimPrefix(r.URL.Path, "/friend-requests/")
@@ -154,10 +265,33 @@ func registerHandlers(mux *http.ServeMux, wsPath string, server *intrnl.Server)
 		server.HandleCreateFriendRequest(w, r)
 	})
 	mux.HandleFunc("/password/change", server.HandlePasswordChange)
+	mux.HandleFunc("/account/delete", server.HandleDeleteAccount)
 	mux.HandleFunc("/exists", server.HandleRoomExists)
+	mux.HandleFunc("/ping", server.HandlePing)
 	mux.Handle("/metrics", server.MetricsHandler())
+	mux.HandleFunc("/admin/ban", server.HandleBanUser)
+	mux.HandleFunc("/admin/room-bans", server.HandleRoomBan)
+	mux.HandleFunc("/admin/audit", server.HandleAuditLog)
+	mux.HandleFunc("/account/status", server.HandleSetAccountStatus)
 
 	// File upload/download routes
 	mux.HandleFunc("/api/upload", server.HandleFileUpload)
-	mux.HandleFunc("/api/files/", server.HandleFileDownload)
+	mux.HandleFunc("/api/files", server.HandleListFiles)
+	mux.HandleFunc("/api/files/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			server.HandleDeleteFile(w, r)
+			return
+		}
+		server.HandleFileDownload(w, r)
+	})
+
+	// Resumable upload routes
+	mux.HandleFunc("/api/uploads", server.HandleCreateUpload)
+	mux.HandleFunc("/api/uploads/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/finalize") {
+			server.HandleFinalizeUpload(w, r)
+			return
+		}
+		server.HandleUploadChunk(w, r)
+	})
 }
@@ -1,18 +1,139 @@
 package internal
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type ChatMessage struct {
+	// Type is "system" for notices the server (or the client itself) generates.
+	// Only these render as system lines, whatever the User field says.
+	Type string `json:"type,omitempty"`
+	// Kind is "action" for /me messages, which read as "* alice waves"; empty
+	// for ordinary chat
+	Kind    string `json:"kind,omitempty"`
+	ID      string `json:"id,omitempty"` // Server-assigned message ID
+	Room    string `json:"room"`
+	User    string `json:"user"`
+	Body    string `json:"body"`
+	Ts      int64  `json:"ts"`
+	TsMs    int64  `json:"ts_ms,omitempty"` // Server receive time in unix ms; older servers omit it
+	Edited  bool   `json:"edited,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+	// Reactions maps emoji to how many people reacted with it
+	Reactions map[string]int `json:"reactions,omitempty"`
+}
+
+// systemMessageType marks ChatMessages that didn't come from a user
+const systemMessageType = "system"
+
+// actionMessageKind marks /me messages
+const actionMessageKind = "action"
+
+// fileMessageKind marks the notice a client shows for a shared file. Its ID is
+// the file's, so the upload can be reacted to like a message.
+const fileMessageKind = "file"
+
+// isFile reports whether the message announces a shared file
+func (chat ChatMessage) isFile() bool {
+	return chat.Kind == fileMessageKind
+}
+
+// isAction reports whether the message is a /me action
+func (chat ChatMessage) isAction() bool {
+	return chat.Kind == actionMessageKind
+}
+
+// isSystem reports whether the message is a notice rather than user chat
+func (chat ChatMessage) isSystem() bool {
+	return chat.Type == systemMessageType
+}
+
+// sentAt returns the most precise timestamp the message carries
+func (chat ChatMessage) sentAt() time.Time {
+	if chat.TsMs > 0 {
+		return time.UnixMilli(chat.TsMs)
+	}
+	return time.Unix(chat.Ts, 0)
+}
+
+// MessageUpdate is sent by a client to change one of its own messages
+// ("edit" or "delete") and broadcast once the server accepts it
+// ("message_edited" or "message_deleted")
+type MessageUpdate struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
 	Room string `json:"room"`
 	User string `json:"user"`
-	Body string `json:"body"`
+	Body string `json:"body,omitempty"`
 	Ts   int64  `json:"ts"`
 }
 
+// MessageReaction is sent by a client to toggle its reaction on a message
+// ("react"). The server answers with the message's updated counts ("reactions").
+type MessageReaction struct {
+	Type      string         `json:"type"`
+	ID        string         `json:"id"`
+	Room      string         `json:"room"`
+	User      string         `json:"user"`
+	Emoji     string         `json:"emoji"`
+	Reactions map[string]int `json:"reactions,omitempty"`
+	Ts        int64          `json:"ts"`
+}
+
+// TypingNotice is sent by a client while its user is typing ("typing"), and
+// once when they clear their input without sending ("typing_stopped"), and
+// relayed to the rest of the room. It is never stored.
+type TypingNotice struct {
+	Type string `json:"type"`
+	Room string `json:"room"`
+	User string `json:"user"`
+	Ts   int64  `json:"ts"`
+}
+
+// RoomPresence lists who is connected to a room ("presence"). The server
+// sends it whenever someone joins or leaves.
+type RoomPresence struct {
+	Type    string   `json:"type"`
+	Room    string   `json:"room"`
+	Members []string `json:"members"`
+}
+
+// maxMessageBodyBytes caps a message's body, all of its lines together. The
+// server's websocket read limit leaves room for it however it's escaped, so a
+// long message is refused with a notice instead of dropping the connection.
+const maxMessageBodyBytes = 4000
+
+// deletedMessageBody replaces the text of a deleted message
+const deletedMessageBody = "[deleted]"
+
+// envelopeType peeks at the "type" field of a websocket payload. Plain chat
+// messages have none.
+func envelopeType(payload []byte) string {
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(payload, &envelope); err != nil {
+		return ""
+	}
+	return envelope.Type
+}
+
 // FileUploadMessage is broadcast when a file is uploaded to a room
 type FileUploadMessage struct {
-	Type       string `json:"type"`        // "file_uploaded"
-	FileID     string `json:"file_id"`     // UUID of the file
-	Filename   string `json:"filename"`    // Original filename
-	SizeBytes  int64  `json:"size_bytes"`  // File size
-	UploadedBy string `json:"uploaded_by"` // Username
-	UploadedAt int64  `json:"uploaded_at"` // Unix timestamp
+	Type         string `json:"type"`          // "file_uploaded"
+	FileID       string `json:"file_id"`       // UUID of the file; also what reactions to the upload target
+	Filename     string `json:"filename"`      // Original filename
+	SizeBytes    int64  `json:"size_bytes"`    // File size
+	UploadedBy   string `json:"uploaded_by"`   // Username
+	UploadedAt   int64  `json:"uploaded_at"`   // Unix timestamp
+	DownloadPath string `json:"download_path"` // Relative download URL (/api/files/{id}?room=...)
+}
+
+// FileDeletedMessage is broadcast when an uploader deletes one of their files
+type FileDeletedMessage struct {
+	Type      string `json:"type"`       // "file_deleted"
+	FileID    string `json:"file_id"`    // UUID of the file
+	Filename  string `json:"filename"`   // Original filename
+	DeletedBy string `json:"deleted_by"` // Username
 }
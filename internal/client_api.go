@@ -2,6 +2,8 @@ package internal
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,15 +21,31 @@ var (
 	httpTimeout = 5 * time.Second
 )
 
+const (
+	uploadChunkSize    = 512 * 1024
+	uploadChunkRetries = 3
+)
+
 type sessionFile struct {
 	Username string `json:"username"`
 	Token    string `json:"token"`
+	// Server is the API base URL that issued the token. Sessions saved before
+	// it existed leave it empty.
+	Server string `json:"server,omitempty"`
+}
+
+// sessionStore is the on-disk session file: one session per server, keyed by
+// API base URL, so switching servers doesn't log you out of the others. Files
+// from older clients hold a single bare sessionFile instead.
+type sessionStore struct {
+	Sessions map[string]sessionFile `json:"sessions"`
 }
 
 type friendListResponse struct {
 	Friends []struct {
 		Username string `json:"username"`
 		Online   bool   `json:"online"`
+		LastSeen int64  `json:"last_seen"`
 	} `json:"friends"`
 }
 
@@ -36,6 +54,14 @@ type friendRequestsPayload struct {
 	Outgoing []string `json:"outgoing"`
 }
 
+// bootstrapPayload is /bootstrap's reply: the friends list and pending
+// requests together. The server's capabilities aren't used yet.
+type bootstrapPayload struct {
+	Username string `json:"username"`
+	friendListResponse
+	Requests friendRequestsPayload `json:"requests"`
+}
+
 func apiSignup(baseURL, username, password string) error {
 	payload := map[string]string{"username": username, "password": password}
 	return doJSONRequest(http.MethodPost, baseURL+"/signup", "", payload, nil)
@@ -54,21 +80,117 @@ func apiLogout(baseURL, token string) error {
 	return doJSONRequest(http.MethodPost, baseURL+"/logout", token, nil, nil)
 }
 
+// apiLogoutAll revokes every session the user holds, not just this one
+func apiLogoutAll(baseURL, token string) error {
+	return doJSONRequest(http.MethodPost, baseURL+"/logout-all", token, nil, nil)
+}
+
+// apiDeleteAccount deletes the account behind token. The server wants the
+// password again before it does.
+func apiDeleteAccount(baseURL, token, password string) error {
+	payload := map[string]string{"password": password}
+	return doJSONRequest(http.MethodPost, baseURL+"/account/delete", token, payload, nil)
+}
+
 func apiGetFriends(baseURL, token string) ([]Friend, error) {
 	var resp friendListResponse
 	if err := doJSONRequest(http.MethodGet, baseURL+"/friends", token, nil, &resp); err != nil {
 		return nil, err
 	}
+	return resp.friends(), nil
+}
+
+// apiBootstrap loads the friends list and pending requests in one request
+func apiBootstrap(baseURL, token string) ([]Friend, friendRequestsPayload, error) {
+	var resp bootstrapPayload
+	if err := doJSONRequest(http.MethodGet, baseURL+"/bootstrap", token, nil, &resp); err != nil {
+		return nil, friendRequestsPayload{}, err
+	}
+	return resp.friends(), resp.Requests, nil
+}
+
+func (resp friendListResponse) friends() []Friend {
 	friends := make([]Friend, 0, len(resp.Friends))
 	for _, f := range resp.Friends {
-		friends = append(friends, Friend{Username: f.Username, Online: f.Online})
+		friend := Friend{Username: f.Username, Online: f.Online}
+		if f.LastSeen > 0 {
+			friend.LastSeen = time.Unix(f.LastSeen, 0)
+		}
+		friends = append(friends, friend)
+	}
+	return friends
+}
+
+// apiPing fetches the relay's clock and region
+func apiPing(baseURL string) (pingResponse, error) {
+	var resp pingResponse
+	err := doJSONRequest(http.MethodGet, baseURL+"/ping", "", nil, &resp)
+	return resp, err
+}
+
+// apiListRoomFiles fetches the files already shared in a room
+func apiListRoomFiles(baseURL, token, roomKey string) ([]FileMetadata, error) {
+	var resp roomFilesResponse
+	endpoint := baseURL + "/api/files?room=" + url.QueryEscape(roomKey)
+	if err := doJSONRequest(http.MethodGet, endpoint, token, nil, &resp); err != nil {
+		return nil, err
 	}
-	return friends, nil
+	files := make([]FileMetadata, 0, len(resp.Files))
+	for _, f := range resp.Files {
+		files = append(files, FileMetadata{
+			ID:           f.ID,
+			Filename:     f.Filename,
+			SizeBytes:    f.SizeBytes,
+			UploadedBy:   f.UploadedBy,
+			UploadedAt:   f.UploadedAt,
+			DownloadPath: f.DownloadPath,
+		})
+	}
+	return files, nil
 }
 
-func apiSendFriendRequest(baseURL, token, friendUsername string) error {
+// apiSendFriendRequest reports accepted when the friend had already sent us a
+// request and the server made us friends right away
+func apiSendFriendRequest(baseURL, token, friendUsername string) (accepted bool, err error) {
 	path := baseURL + "/friend-requests/" + url.PathEscape(friendUsername)
-	return doJSONRequest(http.MethodPost, path, token, nil, nil)
+	var resp friendRequestResult
+	if err := doJSONRequest(http.MethodPost, path, token, nil, &resp); err != nil {
+		return false, err
+	}
+	return resp.Status == "accepted", nil
+}
+
+// apiRemoveFriend ends a friendship for both of us
+func apiRemoveFriend(baseURL, token, friendUsername string) error {
+	return doJSONRequest(http.MethodDelete, baseURL+"/friends/"+url.PathEscape(friendUsername), token, nil, nil)
+}
+
+// apiBlockUser stops username from befriending or messaging us
+func apiBlockUser(baseURL, token, username string) error {
+	return doJSONRequest(http.MethodPost, baseURL+"/blocks/"+url.PathEscape(username), token, nil, nil)
+}
+
+// apiUnblockUser lifts our block on username
+func apiUnblockUser(baseURL, token, username string) error {
+	return doJSONRequest(http.MethodDelete, baseURL+"/blocks/"+url.PathEscape(username), token, nil, nil)
+}
+
+// apiListBlocked fetches who we've blocked
+func apiListBlocked(baseURL, token string) ([]string, error) {
+	var resp blocksResponse
+	if err := doJSONRequest(http.MethodGet, baseURL+"/blocks", token, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Blocked, nil
+}
+
+func apiBatchFriendRequests(baseURL, token string, usernames []string) ([]batchFriendResult, error) {
+	var resp batchFriendResponse
+	payload := batchFriendRequest{Usernames: usernames}
+	if err := doJSONRequest(http.MethodPost, baseURL+"/friend-requests", token, payload, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Results, nil
 }
 
 func apiGetFriendRequests(baseURL, token string) (friendRequestsPayload, error) {
@@ -82,6 +204,13 @@ func apiRespondFriendRequest(baseURL, token, friendUsername, action string) erro
 	return doJSONRequest(http.MethodPost, path, token, nil, nil)
 }
 
+// isTransportError reports whether the request never got an HTTP reply, e.g.
+// DNS failure, refused connection or timeout
+func isTransportError(err error) bool {
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
 func doJSONRequest(method, endpoint, token string, payload interface{}, out interface{}) error {
 	var body io.Reader
 	if payload != nil {
@@ -112,7 +241,7 @@ func doJSONRequest(method, endpoint, token string, payload interface{}, out inte
 		return errUnauthorized
 	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("server returned %d: %s", resp.StatusCode, readResponseError(resp.Body))
+		return &apiStatusError{StatusCode: resp.StatusCode, Message: readResponseError(resp.Body)}
 	}
 	if out != nil && resp.ContentLength != 0 {
 		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
@@ -133,6 +262,17 @@ func doJSONRequest(method, endpoint, token string, payload interface{}, out inte
 	return nil
 }
 
+// apiStatusError keeps the status code of a failed API call so callers can
+// react to specific responses
+type apiStatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *apiStatusError) Error() string {
+	return fmt.Sprintf("server returned %d: %s", e.StatusCode, e.Message)
+}
+
 func readResponseError(body io.Reader) string {
 	data, err := io.ReadAll(body)
 	if err != nil || len(data) == 0 {
@@ -166,27 +306,83 @@ func httpBaseFromJoinURL(wsURL string) (string, error) {
 	return strings.TrimRight(parsed.String(), "/"), nil
 }
 
-func loadSessionFromDisk(path string) (*sessionFile, error) {
+// loadSessionFromDisk returns the session saved for apiBase. A legacy session
+// that doesn't record its server is used for any server, as it always was.
+func loadSessionFromDisk(path, apiBase string) (*sessionFile, error) {
+	store, err := readSessionStore(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{apiBase, ""} {
+		if session, ok := store.Sessions[key]; ok {
+			return &session, nil
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// saveSessionToDisk stores the session under its server, keeping sessions for
+// other servers. It replaces a legacy server-less session, just as a new login
+// replaced the single session before.
+func saveSessionToDisk(path string, session sessionFile) error {
+	store, err := readSessionStore(path)
+	if err != nil {
+		store = &sessionStore{Sessions: make(map[string]sessionFile)}
+	}
+	delete(store.Sessions, "")
+	store.Sessions[session.Server] = session
+	return writeSessionStore(path, store)
+}
+
+// deleteSessionFromDisk forgets the session for apiBase, along with any legacy
+// session that would otherwise stand in for it. The file goes once it's empty.
+func deleteSessionFromDisk(path, apiBase string) error {
+	if path == "" {
+		return nil
+	}
+	store, err := readSessionStore(path)
+	if err != nil {
+		// Missing is fine; unreadable can't be edited, so start over
+		return deleteSessionFile(path)
+	}
+	delete(store.Sessions, apiBase)
+	delete(store.Sessions, "")
+	if len(store.Sessions) == 0 {
+		return deleteSessionFile(path)
+	}
+	return writeSessionStore(path, store)
+}
+
+func readSessionStore(path string) (*sessionStore, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	var session sessionFile
-	if err := json.Unmarshal(data, &session); err != nil {
+	var store sessionStore
+	if err := json.Unmarshal(data, &store); err != nil {
 		return nil, err
 	}
-	if session.Username == "" || session.Token == "" {
-		return nil, errors.New("session file incomplete")
+	if store.Sessions == nil {
+		var legacy sessionFile
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return nil, err
+		}
+		store.Sessions = map[string]sessionFile{legacy.Server: legacy}
+	}
+	for key, session := range store.Sessions {
+		if session.Username == "" || session.Token == "" {
+			delete(store.Sessions, key)
+		}
 	}
-	return &session, nil
+	return &store, nil
 }
 
-func saveSessionToDisk(path string, session sessionFile) error {
+func writeSessionStore(path string, store *sessionStore) error {
 	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0o700); err != nil {
 		return err
 	}
-	data, err := json.MarshalIndent(session, "", "  ")
+	data, err := json.MarshalIndent(store, "", "  ")
 	if err != nil {
 		return err
 	}
@@ -208,7 +404,7 @@ func deleteSessionFile(path string) error {
 }
 
 // apiUploadFile uploads a file to the server
-func apiUploadFile(baseURL, token, filePath, roomKey, username string, progressCallback func(float64)) (string, error) {
+func apiUploadFile(baseURL, token, filePath, roomKey string, progressCallback func(float64)) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", fmt.Errorf("open file: %w", err)
@@ -256,7 +452,6 @@ func apiUploadFile(baseURL, token, filePath, roomKey, username string, progressC
 
 		// Add other fields
 		writer.WriteField("room_key", roomKey)
-		writer.WriteField("username", username)
 	}()
 
 	// Create request
@@ -289,10 +484,135 @@ func apiUploadFile(baseURL, token, filePath, roomKey, username string, progressC
 	return result.FileID, nil
 }
 
-// apiDownloadFile downloads a file from the server
-func apiDownloadFile(baseURL, token, fileID, roomKey, destPath string) error {
-	url := fmt.Sprintf("%s/api/files/%s?room=%s", baseURL, fileID, roomKey)
-	req, err := http.NewRequest("GET", url, nil)
+// apiCreateUpload opens a resumable upload session for a file
+func apiCreateUpload(baseURL, token, roomKey, filename string, size int64, sha string) (string, error) {
+	payload := createUploadRequest{
+		RoomKey:   roomKey,
+		Filename:  filename,
+		SizeBytes: size,
+		SHA256:    sha,
+	}
+	var resp uploadOffsetResponse
+	if err := doJSONRequest(http.MethodPost, baseURL+"/api/uploads", token, payload, &resp); err != nil {
+		return "", err
+	}
+	return resp.UploadID, nil
+}
+
+// apiUploadChunk sends one chunk at offset and returns the offset the server
+// has acknowledged. On an offset mismatch the server's offset is returned
+// without error so the caller can resume from there.
+func apiUploadChunk(baseURL, token, uploadID string, offset int64, chunk []byte) (int64, error) {
+	endpoint := fmt.Sprintf("%s/api/uploads/%s?offset=%d", baseURL, url.PathEscape(uploadID), offset)
+	req, err := http.NewRequest(http.MethodPut, endpoint, bytes.NewReader(chunk))
+	if err != nil {
+		return offset, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return offset, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		return offset, &apiStatusError{StatusCode: resp.StatusCode, Message: readResponseError(resp.Body)}
+	}
+	var result uploadOffsetResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return offset, fmt.Errorf("decode response: %w", err)
+	}
+	return result.Offset, nil
+}
+
+// apiFinalizeUpload asks the server to verify and publish a completed upload
+func apiFinalizeUpload(baseURL, token, uploadID string) (string, error) {
+	var result struct {
+		FileID string `json:"file_id"`
+	}
+	endpoint := baseURL + "/api/uploads/" + url.PathEscape(uploadID) + "/finalize"
+	if err := doJSONRequest(http.MethodPost, endpoint, token, nil, &result); err != nil {
+		return "", err
+	}
+	return result.FileID, nil
+}
+
+// apiResumableUpload uploads a file in chunks. Passing the upload ID from a
+// previous failed attempt resumes from the server's last acknowledged offset.
+// On failure the upload ID is returned so the upload can be resumed later.
+func apiResumableUpload(baseURL, token, filePath, roomKey, uploadID string, progressCallback func(float64)) (string, string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", "", fmt.Errorf("open file: %w", err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return "", "", fmt.Errorf("stat file: %w", err)
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", "", fmt.Errorf("hash file: %w", err)
+	}
+	sum := hex.EncodeToString(hasher.Sum(nil))
+
+	// Probe the existing session with an empty chunk to learn its offset
+	var offset int64
+	if uploadID != "" {
+		offset, err = apiUploadChunk(baseURL, token, uploadID, 0, nil)
+		var statusErr *apiStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			uploadID = ""
+		} else if err != nil {
+			return "", uploadID, fmt.Errorf("resume upload: %w", err)
+		}
+	}
+	if uploadID == "" {
+		uploadID, err = apiCreateUpload(baseURL, token, roomKey, filepath.Base(filePath), stat.Size(), sum)
+		if err != nil {
+			return "", "", fmt.Errorf("start upload: %w", err)
+		}
+		offset = 0
+	}
+
+	buf := make([]byte, uploadChunkSize)
+	for offset < stat.Size() {
+		n, err := file.ReadAt(buf, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", uploadID, fmt.Errorf("read file: %w", err)
+		}
+		var acked int64
+		for attempt := 0; ; attempt++ {
+			acked, err = apiUploadChunk(baseURL, token, uploadID, offset, buf[:n])
+			if err == nil || attempt >= uploadChunkRetries {
+				break
+			}
+			time.Sleep(time.Duration(attempt+1) * 500 * time.Millisecond)
+		}
+		if err != nil {
+			return "", uploadID, fmt.Errorf("upload chunk: %w", err)
+		}
+		offset = acked
+		if progressCallback != nil && stat.Size() > 0 {
+			progressCallback(float64(offset) / float64(stat.Size()))
+		}
+	}
+
+	fileID, err := apiFinalizeUpload(baseURL, token, uploadID)
+	if err != nil {
+		return "", uploadID, fmt.Errorf("finalize upload: %w", err)
+	}
+	return fileID, "", nil
+}
+
+// apiDownloadFile downloads a file from the server using the relative
+// download path advertised in the upload broadcast
+func apiDownloadFile(baseURL, token, downloadPath, destPath string) error {
+	req, err := http.NewRequest("GET", baseURL+downloadPath, nil)
 	if err != nil {
 		return err
 	}
@@ -325,6 +645,11 @@ func apiDownloadFile(baseURL, token, fileID, roomKey, destPath string) error {
 	return nil
 }
 
+// apiDeleteFile deletes a file we uploaded to roomKey
+func apiDeleteFile(baseURL, token, fileID, roomKey string) error {
+	return doJSONRequest(http.MethodDelete, baseURL+fileDownloadPath(fileID, roomKey), token, nil, nil)
+}
+
 // progressTracker wraps an io.Reader to track read progress
 type progressTracker struct {
 	reader   io.Reader
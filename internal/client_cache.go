@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// friendsCache keeps the last friends and requests fetched from each server so
+// the friends view has something to show while the server is unreachable
+type friendsCache struct {
+	Entries map[string]friendsCacheEntry `json:"entries"` // keyed by API base URL
+}
+
+type friendsCacheEntry struct {
+	Username  string      `json:"username"`
+	Friends   []friendDTO `json:"friends"`
+	Incoming  []string    `json:"incoming"`
+	Outgoing  []string    `json:"outgoing"`
+	FetchedAt time.Time   `json:"fetched_at"`
+}
+
+func defaultFriendsCachePath() string {
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".termchat", "friends_cache.json")
+	}
+	return filepath.Join(".termchat", "friends_cache.json")
+}
+
+// loadFriendsCache returns what was cached for username on apiBase. A cache
+// left behind by a different account on that server doesn't count.
+func loadFriendsCache(path, apiBase, username string) (*friendsCacheEntry, error) {
+	cache, err := readFriendsCache(path)
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := cache.Entries[apiBase]
+	if !ok || entry.Username != username {
+		return nil, os.ErrNotExist
+	}
+	return &entry, nil
+}
+
+// updateFriendsCache applies update to the entry for username on apiBase and
+// stamps it with the current time. Friends and requests arrive separately, so
+// each caller only touches its own part.
+func updateFriendsCache(path, apiBase, username string, update func(*friendsCacheEntry)) error {
+	if path == "" || apiBase == "" || username == "" {
+		return nil
+	}
+	cache, err := readFriendsCache(path)
+	if err != nil {
+		cache = &friendsCache{Entries: make(map[string]friendsCacheEntry)}
+	}
+	entry := cache.Entries[apiBase]
+	if entry.Username != username {
+		entry = friendsCacheEntry{Username: username}
+	}
+	update(&entry)
+	entry.FetchedAt = time.Now()
+	cache.Entries[apiBase] = entry
+	return writeFriendsCache(path, cache)
+}
+
+// deleteFriendsCache forgets what was cached for apiBase, e.g. on logout
+func deleteFriendsCache(path, apiBase string) error {
+	cache, err := readFriendsCache(path)
+	if err != nil {
+		return nil
+	}
+	delete(cache.Entries, apiBase)
+	if len(cache.Entries) == 0 {
+		return deleteSessionFile(path)
+	}
+	return writeFriendsCache(path, cache)
+}
+
+func readFriendsCache(path string) (*friendsCache, error) {
+	if path == "" {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cache friendsCache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return nil, err
+	}
+	if cache.Entries == nil {
+		cache.Entries = make(map[string]friendsCacheEntry)
+	}
+	return &cache, nil
+}
+
+func writeFriendsCache(path string, cache *friendsCache) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,272 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ErrServerUnreachable means nothing answered at the configured server, as
+// opposed to a server that answered and turned the request down
+var ErrServerUnreachable = errors.New("can't reach server")
+
+const serverProbeTimeout = 5 * time.Second
+
+// CheckServer probes /ping before the TUI starts, so a dead or retired host
+// gets one clear warning instead of only a loop of reconnects. Any reply
+// counts, including a 404 from servers older than /ping, except a gateway
+// error from a proxy fronting a stopped app.
+func CheckServer(serverJoinURL string) error {
+	apiBase, err := httpBaseFromJoinURL(serverJoinURL)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: serverProbeTimeout}
+	resp, err := client.Get(apiBase + "/ping")
+	if err != nil {
+		return fmt.Errorf("%w at %s: %v", ErrServerUnreachable, apiBase, err)
+	}
+	_ = resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return fmt.Errorf("%w at %s: %s", ErrServerUnreachable, apiBase, resp.Status)
+	}
+	return nil
+}
+
+// ConnectionURLs lists the URLs the client derives from serverJoinURL for
+// roomKey: the websocket join URL, the REST base and the room exists check.
+// It's for pasting into websocat or curl when a connection won't come up.
+func ConnectionURLs(serverJoinURL, roomKey string) (string, error) {
+	if strings.TrimSpace(roomKey) == "" {
+		return "", errors.New("a room is required")
+	}
+	joinURL, err := buildJoinURL(serverJoinURL, roomKey)
+	if err != nil {
+		return "", err
+	}
+	apiBase, err := httpBaseFromJoinURL(serverJoinURL)
+	if err != nil {
+		return "", err
+	}
+	existsURL, err := buildExistsURL(serverJoinURL, roomKey)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("join:   %s\napi:    %s\nexists: %s\n", joinURL, apiBase, existsURL), nil
+}
+
+// Login authenticates without the TUI and saves the session where the TUI
+// will pick it up, for scripts and other non-interactive use.
+func Login(serverJoinURL, username, password string) error {
+	username = strings.TrimSpace(username)
+	if username == "" || password == "" {
+		return errors.New("username and password are required")
+	}
+	apiBase, err := httpBaseFromJoinURL(serverJoinURL)
+	if err != nil {
+		return err
+	}
+	resp, err := apiLogin(apiBase, username, password)
+	if err != nil {
+		return err
+	}
+	return saveSessionToDisk(defaultSessionPath(), sessionFile{Username: resp.Username, Token: resp.Token, Server: apiBase})
+}
+
+// Signup creates an account and logs straight into it, saving the session
+// like Login does. The username is checked against the same rules as the TUI
+// signup form before anything is sent.
+func Signup(serverJoinURL, username, password string) error {
+	username = strings.TrimSpace(username)
+	if err := validateUsername(username); err != nil {
+		return err
+	}
+	if strings.TrimSpace(password) == "" {
+		return errors.New("Password cannot be empty.")
+	}
+	apiBase, err := httpBaseFromJoinURL(serverJoinURL)
+	if err != nil {
+		return err
+	}
+	if err := apiSignup(apiBase, username, password); err != nil {
+		return err
+	}
+	resp, err := apiLogin(apiBase, username, password)
+	if err != nil {
+		return err
+	}
+	return saveSessionToDisk(defaultSessionPath(), sessionFile{Username: resp.Username, Token: resp.Token, Server: apiBase})
+}
+
+// Logout ends the saved session for this server. Its local copy is always
+// removed, even if the server can't be reached: serverErr reports a failed
+// revoke while err is only set if the local cleanup itself failed. Sessions
+// for other servers are left alone.
+func Logout(serverJoinURL string) (username string, serverErr error, err error) {
+	apiBase, err := httpBaseFromJoinURL(serverJoinURL)
+	if err != nil {
+		return "", nil, err
+	}
+	path := defaultSessionPath()
+	session, loadErr := loadSessionFromDisk(path, apiBase)
+	if loadErr != nil {
+		if os.IsNotExist(loadErr) {
+			return "", nil, nil
+		}
+		// Unreadable; nothing to revoke, just clear it
+		return "", nil, deleteSessionFile(path)
+	}
+	if logoutErr := apiLogout(apiBase, session.Token); logoutErr != nil && !errors.Is(logoutErr, errUnauthorized) {
+		// An unauthorized reply means the token was already dead server-side
+		serverErr = logoutErr
+	}
+	return session.Username, serverErr, deleteSessionFromDisk(path, apiBase)
+}
+
+// Tail streams the chat in each room to out as plain text until ctx is done,
+// using the saved session. Every line names its room, so several rooms can
+// be followed into one log.
+func Tail(ctx context.Context, serverJoinURL string, roomKeys []string, out io.Writer) error {
+	if len(roomKeys) == 0 {
+		return errors.New("at least one room is required")
+	}
+	apiBase, err := httpBaseFromJoinURL(serverJoinURL)
+	if err != nil {
+		return err
+	}
+	session, err := loadSessionFromDisk(defaultSessionPath(), apiBase)
+	if err != nil {
+		return errors.New("not logged in; run termchat login first")
+	}
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer "+session.Token)
+
+	conns := make([]*websocket.Conn, 0, len(roomKeys))
+	closeAll := func() {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+	for _, roomKey := range roomKeys {
+		joinURL, err := buildJoinURL(serverJoinURL, roomKey)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		conn, resp, err := websocket.DefaultDialer.DialContext(ctx, joinURL, headers)
+		if err != nil {
+			closeAll()
+			if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+				err = errUnauthorized
+			} else if resp != nil && resp.StatusCode == http.StatusForbidden {
+				err = errRoomForbidden
+			}
+			return fmt.Errorf("join %s: %w", roomKey, err)
+		}
+		conns = append(conns, conn)
+	}
+
+	transcript := newTranscriptWriter(out)
+	done := make(chan error, len(conns))
+	for i, conn := range conns {
+		go func(roomKey string, conn *websocket.Conn) {
+			done <- transcript.follow(roomKey, conn)
+		}(roomKeys[i], conn)
+	}
+	defer closeAll()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-done:
+		return err
+	}
+}
+
+// transcriptColors are the ANSI colors given to rooms in the order they
+// first appear in a transcript
+var transcriptColors = []int{36, 33, 35, 32, 34, 31}
+
+// transcriptWriter prints chat from several rooms as plain lines, each
+// prefixed with its room, colored per room unless NO_COLOR is set
+type transcriptWriter struct {
+	mu     sync.Mutex
+	out    io.Writer
+	color  bool
+	colors map[string]int
+}
+
+func newTranscriptWriter(out io.Writer) *transcriptWriter {
+	return &transcriptWriter{out: out, color: os.Getenv("NO_COLOR") == "", colors: make(map[string]int)}
+}
+
+// follow writes the chat read from conn, which is joined to roomKey, until
+// the connection ends. Edits, reactions and other updates are left out.
+func (transcript *transcriptWriter) follow(roomKey string, conn *websocket.Conn) error {
+	for {
+		_, payload, err := conn.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("%s: %w", roomKey, err)
+		}
+		switch envelopeType(payload) {
+		case "", systemMessageType:
+			var chat ChatMessage
+			if err := json.Unmarshal(payload, &chat); err == nil && chat.Body != "" {
+				transcript.write(roomKey, chat)
+			}
+		case "file_uploaded":
+			var upload FileUploadMessage
+			if err := json.Unmarshal(payload, &upload); err == nil {
+				transcript.write(roomKey, ChatMessage{
+					Type: systemMessageType,
+					Body: fmt.Sprintf("%s uploaded: %s (%s)", upload.UploadedBy, upload.Filename, formatFileSize(upload.SizeBytes)),
+					Ts:   upload.UploadedAt,
+				})
+			}
+		}
+	}
+}
+
+// write prints one message as "[room] time user: body", or "* user body" for
+// a /me action. Later lines of a multi-line message repeat the room so grep
+// still finds them.
+func (transcript *transcriptWriter) write(roomKey string, chat ChatMessage) {
+	transcript.mu.Lock()
+	defer transcript.mu.Unlock()
+	prefix := transcript.prefix(roomKey)
+	chat.User = escapeName(chat.User)
+	chat.Body = escapeControlChars(chat.Body)
+	sender := chat.User + ":"
+	if chat.isSystem() {
+		sender = "*"
+	} else if chat.isAction() {
+		sender = "* " + chat.User
+	}
+	lines := strings.Split(chat.Body, "\n")
+	fmt.Fprintf(transcript.out, "%s %s %s %s\n", prefix, formatMessageTime(chat), sender, lines[0])
+	for _, line := range lines[1:] {
+		fmt.Fprintf(transcript.out, "%s   %s\n", prefix, line)
+	}
+}
+
+func (transcript *transcriptWriter) prefix(roomKey string) string {
+	label := "[" + roomKey + "]"
+	if !transcript.color {
+		return label
+	}
+	color, ok := transcript.colors[roomKey]
+	if !ok {
+		color = transcriptColors[len(transcript.colors)%len(transcriptColors)]
+		transcript.colors[roomKey] = color
+	}
+	return fmt.Sprintf("\x1b[%dm%s\x1b[0m", color, label)
+}
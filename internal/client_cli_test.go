@@ -0,0 +1,279 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestLoginSavesSession verifies the non-interactive login stores a session
+// the TUI can reuse
+func TestLoginSavesSession(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	server, _ := newTestServer(t)
+	if rec := postTestSignup(server, "alice"); rec.Code != http.StatusCreated {
+		t.Fatalf("signup: %d %s", rec.Code, rec.Body.String())
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", server.HandleLogin)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+	joinURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/join"
+
+	if err := Login(joinURL, "alice", "wrong-password"); err == nil {
+		t.Fatal("expected a bad password to fail")
+	}
+	if err := Login(joinURL, "alice", "hunter22"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	session, err := loadSessionFromDisk(defaultSessionPath(), httpServer.URL)
+	if err != nil {
+		t.Fatalf("load session: %v", err)
+	}
+	if session.Username != "alice" || session.Token == "" {
+		t.Fatalf("unexpected session %+v", session)
+	}
+	if session.Server != httpServer.URL {
+		t.Errorf("expected the session to record %s, got %q", httpServer.URL, session.Server)
+	}
+}
+
+// TestSignupCreatesAccountAndSession verifies signup validates locally before
+// calling the server and then saves a usable session
+func TestSignupCreatesAccountAndSession(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	server, _ := newTestServer(t)
+	var signupCalls int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/signup", func(w http.ResponseWriter, r *http.Request) {
+		signupCalls++
+		server.HandleSignup(w, r)
+	})
+	mux.HandleFunc("/login", server.HandleLogin)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+	joinURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/join"
+
+	if err := Signup(joinURL, "al!", "hunter22"); err == nil {
+		t.Fatal("expected an invalid username to be rejected")
+	}
+	if err := Signup(joinURL, "alice", "  "); err == nil {
+		t.Fatal("expected an empty password to be rejected")
+	}
+	if signupCalls != 0 {
+		t.Fatalf("expected invalid input to stay client-side, got %d signup calls", signupCalls)
+	}
+
+	if err := Signup(joinURL, "alice", "hunter22"); err != nil {
+		t.Fatalf("Signup: %v", err)
+	}
+	session, err := loadSessionFromDisk(defaultSessionPath(), httpServer.URL)
+	if err != nil {
+		t.Fatalf("load session: %v", err)
+	}
+	if session.Username != "alice" || session.Token == "" {
+		t.Fatalf("unexpected session %+v", session)
+	}
+	if err := Signup(joinURL, "alice", "hunter22"); err == nil {
+		t.Fatal("expected a duplicate signup to fail")
+	}
+}
+
+// TestLogoutRemovesSessionWhenServerUnreachable verifies local cleanup happens
+// even if the server call fails
+func TestLogoutRemovesSessionWhenServerUnreachable(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	if err := saveSessionToDisk(defaultSessionPath(), sessionFile{Username: "alice", Token: "token"}); err != nil {
+		t.Fatalf("save session: %v", err)
+	}
+	httpServer := httptest.NewServer(http.NotFoundHandler())
+	joinURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/join"
+	httpServer.Close()
+
+	username, serverErr, err := Logout(joinURL)
+	if err != nil {
+		t.Fatalf("Logout: %v", err)
+	}
+	if username != "alice" || serverErr == nil {
+		t.Fatalf("expected alice with a server error, got %q, %v", username, serverErr)
+	}
+	if _, err := os.Stat(defaultSessionPath()); !os.IsNotExist(err) {
+		t.Fatalf("expected session file removed, stat err=%v", err)
+	}
+
+	// Logging out again is a no-op
+	if username, serverErr, err := Logout(joinURL); username != "" || serverErr != nil || err != nil {
+		t.Fatalf("expected no-op logout, got %q, %v, %v", username, serverErr, err)
+	}
+}
+
+// TestCheckServerReportsUnreachableHost verifies /ping is probed, and a dead
+// host or a gateway in front of a stopped app is reported as unreachable,
+// while any real server reply passes
+func TestCheckServerReportsUnreachableHost(t *testing.T) {
+	for _, tc := range []struct {
+		status      int
+		unreachable bool
+	}{
+		{http.StatusBadRequest, false},
+		{http.StatusNotFound, false},
+		{http.StatusBadGateway, true},
+		{http.StatusServiceUnavailable, true},
+	} {
+		var probed string
+		httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			probed = r.URL.Path
+			w.WriteHeader(tc.status)
+		}))
+		err := CheckServer("ws" + strings.TrimPrefix(httpServer.URL, "http") + "/join")
+		httpServer.Close()
+		if errors.Is(err, ErrServerUnreachable) != tc.unreachable {
+			t.Errorf("status %d: unexpected result %v", tc.status, err)
+		}
+		if probed != "/ping" {
+			t.Errorf("expected /ping probed, got %q", probed)
+		}
+	}
+
+	httpServer := httptest.NewServer(http.NotFoundHandler())
+	joinURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/join"
+	httpServer.Close()
+	if err := CheckServer(joinURL); !errors.Is(err, ErrServerUnreachable) {
+		t.Fatalf("expected a closed server to be unreachable, got %v", err)
+	}
+}
+
+// TestConnectionURLsMatchBuilders verifies --print-url shows exactly what the
+// client itself would connect to
+func TestConnectionURLsMatchBuilders(t *testing.T) {
+	const server = "wss://chat.example.com/join"
+	got, err := ConnectionURLs(server, "room 42")
+	if err != nil {
+		t.Fatalf("ConnectionURLs: %v", err)
+	}
+	joinURL, _ := buildJoinURL(server, "room 42")
+	apiBase, _ := httpBaseFromJoinURL(server)
+	existsURL, _ := buildExistsURL(server, "room 42")
+	want := "join:   " + joinURL + "\napi:    " + apiBase + "\nexists: " + existsURL + "\n"
+	if got != want {
+		t.Fatalf("expected\n%s\ngot\n%s", want, got)
+	}
+	if !strings.Contains(got, "wss://chat.example.com/join?room=room+42") || !strings.Contains(got, "https://chat.example.com/exists?room=room+42") {
+		t.Fatalf("unexpected URLs:\n%s", got)
+	}
+
+	if _, err := ConnectionURLs(server, ""); err == nil {
+		t.Fatal("expected an error without a room")
+	}
+	if _, err := ConnectionURLs("http://chat.example.com/join", "lobby"); err == nil {
+		t.Fatal("expected an error for a non-websocket server URL")
+	}
+}
+
+// TestTranscriptPrefixesRooms verifies each transcript line starts with its
+// room, every room keeps its own color, and NO_COLOR leaves plain text
+func TestTranscriptPrefixesRooms(t *testing.T) {
+	t.Setenv("NO_COLOR", "")
+	sent := time.Date(2024, 5, 1, 13, 4, 5, 0, time.Local).Unix()
+	var out bytes.Buffer
+	transcript := newTranscriptWriter(&out)
+	transcript.write("lobby", ChatMessage{User: "alice", Body: "hi", Ts: sent})
+	transcript.write("dev", ChatMessage{User: "bob", Body: "two\nlines", Ts: sent})
+	transcript.write("lobby", ChatMessage{Type: systemMessageType, User: "system", Body: "bob joined", Ts: sent})
+
+	want := "\x1b[36m[lobby]\x1b[0m 13:04:05 alice: hi\n" +
+		"\x1b[33m[dev]\x1b[0m 13:04:05 bob: two\n" +
+		"\x1b[33m[dev]\x1b[0m   lines\n" +
+		"\x1b[36m[lobby]\x1b[0m 13:04:05 * bob joined\n"
+	if got := out.String(); got != want {
+		t.Errorf("unexpected colored transcript:\n%q\nwant\n%q", got, want)
+	}
+
+	t.Setenv("NO_COLOR", "1")
+	out.Reset()
+	transcript = newTranscriptWriter(&out)
+	transcript.write("lobby", ChatMessage{User: "alice", Body: "hi", Ts: sent})
+	transcript.write("dev", ChatMessage{User: "bob", Body: "yo", Ts: sent})
+	transcript.write("dev", ChatMessage{User: "bob", Kind: actionMessageKind, Body: "waves", Ts: sent})
+	if got := out.String(); got != "[lobby] 13:04:05 alice: hi\n[dev] 13:04:05 bob: yo\n[dev] 13:04:05 * bob waves\n" {
+		t.Errorf("unexpected plain transcript %q", got)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe to read while Tail writes to it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// TestTailFollowsSeveralRooms verifies tail joins every room with the saved
+// session and labels each message with the room it was sent to
+func TestTailFollowsSeveralRooms(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("NO_COLOR", "1")
+	server, httpServer := newTestServer(t)
+	if err := saveSessionToDisk(defaultSessionPath(), sessionFile{Username: "alice", Token: createTestSession(t, server, "alice"), Server: httpServer.URL}); err != nil {
+		t.Fatalf("save session: %v", err)
+	}
+	joinURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/join"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var out syncBuffer
+	tailErr := make(chan error, 1)
+	go func() { tailErr <- Tail(ctx, joinURL, []string{"lobby", "dev"}, &out) }()
+	waitForRoomSize(t, server.hub, "lobby", 1)
+	waitForRoomSize(t, server.hub, "dev", 1)
+
+	bobToken := createTestSession(t, server, "bob")
+	for _, room := range []string{"lobby", "dev"} {
+		conn, _, err := dialTestRoom(httpServer, bobToken, room)
+		if err != nil {
+			t.Fatalf("dial %s: %v", room, err)
+		}
+		defer conn.Close()
+		if err := conn.WriteJSON(ChatMessage{Body: "hi " + room}); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	// Each message must be on a line labeled with the room it was sent to
+	labeled := func(room string) bool {
+		for _, line := range strings.Split(out.String(), "\n") {
+			if strings.HasPrefix(line, "["+room+"] ") && strings.HasSuffix(line, " bob: hi "+room) {
+				return true
+			}
+		}
+		return false
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !labeled("lobby") || !labeled("dev") {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected both rooms labeled in the transcript, got %q", out.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-tailErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected tail to stop with the context, got %v", err)
+	}
+}
@@ -1,16 +1,22 @@
 package internal
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base32"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
+	"unicode"
 
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/gorilla/websocket"
@@ -22,14 +28,67 @@ type versionCheckMsg struct {
 	err       error
 }
 
+// keepaliveTimeout is how long the client waits for any frame, including the
+// server's pings, before treating the connection as dead. The server pings
+// every 54s, so this leaves room for one late ping.
+var keepaliveTimeout = 75 * time.Second
+
+// errConnectionLost means the server went silent, e.g. a half-open TCP
+// connection after a network change
+var errConnectionLost = errors.New("connection lost")
+
+// errRoomForbidden means the server refused us the room, e.g. because we were
+// removed from it. Retrying won't help.
+var errRoomForbidden = errors.New("you don't have access to this room")
+
+// errConnectTimedOut means the dial or handshake took longer than the
+// connect timeout, e.g. a black-holed host
+var errConnectTimedOut = errors.New("connecting timed out")
+
+// errExistsTimedOut means the room check got no answer within
+// existsCheckTimeout
+var errExistsTimedOut = errors.New("checking the room timed out")
+
+// existsCheckTimeout bounds the /exists request made before joining a room
+var existsCheckTimeout = 3 * time.Second
+
+// Reconnect backoff: the delay doubles from reconnectBaseDelay up to
+// reconnectMaxDelay, and after maxReconnectAttempts the client gives up
+var (
+	reconnectBaseDelay   = 500 * time.Millisecond
+	reconnectMaxDelay    = 30 * time.Second
+	maxReconnectAttempts = 8
+)
+
+// scheduleReconnect waits out the next backoff delay before trying the room
+// again, or gives up and returns to the friends list once the attempts run out
 func (model *TUIModel) scheduleReconnect() tea.Cmd {
-	const retryDelay = 2 * time.Second
+	if model.reconnectAttempts >= maxReconnectAttempts {
+		model.leaveChat()
+		model.appendSystemNotice("Giving up reconnecting. Join the room again once the server is back.")
+		return nil
+	}
+	delay := reconnectDelay(model.reconnectAttempts)
+	model.reconnectAttempts++
 	// we schedule a future poke that nudges Update to try the connection again.
-	return tea.Tick(retryDelay, func(time.Time) tea.Msg {
+	return tea.Tick(delay, func(time.Time) tea.Msg {
 		return reconnectMsg{}
 	})
 }
 
+// reconnectDelay is min(2^attempt * reconnectBaseDelay, reconnectMaxDelay),
+// jittered down by up to half so clients dropped together don't all come back
+// at the same moment
+func reconnectDelay(attempt int) time.Duration {
+	delay := reconnectMaxDelay
+	if attempt < 16 {
+		if backoff := reconnectBaseDelay << uint(attempt); backoff < delay {
+			delay = backoff
+		}
+	}
+	return delay/2 + time.Duration(mathrand.Int63n(int64(delay/2)+1))
+}
+
 // websocket dial
 func (model *TUIModel) connectCmd() tea.Cmd {
 	return func() tea.Msg {
@@ -41,29 +100,78 @@ func (model *TUIModel) connectCmd() tea.Cmd {
 		if model.sessionToken != "" {
 			headers.Set("Authorization", "Bearer "+model.sessionToken)
 		}
-		conn, _, err := websocket.DefaultDialer.Dial(joinURL, headers)
+		timeout := model.connectTimeout
+		if timeout <= 0 {
+			timeout = DefaultConnectTimeout
+		}
+		dialer := *websocket.DefaultDialer
+		dialer.HandshakeTimeout = timeout
+		conn, resp, err := dialer.Dial(joinURL, headers)
 		if err != nil {
+			if resp != nil && resp.StatusCode == http.StatusForbidden {
+				return connectFailedMsg{err: errRoomForbidden}
+			}
+			if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+				return connectFailedMsg{err: errUnauthorized}
+			}
+			var netErr net.Error
+			if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+				return connectFailedMsg{err: fmt.Errorf("%w after %s", errConnectTimedOut, timeout)}
+			}
 			return connectFailedMsg{err: err}
 		}
+		_ = conn.SetReadDeadline(time.Now().Add(keepaliveTimeout))
+		conn.SetPingHandler(func(appData string) error {
+			_ = conn.SetReadDeadline(time.Now().Add(keepaliveTimeout))
+			err := conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(time.Second))
+			if errors.Is(err, websocket.ErrCloseSent) {
+				return nil
+			}
+			return err
+		})
 		model.websocketConn = conn
 		return connectedMsg{}
 	}
 }
 
-// HTTP GET against /exists so we can warn the user
+// HTTP GET against /exists so we can warn the user. The session token goes
+// along because direct rooms are only found by their members.
 func (model *TUIModel) existsCmd(key string) tea.Cmd {
+	token := model.sessionToken
 	return func() tea.Msg {
 		urlStr, err := buildExistsURL(model.serverJoinURL, key)
 		if err != nil {
 			return existsMsg{key: key, exists: false, err: err}
 		}
-		client := &http.Client{Timeout: 3 * time.Second}
-		resp, err := client.Get(urlStr)
+		req, err := http.NewRequest(http.MethodGet, urlStr, nil)
 		if err != nil {
 			return existsMsg{key: key, exists: false, err: err}
 		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		client := &http.Client{Timeout: existsCheckTimeout}
+		resp, err := client.Do(req)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				err = fmt.Errorf("%w after %s", errExistsTimedOut, existsCheckTimeout)
+			}
+			return existsMsg{key: key, exists: false, err: err}
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64))
 		_ = resp.Body.Close()
-		return existsMsg{key: key, exists: resp.StatusCode == http.StatusOK, err: nil}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			// Older servers only know live rooms and answer "ok"
+			saved := strings.TrimSpace(string(body)) == roomStatusSaved
+			return existsMsg{key: key, exists: true, saved: saved, err: nil}
+		case http.StatusNotFound:
+			return existsMsg{key: key, exists: false, err: nil}
+		default:
+			// A 500 or 429 says nothing about the room, so don't report it missing
+			return existsMsg{key: key, exists: false, err: fmt.Errorf("server returned %s", resp.Status)}
+		}
 	}
 }
 
@@ -73,10 +181,16 @@ func (model *TUIModel) readOnceCmd() tea.Cmd {
 		if model.websocketConn == nil {
 			return errorMsg(fmt.Errorf("websocket not connected"))
 		}
-		messageType, payload, err := model.websocketConn.ReadMessage()
+		conn := model.websocketConn
+		messageType, payload, err := conn.ReadMessage()
 		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return connectLostMsg{}
+			}
 			return errorMsg(err)
 		}
+		_ = conn.SetReadDeadline(time.Now().Add(keepaliveTimeout))
 		if messageType != websocket.TextMessage {
 			return nil
 		}
@@ -86,16 +200,20 @@ func (model *TUIModel) readOnceCmd() tea.Cmd {
 		if err := json.Unmarshal(payload, &fileMsg); err == nil && fileMsg.Type == "file_uploaded" {
 			// Add to room files list
 			model.roomFiles = append(model.roomFiles, FileMetadata{
-				ID:         fileMsg.FileID,
-				Filename:   fileMsg.Filename,
-				SizeBytes:  fileMsg.SizeBytes,
-				UploadedBy: fileMsg.UploadedBy,
-				UploadedAt: fileMsg.UploadedAt,
+				ID:           fileMsg.FileID,
+				Filename:     fileMsg.Filename,
+				SizeBytes:    fileMsg.SizeBytes,
+				UploadedBy:   fileMsg.UploadedBy,
+				UploadedAt:   fileMsg.UploadedAt,
+				DownloadPath: fileMsg.DownloadPath,
 			})
 			// Display as system message
 			sizeStr := formatFileSize(fileMsg.SizeBytes)
 			chat := ChatMessage{
+				ID:   fileMsg.FileID, // so the notice can be reacted to
 				Room: model.roomKey,
+				Type: systemMessageType,
+				Kind: fileMessageKind,
 				User: "system",
 				Body: fmt.Sprintf("📎 %s uploaded: %s (%s)", fileMsg.UploadedBy, fileMsg.Filename, sizeStr),
 				Ts:   fileMsg.UploadedAt,
@@ -103,6 +221,34 @@ func (model *TUIModel) readOnceCmd() tea.Cmd {
 			return incomingMsg(chat)
 		}
 
+		switch envelopeType(payload) {
+		case "message_edited", "message_deleted":
+			var update MessageUpdate
+			if err := json.Unmarshal(payload, &update); err == nil {
+				return messageUpdateMsg(update)
+			}
+		case "reactions":
+			var reaction MessageReaction
+			if err := json.Unmarshal(payload, &reaction); err == nil {
+				return reactionsMsg(reaction)
+			}
+		case "typing", "typing_stopped":
+			// Never falls through to ChatMessage, where it would show as an
+			// empty line; a malformed notice comes back empty and is ignored
+			var typing TypingNotice
+			_ = json.Unmarshal(payload, &typing)
+			return typingMsg(typing)
+		case "presence":
+			var presence RoomPresence
+			_ = json.Unmarshal(payload, &presence)
+			return presenceMsg(presence)
+		case "file_deleted":
+			var deleted FileDeletedMessage
+			if err := json.Unmarshal(payload, &deleted); err == nil {
+				return fileDeletedMsg(deleted)
+			}
+		}
+
 		// Try to parse as regular ChatMessage
 		var chat ChatMessage
 		if err := json.Unmarshal(payload, &chat); err == nil {
@@ -115,29 +261,119 @@ func (model *TUIModel) readOnceCmd() tea.Cmd {
 }
 
 func (model *TUIModel) sendCmd(chat ChatMessage) tea.Cmd {
+	// The message itself clears our typing indicator for the room, so the
+	// next keystroke can announce typing again right away
+	model.typingAnnounced = false
+	model.lastTypingSent = time.Time{}
+	return model.sendJSONCmd(chat)
+}
+
+// sendEditCmd asks the server to replace the body of one of our messages
+func (model *TUIModel) sendEditCmd(messageID, body string) tea.Cmd {
+	return model.sendJSONCmd(MessageUpdate{Type: "edit", ID: messageID, Room: model.roomKey, Body: body})
+}
+
+// sendDeleteCmd asks the server to delete one of our messages
+func (model *TUIModel) sendDeleteCmd(messageID string) tea.Cmd {
+	return model.sendJSONCmd(MessageUpdate{Type: "delete", ID: messageID, Room: model.roomKey})
+}
+
+// sendReactionCmd toggles our reaction on a message
+func (model *TUIModel) sendReactionCmd(messageID, emoji string) tea.Cmd {
+	return model.sendJSONCmd(MessageReaction{Type: "react", ID: messageID, Room: model.roomKey, Emoji: emoji})
+}
+
+// sendTypingCmd tells the room we're typing, at most once per
+// typingSendInterval
+func (model *TUIModel) sendTypingCmd() tea.Cmd {
+	now := time.Now()
+	if !model.isConnected || now.Sub(model.lastTypingSent) < typingSendInterval {
+		return nil
+	}
+	model.lastTypingSent = now
+	model.typingAnnounced = true
+	return model.notifyCmd(TypingNotice{Type: "typing", Room: model.roomKey, Ts: now.Unix()})
+}
+
+// stopTypingCmd tells the room we stopped typing, if we'd said we were
+func (model *TUIModel) stopTypingCmd() tea.Cmd {
+	if !model.isConnected || !model.typingAnnounced {
+		return nil
+	}
+	model.typingAnnounced = false
+	model.lastTypingSent = time.Time{}
+	return model.notifyCmd(TypingNotice{Type: "typing_stopped", Room: model.roomKey, Ts: time.Now().Unix()})
+}
+
+func (model *TUIModel) sendJSONCmd(value interface{}) tea.Cmd {
 	return func() tea.Msg {
-		if model.websocketConn == nil {
-			return errorMsg(fmt.Errorf("websocket not connected"))
-		}
-		encoded, err := json.Marshal(chat)
-		if err != nil {
+		if err := model.writeJSON(value); err != nil {
 			return errorMsg(err)
 		}
-		model.writeMutex.Lock()
-		err = model.websocketConn.WriteMessage(websocket.TextMessage, encoded)
-		model.writeMutex.Unlock()
-		if err != nil {
+		model.textInput.SetValue("")
+		return nil
+	}
+}
+
+// notifyCmd sends a notice such as typing which, unlike a message, leaves
+// what's being typed in the input
+func (model *TUIModel) notifyCmd(value interface{}) tea.Cmd {
+	return func() tea.Msg {
+		if err := model.writeJSON(value); err != nil {
 			return errorMsg(err)
 		}
-		model.textInput.SetValue("")
 		return nil
 	}
 }
 
+// writeJSON sends value as one websocket text frame
+func (model *TUIModel) writeJSON(value interface{}) error {
+	if model.websocketConn == nil {
+		return fmt.Errorf("websocket not connected")
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	model.writeMutex.Lock()
+	defer model.writeMutex.Unlock()
+	return model.websocketConn.WriteMessage(websocket.TextMessage, encoded)
+}
+
+// ClientOptions tunes optional client behaviour
+type ClientOptions struct {
+	// ConnectTimeout bounds the websocket dial and handshake. Zero means
+	// DefaultConnectTimeout.
+	ConnectTimeout time.Duration
+	// NameWidth caps how many cells a username takes in lists and chat
+	// before it is cut with an ellipsis. Zero means DefaultNameWidth.
+	NameWidth int
+}
+
+// DefaultConnectTimeout is how long joining a room may take before the
+// attempt counts as failed and the reconnect backoff takes over
+const DefaultConnectTimeout = 10 * time.Second
+
+// DefaultNameWidth is how many cells a username may take on screen before
+// it is truncated
+const DefaultNameWidth = 20
+
 // entry for bubbletea
 func RunClient(serverJoinURL, roomKey, username string) error {
+	return RunClientWithOptions(serverJoinURL, roomKey, username, ClientOptions{})
+}
+
+// RunClientWithOptions starts the TUI with the full set of options
+func RunClientWithOptions(serverJoinURL, roomKey, username string, opts ClientOptions) error {
+	model := NewTUIModel(serverJoinURL, roomKey, username)
+	if opts.ConnectTimeout > 0 {
+		model.connectTimeout = opts.ConnectTimeout
+	}
+	if opts.NameWidth > 0 {
+		model.nameWidth = opts.NameWidth
+	}
 	program := tea.NewProgram(
-		NewTUIModel(serverJoinURL, roomKey, username),
+		model,
 		tea.WithAltScreen(), // render on an isolated canvas so we don't leave scrollback noise
 	)
 	_, err := program.Run()
@@ -164,6 +400,46 @@ func (model *TUIModel) submitCredentialsCmd(username, password string) tea.Cmd {
 	}
 }
 
+// fetchRoomFilesCmd loads files uploaded before we joined, which never reach
+// us as file_uploaded broadcasts
+func (model *TUIModel) fetchRoomFilesCmd() tea.Cmd {
+	token := model.sessionToken
+	base := model.apiBaseURL
+	roomKey := model.roomKey
+	return func() tea.Msg {
+		if base == "" || token == "" {
+			return roomFilesMsg{room: roomKey, err: fmt.Errorf("missing session")}
+		}
+		files, err := apiListRoomFiles(base, token, roomKey)
+		return roomFilesMsg{room: roomKey, files: files, err: err}
+	}
+}
+
+// relayInfoCmd asks the server which relay it is and estimates how far our
+// clock is ahead of it, reading the server's time as of halfway through the
+// request
+func (model *TUIModel) relayInfoCmd() tea.Cmd {
+	base := model.apiBaseURL
+	return func() tea.Msg {
+		if base == "" {
+			return relayInfoMsg{err: fmt.Errorf("missing server")}
+		}
+		sent := time.Now()
+		resp, err := apiPing(base)
+		if err != nil {
+			return relayInfoMsg{err: err}
+		}
+		midpoint := sent.Add(time.Since(sent) / 2)
+		name := resp.Region
+		if name == "" {
+			if parsed, err := url.Parse(base); err == nil {
+				name = parsed.Host
+			}
+		}
+		return relayInfoMsg{name: name, skew: midpoint.Sub(time.UnixMilli(resp.ServerTimeMs))}
+	}
+}
+
 func (model *TUIModel) fetchFriendsCmd() tea.Cmd {
 	token := model.sessionToken
 	base := model.apiBaseURL
@@ -176,6 +452,26 @@ func (model *TUIModel) fetchFriendsCmd() tea.Cmd {
 	}
 }
 
+// bootstrapCmd loads the friends screen in one round trip, falling back to
+// the separate friends and requests calls on servers without /bootstrap
+func (model *TUIModel) bootstrapCmd() tea.Cmd {
+	token := model.sessionToken
+	base := model.apiBaseURL
+	return func() tea.Msg {
+		if base == "" || token == "" {
+			return bootstrapLoadedMsg{err: fmt.Errorf("missing session")}
+		}
+		friends, requests, err := apiBootstrap(base, token)
+		var statusErr *apiStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			if friends, err = apiGetFriends(base, token); err == nil {
+				requests, err = apiGetFriendRequests(base, token)
+			}
+		}
+		return bootstrapLoadedMsg{friends: friends, incoming: requests.Incoming, outgoing: requests.Outgoing, err: err}
+	}
+}
+
 func (model *TUIModel) sendFriendRequestCmd(friendUsername string) tea.Cmd {
 	token := model.sessionToken
 	base := model.apiBaseURL
@@ -183,11 +479,81 @@ func (model *TUIModel) sendFriendRequestCmd(friendUsername string) tea.Cmd {
 		if base == "" || token == "" {
 			return friendRequestActionMsg{username: friendUsername, err: fmt.Errorf("missing session")}
 		}
-		err := apiSendFriendRequest(base, token, friendUsername)
+		accepted, err := apiSendFriendRequest(base, token, friendUsername)
+		if accepted {
+			return friendRequestActionMsg{username: friendUsername, action: "accept", err: err}
+		}
 		return friendRequestActionMsg{username: friendUsername, action: "sent", err: err}
 	}
 }
 
+func (model *TUIModel) removeFriendCmd(friendUsername string) tea.Cmd {
+	token := model.sessionToken
+	base := model.apiBaseURL
+	return func() tea.Msg {
+		if base == "" || token == "" {
+			return friendRequestActionMsg{username: friendUsername, action: "remove", err: fmt.Errorf("missing session")}
+		}
+		err := apiRemoveFriend(base, token, friendUsername)
+		return friendRequestActionMsg{username: friendUsername, action: "remove", err: err}
+	}
+}
+
+// blockUserCmd blocks someone, which also ends our friendship with them
+func (model *TUIModel) blockUserCmd(username string) tea.Cmd {
+	token := model.sessionToken
+	base := model.apiBaseURL
+	return func() tea.Msg {
+		if base == "" || token == "" {
+			return friendRequestActionMsg{username: username, action: "block", err: fmt.Errorf("missing session")}
+		}
+		err := apiBlockUser(base, token, username)
+		return friendRequestActionMsg{username: username, action: "block", err: err}
+	}
+}
+
+// importFriendsCmd sends friend requests to every username in the list
+func (model *TUIModel) importFriendsCmd(usernames []string) tea.Cmd {
+	token := model.sessionToken
+	base := model.apiBaseURL
+	return func() tea.Msg {
+		if base == "" || token == "" {
+			return friendImportMsg{err: fmt.Errorf("missing session")}
+		}
+		results, err := apiBatchFriendRequests(base, token, usernames)
+		return friendImportMsg{results: results, err: err}
+	}
+}
+
+// parseFriendImport accepts usernames separated by commas, spaces or newlines,
+// or the path to a file containing such a list
+func parseFriendImport(input string) ([]string, error) {
+	input = strings.TrimSpace(input)
+	path := input
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[2:])
+		}
+	}
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		input = string(data)
+	}
+	usernames := strings.FieldsFunc(input, func(r rune) bool {
+		return r == ',' || r == ';' || unicode.IsSpace(r)
+	})
+	if len(usernames) == 0 {
+		return nil, errors.New("no usernames found")
+	}
+	if len(usernames) > maxFriendBatchSize {
+		return nil, fmt.Errorf("too many usernames (max %d per import)", maxFriendBatchSize)
+	}
+	return usernames, nil
+}
+
 func (model *TUIModel) logoutCmd() tea.Cmd {
 	token := model.sessionToken
 	base := model.apiBaseURL
@@ -200,6 +566,56 @@ func (model *TUIModel) logoutCmd() tea.Cmd {
 	}
 }
 
+// logoutAllCmd signs the user out on every device
+func (model *TUIModel) logoutAllCmd() tea.Cmd {
+	token := model.sessionToken
+	base := model.apiBaseURL
+	return func() tea.Msg {
+		if base == "" || token == "" {
+			return logoutResultMsg{err: nil}
+		}
+		return logoutResultMsg{err: apiLogoutAll(base, token)}
+	}
+}
+
+// deleteAccountCmd deletes the signed-in account, confirmed by its password
+func (model *TUIModel) deleteAccountCmd(password string) tea.Cmd {
+	token := model.sessionToken
+	base := model.apiBaseURL
+	return func() tea.Msg {
+		if base == "" || token == "" {
+			return accountDeletedMsg{err: fmt.Errorf("missing session")}
+		}
+		return accountDeletedMsg{err: apiDeleteAccount(base, token, password)}
+	}
+}
+
+// unblockUserCmd lifts our block on someone. It doesn't make them a friend
+// again.
+func (model *TUIModel) unblockUserCmd(username string) tea.Cmd {
+	token := model.sessionToken
+	base := model.apiBaseURL
+	return func() tea.Msg {
+		if base == "" || token == "" {
+			return friendRequestActionMsg{username: username, action: "unblock", err: fmt.Errorf("missing session")}
+		}
+		err := apiUnblockUser(base, token, username)
+		return friendRequestActionMsg{username: username, action: "unblock", err: err}
+	}
+}
+
+func (model *TUIModel) fetchBlockedUsersCmd() tea.Cmd {
+	token := model.sessionToken
+	base := model.apiBaseURL
+	return func() tea.Msg {
+		if base == "" || token == "" {
+			return blockedUsersLoadedMsg{err: fmt.Errorf("missing session")}
+		}
+		users, err := apiListBlocked(base, token)
+		return blockedUsersLoadedMsg{users: users, err: err}
+	}
+}
+
 func (model *TUIModel) fetchFriendRequestsCmd() tea.Cmd {
 	token := model.sessionToken
 	base := model.apiBaseURL
@@ -322,8 +738,19 @@ func formatFileSize(bytes int64) string {
 	}
 }
 
-// uploadFileCmd uploads selected file
+// pendingUpload identifies an interrupted upload to resume. The server ties
+// each upload to the room it was started in, so the same file sent to
+// another room starts afresh.
+type pendingUpload struct {
+	room string
+	path string
+}
+
+// uploadFileCmd uploads selected file, resuming an earlier interrupted
+// upload of the same path to this room when the server still has it
 func (model *TUIModel) uploadFileCmd(filePath string) tea.Cmd {
+	roomKey := model.roomKey
+	resumeID := model.pendingUploads[pendingUpload{room: roomKey, path: filePath}]
 	return func() tea.Msg {
 		// Progress callback
 		progressFn := func(progress float64) {
@@ -331,25 +758,44 @@ func (model *TUIModel) uploadFileCmd(filePath string) tea.Cmd {
 			// For simplicity, we'll handle it in one shot
 		}
 
-		fileID, err := apiUploadFile(
+		fileID, uploadID, err := apiResumableUpload(
 			model.apiBaseURL,
 			model.sessionToken,
 			filePath,
-			model.roomKey,
-			model.username,
+			roomKey,
+			resumeID,
 			progressFn,
 		)
 
+		// Servers without resumable uploads only understand the multipart form
+		var statusErr *apiStatusError
+		if errors.As(err, &statusErr) && uploadID == "" &&
+			(statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusMethodNotAllowed) {
+			fileID, err = apiUploadFile(
+				model.apiBaseURL,
+				model.sessionToken,
+				filePath,
+				roomKey,
+				progressFn,
+			)
+		}
+
 		if err != nil {
-			return fileUploadErrorMsg{err: err, filename: filePath}
+			return fileUploadErrorMsg{err: err, filename: filePath, uploadID: uploadID, room: roomKey}
 		}
 
-		return fileUploadedMsg{fileID: fileID, filename: filepath.Base(filePath)}
+		return fileUploadedMsg{fileID: fileID, filename: filepath.Base(filePath), path: filePath, room: roomKey}
 	}
 }
 
 // downloadFileCmd downloads a file from the server
-func (model *TUIModel) downloadFileCmd(fileID, filename string) tea.Cmd {
+func (model *TUIModel) downloadFileCmd(file FileMetadata) tea.Cmd {
+	filename := file.Filename
+	downloadPath := file.DownloadPath
+	if downloadPath == "" {
+		// Older servers only broadcast the ID
+		downloadPath = fileDownloadPath(file.ID, model.roomKey)
+	}
 	return func() tea.Msg {
 		// Download to ~/Downloads
 		destDir := filepath.Join(os.Getenv("HOME"), "Downloads")
@@ -361,8 +807,7 @@ func (model *TUIModel) downloadFileCmd(fileID, filename string) tea.Cmd {
 		err := apiDownloadFile(
 			model.apiBaseURL,
 			model.sessionToken,
-			fileID,
-			model.roomKey,
+			downloadPath,
 			destPath,
 		)
 
@@ -374,6 +819,14 @@ func (model *TUIModel) downloadFileCmd(fileID, filename string) tea.Cmd {
 	}
 }
 
+// deleteFileCmd asks the server to delete a file we uploaded to this room
+func (model *TUIModel) deleteFileCmd(file FileMetadata) tea.Cmd {
+	apiBase, token, roomKey := model.apiBaseURL, model.sessionToken, model.roomKey
+	return func() tea.Msg {
+		return fileDeleteResultMsg{file: file, err: apiDeleteFile(apiBase, token, file.ID, roomKey)}
+	}
+}
+
 // checkVersionCmd checks for updates in the background
 func checkVersionCmd() tea.Cmd {
 	return func() tea.Msg {
@@ -0,0 +1,1263 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/gorilla/websocket"
+
+	"termchat/internal/storage"
+)
+
+// TestClientDetectsStalledConnection verifies the client gives up on a server
+// that stops pinging instead of blocking in ReadMessage forever
+func TestClientDetectsStalledConnection(t *testing.T) {
+	previous := keepaliveTimeout
+	keepaliveTimeout = 100 * time.Millisecond
+	defer func() { keepaliveTimeout = previous }()
+
+	const pingFor = 250 * time.Millisecond
+	stop := make(chan struct{})
+	defer close(stop)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Ping for a while, then go silent without closing, like a half-open socket
+		deadline := time.Now().Add(pingFor)
+		for time.Now().Before(deadline) {
+			_ = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+			time.Sleep(30 * time.Millisecond)
+		}
+		<-stop
+	}))
+	defer httpServer.Close()
+
+	model := &TUIModel{
+		mode:          modeChat,
+		roomKey:       "stalled",
+		serverJoinURL: "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/join",
+	}
+	if msg := model.connectCmd()(); msg != (connectedMsg{}) {
+		t.Fatalf("expected connectedMsg, got %#v", msg)
+	}
+	model.Update(connectedMsg{})
+
+	started := time.Now()
+	msg := model.readOnceCmd()()
+	if _, ok := msg.(connectLostMsg); !ok {
+		t.Fatalf("expected connectLostMsg, got %#v", msg)
+	}
+	if elapsed := time.Since(started); elapsed < pingFor {
+		t.Errorf("expected pings to keep the connection alive for %v, lost after %v", pingFor, elapsed)
+	}
+
+	_, cmd := model.Update(msg)
+	if cmd == nil {
+		t.Error("expected a reconnect to be scheduled")
+	}
+	if model.isConnected || model.mode != modeChat {
+		t.Errorf("expected to stay in chat while disconnected, got connected=%v mode=%v", model.isConnected, model.mode)
+	}
+	if view := model.View(); !strings.Contains(view, "Connection lost") {
+		t.Errorf("expected status line to report the lost connection, got:\n%s", view)
+	}
+}
+
+// TestExistsCheckDistinguishesServerErrors verifies only a 404 reads as a
+// missing room, other failures ask the user to retry instead, and joining a
+// saved but empty room says so
+func TestExistsCheckDistinguishesServerErrors(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	for _, tc := range []struct {
+		status     int
+		body       string
+		wantMode   appMode
+		wantNotice string
+		wantToast  string
+	}{
+		{status: http.StatusOK, body: "active", wantMode: modeChat},
+		{status: http.StatusOK, body: "ok", wantMode: modeChat},
+		{status: http.StatusOK, body: "saved", wantMode: modeChat, wantNotice: "Nobody is in this room right now"},
+		{status: http.StatusNotFound, wantMode: modeManualRoom, wantNotice: "Room not found"},
+		{status: http.StatusInternalServerError, wantMode: modeManualRoom, wantToast: "Couldn't check room, try again"},
+		{status: http.StatusTooManyRequests, wantMode: modeManualRoom, wantToast: "429"},
+	} {
+		httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+			_, _ = w.Write([]byte(tc.body))
+		}))
+		joinURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/join"
+		model := NewTUIModel(joinURL, "", "alice")
+		model.mode = modeManualRoom
+
+		msg := model.existsCmd("room1")().(existsMsg)
+		httpServer.Close()
+		if (msg.err == nil) != (tc.wantToast == "") {
+			t.Errorf("status %d: unexpected err %v", tc.status, msg.err)
+		}
+		model.handleExistsMsg(msg)
+		if model.mode != tc.wantMode {
+			t.Errorf("status %d: expected mode %v, got %v", tc.status, tc.wantMode, model.mode)
+		}
+		if !strings.Contains(model.toast, tc.wantToast) || (tc.wantToast == "" && model.toast != "") {
+			t.Errorf("status %d: expected toast %q, got %q", tc.status, tc.wantToast, model.toast)
+		}
+		var notices string
+		for _, chat := range model.messages {
+			notices += chat.Body
+		}
+		if !strings.Contains(notices, tc.wantNotice) || (tc.wantNotice == "" && notices != "") {
+			t.Errorf("status %d: expected notice %q, got %q", tc.status, tc.wantNotice, notices)
+		}
+	}
+}
+
+// TestExistsCheckShowsProgressAndRetriesAfterTimeout verifies the manual
+// join shows a spinner while the room is checked, offers a retry when the
+// check times out, and ignores a result that arrives after backing out
+func TestExistsCheckShowsProgressAndRetriesAfterTimeout(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	previous := existsCheckTimeout
+	existsCheckTimeout = 50 * time.Millisecond
+	defer func() { existsCheckTimeout = previous }()
+	release := make(chan struct{})
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer httpServer.Close()
+	defer close(release)
+
+	model := NewTUIModel("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/join", "", "alice")
+	model.mode = modeManualRoom
+	model.textInput.SetValue("room1")
+	if _, cmd := model.Update(tea.KeyMsg{Type: tea.KeyEnter}); cmd == nil {
+		t.Fatal("expected the check to start")
+	}
+	if view := model.View(); !strings.Contains(view, "Checking room…") {
+		t.Fatalf("expected a progress line, got:\n%s", view)
+	}
+	model.textInput.SetValue("room2")
+	if _, cmd := model.Update(tea.KeyMsg{Type: tea.KeyEnter}); cmd != nil {
+		t.Fatal("expected Enter to wait for the pending check")
+	}
+
+	msg := model.existsCmd("room1")().(existsMsg)
+	if !errors.Is(msg.err, errExistsTimedOut) {
+		t.Fatalf("expected a timeout, got %v", msg.err)
+	}
+	model.Update(msg)
+	if model.mode != modeManualRoom || model.textInput.Value() != "room1" || !strings.Contains(model.toast, "Press Enter to try again") {
+		t.Fatalf("expected a retry offer, got mode %v input %q toast %q", model.mode, model.textInput.Value(), model.toast)
+	}
+	if view := model.View(); strings.Contains(view, "Checking room…") {
+		t.Fatalf("expected the progress line gone, got:\n%s", view)
+	}
+
+	// Backing out while a check is pending doesn't drop us into the room
+	model.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	model.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	model.Update(existsMsg{key: "room1", exists: true})
+	if model.mode != modeFriends || model.roomKey != "" {
+		t.Fatalf("expected to stay on friends, got mode %v room %q", model.mode, model.roomKey)
+	}
+}
+
+// TestHandleRoomExistsStatuses verifies the endpoint only answers 200 or 404
+// for a well-formed check, that an empty room with saved history still
+// exists but isn't reported active, and that a direct room is only found by
+// its members
+func TestHandleRoomExistsStatuses(t *testing.T) {
+	server, _ := newTestServer(t)
+	server.hub.getOrCreateRoom("live")
+	dmKey := directRoomKey("alice", "bob")
+	server.hub.getOrCreateRoom(dmKey)
+	if err := server.store.InsertMessage(context.Background(), storage.Message{ID: "m1", RoomKey: "quiet", Username: "bob", Body: "hi", Ts: time.Now()}); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	aliceToken := createTestSession(t, server, "alice")
+	carolToken := createTestSession(t, server, "carol")
+	for _, tc := range []struct {
+		method, query, token string
+		want                 int
+		body                 string
+	}{
+		{http.MethodGet, "?room=live", "", http.StatusOK, roomStatusActive},
+		{http.MethodGet, "?room=quiet", "", http.StatusOK, roomStatusSaved},
+		{http.MethodGet, "?room=gone", "", http.StatusNotFound, ""},
+		{http.MethodGet, "", "", http.StatusBadRequest, ""},
+		{http.MethodPost, "?room=live", "", http.StatusMethodNotAllowed, ""},
+		{http.MethodGet, "?room=" + dmKey, "", http.StatusNotFound, ""},
+		{http.MethodGet, "?room=" + dmKey, carolToken, http.StatusNotFound, ""},
+		{http.MethodGet, "?room=" + dmKey, aliceToken, http.StatusOK, roomStatusActive},
+	} {
+		req := httptest.NewRequest(tc.method, "/exists"+tc.query, nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		server.HandleRoomExists(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s %s: expected %d, got %d", tc.method, tc.query, tc.want, rec.Code)
+		}
+		if tc.body != "" && rec.Body.String() != tc.body {
+			t.Errorf("%s %s: expected body %q, got %q", tc.method, tc.query, tc.body, rec.Body.String())
+		}
+	}
+}
+
+// TestReconnectBackfillsHistory verifies a client that drops and reconnects
+// gets the room's recent history again, including edits it missed, without
+// duplicating what it already showed
+func TestReconnectBackfillsHistory(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	token := createTestSession(t, server, "alice")
+	ctx := context.Background()
+	if err := server.store.InsertMessage(ctx, storage.Message{ID: "m1", RoomKey: "lobby", Username: "bob", Body: "first", Ts: time.Now()}); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+
+	model := &TUIModel{
+		mode:          modeChat,
+		roomKey:       "lobby",
+		sessionToken:  token,
+		serverJoinURL: "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/join",
+	}
+	readBackfill := func() {
+		t.Helper()
+		if msg := model.connectCmd()(); msg != (connectedMsg{}) {
+			t.Fatalf("expected connectedMsg, got %#v", msg)
+		}
+		model.isConnected = true
+		_ = model.websocketConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		msg, ok := model.readOnceCmd()().(incomingMsg)
+		if !ok {
+			t.Fatalf("expected the backfilled message, got %#v", msg)
+		}
+		model.Update(msg)
+	}
+
+	readBackfill()
+	if len(model.messages) != 1 || model.messages[0].Body != "first" {
+		t.Fatalf("unexpected messages after join: %+v", model.messages)
+	}
+
+	// Drop the connection and edit the message while we're away
+	model.closeConnection()
+	for deadline := time.Now().Add(2 * time.Second); server.hub.Exists("lobby"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("server never noticed the disconnect")
+		}
+	}
+	if err := server.store.EditMessage(ctx, "m1", "first (edited)"); err != nil {
+		t.Fatalf("EditMessage: %v", err)
+	}
+
+	readBackfill()
+	defer model.closeConnection()
+	if len(model.messages) != 1 || model.messages[0].Body != "first (edited)" || !model.messages[0].Edited {
+		t.Fatalf("expected the backfill to update the message in place, got %+v", model.messages)
+	}
+}
+
+// TestExpiredSessionRejoinsAfterLogin verifies a 401 on reconnect stops the
+// retry loop and asks the user to log in, after which they land back in the
+// room they were in
+func TestExpiredSessionRejoinsAfterLogin(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	server, httpServer := newTestServer(t)
+	token := createTestSession(t, server, "alice")
+	model := NewTUIModel("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/join", "", "alice")
+	model.username = "alice"
+	model.sessionToken = token
+	model.startChatWithRoom("lobby", "")
+	if msg := model.connectCmd()(); msg != (connectedMsg{}) {
+		t.Fatalf("expected connectedMsg, got %#v", msg)
+	}
+	model.isConnected = true
+
+	// The session ends server-side while we're connected, then the
+	// connection drops
+	if err := server.store.DeleteSession(context.Background(), token); err != nil {
+		t.Fatalf("DeleteSession: %v", err)
+	}
+	model.closeConnection()
+	failed, ok := model.connectCmd()().(connectFailedMsg)
+	if !ok || !errors.Is(failed.err, errUnauthorized) {
+		t.Fatalf("expected an unauthorized connect failure, got %#v", failed)
+	}
+	if _, cmd := model.Update(failed); cmd != nil {
+		t.Fatal("expected no reconnect to be scheduled")
+	}
+	if model.mode != modeAuthMenu || model.sessionToken != "" {
+		t.Fatalf("expected to be sent to log in, got mode %v", model.mode)
+	}
+	if view := model.View(); !strings.Contains(view, "rejoin the room") {
+		t.Fatalf("expected a notice about rejoining, got:\n%s", view)
+	}
+
+	_, cmd := model.Update(authResultMsg{token: createTestSession(t, server, "alice"), username: "alice"})
+	if cmd == nil || model.mode != modeChat || model.roomKey != "lobby" {
+		t.Fatalf("expected to be back in lobby, got mode %v room %q", model.mode, model.roomKey)
+	}
+	if msg := model.connectCmd()(); msg != (connectedMsg{}) {
+		t.Fatalf("expected the new token to connect, got %#v", msg)
+	}
+	model.closeConnection()
+
+	// Someone else logging in on this terminal doesn't inherit the room
+	model.resumeUser, model.resumeRoom = "alice", "lobby"
+	model.mode = modeAuthMenu
+	model.Update(authResultMsg{token: createTestSession(t, server, "bob"), username: "bob"})
+	if model.mode != modeFriends || model.resumeRoom != "" {
+		t.Fatalf("expected bob to land on friends, got mode %v", model.mode)
+	}
+}
+
+// TestEditByMessageID verifies our messages show the ID prefix /edit takes,
+// /edit can target one of them by ID or prefix, refuses other people's, and
+// otherwise edits the last message
+func TestEditByMessageID(t *testing.T) {
+	sent := make(chan MessageUpdate, 4)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var update MessageUpdate
+			if err := conn.ReadJSON(&update); err != nil {
+				return
+			}
+			sent <- update
+		}
+	}))
+	defer httpServer.Close()
+
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/join", "lobby", "alice")
+	model.username = "alice"
+	model.mode = modeChat
+	if msg := model.connectCmd()(); msg != (connectedMsg{}) {
+		t.Fatalf("expected connectedMsg, got %#v", msg)
+	}
+	defer model.closeConnection()
+	model.isConnected = true
+	model.messages = []ChatMessage{
+		{ID: "3f2a9c1e-1111-4111-8111-111111111111", Room: "lobby", User: "alice", Body: "helo"},
+		{ID: "7b0d4e2a-2222-4222-8222-222222222222", Room: "lobby", User: "bob", Body: "hi"},
+		{ID: "c0ffee00-3333-4333-8333-333333333333", Room: "lobby", User: "alice", Body: "later"},
+	}
+	edit := func(input string) tea.Cmd {
+		t.Helper()
+		model.textInput.SetValue(input)
+		_, cmd := model.Update(tea.KeyMsg{Type: tea.KeyEnter})
+		return cmd
+	}
+	expectSent := func(id, body string) {
+		t.Helper()
+		select {
+		case update := <-sent:
+			if update.Type != "edit" || update.ID != id || update.Body != body {
+				t.Fatalf("expected an edit of %s to %q, got %+v", id, body, update)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected an edit to be sent")
+		}
+	}
+
+	// Our messages show the ID to type; other people's don't
+	view := model.View()
+	if !strings.Contains(view, "#3f2a9c1e") || !strings.Contains(view, "#c0ffee00") || strings.Contains(view, "#7b0d4e2a") {
+		t.Fatalf("expected only alice's messages tagged with their IDs, got:\n%s", view)
+	}
+	edit("/edit #3f2a9c1e hello there")()
+	expectSent("3f2a9c1e-1111-4111-8111-111111111111", "hello there")
+	edit("/edit c0ffee00-3333-4333-8333-333333333333 much later")()
+	expectSent("c0ffee00-3333-4333-8333-333333333333", "much later")
+	edit("/edit fixed it")()
+	expectSent("c0ffee00-3333-4333-8333-333333333333", "fixed it")
+
+	if cmd := edit("/edit 7b0d4e2a rewritten"); cmd != nil {
+		t.Fatal("expected no edit of bob's message to be sent")
+	}
+	if last := model.messages[len(model.messages)-1]; last.Body != "You can only edit your own messages." {
+		t.Fatalf("expected a notice, got %+v", last)
+	}
+}
+
+// TestMultiLineCompose verifies Alt+Enter and Ctrl+J build up a multi-line
+// message that Enter sends as one, that Backspace and Esc edit or drop the
+// draft, and that an over-long message is refused before it's sent
+func TestMultiLineCompose(t *testing.T) {
+	sent := make(chan ChatMessage, 4)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var chat ChatMessage
+			if err := conn.ReadJSON(&chat); err != nil {
+				return
+			}
+			sent <- chat
+		}
+	}))
+	defer httpServer.Close()
+
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/join", "lobby", "alice")
+	model.username = "alice"
+	model.mode = modeChat
+	if msg := model.connectCmd()(); msg != (connectedMsg{}) {
+		t.Fatalf("expected connectedMsg, got %#v", msg)
+	}
+	defer model.closeConnection()
+	model.isConnected = true
+	key := func(input string, msg tea.KeyMsg) tea.Cmd {
+		t.Helper()
+		model.textInput.SetValue(input)
+		_, cmd := model.Update(msg)
+		return cmd
+	}
+	newLine := tea.KeyMsg{Type: tea.KeyEnter, Alt: true}
+
+	key("first line", newLine)
+	key("", tea.KeyMsg{Type: tea.KeyCtrlJ})
+	if len(model.composeLines) != 2 || model.textInput.Value() != "" {
+		t.Fatalf("expected two composed lines and an empty input, got %q and %q", model.composeLines, model.textInput.Value())
+	}
+	// Backspace on an empty line steps back through the draft
+	key("", tea.KeyMsg{Type: tea.KeyBackspace})
+	key("", tea.KeyMsg{Type: tea.KeyBackspace})
+	if len(model.composeLines) != 0 || model.textInput.Value() != "first line" {
+		t.Fatalf("expected to be back on the first line, got %q and %q", model.composeLines, model.textInput.Value())
+	}
+	key("first line", newLine)
+	key("", newLine)
+	model.textInput.SetValue("third")
+	if view := model.View(); !strings.Contains(view, "  first line") || !strings.Contains(view, "Esc discard") {
+		t.Fatalf("expected the draft in the input box, got %q", view)
+	}
+	key("third", tea.KeyMsg{Type: tea.KeyEnter})()
+	select {
+	case chat := <-sent:
+		if chat.Body != "first line\n\nthird" {
+			t.Fatalf("expected one multi-line message, got %q", chat.Body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the message to be sent")
+	}
+	if len(model.composeLines) != 0 {
+		t.Fatalf("expected the draft cleared, got %q", model.composeLines)
+	}
+
+	key("never mind", newLine)
+	key("", tea.KeyMsg{Type: tea.KeyEsc})
+	if model.mode != modeChat || len(model.composeLines) != 0 {
+		t.Fatalf("expected Esc to drop the draft and stay in the room, got mode %v and %q", model.mode, model.composeLines)
+	}
+
+	long := strings.Repeat("x", maxMessageBodyBytes)
+	key(long, newLine)
+	if cmd := key("y", tea.KeyMsg{Type: tea.KeyEnter}); cmd == nil || !strings.Contains(model.toast, "too long") {
+		t.Fatalf("expected a too long toast, got %q", model.toast)
+	}
+	if len(model.composeLines) != 1 {
+		t.Fatal("expected the draft kept so it can be shortened")
+	}
+	select {
+	case chat := <-sent:
+		t.Fatalf("expected nothing sent, got %q", chat.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestPastedLinesStayTogether verifies Enter and Tab typed in by a terminal
+// paste build up the draft instead of sending it or completing a command,
+// even when the paste starts with a one-character line
+func TestPastedLinesStayTogether(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws://127.0.0.1:1/join", "lobby", "alice")
+	model.mode = modeChat
+	model.textInput.Focus()
+	for _, msg := range []tea.KeyMsg{
+		{Type: tea.KeyRunes, Runes: []rune("if")},
+		{Type: tea.KeySpace, Runes: []rune(" ")},
+		{Type: tea.KeyRunes, Runes: []rune("ok{")},
+		{Type: tea.KeyEnter},
+		{Type: tea.KeyTab},
+		{Type: tea.KeyRunes, Runes: []rune("return")},
+		{Type: tea.KeyEnter},
+		{Type: tea.KeyRunes, Runes: []rune("}")},
+	} {
+		model.Update(msg)
+	}
+	if got := strings.Join(model.composeLines, "|"); got != "if ok{|    return" || model.textInput.Value() != "}" {
+		t.Fatalf("expected the pasted lines in the draft, got %q and %q", model.composeLines, model.textInput.Value())
+	}
+
+	// A paste whose first line is one character comes as a single rune and
+	// then Enter, straight after it
+	model.composeLines = nil
+	model.textInput.SetValue("")
+	model.pastingUntil = time.Time{}
+	for _, msg := range []tea.KeyMsg{
+		{Type: tea.KeyRunes, Runes: []rune("a")},
+		{Type: tea.KeyEnter},
+		{Type: tea.KeyRunes, Runes: []rune("b")},
+	} {
+		model.Update(msg)
+	}
+	if got := strings.Join(model.composeLines, "|"); got != "a" || model.textInput.Value() != "b" {
+		t.Fatalf("expected the single-character line kept in the draft, got %q and %q", model.composeLines, model.textInput.Value())
+	}
+
+	// Enter typed after a human pause still sends
+	model.composeLines = nil
+	model.textInput.SetValue("")
+	model.pastingUntil = time.Time{}
+	model.lastTextAt = time.Time{}
+	model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("k")})
+	model.lastTextAt = model.lastTextAt.Add(-time.Second)
+	model.isConnected = true
+	if _, cmd := model.Update(tea.KeyMsg{Type: tea.KeyEnter}); cmd == nil || len(model.composeLines) != 0 {
+		t.Fatalf("expected a typed Enter to send, got draft %q", model.composeLines)
+	}
+	model.isConnected = false
+
+	// Once the paste is over, Tab completes again
+	model.pastingUntil = time.Time{}
+	model.lastTextAt = time.Time{}
+	model.composeLines = nil
+	model.textInput.SetValue("/he")
+	model.textInput.CursorEnd()
+	model.Update(tea.KeyMsg{Type: tea.KeyTab})
+	if model.textInput.Value() != "/help " {
+		t.Fatalf("expected Tab to complete after the paste, got %q", model.textInput.Value())
+	}
+}
+
+// TestTypingIndicator verifies a typing notice is read as such rather than as
+// a chat message, and shows under the message box until it expires
+func TestTypingIndicator(t *testing.T) {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.WriteJSON(TypingNotice{Type: "typing", Room: "lobby", User: "bob"})
+		_, _, _ = conn.ReadMessage()
+	}))
+	defer httpServer.Close()
+
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/join", "lobby", "alice")
+	model.username = "alice"
+	model.mode = modeChat
+	if msg := model.connectCmd()(); msg != (connectedMsg{}) {
+		t.Fatalf("expected connectedMsg, got %#v", msg)
+	}
+	defer model.closeConnection()
+	msg, ok := model.readOnceCmd()().(typingMsg)
+	if !ok {
+		t.Fatalf("expected a typingMsg, got %#v", msg)
+	}
+	model.Update(msg)
+	if len(model.messages) != 0 {
+		t.Fatalf("expected no chat line for a typing notice, got %+v", model.messages)
+	}
+	if view := model.View(); !strings.Contains(view, "bob is typing…") {
+		t.Fatalf("expected the typing line, got:\n%s", view)
+	}
+
+	model.Update(typingMsg{Type: "typing", Room: "lobby", User: "alice"})
+	model.Update(typingMsg{Type: "typing", Room: "lobby", User: "carol"})
+	if line := model.typingLine(); line != "bob and carol are typing…" {
+		t.Fatalf("expected our own notice ignored, got %q", line)
+	}
+
+	// Our own notices are debounced
+	model.isConnected = true
+	if model.sendTypingCmd() == nil || model.sendTypingCmd() != nil {
+		t.Fatalf("expected one typing notice per interval")
+	}
+
+	// Sending clears the sender's indicator; silence lets the rest expire
+	model.Update(incomingMsg{ID: "m1", Room: "lobby", User: "bob", Body: "hi"})
+	model.typingUsers["carol"] = time.Now().Add(-time.Millisecond)
+	model.Update(typingExpiredMsg{})
+	if line := model.typingLine(); line != "" || len(model.typingUsers) != 0 {
+		t.Fatalf("expected nobody typing, got %q (%v)", line, model.typingUsers)
+	}
+}
+
+// TestRoomMembersInChatHeader verifies the chat header lists who's online from
+// the server's presence updates and forgets it on leaving the room
+func TestRoomMembersInChatHeader(t *testing.T) {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.WriteJSON(RoomPresence{Type: "presence", Room: "lobby", Members: []string{"alice", "bob"}})
+		_, _, _ = conn.ReadMessage()
+	}))
+	defer httpServer.Close()
+
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/join", "lobby", "alice")
+	model.username = "alice"
+	model.mode = modeChat
+	if msg := model.connectCmd()(); msg != (connectedMsg{}) {
+		t.Fatalf("expected connectedMsg, got %#v", msg)
+	}
+	defer model.closeConnection()
+	msg, ok := model.readOnceCmd()().(presenceMsg)
+	if !ok {
+		t.Fatalf("expected a presenceMsg, got %#v", msg)
+	}
+	model.Update(msg)
+	if view := model.View(); !strings.Contains(view, "Online: alice, bob") {
+		t.Fatalf("expected the members in the header, got:\n%s", view)
+	}
+	if len(model.messages) != 0 {
+		t.Fatalf("expected no chat line for a presence update, got %+v", model.messages)
+	}
+
+	model.Update(presenceMsg{Type: "presence", Room: "other", Members: []string{"mallory"}})
+	model.Update(presenceMsg{Type: "presence", Room: "lobby", Members: []string{"a", "b", "c", "d", "e", "f"}})
+	if segment := model.membersSegment(); segment != "Online: a, b, c, d +2" {
+		t.Fatalf("unexpected members segment %q", segment)
+	}
+
+	model.resetChatLog()
+	if segment := model.membersSegment(); segment != "" {
+		t.Fatalf("expected the members cleared, got %q", segment)
+	}
+}
+
+// TestReconnectBacksOffAndGivesUp verifies reconnect delays grow
+// exponentially up to the cap and that the client stops retrying after
+// maxReconnectAttempts
+func TestReconnectBacksOffAndGivesUp(t *testing.T) {
+	for _, tc := range []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{0, 250 * time.Millisecond, 500 * time.Millisecond},
+		{3, 2 * time.Second, 4 * time.Second},
+		{10, 15 * time.Second, 30 * time.Second},
+		{100, 15 * time.Second, 30 * time.Second},
+	} {
+		for i := 0; i < 20; i++ {
+			if delay := reconnectDelay(tc.attempt); delay < tc.min || delay > tc.max {
+				t.Fatalf("attempt %d: delay %v outside [%v, %v]", tc.attempt, delay, tc.min, tc.max)
+			}
+		}
+	}
+
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws://127.0.0.1:1/join", "lobby", "alice")
+	model.mode = modeChat
+	failure := connectFailedMsg{err: errors.New("connection refused")}
+	for i := 0; i < maxReconnectAttempts; i++ {
+		model.Update(failure)
+		if model.mode != modeChat || model.reconnectAttempts != i+1 {
+			t.Fatalf("attempt %d: expected to keep retrying, got mode %v attempts %d", i, model.mode, model.reconnectAttempts)
+		}
+	}
+	model.Update(connectedMsg{})
+	if model.reconnectAttempts != 0 {
+		t.Fatalf("expected a successful connect to reset the attempts, got %d", model.reconnectAttempts)
+	}
+	model.closeConnection()
+
+	for i := 0; i <= maxReconnectAttempts; i++ {
+		model.Update(failure)
+	}
+	if model.mode != modeFriends || model.roomKey != "" {
+		t.Fatalf("expected to give up and return to friends, got mode %v room %q", model.mode, model.roomKey)
+	}
+	last := model.messages[len(model.messages)-1]
+	if !strings.Contains(last.Body, "Giving up reconnecting") {
+		t.Fatalf("expected a give-up notice, got %+v", last)
+	}
+}
+
+// TestConnectTimesOut verifies a host that accepts the TCP connection but
+// never answers the handshake fails promptly with a distinct error
+func TestConnectTimesOut(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close() // hold it open and say nothing
+		}
+	}()
+
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws://"+listener.Addr().String()+"/join", "lobby", "alice")
+	model.mode = modeChat
+	model.connectTimeout = 100 * time.Millisecond
+	started := time.Now()
+	msg, ok := model.connectCmd()().(connectFailedMsg)
+	if !ok || !errors.Is(msg.err, errConnectTimedOut) {
+		t.Fatalf("expected a timed out connect, got %#v", msg)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Fatalf("expected the connect to give up promptly, took %v", elapsed)
+	}
+
+	if _, cmd := model.Update(msg); cmd == nil {
+		t.Fatalf("expected a reconnect to be scheduled")
+	}
+	if !strings.Contains(model.toast, "timed out") || !strings.Contains(model.View(), "connecting timed out") {
+		t.Fatalf("expected the timeout to be reported, got toast %q", model.toast)
+	}
+}
+
+// TestRoomBanStopsReconnects verifies a user removed from a room is refused
+// when their client tries to rejoin, and that the client stops retrying
+// instead of looping
+func TestRoomBanStopsReconnects(t *testing.T) {
+	server := NewServerWithOptions(newTestStore(t), ServerOptions{UploadDir: t.TempDir(), MaxFileSize: 1024 * 1024, AdminToken: "op-secret"})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/join", server.ServeWS)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+	token := createTestSession(t, server, "mallory")
+
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/join", "lobby", "mallory")
+	model.sessionToken = token
+	model.mode = modeChat
+	if msg := model.connectCmd()(); msg != (connectedMsg{}) {
+		t.Fatalf("expected connectedMsg, got %#v", msg)
+	}
+	waitForRoomSize(t, server.hub, "lobby", 1)
+
+	banRoom := func(method string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/room-bans", strings.NewReader(`{"room":"lobby","username":"mallory"}`))
+		req.Header.Set("Authorization", "Bearer op-secret")
+		rec := httptest.NewRecorder()
+		server.HandleRoomBan(rec, req)
+		return rec
+	}
+	if rec := banRoom(http.MethodPost); rec.Code != http.StatusNoContent {
+		t.Fatalf("ban: %d %s", rec.Code, rec.Body.String())
+	}
+	var notice ChatMessage
+	readTestJSON(t, model.websocketConn, &notice)
+	if !strings.Contains(notice.Body, "removed from this room") {
+		t.Fatalf("expected a removal notice, got %+v", notice)
+	}
+	model.closeConnection()
+
+	// The client tries to come back as it would after a dropped connection
+	msg, ok := model.connectCmd()().(connectFailedMsg)
+	if !ok || !errors.Is(msg.err, errRoomForbidden) {
+		t.Fatalf("expected the rejoin to be refused, got %#v", msg)
+	}
+	if _, cmd := model.Update(msg); cmd != nil {
+		t.Fatalf("expected no reconnect after being refused")
+	}
+	if model.mode != modeFriends || model.roomKey != "" {
+		t.Fatalf("expected to return to friends, got mode %v room %q", model.mode, model.roomKey)
+	}
+	if last := model.messages[len(model.messages)-1]; !strings.Contains(last.Body, "don't have access") {
+		t.Fatalf("expected an access notice, got %+v", last)
+	}
+
+	if rec := banRoom(http.MethodDelete); rec.Code != http.StatusNoContent {
+		t.Fatalf("unban: %d %s", rec.Code, rec.Body.String())
+	}
+	conn, _, err := dialTestRoom(httpServer, token, "lobby")
+	if err != nil {
+		t.Fatalf("expected to rejoin once unbanned: %v", err)
+	}
+	conn.Close()
+}
+
+// TestDeleteFileCommand verifies /delete <file> asks the server to delete our
+// own upload, refuses other people's, and drops a file the server no longer has
+func TestDeleteFileCommand(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	var deleted []string
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete || r.URL.Query().Get("room") != "lobby" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/api/files/"))
+		if r.URL.Path == "/api/files/gone" {
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"file_id":"f1","status":"deleted"}`))
+	}))
+	defer httpServer.Close()
+
+	model := NewTUIModel("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/join", "lobby", "alice")
+	model.mode = modeChat
+	model.roomFiles = []FileMetadata{
+		{ID: "f1", Filename: "report.pdf", UploadedBy: "alice"},
+		{ID: "f2", Filename: "notes.txt", UploadedBy: "bob"},
+		{ID: "gone", Filename: "old.zip", UploadedBy: "alice"},
+	}
+	run := func(line string) {
+		t.Helper()
+		model.textInput.SetValue(line)
+		_, cmd := model.Update(tea.KeyMsg{Type: tea.KeyEnter})
+		if cmd != nil {
+			model.Update(cmd())
+		}
+	}
+
+	run("/delete notes.txt")
+	run("/delete report.pdf")
+	if strings.Join(deleted, ",") != "f1" {
+		t.Fatalf("expected only report.pdf deleted, got %v", deleted)
+	}
+	if model.toast != "" || len(model.roomFiles) != 3 {
+		t.Fatalf("expected the list left for the broadcast to update, got toast %q files %+v", model.toast, model.roomFiles)
+	}
+	model.Update(fileDeletedMsg{Type: "file_deleted", FileID: "f1", Filename: "report.pdf", DeletedBy: "alice"})
+	if model.findRoomFile("report.pdf") != nil {
+		t.Error("expected report.pdf gone after the broadcast")
+	}
+
+	run("/delete old.zip")
+	if model.findRoomFile("old.zip") != nil {
+		t.Error("expected a file the server no longer has dropped from the list")
+	}
+	var notices string
+	for _, chat := range model.messages {
+		notices += chat.Body + "\n"
+	}
+	for _, want := range []string{"You can only delete files you uploaded.", "alice deleted: report.pdf", "old.zip was already deleted."} {
+		if !strings.Contains(notices, want) {
+			t.Errorf("expected notice %q, got %q", want, notices)
+		}
+	}
+}
+
+// TestInputHistoryRecall verifies Alt+Up/Alt+Down step through sent lines
+// like a shell, restoring the half-typed line at the end, while plain Up on
+// an empty input still edits the last message
+func TestInputHistoryRecall(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws://localhost:8080/join", "lobby", "alice")
+	model.mode = modeChat
+	model.rememberInput("first")
+	model.rememberInput("second")
+	model.rememberInput("second")
+	// Commands are remembered too, even when they go nowhere
+	model.textInput.SetValue("/nope")
+	model.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if len(model.inputHistory) != 3 {
+		t.Fatalf("expected repeats collapsed, got %q", model.inputHistory)
+	}
+
+	model.textInput.SetValue("draft")
+	altUp := tea.KeyMsg{Type: tea.KeyUp, Alt: true}
+	altDown := tea.KeyMsg{Type: tea.KeyDown, Alt: true}
+	for _, step := range []struct {
+		key  tea.KeyMsg
+		want string
+	}{
+		{altUp, "/nope"},
+		{altUp, "second"},
+		{altUp, "first"},
+		{altUp, "first"}, // nothing older
+		{altDown, "second"},
+		{altDown, "/nope"},
+		{altDown, "draft"},
+		{altDown, "draft"},
+	} {
+		model.Update(step.key)
+		if got := model.textInput.Value(); got != step.want {
+			t.Fatalf("expected %q, got %q", step.want, got)
+		}
+	}
+
+	for i := 0; i < maxInputHistory+10; i++ {
+		model.rememberInput(strings.Repeat("x", i+1))
+	}
+	if len(model.inputHistory) != maxInputHistory || model.inputHistory[0] != strings.Repeat("x", 11) {
+		t.Fatalf("expected the oldest lines dropped, got %d starting %q", len(model.inputHistory), model.inputHistory[0])
+	}
+
+	model.textInput.SetValue("")
+	model.messages = append(model.messages, ChatMessage{ID: "m1", Room: "lobby", User: "alice", Body: "typo"})
+	model.Update(tea.KeyMsg{Type: tea.KeyUp})
+	if got := model.textInput.Value(); got != "/edit typo" {
+		t.Errorf("expected plain Up to edit the last message, got %q", got)
+	}
+}
+
+// TestInputHistorySurvivesRestart verifies sent lines are saved to the
+// history file per account and server, trimmed to the newest
+// maxInputHistory, and recalled by the next model to start
+func TestInputHistorySurvivesRestart(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	path := defaultHistoryPath()
+	if want := filepath.Join(os.Getenv("HOME"), ".termchat", "history"); path != want {
+		t.Fatalf("expected history kept in %s, got %s", want, path)
+	}
+	const apiBase = "http://localhost:8080"
+
+	lines := []string{"one", "two\nhalf", "", "three"}
+	if err := saveInputHistory(path, apiBase, "alice", lines); err != nil {
+		t.Fatalf("saveInputHistory: %v", err)
+	}
+	if got, err := loadInputHistory(path, apiBase, "alice"); err != nil || strings.Join(got, ",") != "one,three" {
+		t.Fatalf("expected lines that span lines and empty ones left out, got %q %v", got, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected a private history file, got %v %v", info, err)
+	}
+	if got, _ := loadInputHistory(path, apiBase, "bob"); len(got) != 0 {
+		t.Fatalf("expected another account's history kept apart, got %q", got)
+	}
+	if got, _ := loadInputHistory(path, "https://elsewhere.example", "alice"); len(got) != 0 {
+		t.Fatalf("expected another server's history kept apart, got %q", got)
+	}
+
+	lines = nil
+	for i := 0; i < maxInputHistory+5; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	if err := saveInputHistory(path, apiBase, "alice", lines); err != nil {
+		t.Fatalf("saveInputHistory: %v", err)
+	}
+	got, err := loadInputHistory(path, apiBase, "alice")
+	if err != nil || len(got) != maxInputHistory || got[0] != "line 5" || got[len(got)-1] != fmt.Sprintf("line %d", maxInputHistory+4) {
+		t.Fatalf("expected the newest %d lines, got %d starting %q (%v)", maxInputHistory, len(got), got, err)
+	}
+
+	model := NewTUIModel("ws://localhost:8080/join", "lobby", "alice")
+	model.mode = modeChat
+	model.textInput.SetValue("hello again")
+	model.Update(tea.KeyMsg{Type: tea.KeyEnter})
+
+	restarted := NewTUIModel("ws://localhost:8080/join", "lobby", "alice")
+	restarted.mode = modeChat
+	restarted.Update(tea.KeyMsg{Type: tea.KeyUp, Alt: true})
+	if got := restarted.textInput.Value(); got != "hello again" {
+		t.Fatalf("expected the last line from before the restart, got %q", got)
+	}
+	restarted.Update(tea.KeyMsg{Type: tea.KeyUp, Alt: true})
+	if got := restarted.textInput.Value(); got != fmt.Sprintf("line %d", maxInputHistory+4) {
+		t.Errorf("expected older saved lines next, got %q", got)
+	}
+
+	bob := NewTUIModel("ws://localhost:8080/join", "lobby", "bob")
+	bob.mode = modeChat
+	bob.Update(tea.KeyMsg{Type: tea.KeyUp, Alt: true})
+	if got := bob.textInput.Value(); got != "" {
+		t.Errorf("expected nothing recalled from alice's history, got %q", got)
+	}
+}
+
+// TestTabCompletion verifies Tab completes commands at the start of the line
+// and @names of room members, cycling through matches on repeated presses
+func TestTabCompletion(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws://localhost:8080/join", "lobby", "alice")
+	model.mode = modeChat
+	model.textInput.Focus()
+	model.roomMembers = []string{"albert", "alex", "alice", "bob"}
+	tab := tea.KeyMsg{Type: tea.KeyTab}
+
+	for _, tc := range []struct {
+		input string
+		tabs  []string // the input after each Tab
+	}{
+		{"/up", []string{"/upload "}},
+		{"/d", []string{"/delete ", "/download ", "/delete "}},
+		{"@al", []string{"@albert ", "@alex ", "@albert "}},
+		{"hi @BO", []string{"hi @bob "}},
+		{"say /up", []string{"say /up"}},
+		{"@zed", []string{"@zed"}},
+	} {
+		model.textInput.SetValue(tc.input)
+		model.textInput.CursorEnd()
+		for i, want := range tc.tabs {
+			model.Update(tab)
+			if got := model.textInput.Value(); got != want {
+				t.Errorf("%q after %d tabs: expected %q, got %q", tc.input, i+1, want, got)
+			}
+		}
+	}
+
+	// Typing after a completion starts a new one
+	model.textInput.SetValue("@al")
+	model.textInput.CursorEnd()
+	model.Update(tab)
+	model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("hey @b")})
+	model.Update(tab)
+	if got := model.textInput.Value(); got != "@albert hey @bob " {
+		t.Errorf("expected a fresh completion, got %q", got)
+	}
+}
+
+// TestChatCommandAliasesAndUnknownCommands verifies /quit and /exit leave like
+// /leave, an unrecognized /command is answered instead of being sent, and
+// /help lists every command in the chat
+func TestChatCommandAliasesAndUnknownCommands(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	for _, command := range []string{"/leave", "/quit", "/EXIT"} {
+		model := NewTUIModel("ws://localhost:8080/join", "lobby", "alice")
+		model.mode = modeChat
+		model.textInput.SetValue(command)
+		model.Update(tea.KeyMsg{Type: tea.KeyEnter})
+		if model.mode != modeFriends || model.roomKey != "" {
+			t.Errorf("%s: expected to leave the room, got mode %v room %q", command, model.mode, model.roomKey)
+		}
+	}
+
+	model := NewTUIModel("ws://localhost:8080/join", "lobby", "alice")
+	model.mode = modeChat
+	model.isConnected = true
+	model.textInput.SetValue("/shrug oh well")
+	if _, cmd := model.Update(tea.KeyMsg{Type: tea.KeyEnter}); cmd != nil {
+		t.Fatalf("expected nothing sent for an unknown command")
+	}
+	last := model.messages[len(model.messages)-1]
+	if !strings.HasPrefix(last.Body, "Unknown command: /shrug.") || !strings.Contains(last.Body, "/leave") {
+		t.Fatalf("expected an unknown command notice listing the commands, got %q", last.Body)
+	}
+	if model.mode != modeChat || model.textInput.Value() != "" {
+		t.Fatalf("expected to stay in the room with the input cleared, got mode %v input %q", model.mode, model.textInput.Value())
+	}
+	model.textInput.SetValue("/help")
+	if _, cmd := model.Update(tea.KeyMsg{Type: tea.KeyEnter}); cmd != nil {
+		t.Fatalf("expected /help to stay local")
+	}
+	help := model.messages[len(model.messages)-1].Body
+	for _, command := range chatCommands {
+		if !strings.Contains(help, command) {
+			t.Errorf("expected /help to explain %s, got:\n%s", command, help)
+		}
+	}
+	if view := model.View(); !strings.Contains(view, "/me <action>") {
+		t.Fatalf("expected the command list shown in the chat, got:\n%s", view)
+	}
+}
+
+// TestClearChatLog verifies /clear empties the screen but keeps us in the
+// room, and /clear messages leaves system notices in place
+func TestClearChatLog(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws://localhost:8080/join", "lobby", "alice")
+	model.mode = modeChat
+	model.isConnected = true
+	fill := func() {
+		now := time.Now().Unix()
+		model.messages = append(model.messages[:0],
+			ChatMessage{ID: "1", Room: "lobby", User: "bob", Body: "hello", Ts: now},
+			ChatMessage{Type: systemMessageType, Room: "lobby", User: "system", Body: "carol joined", Ts: now},
+			ChatMessage{ID: "2", Room: "lobby", User: "alice", Body: "hi bob", Ts: now},
+		)
+	}
+	enter := func(line string) tea.Cmd {
+		model.textInput.SetValue(line)
+		_, cmd := model.Update(tea.KeyMsg{Type: tea.KeyEnter})
+		return cmd
+	}
+
+	fill()
+	if cmd := enter("/clear"); cmd != nil {
+		t.Fatal("expected /clear to send nothing")
+	}
+	if len(model.messages) != 0 || model.mode != modeChat || model.roomKey != "lobby" || !model.isConnected {
+		t.Fatalf("expected an empty log in the same room, got %d messages, mode %v room %q", len(model.messages), model.mode, model.roomKey)
+	}
+
+	fill()
+	enter("/clear messages")
+	if len(model.messages) != 1 || model.messages[0].Body != "carol joined" {
+		t.Fatalf("expected only the notice kept, got %+v", model.messages)
+	}
+
+	enter("/clear everything")
+	if last := model.messages[len(model.messages)-1]; last.Body != "Usage: /clear [messages]" {
+		t.Fatalf("expected a usage notice, got %q", last.Body)
+	}
+}
+
+// TestTypingStopAndTimeout verifies typing notices leave the input alone,
+// erasing the input tells the room we stopped, and someone else's indicator
+// still clears on its own when their stop notice never arrives
+func TestTypingStopAndTimeout(t *testing.T) {
+	frames := make(chan TypingNotice, 10)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var notice TypingNotice
+			if err := conn.ReadJSON(&notice); err != nil {
+				return
+			}
+			frames <- notice
+		}
+	}))
+	defer httpServer.Close()
+
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/join", "lobby", "alice")
+	model.mode = modeChat
+	model.textInput.Focus()
+	if msg := model.connectCmd()(); msg != (connectedMsg{}) {
+		t.Fatalf("expected connectedMsg, got %#v", msg)
+	}
+	defer model.closeConnection()
+	model.isConnected = true
+
+	// run executes the commands a key produced, as the program would
+	run := func(cmd tea.Cmd) {
+		if cmd == nil {
+			return
+		}
+		if batch, ok := cmd().(tea.BatchMsg); ok {
+			for _, c := range batch {
+				if c != nil {
+					c()
+				}
+			}
+		}
+	}
+	next := func() string {
+		select {
+		case notice := <-frames:
+			return notice.Type
+		case <-time.After(2 * time.Second):
+			return "nothing"
+		}
+	}
+
+	_, cmd := model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("h")})
+	run(cmd)
+	if got := next(); got != "typing" {
+		t.Fatalf("expected a typing notice, got %s", got)
+	}
+	if got := model.textInput.Value(); got != "h" {
+		t.Fatalf("expected the typing notice to leave the input alone, got %q", got)
+	}
+	_, cmd = model.Update(tea.KeyMsg{Type: tea.KeyBackspace})
+	run(cmd)
+	if got := next(); got != "typing_stopped" {
+		t.Fatalf("expected a stop notice once the input was erased, got %s", got)
+	}
+	if model.stopTypingCmd() != nil {
+		t.Error("expected only one stop notice per typing notice")
+	}
+
+	// bob's stop notice clears him at once
+	model.Update(typingMsg{Type: "typing", Room: "lobby", User: "bob"})
+	model.Update(typingMsg{Type: "typing_stopped", Room: "lobby", User: "bob"})
+	if line := model.typingLine(); line != "" {
+		t.Fatalf("expected bob cleared by his stop notice, got %q", line)
+	}
+
+	// carol's never arrives: she stays until the expiry, then the tick clears her
+	_, cmd = model.Update(typingMsg{Type: "typing", Room: "lobby", User: "carol"})
+	if cmd == nil {
+		t.Fatal("expected an expiry tick")
+	}
+	model.Update(typingExpiredMsg{})
+	if line := model.typingLine(); line != "carol is typing…" {
+		t.Fatalf("expected carol shown until her notice expires, got %q", line)
+	}
+	model.typingUsers["carol"] = time.Now().Add(-time.Millisecond)
+	model.Update(typingExpiredMsg{})
+	if line := model.typingLine(); line != "" {
+		t.Fatalf("expected carol cleared after the timeout, got %q", line)
+	}
+}
+
+// TestDeleteAccountFlow verifies Shift+D asks for the password, a wrong one
+// leaves everything in place, and the right one deletes the account and
+// forgets the saved session and input history
+func TestDeleteAccountFlow(t *testing.T) {
+	server := NewServerWithConfig(newTestStore(t), t.TempDir(), 1024*1024)
+	httpServer := httptest.NewServer(http.HandlerFunc(server.HandleDeleteAccount))
+	defer httpServer.Close()
+	if rec := postTestSignup(server, "alice"); rec.Code != http.StatusCreated {
+		t.Fatalf("signup: %d %s", rec.Code, rec.Body.String())
+	}
+	var login loginResponse
+	if rec := postTestLogin(server, "alice"); json.Unmarshal(rec.Body.Bytes(), &login) != nil {
+		t.Fatalf("login: %d %s", rec.Code, rec.Body.String())
+	}
+
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/join", "", "alice")
+	model.sessionToken = login.Token
+	model.mode = modeFriends
+	model.rememberInput("something private")
+	if err := saveSessionToDisk(model.sessionPath, sessionFile{Username: "alice", Token: login.Token, Server: model.apiBaseURL}); err != nil {
+		t.Fatalf("save session: %v", err)
+	}
+	submit := func(password string) {
+		t.Helper()
+		model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("D")})
+		if model.mode != modeDeleteAccount || model.textInput.EchoMode != textinput.EchoPassword {
+			t.Fatalf("expected a hidden password prompt, got mode %v", model.mode)
+		}
+		model.textInput.SetValue(password)
+		_, cmd := model.Update(tea.KeyMsg{Type: tea.KeyEnter})
+		model.Update(cmd())
+	}
+
+	submit("wrong")
+	if model.mode != modeFriends || !strings.Contains(model.toast, "password incorrect") {
+		t.Fatalf("expected to stay signed in with a warning, got mode %v and toast %q", model.mode, model.toast)
+	}
+	if session, err := loadSessionFromDisk(model.sessionPath, model.apiBaseURL); err != nil || session == nil {
+		t.Fatalf("expected the session kept, got %+v (%v)", session, err)
+	}
+
+	submit("hunter22")
+	if model.mode != modeAuthMenu || model.sessionToken != "" {
+		t.Fatalf("expected to be signed out, got mode %v", model.mode)
+	}
+	if session, _ := loadSessionFromDisk(model.sessionPath, model.apiBaseURL); session != nil {
+		t.Fatalf("expected the saved session removed, got %+v", session)
+	}
+	if history, _ := loadInputHistory(model.historyPath, model.apiBaseURL, "alice"); len(history) != 0 || len(model.inputHistory) != 0 {
+		t.Fatalf("expected the input history forgotten, got %q", history)
+	}
+	if user, err := server.store.GetUserByUsername(context.Background(), "alice"); err != nil || user != nil {
+		t.Fatalf("expected alice deleted, got %+v (%v)", user, err)
+	}
+}
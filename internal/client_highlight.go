@@ -0,0 +1,262 @@
+package internal
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/mattn/go-runewidth"
+)
+
+var (
+	codeBarStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("60"))
+	codeTextStyle    = lipgloss.NewStyle().Foreground(lipgloss.Color("252"))
+	codeKeywordStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("204")).Bold(true)
+	codeStringStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("114"))
+	codeNumberStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("179"))
+	codeCommentStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("244")).Italic(true)
+)
+
+// codeLanguage is what the highlighter knows about one language: its
+// keywords and how a line comment starts
+type codeLanguage struct {
+	keywords map[string]bool
+	comment  string
+}
+
+func newCodeLanguage(comment, keywords string) *codeLanguage {
+	lang := &codeLanguage{keywords: make(map[string]bool), comment: comment}
+	for _, word := range strings.Fields(keywords) {
+		lang.keywords[word] = true
+	}
+	return lang
+}
+
+var (
+	goLanguage = newCodeLanguage("//", "break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false")
+	jsLanguage = newCodeLanguage("//", "async await break case catch class const continue default delete do else export extends finally for from function if import in instanceof let new of return static super switch this throw try typeof var void while yield null undefined true false interface type enum implements")
+	pyLanguage = newCodeLanguage("#", "and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield None True False self")
+	shLanguage = newCodeLanguage("#", "case do done elif else esac export fi for function if in local return then until while echo cd exit set")
+	rsLanguage = newCodeLanguage("//", "as async await break const continue crate else enum extern fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait type unsafe use where while true false")
+	cLanguage  = newCodeLanguage("//", "auto break case char class const continue default do double else enum extern float for goto if int long namespace new private protected public return short signed sizeof static struct switch template this throw try typedef union unsigned using virtual void volatile while true false null nullptr")
+)
+
+// codeLanguages maps fence tags to languages. Anything else is shown plain.
+var codeLanguages = map[string]*codeLanguage{
+	"go":         goLanguage,
+	"golang":     goLanguage,
+	"js":         jsLanguage,
+	"javascript": jsLanguage,
+	"ts":         jsLanguage,
+	"typescript": jsLanguage,
+	"py":         pyLanguage,
+	"python":     pyLanguage,
+	"sh":         shLanguage,
+	"bash":       shLanguage,
+	"shell":      shLanguage,
+	"zsh":        shLanguage,
+	"rs":         rsLanguage,
+	"rust":       rsLanguage,
+	"c":          cLanguage,
+	"cpp":        cLanguage,
+	"c++":        cLanguage,
+	"java":       cLanguage,
+}
+
+// messageSegment is a run of ordinary text or one fenced code block
+type messageSegment struct {
+	code bool
+	lang string
+	text string
+}
+
+// splitCodeFences finds ```lang fenced blocks in a message. A fence that is
+// never closed is left as ordinary text.
+func splitCodeFences(body string) []messageSegment {
+	lines := strings.Split(body, "\n")
+	var segments []messageSegment
+	var text []string
+	flushText := func() {
+		if len(text) > 0 {
+			segments = append(segments, messageSegment{text: strings.Join(text, "\n")})
+			text = nil
+		}
+	}
+	for i := 0; i < len(lines); i++ {
+		open := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(open, "```") {
+			text = append(text, lines[i])
+			continue
+		}
+		end := -1
+		for j := i + 1; j < len(lines); j++ {
+			if strings.TrimSpace(lines[j]) == "```" {
+				end = j
+				break
+			}
+		}
+		if end < 0 {
+			text = append(text, lines[i])
+			continue
+		}
+		flushText()
+		lang := strings.ToLower(strings.TrimSpace(strings.TrimPrefix(open, "```")))
+		segments = append(segments, messageSegment{code: true, lang: lang, text: strings.Join(lines[i+1:end], "\n")})
+		i = end
+	}
+	flushText()
+	return segments
+}
+
+// codeTokenKind says how a piece of a code line is colored
+type codeTokenKind int
+
+const (
+	codeText codeTokenKind = iota
+	codeKeyword
+	codeString
+	codeNumber
+	codeComment
+)
+
+type codeToken struct {
+	kind codeTokenKind
+	text string
+}
+
+// tokenizeCodeLine splits one line of code for highlighting. It works a line
+// at a time, so block comments and strings spanning lines aren't recognized;
+// that's the price of staying small.
+func tokenizeCodeLine(lang *codeLanguage, line string) []codeToken {
+	runes := []rune(line)
+	var tokens []codeToken
+	add := func(kind codeTokenKind, text string) {
+		if n := len(tokens); n > 0 && tokens[n-1].kind == kind {
+			tokens[n-1].text += text
+			return
+		}
+		tokens = append(tokens, codeToken{kind: kind, text: text})
+	}
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case strings.HasPrefix(string(runes[i:]), lang.comment):
+			add(codeComment, string(runes[i:]))
+			return tokens
+		case r == '"' || r == '\'' || r == '`':
+			j := i + 1
+			for j < len(runes) && runes[j] != r {
+				if runes[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			j = min(j+1, len(runes))
+			add(codeString, string(runes[i:j]))
+			i = j
+		case unicode.IsDigit(r):
+			j := i
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || unicode.IsLetter(runes[j]) || runes[j] == '.' || runes[j] == '_') {
+				j++
+			}
+			add(codeNumber, string(runes[i:j]))
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || runes[j] == '_') {
+				j++
+			}
+			word := string(runes[i:j])
+			if lang.keywords[word] {
+				add(codeKeyword, word)
+			} else {
+				add(codeText, word)
+			}
+			i = j
+		default:
+			add(codeText, string(r))
+			i++
+		}
+	}
+	return tokens
+}
+
+var codeTokenStyles = map[codeTokenKind]lipgloss.Style{
+	codeText:    codeTextStyle,
+	codeKeyword: codeKeywordStyle,
+	codeString:  codeStringStyle,
+	codeNumber:  codeNumberStyle,
+	codeComment: codeCommentStyle,
+}
+
+// renderCodeBlock draws a fenced block behind a bar, keeping its indentation.
+// Lines wider than width are broken rather than reflowed, and known languages
+// are highlighted.
+func renderCodeBlock(lang, code string, width int) string {
+	known := codeLanguages[lang]
+	bar := codeBarStyle.Render("│ ")
+	var out []string
+	if lang != "" {
+		out = append(out, codeBarStyle.Render("╭ "+lang))
+	}
+	for _, line := range strings.Split(strings.ReplaceAll(code, "\t", "    "), "\n") {
+		for _, part := range breakCodeLine(line, width-2) {
+			if known == nil {
+				out = append(out, bar+codeTextStyle.Render(part))
+				continue
+			}
+			var sb strings.Builder
+			for _, token := range tokenizeCodeLine(known, part) {
+				sb.WriteString(codeTokenStyles[token.kind].Render(token.text))
+			}
+			out = append(out, bar+sb.String())
+		}
+	}
+	return strings.Join(out, "\n")
+}
+
+// breakCodeLine cuts a line into pieces of at most width cells, or leaves it
+// whole when width isn't known
+func breakCodeLine(line string, width int) []string {
+	if width <= 0 || displayWidth(line) <= width {
+		return []string{line}
+	}
+	var parts []string
+	var part strings.Builder
+	partWidth := 0
+	for _, r := range line {
+		runeWidth := runewidth.RuneWidth(r)
+		if partWidth+runeWidth > width {
+			parts = append(parts, part.String())
+			part.Reset()
+			partWidth = 0
+		}
+		part.WriteRune(r)
+		partWidth += runeWidth
+	}
+	return append(parts, part.String())
+}
+
+// renderMessageBody wraps and styles a message's text, drawing any fenced
+// code blocks in it as code
+func renderMessageBody(body string, width int) string {
+	if !strings.Contains(body, "```") {
+		if width > 0 {
+			body = wrapText(body, width)
+		}
+		return messageBodyStyle.Render(body)
+	}
+	var parts []string
+	for _, segment := range splitCodeFences(body) {
+		if segment.code {
+			parts = append(parts, renderCodeBlock(segment.lang, segment.text, width))
+			continue
+		}
+		text := segment.text
+		if width > 0 {
+			text = wrapText(text, width)
+		}
+		parts = append(parts, messageBodyStyle.Render(text))
+	}
+	return strings.Join(parts, "\n")
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// inputHistoryFile keeps each account's sent lines apart, oldest first and
+// capped at maxInputHistory, like a shell history per user. Only what's typed
+// in the chat box goes in; passwords are read in their own masked prompts and
+// never pass through rememberInput. Messages spanning several lines aren't
+// saved, since the chat input can't recall them intact.
+type inputHistoryFile struct {
+	Entries map[string][]string `json:"entries"` // keyed by pinsKey
+}
+
+func defaultHistoryPath() string {
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".termchat", "history")
+	}
+	return filepath.Join(".termchat", "history")
+}
+
+// loadInputHistory reads the newest maxInputHistory lines username sent on
+// apiBase
+func loadInputHistory(path, apiBase, username string) ([]string, error) {
+	history, err := readInputHistory(path)
+	if err != nil {
+		return nil, err
+	}
+	return trimInputHistory(history.Entries[pinsKey(apiBase, username)]), nil
+}
+
+// saveInputHistory replaces username's history on apiBase with the newest
+// maxInputHistory lines, or forgets it when there are none. The chat input
+// is a single line and would flatten anything spanning lines, so those are
+// left out.
+func saveInputHistory(path, apiBase, username string, lines []string) error {
+	if path == "" || username == "" {
+		return nil
+	}
+	history, err := readInputHistory(path)
+	if err != nil {
+		history = &inputHistoryFile{Entries: make(map[string][]string)}
+	}
+	var kept []string
+	for _, line := range trimInputHistory(lines) {
+		if line != "" && !strings.ContainsAny(line, "\r\n") {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) == 0 {
+		delete(history.Entries, pinsKey(apiBase, username))
+	} else {
+		history.Entries[pinsKey(apiBase, username)] = kept
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readInputHistory(path string) (*inputHistoryFile, error) {
+	if path == "" {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var history inputHistoryFile
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, err
+	}
+	if history.Entries == nil {
+		history.Entries = make(map[string][]string)
+	}
+	return &history, nil
+}
+
+func trimInputHistory(lines []string) []string {
+	if len(lines) > maxInputHistory {
+		return lines[len(lines)-maxInputHistory:]
+	}
+	return lines
+}
+
+// loadHistory reads the signed-in account's input history the first time
+// it's needed, and again after switching accounts
+func (model *TUIModel) loadHistory() {
+	key := pinsKey(model.apiBaseURL, model.username)
+	if model.historyFor == key {
+		return
+	}
+	model.historyFor = key
+	model.inputHistory, _ = loadInputHistory(model.historyPath, model.apiBaseURL, model.username)
+	model.historyPos = len(model.inputHistory)
+	model.historyDraft = ""
+}
+
+// forgetHistory drops the signed-in account's input history, on disk too
+func (model *TUIModel) forgetHistory() {
+	_ = saveInputHistory(model.historyPath, model.apiBaseURL, model.username, nil)
+	model.inputHistory = nil
+	model.historyPos = 0
+	model.historyDraft = ""
+}
@@ -1,13 +1,16 @@
 package internal
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/charmbracelet/bubbles/filepicker"
+	"github.com/charmbracelet/bubbles/spinner"
 	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/gorilla/websocket"
 )
@@ -26,6 +29,7 @@ type TUIModel struct {
 	friends         []Friend
 	incomingReqs    []string
 	outgoingReqs    []string
+	blockedUsers    []string // who we've blocked, loaded when the block list opens
 	selectedFriend  int
 	selectedRequest int
 	// Version checking
@@ -42,6 +46,91 @@ type TUIModel struct {
 	mode            appMode
 	pendingAction   actionType
 	loading         bool
+	width           int // terminal width from tea.WindowSizeMsg; 0 until known
+	height          int // terminal height, likewise
+
+	// chatViewport holds the rendered message log once the terminal size is
+	// known, so PgUp/PgDn can scroll back through it
+	chatViewport viewport.Model
+
+	// Failed reconnects since the last successful connect; drives the backoff
+	reconnectAttempts int
+	connectTimeout    time.Duration // zero means DefaultConnectTimeout
+	nameWidth         int           // zero means DefaultNameWidth
+
+	// Friend or requester awaiting a second press of confirmKey ("x" removes
+	// them, "k" blocks them); any other key on their screen cancels
+	confirmKey    string
+	confirmFriend string
+
+	// Transient error toast; kept apart from the notice list and cleared
+	// once toastExpiry passes
+	toast       string
+	toastExpiry time.Time
+
+	// Offline friends view: when a fetch fails the last cached lists are
+	// shown, marked stale, and refetched in the background
+	friendsCachePath    string
+	friendsOffline      bool
+	friendsCachedAt     time.Time // zero when showing lists from this run
+	friendsRetryPending bool
+
+	// Friends pinned to the top of the list, saved per account at pinsPath;
+	// pinnedFor says which account pinned was loaded for
+	pinsPath  string
+	pinned    map[string]bool
+	pinnedFor string
+
+	// Typing indicator: who else is typing in the room, until when, when we
+	// last told the room we were typing and whether we've since stopped
+	typingUsers     map[string]time.Time
+	lastTypingSent  time.Time
+	typingAnnounced bool
+
+	roomMembers []string // who's connected to the room, from the server's presence updates
+
+	// Earlier lines of a multi-line message being composed; the line being
+	// typed stays in textInput
+	composeLines []string
+	// pastingUntil is when the paste being typed in is taken to be over, and
+	// lastTextAt when text was last typed into the chat box; see
+	// handleChatKeys
+	pastingUntil time.Time
+	lastTextAt   time.Time
+
+	// Lines sent, oldest first, for Alt+Up/Alt+Down recall. They're saved per
+	// account at historyPath so recall survives restarts; historyFor is the
+	// pinsKey they were loaded for. historyPos is the entry being shown,
+	// len(inputHistory) when none is, and historyDraft what was typed before
+	// browsing started.
+	historyPath  string
+	historyFor   string
+	inputHistory []string
+	historyPos   int
+	historyDraft string
+
+	// Tab completion: the matches for the word being completed, which one is
+	// shown and where the word starts, kept while Tab is pressed again
+	completions     []string
+	completionIndex int
+	completionStart int
+	completedInput  string // the input as the last Tab left it
+
+	// Where to go back to once the user logs in again after their session
+	// expired mid-chat
+	resumeUser   string
+	resumeRoom   string
+	resumeFriend string
+
+	// Room code being checked with /exists before joining, and the spinner
+	// shown meanwhile
+	checkingRoom string
+	roomSpinner  spinner.Model
+
+	// Relay the chat goes through, from /ping, and how far our clock is
+	// ahead of it
+	relayName string
+	clockSkew time.Duration
 
 	// File upload state
 	uploadingFile  bool
@@ -50,6 +139,9 @@ type TUIModel struct {
 	uploadError    string
 	roomFiles      []FileMetadata
 	filePicker     filepicker.Model
+	pickerError    string // why the picker couldn't open the last directory
+	// resumable upload IDs of interrupted uploads, by room and file path
+	pendingUploads map[pendingUpload]string
 }
 
 type appMode int
@@ -60,11 +152,14 @@ const (
 	modeAuthPassword
 	modeFriends
 	modeAddFriend
+	modeImportFriends
 	modeManualRoom
 	modeRequestsIncoming
 	modeRequestsOutgoing
 	modeChat
 	modeFileSelect
+	modeDeleteAccount
+	modeBlockedUsers
 )
 
 type actionType int
@@ -92,15 +187,17 @@ const (
 type Friend struct {
 	Username string
 	Online   bool
+	LastSeen time.Time // when an offline friend was last connected; zero if unknown
 }
 
 // FileMetadata represents a file uploaded to the current room
 type FileMetadata struct {
-	ID         string
-	Filename   string
-	SizeBytes  int64
-	UploadedBy string
-	UploadedAt int64
+	ID           string
+	Filename     string
+	SizeBytes    int64
+	UploadedBy   string
+	UploadedAt   int64
+	DownloadPath string
 }
 
 // FileItem represents an item in the file browser
@@ -118,6 +215,7 @@ func NewTUIModel(serverJoinURL, roomKey, username string) *TUIModel {
 	input.Focus()
 	input.Prompt = "> "
 
+	requestedUser := username
 	if username == "" {
 		username = defaultUsername()
 	}
@@ -143,19 +241,32 @@ func NewTUIModel(serverJoinURL, roomKey, username string) *TUIModel {
 
 
 	model := &TUIModel{
-		textInput:     input,
-		messages:      make([]ChatMessage, 0, 64),
-		serverJoinURL: serverJoinURL,
-		apiBaseURL:    apiBase,
-		sessionPath:   defaultSessionPath(),
-		roomKey:       roomKey,
-		username:      username,
-		filePicker:    fp,
+		textInput:        input,
+		messages:         make([]ChatMessage, 0, 64),
+		serverJoinURL:    serverJoinURL,
+		apiBaseURL:       apiBase,
+		sessionPath:      defaultSessionPath(),
+		friendsCachePath: defaultFriendsCachePath(),
+		pinsPath:         defaultPinsPath(),
+		historyPath:      defaultHistoryPath(),
+		roomKey:          roomKey,
+		username:         username,
+		filePicker:       fp,
+		pendingUploads:   make(map[pendingUpload]string),
+		roomSpinner:      spinner.New(spinner.WithSpinner(spinner.Dot), spinner.WithStyle(connectingStyle)),
 	}
 
-	if session, err := loadSessionFromDisk(model.sessionPath); err == nil {
-		model.sessionToken = session.Token
-		model.username = session.Username
+	// Only a session issued by this server is used; a token from another
+	// server would only earn confusing 401s. An explicit --user wins over a
+	// session saved for someone else: that session is left on disk and we ask
+	// for a login as the requested user instead.
+	if session, err := loadSessionFromDisk(model.sessionPath, apiBase); err == nil {
+		if requestedUser != "" && session.Username != requestedUser {
+			model.appendSystemNotice(fmt.Sprintf("Saved session is for %s; log in as %s to continue.", session.Username, requestedUser))
+		} else {
+			model.sessionToken = session.Token
+			model.username = session.Username
+		}
 	}
 
 	switch {
@@ -208,9 +319,31 @@ func defaultSessionPath() string {
 }
 
 func (model *TUIModel) appendSystemNotice(body string) {
-	model.messages = append(model.messages, ChatMessage{User: "system", Body: body, Ts: time.Now().Unix()})
+	model.messages = append(model.messages, ChatMessage{Type: systemMessageType, User: "system", Body: body, Ts: time.Now().Unix()})
+}
+
+// toastDuration is how long an error toast stays on screen
+const toastDuration = 4 * time.Second
+
+// showToast flashes a transient error above the current view. Unlike
+// appendSystemNotice nothing is kept; the returned tick dismisses it.
+func (model *TUIModel) showToast(text string) tea.Cmd {
+	model.toast = text
+	model.toastExpiry = time.Now().Add(toastDuration)
+	return tea.Tick(toastDuration, func(time.Time) tea.Msg {
+		return toastExpiredMsg{}
+	})
 }
 
+// typingSendInterval debounces our typing notices; typingExpiry is how long
+// someone shows as typing after their last notice
+const (
+	typingSendInterval = 3 * time.Second
+	typingExpiry       = 5 * time.Second
+)
+
+// resetChatLog clears the previous room's messages, files, members and typing
+// state, keeping room-independent notices
 func (model *TUIModel) resetChatLog() {
 	filtered := model.messages[:0]
 	for _, msg := range model.messages {
@@ -219,15 +352,113 @@ func (model *TUIModel) resetChatLog() {
 		}
 	}
 	model.messages = filtered
+	model.roomFiles = nil
+	model.typingUsers = nil
+	model.roomMembers = nil
+	model.composeLines = nil
+	model.chatViewport = viewport.Model{} // the next room opens on its newest messages
+}
+
+// clearChatLog empties the on-screen log without leaving the room, optionally
+// keeping system notices. Nothing is deleted on the server, so recent history
+// comes back the next time the room is joined.
+func (model *TUIModel) clearChatLog(keepNotices bool) {
+	kept := model.messages[:0]
+	for _, msg := range model.messages {
+		if keepNotices && msg.isSystem() {
+			kept = append(kept, msg)
+		}
+	}
+	model.messages = kept
+}
+
+// setRoomFiles replaces the file list with the server's, keeping any file
+// announced live while the listing was in flight
+func (model *TUIModel) setRoomFiles(files []FileMetadata) {
+	listed := make(map[string]bool, len(files))
+	for _, file := range files {
+		listed[file.ID] = true
+	}
+	for _, file := range model.roomFiles {
+		if !listed[file.ID] {
+			files = append(files, file)
+		}
+	}
+	model.roomFiles = files
+}
+
+// friendsRetryDelay is how long the friends view waits before refetching
+// after a failed load
+const friendsRetryDelay = 10 * time.Second
+
+// cacheFriends saves the freshly fetched friends list for offline use
+func (model *TUIModel) cacheFriends() {
+	friends := make([]friendDTO, 0, len(model.friends))
+	for _, f := range model.friends {
+		dto := friendDTO{Username: f.Username}
+		if !f.LastSeen.IsZero() {
+			dto.LastSeen = f.LastSeen.Unix()
+		}
+		friends = append(friends, dto)
+	}
+	_ = updateFriendsCache(model.friendsCachePath, model.apiBaseURL, model.username, func(entry *friendsCacheEntry) {
+		entry.Friends = friends
+	})
+}
+
+// cacheFriendRequests saves the freshly fetched requests for offline use
+func (model *TUIModel) cacheFriendRequests() {
+	_ = updateFriendsCache(model.friendsCachePath, model.apiBaseURL, model.username, func(entry *friendsCacheEntry) {
+		entry.Incoming = model.incomingReqs
+		entry.Outgoing = model.outgoingReqs
+	})
+}
+
+// goOffline marks the friends view stale after a failed fetch, filling empty
+// lists from the cache. It reports whether there is anything to show and
+// returns the background retry, if one isn't already scheduled.
+func (model *TUIModel) goOffline() (bool, tea.Cmd) {
+	model.friendsOffline = true
+	if len(model.friends) == 0 && len(model.incomingReqs) == 0 && len(model.outgoingReqs) == 0 {
+		if entry, err := loadFriendsCache(model.friendsCachePath, model.apiBaseURL, model.username); err == nil {
+			model.friends = model.friends[:0]
+			for _, f := range entry.Friends {
+				// presence is unknown while offline; last seen is as of the cache
+				friend := Friend{Username: f.Username}
+				if f.LastSeen > 0 {
+					friend.LastSeen = time.Unix(f.LastSeen, 0)
+				}
+				model.friends = append(model.friends, friend)
+			}
+			model.orderFriends()
+			model.incomingReqs = entry.Incoming
+			model.outgoingReqs = entry.Outgoing
+			model.friendsCachedAt = entry.FetchedAt
+		}
+	}
+	hasData := len(model.friends) > 0 || len(model.incomingReqs) > 0 || len(model.outgoingReqs) > 0 || !model.friendsCachedAt.IsZero()
+	if model.friendsRetryPending {
+		return hasData, nil
+	}
+	model.friendsRetryPending = true
+	return hasData, tea.Tick(friendsRetryDelay, func(time.Time) tea.Msg {
+		return friendsRetryMsg{}
+	})
+}
+
+// backOnline clears the stale marker once a fetch succeeds
+func (model *TUIModel) backOnline() {
+	model.friendsOffline = false
+	model.friendsCachedAt = time.Time{}
 }
 
 func (model *TUIModel) persistSession() error {
 	if model.sessionPath == "" {
 		return nil
 	}
-	return saveSessionToDisk(model.sessionPath, sessionFile{Username: model.username, Token: model.sessionToken})
+	return saveSessionToDisk(model.sessionPath, sessionFile{Username: model.username, Token: model.sessionToken, Server: model.apiBaseURL})
 }
 
 func (model *TUIModel) removeSessionFile() error {
-	return deleteSessionFile(model.sessionPath)
+	return deleteSessionFromDisk(model.sessionPath, model.apiBaseURL)
 }
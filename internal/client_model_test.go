@@ -0,0 +1,433 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// TestSessionsAreKeptPerServer verifies each server gets its own saved session,
+// so switching servers neither reuses the wrong token nor logs you out
+func TestSessionsAreKeptPerServer(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	path := defaultSessionPath()
+
+	// A file from before servers were tracked is used for whichever server
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(`{"username":"alice","token":"legacy"}`), 0o600); err != nil {
+		t.Fatalf("write legacy session: %v", err)
+	}
+	if model := NewTUIModel("wss://a.example.com/join", "", ""); model.sessionToken != "legacy" {
+		t.Fatalf("expected the legacy session to load, got %q", model.sessionToken)
+	}
+
+	for _, session := range []sessionFile{
+		{Username: "alice", Token: "token-a", Server: "https://a.example.com"},
+		{Username: "alice2", Token: "token-b", Server: "http://localhost:8080"},
+	} {
+		if err := saveSessionToDisk(path, session); err != nil {
+			t.Fatalf("save session: %v", err)
+		}
+	}
+
+	model := NewTUIModel("wss://a.example.com/join", "", "")
+	if model.sessionToken != "token-a" || model.mode != modeFriends {
+		t.Fatalf("expected server A's session, got token %q mode %v", model.sessionToken, model.mode)
+	}
+	model = NewTUIModel("ws://localhost:8080/join", "", "")
+	if model.sessionToken != "token-b" || model.username != "alice2" {
+		t.Fatalf("expected the local server's session, got %q as %q", model.sessionToken, model.username)
+	}
+	if model := NewTUIModel("wss://c.example.com/join", "", ""); model.sessionToken != "" || model.mode != modeAuthMenu {
+		t.Fatalf("expected a login prompt for an unknown server, got token %q mode %v", model.sessionToken, model.mode)
+	}
+
+	// Logging out of one server keeps the other
+	if err := model.removeSessionFile(); err != nil {
+		t.Fatalf("remove session: %v", err)
+	}
+	if _, err := loadSessionFromDisk(path, "http://localhost:8080"); err == nil {
+		t.Fatal("expected the local server's session to be gone")
+	}
+	if session, err := loadSessionFromDisk(path, "https://a.example.com"); err != nil || session.Token != "token-a" {
+		t.Fatalf("expected server A's session to survive, got %+v (err=%v)", session, err)
+	}
+}
+
+// TestUserFlagOverridesMismatchedSession verifies --user for someone other than
+// the saved session's user asks for a login as them, leaving the session on disk
+func TestUserFlagOverridesMismatchedSession(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	path := defaultSessionPath()
+	if err := saveSessionToDisk(path, sessionFile{Username: "alice", Token: "token-a", Server: "https://a.example.com"}); err != nil {
+		t.Fatalf("save session: %v", err)
+	}
+
+	model := NewTUIModel("wss://a.example.com/join", "lobby", "bob")
+	if model.sessionToken != "" || model.mode != modeAuthMenu || model.username != "bob" {
+		t.Fatalf("expected a login prompt as bob, got token %q mode %v user %q", model.sessionToken, model.mode, model.username)
+	}
+	if !strings.Contains(model.View(), "Saved session is for alice") {
+		t.Error("expected a notice explaining why the session was skipped")
+	}
+	model.startAuthPrompt(authIntentLogin)
+	if got := model.textInput.Value(); got != "bob" {
+		t.Errorf("expected the login prompt prefilled with bob, got %q", got)
+	}
+	if session, err := loadSessionFromDisk(path, "https://a.example.com"); err != nil || session.Token != "token-a" {
+		t.Fatalf("expected alice's session kept on disk, got %+v (err=%v)", session, err)
+	}
+
+	// Naming the saved user, or nobody, still resumes the session
+	for _, username := range []string{"alice", ""} {
+		if model := NewTUIModel("wss://a.example.com/join", "", username); model.sessionToken != "token-a" || model.username != "alice" {
+			t.Errorf("--user %q: expected alice's session, got token %q user %q", username, model.sessionToken, model.username)
+		}
+	}
+}
+
+// TestFriendsViewFallsBackToCache verifies a failed fetch shows the last
+// cached lists, marked offline, and retries until the server is back
+func TestFriendsViewFallsBackToCache(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	newModel := func(username string) *TUIModel {
+		model := NewTUIModel("wss://chat.example.com/join", "", username)
+		model.username = username
+		model.sessionToken = "token"
+		model.mode = modeFriends
+		return model
+	}
+
+	online := newModel("alice")
+	online.Update(friendsLoadedMsg{friends: []Friend{{Username: "bob", Online: true}}})
+	online.Update(friendRequestsLoadedMsg{incoming: []string{"carol"}})
+
+	// Restart while the server is down
+	model := newModel("alice")
+	outage := errors.New("connection refused")
+	_, cmd := model.Update(friendsLoadedMsg{err: outage})
+	if cmd == nil {
+		t.Fatalf("expected a background retry to be scheduled")
+	}
+	if len(model.friends) != 1 || model.friends[0].Username != "bob" || model.friends[0].Online {
+		t.Fatalf("expected cached friends with unknown presence, got %+v", model.friends)
+	}
+	if len(model.incomingReqs) != 1 || model.incomingReqs[0] != "carol" {
+		t.Fatalf("expected cached requests, got %+v", model.incomingReqs)
+	}
+	if model.toast != "" {
+		t.Fatalf("expected no error toast over cached data, got %q", model.toast)
+	}
+	if view := model.View(); !strings.Contains(view, "Offline") || !strings.Contains(view, "bob") {
+		t.Fatalf("expected the cached list marked offline, got:\n%s", view)
+	}
+	if _, cmd := model.Update(friendRequestsLoadedMsg{err: outage}); cmd != nil {
+		t.Fatalf("expected the pending retry to be reused")
+	}
+	if _, cmd := model.Update(friendsRetryMsg{}); cmd == nil {
+		t.Fatalf("expected the retry to refetch while offline")
+	}
+
+	model.Update(friendsLoadedMsg{friends: []Friend{{Username: "bob", Online: true}, {Username: "dave"}}})
+	if model.friendsOffline || strings.Contains(model.View(), "Offline") {
+		t.Fatalf("expected the offline marker to clear once the fetch succeeds")
+	}
+
+	// Someone else's cache is never shown
+	other := newModel("mallory")
+	other.Update(friendsLoadedMsg{err: outage})
+	if len(other.friends) != 0 || other.toast == "" {
+		t.Fatalf("expected no cached friends for another account, got %+v", other.friends)
+	}
+
+	// Logging out drops the cache
+	model.clearSessionState()
+	if _, err := loadFriendsCache(model.friendsCachePath, model.apiBaseURL, "alice"); err == nil {
+		t.Fatalf("expected the cache to be removed on logout")
+	}
+}
+
+// TestConcurrentAuthFailuresExpireSessionOnce verifies friends and requests
+// both coming back unauthorized sign out once, with a single notice
+func TestConcurrentAuthFailuresExpireSessionOnce(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("wss://chat.example.com/join", "", "alice")
+	model.sessionToken = "expired"
+	model.mode = modeFriends
+
+	model.Update(friendsLoadedMsg{err: errUnauthorized})
+	model.Update(friendRequestsLoadedMsg{err: errUnauthorized})
+
+	notices := 0
+	for _, msg := range model.messages {
+		if strings.Contains(msg.Body, "Session expired") {
+			notices++
+		}
+	}
+	if notices != 1 {
+		t.Fatalf("expected one session expired notice, got %d: %+v", notices, model.messages)
+	}
+	if model.mode != modeAuthMenu || model.sessionToken != "" || model.toast != "" {
+		t.Fatalf("expected a quiet sign out, got mode %v token %q toast %q", model.mode, model.sessionToken, model.toast)
+	}
+}
+
+// TestFriendsListNeverOffersSelfDM verifies we're left out of our own friends
+// list, and that a self entry can't start a chat if one slips through
+func TestFriendsListNeverOffersSelfDM(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws://127.0.0.1:0/join", "", "alice")
+	model.username = "alice"
+	model.sessionToken = "token"
+	model.mode = modeFriends
+
+	model.Update(friendsLoadedMsg{friends: []Friend{{Username: "Alice"}, {Username: "bob"}}})
+	if len(model.friends) != 1 || model.friends[0].Username != "bob" {
+		t.Fatalf("expected only bob listed, got %+v", model.friends)
+	}
+
+	model.friends = []Friend{{Username: "alice"}}
+	model.selectedFriend = 0
+	if _, cmd := model.Update(tea.KeyMsg{Type: tea.KeyEnter}); cmd != nil || model.mode != modeFriends {
+		t.Fatalf("expected Enter on ourselves to do nothing, got mode %v", model.mode)
+	}
+	if last := model.messages[len(model.messages)-1]; last.Body != "You can't message yourself." {
+		t.Fatalf("expected a notice, got %+v", last)
+	}
+}
+
+// TestPinnedFriends verifies P pins the selected friend into a section at the
+// top with their presence intact, a second P unpins them, and pins outlive a
+// refetch and a restart
+func TestPinnedFriends(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws://127.0.0.1:0/join", "", "alice")
+	model.sessionToken = "token"
+	model.mode = modeFriends
+	friends := []Friend{{Username: "bob"}, {Username: "carol"}, {Username: "dave", Online: true}}
+	model.Update(friendsLoadedMsg{friends: append([]Friend(nil), friends...)})
+	pin := tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("p")}
+	order := func(m *TUIModel) string {
+		names := make([]string, len(m.friends))
+		for i, friend := range m.friends {
+			names[i] = friend.Username
+		}
+		return strings.Join(names, ",")
+	}
+
+	model.selectedFriend = 2
+	model.Update(pin)
+	model.selectedFriend = 2
+	model.Update(pin)
+	if got := order(model); got != "dave,carol,bob" {
+		t.Fatalf("expected dave and carol pinned first, got %s", got)
+	}
+	if model.friends[model.selectedFriend].Username != "carol" {
+		t.Fatalf("expected the selection to follow carol, got %s", model.friends[model.selectedFriend].Username)
+	}
+	view := model.View()
+	var listed []string
+	for _, line := range strings.Split(view[strings.LastIndex(view, "╭"):strings.LastIndex(view, "╰")], "\n") {
+		if entry := strings.Trim(line, "│╭╮╰╯─ "); entry != "" {
+			listed = append(listed, entry)
+		}
+	}
+	want := []string{"Pinned", presenceDot(true) + " dave", "➤ " + presenceDot(false) + " carol", "Friends", presenceDot(false) + " bob"}
+	if strings.Join(listed, "|") != strings.Join(want, "|") {
+		t.Fatalf("expected %q, got %q in:\n%s", want, listed, view)
+	}
+
+	// A refetch in the server's order keeps the pins on top
+	model.Update(friendsLoadedMsg{friends: append([]Friend(nil), friends...)})
+	if got := order(model); got != "carol,dave,bob" {
+		t.Fatalf("expected pins kept after a refetch, got %s", got)
+	}
+	restarted := NewTUIModel("ws://127.0.0.1:0/join", "", "alice")
+	restarted.sessionToken = "token"
+	restarted.Update(friendsLoadedMsg{friends: append([]Friend(nil), friends...)})
+	if got := order(restarted); got != "carol,dave,bob" {
+		t.Fatalf("expected pins saved across restarts, got %s", got)
+	}
+
+	model.selectedFriend = 0
+	model.Update(pin)
+	if got := order(model); got != "dave,carol,bob" || model.pinnedCount() != 1 {
+		t.Fatalf("expected carol unpinned, got %s", got)
+	}
+}
+
+// TestBlockFromRequestsAndUnblock verifies K on an incoming request blocks
+// the sender after a second press, and Shift+K opens the block list where U
+// unblocks someone and the list is refetched
+func TestBlockFromRequestsAndUnblock(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws://127.0.0.1:0/join", "", "alice")
+	model.sessionToken = "token"
+	model.mode = modeFriends
+	model.incomingReqs = []string{"mallory", "bob"}
+	k := tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("k")}
+
+	model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("i")})
+	if _, cmd := model.Update(k); cmd != nil || model.confirmFriend != "mallory" {
+		t.Fatalf("expected K to ask before blocking mallory, got %q", model.confirmFriend)
+	}
+	if last := model.messages[len(model.messages)-1]; !strings.Contains(last.Body, "Press K again to block mallory") {
+		t.Fatalf("expected a block confirmation notice, got %q", last.Body)
+	}
+	if _, cmd := model.Update(k); cmd == nil || model.confirmFriend != "" {
+		t.Fatal("expected the second K to block mallory")
+	}
+	model.Update(friendRequestActionMsg{username: "mallory", action: "block"})
+	if model.mode != modeFriends {
+		t.Fatalf("expected the friends screen after blocking, got mode %d", model.mode)
+	}
+
+	if _, cmd := model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("K")}); cmd == nil || model.mode != modeBlockedUsers {
+		t.Fatalf("expected Shift+K to open and load the block list, got mode %d", model.mode)
+	}
+	model.Update(blockedUsersLoadedMsg{users: []string{"mallory", "trudy"}})
+	model.Update(tea.KeyMsg{Type: tea.KeyDown})
+	if view := model.View(); !strings.Contains(view, "Blocked users") || !strings.Contains(view, "➤ trudy") {
+		t.Fatalf("expected trudy selected on the block list, got:\n%s", view)
+	}
+	if _, cmd := model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("u")}); cmd == nil {
+		t.Fatal("expected U to unblock trudy")
+	}
+	if _, cmd := model.Update(friendRequestActionMsg{username: "trudy", action: "unblock"}); cmd == nil || model.mode != modeBlockedUsers {
+		t.Fatalf("expected to stay on the block list while it's refetched, got mode %d", model.mode)
+	}
+	model.Update(blockedUsersLoadedMsg{users: []string{"mallory"}})
+	if model.selectedRequest != 0 {
+		t.Fatalf("expected the selection kept on the list, got %d", model.selectedRequest)
+	}
+	model.Update(tea.KeyMsg{Type: tea.KeyEsc})
+	if model.mode != modeFriends {
+		t.Fatalf("expected Esc back to the friends screen, got mode %d", model.mode)
+	}
+}
+
+// TestRemoveFriendAsksFirst verifies X only removes (and K only blocks) the
+// selected friend when pressed twice in a row, and the list is refetched
+// afterwards
+func TestRemoveFriendAsksFirst(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws://127.0.0.1:0/join", "", "alice")
+	model.sessionToken = "token"
+	model.mode = modeFriends
+	model.friends = []Friend{{Username: "bob"}, {Username: "carol"}}
+	x := tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("x")}
+
+	if _, cmd := model.Update(x); cmd != nil || model.confirmFriend != "bob" {
+		t.Fatalf("expected a confirmation prompt for bob, got %q", model.confirmFriend)
+	}
+	if last := model.messages[len(model.messages)-1]; !strings.Contains(last.Body, "Press X again to remove bob") {
+		t.Fatalf("expected a confirmation notice, got %q", last.Body)
+	}
+	// Moving away cancels
+	model.Update(tea.KeyMsg{Type: tea.KeyDown})
+	if _, cmd := model.Update(x); cmd != nil || model.confirmFriend != "carol" {
+		t.Fatalf("expected the confirmation to restart for carol, got %q", model.confirmFriend)
+	}
+	if _, cmd := model.Update(x); cmd == nil || model.confirmFriend != "" {
+		t.Fatal("expected the second X to remove carol")
+	}
+
+	// K asks for its own confirmation, even right after an X
+	model.Update(x)
+	k := tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("k")}
+	if _, cmd := model.Update(k); cmd != nil || model.confirmKey != "k" {
+		t.Fatalf("expected K to ask before blocking, got key %q", model.confirmKey)
+	}
+	if last := model.messages[len(model.messages)-1]; !strings.Contains(last.Body, "Press K again to block carol") {
+		t.Fatalf("expected a block confirmation notice, got %q", last.Body)
+	}
+	if _, cmd := model.Update(k); cmd == nil {
+		t.Fatal("expected the second K to block carol")
+	}
+
+	if _, cmd := model.Update(friendRequestActionMsg{username: "carol", action: "remove"}); cmd == nil {
+		t.Fatal("expected the friends list to be refetched")
+	}
+	if last := model.messages[len(model.messages)-1]; last.Body != "Removed carol from your friends." {
+		t.Fatalf("expected a removal notice, got %q", last.Body)
+	}
+}
+
+// TestLogoutEverywhereAsksFirst verifies Shift+L only signs out every device
+// when pressed twice in a row, while L logs out straight away
+func TestLogoutEverywhereAsksFirst(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws://127.0.0.1:0/join", "", "alice")
+	model.sessionToken = "token"
+	model.mode = modeFriends
+	shiftL := tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("L")}
+
+	if _, cmd := model.Update(shiftL); cmd != nil || model.mode != modeFriends || model.sessionToken != "token" {
+		t.Fatalf("expected Shift+L to ask first, got mode %v", model.mode)
+	}
+	if last := model.messages[len(model.messages)-1]; !strings.Contains(last.Body, "Press Shift+L again") {
+		t.Fatalf("expected a confirmation notice, got %q", last.Body)
+	}
+	// Any other key cancels
+	model.Update(tea.KeyMsg{Type: tea.KeyDown})
+	if _, cmd := model.Update(shiftL); cmd != nil || model.mode != modeFriends {
+		t.Fatal("expected the confirmation to start over")
+	}
+	if _, cmd := model.Update(shiftL); cmd == nil || model.mode != modeAuthMenu || model.sessionToken != "" {
+		t.Fatalf("expected the second Shift+L to sign out, got mode %v", model.mode)
+	}
+
+	model.sessionToken = "token"
+	model.mode = modeFriends
+	if _, cmd := model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("l")}); cmd == nil || model.mode != modeAuthMenu {
+		t.Fatalf("expected L to log out at once, got mode %v", model.mode)
+	}
+}
+
+// TestFilePickerStaysPutOnUnreadableDirectory verifies opening a directory we
+// can't read shows why inline and leaves the picker where it was
+func TestFilePickerStaysPutOnUnreadableDirectory(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	root := t.TempDir()
+	locked := filepath.Join(root, "locked")
+	if err := os.Mkdir(locked, 0o700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	previous := readDirectory
+	readDirectory = func(dir string) ([]os.DirEntry, error) {
+		if dir == locked {
+			return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrPermission}
+		}
+		return os.ReadDir(dir)
+	}
+	defer func() { readDirectory = previous }()
+
+	if err := browseDirectory(locked); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("expected a permission denied error, got %v", err)
+	}
+	if err := browseDirectory(root); err != nil {
+		t.Fatalf("expected %s to be readable: %v", root, err)
+	}
+
+	model := NewTUIModel("ws://127.0.0.1:0/join", "", "alice")
+	model.mode = modeFileSelect
+	model.filePicker.CurrentDirectory = root
+	model.Update(model.filePicker.Init()())
+
+	model.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if model.filePicker.CurrentDirectory != root {
+		t.Fatalf("expected to stay in %s, got %s", root, model.filePicker.CurrentDirectory)
+	}
+	if !strings.Contains(model.View(), "permission denied: "+locked) {
+		t.Fatalf("expected the error in the picker, got %q", model.View())
+	}
+	if model.mode != modeFileSelect {
+		t.Fatalf("expected the picker to stay open, got mode %v", model.mode)
+	}
+}
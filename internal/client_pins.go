@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// pinnedFriendsFile remembers which friends each account pinned to the top of
+// the friends list. Unlike the friends cache it survives logout, since pins
+// are a preference rather than a copy of server data.
+type pinnedFriendsFile struct {
+	Entries map[string][]string `json:"entries"` // keyed by pinsKey
+}
+
+func defaultPinsPath() string {
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".termchat", "pinned_friends.json")
+	}
+	return filepath.Join(".termchat", "pinned_friends.json")
+}
+
+// pinsKey keeps pins apart per account and server, e.g. "alice@https://…"
+func pinsKey(apiBase, username string) string {
+	return username + "@" + apiBase
+}
+
+// loadPinnedFriends returns the friends username pinned on apiBase
+func loadPinnedFriends(path, apiBase, username string) ([]string, error) {
+	pins, err := readPinnedFriends(path)
+	if err != nil {
+		return nil, err
+	}
+	return pins.Entries[pinsKey(apiBase, username)], nil
+}
+
+// savePinnedFriends replaces the pins for username on apiBase
+func savePinnedFriends(path, apiBase, username string, names []string) error {
+	if path == "" || username == "" {
+		return nil
+	}
+	pins, err := readPinnedFriends(path)
+	if err != nil {
+		pins = &pinnedFriendsFile{Entries: make(map[string][]string)}
+	}
+	if len(names) == 0 {
+		delete(pins.Entries, pinsKey(apiBase, username))
+	} else {
+		pins.Entries[pinsKey(apiBase, username)] = names
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(pins, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readPinnedFriends(path string) (*pinnedFriendsFile, error) {
+	if path == "" {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pins pinnedFriendsFile
+	if err := json.Unmarshal(data, &pins); err != nil {
+		return nil, err
+	}
+	if pins.Entries == nil {
+		pins.Entries = make(map[string][]string)
+	}
+	return &pins, nil
+}
+
+// isPinned reports whether name is pinned by the signed-in account
+func (model *TUIModel) isPinned(name string) bool {
+	model.loadPins()
+	return model.pinned[name]
+}
+
+// loadPins reads the signed-in account's pins the first time they're needed,
+// and again after switching accounts
+func (model *TUIModel) loadPins() {
+	key := pinsKey(model.apiBaseURL, model.username)
+	if model.pinned != nil && model.pinnedFor == key {
+		return
+	}
+	model.pinned = make(map[string]bool)
+	model.pinnedFor = key
+	names, _ := loadPinnedFriends(model.pinsPath, model.apiBaseURL, model.username)
+	for _, name := range names {
+		model.pinned[name] = true
+	}
+}
+
+// togglePin pins or unpins the selected friend and saves the change. The
+// selection follows the friend to their new place in the list.
+func (model *TUIModel) togglePin() {
+	if len(model.friends) == 0 {
+		return
+	}
+	name := model.friends[model.selectedFriend].Username
+	model.loadPins()
+	if model.pinned[name] {
+		delete(model.pinned, name)
+		model.appendSystemNotice(fmt.Sprintf("Unpinned %s.", name))
+	} else {
+		model.pinned[name] = true
+		model.appendSystemNotice(fmt.Sprintf("Pinned %s.", name))
+	}
+	names := make([]string, 0, len(model.pinned))
+	for pinned := range model.pinned {
+		names = append(names, pinned)
+	}
+	sort.Strings(names)
+	if err := savePinnedFriends(model.pinsPath, model.apiBaseURL, model.username, names); err != nil {
+		model.appendSystemNotice(fmt.Sprintf("Couldn't save pinned friends: %v", err))
+	}
+	model.orderFriends()
+	for i, friend := range model.friends {
+		if friend.Username == name {
+			model.selectedFriend = i
+		}
+	}
+}
+
+// orderFriends moves pinned friends to the top, keeping the server's order
+// within each group
+func (model *TUIModel) orderFriends() {
+	sort.SliceStable(model.friends, func(i, j int) bool {
+		return model.isPinned(model.friends[i].Username) && !model.isPinned(model.friends[j].Username)
+	})
+}
+
+// pinnedCount is how many friends at the top of the list are pinned
+func (model *TUIModel) pinnedCount() int {
+	count := 0
+	for _, friend := range model.friends {
+		if !model.isPinned(friend.Username) {
+			break
+		}
+		count++
+	}
+	return count
+}
@@ -3,11 +3,14 @@ package internal
 import (
 	"errors"
 	"fmt"
+	"io/fs"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/charmbracelet/bubbles/spinner"
 	"github.com/charmbracelet/bubbles/textinput"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/gorilla/websocket"
@@ -17,12 +20,22 @@ import (
 type (
 	connectedMsg     struct{}
 	incomingMsg      ChatMessage
+	messageUpdateMsg MessageUpdate
+	reactionsMsg     MessageReaction
+	typingMsg        TypingNotice
+	presenceMsg      RoomPresence
+	fileDeletedMsg   FileDeletedMessage
 	errorMsg         error
 	connectFailedMsg struct{ err error }
+	connectLostMsg   struct{}
 	reconnectMsg     struct{}
+	toastExpiredMsg  struct{}
+	friendsRetryMsg  struct{}
+	typingExpiredMsg struct{}
 	existsMsg        struct {
 		key    string
 		exists bool
+		saved  bool // exists, but nobody is connected right now
 		err    error
 	}
 	authResultMsg struct {
@@ -39,14 +52,42 @@ type (
 		outgoing []string
 		err      error
 	}
+	blockedUsersLoadedMsg struct {
+		users []string
+		err   error
+	}
+	// bootstrapLoadedMsg carries both of the above from one request
+	bootstrapLoadedMsg struct {
+		friends  []Friend
+		incoming []string
+		outgoing []string
+		err      error
+	}
 	friendRequestActionMsg struct {
 		username string
 		action   string
 		err      error
 	}
+	friendImportMsg struct {
+		results []batchFriendResult
+		err     error
+	}
+	relayInfoMsg struct {
+		name string
+		skew time.Duration
+		err  error
+	}
+	roomFilesMsg struct {
+		room  string
+		files []FileMetadata
+		err   error
+	}
 	logoutResultMsg struct {
 		err error
 	}
+	accountDeletedMsg struct {
+		err error
+	}
 	fileBrowseMsg struct {
 		path  string
 		items []FileItem
@@ -57,10 +98,14 @@ type (
 	fileUploadedMsg struct {
 		fileID   string
 		filename string
+		path     string
+		room     string
 	}
 	fileUploadErrorMsg struct {
 		err      error
 		filename string
+		uploadID string
+		room     string
 	}
 	fileDownloadedMsg struct {
 		filename string
@@ -70,9 +115,23 @@ type (
 		err      error
 		filename string
 	}
+	fileDeleteResultMsg struct {
+		file FileMetadata
+		err  error
+	}
 )
 
+// Update handles message, then re-fits the chat's message log so View only
+// has to draw it
 func (model *TUIModel) Update(message tea.Msg) (tea.Model, tea.Cmd) {
+	updated, cmd := model.update(message)
+	if model.mode == modeChat {
+		model.layoutMessages()
+	}
+	return updated, cmd
+}
+
+func (model *TUIModel) update(message tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := message.(type) {
 	case tea.KeyMsg:
 		if msg.Type == tea.KeyCtrlC {
@@ -81,32 +140,153 @@ func (model *TUIModel) Update(message tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		return model.handleKeyMsg(msg)
 
+	case tea.WindowSizeMsg:
+		model.width = msg.Width
+		model.height = msg.Height
+		return model, nil
+
 	case connectedMsg:
 		model.isConnected = true
 		model.connectionError = nil
-		return model, model.readOnceCmd()
+		model.reconnectAttempts = 0
+		return model, tea.Batch(model.readOnceCmd(), model.fetchRoomFilesCmd(), model.relayInfoCmd())
+
+	case relayInfoMsg:
+		if msg.err != nil {
+			return model, nil // older servers have no /ping; the header just goes without
+		}
+		model.relayName = msg.name
+		model.clockSkew = msg.skew
+		return model, nil
+
+	case roomFilesMsg:
+		if msg.room != model.roomKey {
+			return model, nil // we've moved on to another room
+		}
+		if msg.err != nil {
+			return model, model.showToast(fmt.Sprintf("Couldn't load room files: %v", msg.err))
+		}
+		model.setRoomFiles(msg.files)
+		return model, nil
 
 	case incomingMsg:
-		model.messages = append(model.messages, ChatMessage(msg))
+		// Messages from older servers have no ID and are always shown. A known
+		// ID is the history backfill after a reconnect; its copy is current, so
+		// it picks up edits and reactions made while we were away.
+		if i := model.findMessage(msg.ID); msg.ID != "" && i >= 0 {
+			model.messages[i] = ChatMessage(msg)
+		} else {
+			model.insertMessage(ChatMessage(msg))
+		}
+		delete(model.typingUsers, msg.User) // they've sent what they were typing
+		return model, model.readOnceCmd()
+
+	case messageUpdateMsg:
+		model.applyMessageUpdate(MessageUpdate(msg))
+		return model, model.readOnceCmd()
+
+	case typingMsg:
+		if msg.User == "" || msg.User == model.username || msg.Room != model.roomKey {
+			return model, model.readOnceCmd()
+		}
+		if msg.Type == "typing_stopped" {
+			delete(model.typingUsers, msg.User)
+			return model, model.readOnceCmd()
+		}
+		if model.typingUsers == nil {
+			model.typingUsers = make(map[string]time.Time)
+		}
+		model.typingUsers[msg.User] = time.Now().Add(typingExpiry)
+		return model, tea.Batch(model.readOnceCmd(), tea.Tick(typingExpiry, func(time.Time) tea.Msg {
+			return typingExpiredMsg{}
+		}))
+
+	case presenceMsg:
+		if msg.Room == model.roomKey {
+			model.roomMembers = msg.Members
+		}
+		return model, model.readOnceCmd()
+
+	case fileDeletedMsg:
+		model.forgetRoomFile(msg.FileID)
+		model.appendSystemNotice(fmt.Sprintf("🗑 %s deleted: %s", msg.DeletedBy, msg.Filename))
+		return model, model.readOnceCmd()
+
+	case typingExpiredMsg:
+		// Each notice schedules its own tick; entries refreshed since stay put
+		now := time.Now()
+		for user, expiry := range model.typingUsers {
+			if !now.Before(expiry) {
+				delete(model.typingUsers, user)
+			}
+		}
+		return model, nil
+
+	case reactionsMsg:
+		if i := model.findMessage(msg.ID); msg.ID != "" && i >= 0 {
+			model.messages[i].Reactions = msg.Reactions
+		}
 		return model, model.readOnceCmd()
 
 	case errorMsg:
 		model.connectionError = msg
 		model.isConnected = false
 		if model.mode == modeChat {
-			model.appendSystemNotice(fmt.Sprintf("Connection closed: %v", msg))
 			model.mode = modeFriends
 			model.roomKey = ""
 			model.currentFriend = ""
 			model.textInput.Blur()
+			return model, model.showToast(fmt.Sprintf("Connection closed: %v", msg))
+		}
+		return model, nil
+
+	case connectLostMsg:
+		// Stay in the room and keep retrying; the status line explains why
+		model.closeConnection()
+		model.connectionError = errConnectionLost
+		if model.mode == modeChat {
+			return model, model.scheduleReconnect()
 		}
 		return model, nil
 
 	case connectFailedMsg:
 		model.connectionError = msg.err
+		if model.mode == modeChat && errors.Is(msg.err, errRoomForbidden) {
+			// Refused, not unreachable: stop here rather than retry
+			model.leaveChat()
+			model.appendSystemNotice("You don't have access to this room.")
+			return model, nil
+		}
+		if model.mode == modeChat && errors.Is(msg.err, errUnauthorized) {
+			// There's no token refresh, so retrying would fail forever; log in
+			// again and come straight back
+			user, room, friend := model.username, model.roomKey, model.currentFriend
+			model.reconnectAttempts = 0
+			model.expireSession()
+			model.resumeUser, model.resumeRoom, model.resumeFriend = user, room, friend
+			model.appendSystemNotice("You'll rejoin the room once you're logged in.")
+			return model, nil
+		}
 		if model.mode == modeChat {
-			model.appendSystemNotice(fmt.Sprintf("Connect failed: %v", msg.err))
-			return model, model.scheduleReconnect()
+			toast := fmt.Sprintf("Connect failed: %v", msg.err)
+			if errors.Is(msg.err, errConnectTimedOut) {
+				toast = fmt.Sprintf("Server didn't answer: %v", msg.err)
+			}
+			return model, tea.Batch(model.showToast(toast), model.scheduleReconnect())
+		}
+		return model, nil
+
+	case toastExpiredMsg:
+		// A newer toast pushes the expiry out, so an older tick leaves it alone
+		if !time.Now().Before(model.toastExpiry) {
+			model.toast = ""
+		}
+		return model, nil
+
+	case friendsRetryMsg:
+		model.friendsRetryPending = false
+		if model.friendsOffline && model.sessionToken != "" {
+			return model, tea.Batch(model.fetchFriendsCmd(), model.fetchFriendRequestsCmd())
 		}
 		return model, nil
 
@@ -119,37 +299,71 @@ func (model *TUIModel) Update(message tea.Msg) (tea.Model, tea.Cmd) {
 	case existsMsg:
 		return model.handleExistsMsg(msg)
 
+	case spinner.TickMsg:
+		if model.checkingRoom == "" {
+			return model, nil // let the spinner stop
+		}
+		var cmd tea.Cmd
+		model.roomSpinner, cmd = model.roomSpinner.Update(msg)
+		return model, cmd
+
 	case authResultMsg:
 		model.loading = false
 		if msg.err != nil {
-			model.appendSystemNotice(fmt.Sprintf("Auth failed: %v", msg.err))
 			model.mode = modeAuthMenu
 			model.textInput.Blur()
 			model.textInput.SetValue("")
 			model.textInput.EchoMode = textinput.EchoNormal
-			return model, nil
+			if isTransportError(msg.err) {
+				// Not a bad password; the server never answered
+				return model, model.showToast(fmt.Sprintf("Can't reach the server: %v", msg.err))
+			}
+			return model, model.showToast(fmt.Sprintf("Auth failed: %v", msg.err))
 		}
 		model.sessionToken = msg.token
 		model.username = msg.username
 		model.mode = modeFriends
 		model.textInput.Blur()
 		model.textInput.SetValue("")
+		model.textInput.CharLimit = 0 // chat and the other prompts are unlimited
 		_ = model.persistSession()
 		model.loading = true
-		return model, tea.Batch(model.fetchFriendsCmd(), model.fetchFriendRequestsCmd())
+		fetch := model.bootstrapCmd()
+		room, friend, resume := model.resumeRoom, model.resumeFriend, model.resumeUser == msg.username
+		model.resumeUser, model.resumeRoom, model.resumeFriend = "", "", ""
+		if resume && room != "" {
+			_, join := model.startChatWithRoom(room, friend)
+			return model, tea.Batch(fetch, join)
+		}
+		return model, fetch
 
 	case friendsLoadedMsg:
 		model.loading = false
+		if model.sessionToken == "" {
+			return model, nil // signed out while this was in flight
+		}
 		if msg.err != nil {
 			if errors.Is(msg.err, errUnauthorized) {
-				model.appendSystemNotice("Session expired. Please log in again.")
-				model.clearSessionState()
+				model.expireSession()
 				return model, nil
 			}
-			model.appendSystemNotice(fmt.Sprintf("Failed to load friends: %v", msg.err))
-			return model, nil
+			hasData, retry := model.goOffline()
+			if hasData {
+				// The view's offline marker says it all; no need for a toast
+				return model, retry
+			}
+			return model, tea.Batch(model.showToast(fmt.Sprintf("Failed to load friends: %v", msg.err)), retry)
 		}
-		model.friends = msg.friends
+		model.backOnline()
+		model.friends = msg.friends[:0]
+		for _, friend := range msg.friends {
+			// Never list ourselves, so there's no way to start a self-DM
+			if !strings.EqualFold(friend.Username, model.username) {
+				model.friends = append(model.friends, friend)
+			}
+		}
+		model.orderFriends()
+		model.cacheFriends()
 		if len(model.friends) == 0 {
 			model.selectedFriend = 0
 		} else if model.selectedFriend >= len(model.friends) {
@@ -157,19 +371,34 @@ func (model *TUIModel) Update(message tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		return model, nil
 
+	case bootstrapLoadedMsg:
+		_, friendsCmd := model.Update(friendsLoadedMsg{friends: msg.friends, err: msg.err})
+		if msg.err != nil {
+			return model, friendsCmd
+		}
+		_, requestsCmd := model.Update(friendRequestsLoadedMsg{incoming: msg.incoming, outgoing: msg.outgoing})
+		return model, tea.Batch(friendsCmd, requestsCmd)
+
 	case friendRequestsLoadedMsg:
 		model.loading = false
+		if model.sessionToken == "" {
+			return model, nil // signed out while this was in flight
+		}
 		if msg.err != nil {
 			if errors.Is(msg.err, errUnauthorized) {
-				model.appendSystemNotice("Session expired. Please log in again.")
-				model.clearSessionState()
+				model.expireSession()
 				return model, nil
 			}
-			model.appendSystemNotice(fmt.Sprintf("Failed to load friend requests: %v", msg.err))
-			return model, nil
+			hasData, retry := model.goOffline()
+			if hasData {
+				return model, retry
+			}
+			return model, tea.Batch(model.showToast(fmt.Sprintf("Failed to load friend requests: %v", msg.err)), retry)
 		}
+		model.backOnline()
 		model.incomingReqs = msg.incoming
 		model.outgoingReqs = msg.outgoing
+		model.cacheFriendRequests()
 		if model.requestView == requestViewIncoming {
 			if len(model.incomingReqs) == 0 {
 				model.selectedRequest = 0
@@ -185,16 +414,37 @@ func (model *TUIModel) Update(message tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		return model, nil
 
+	case blockedUsersLoadedMsg:
+		model.loading = false
+		if msg.err != nil {
+			if errors.Is(msg.err, errUnauthorized) {
+				model.expireSession()
+				return model, nil
+			}
+			return model, model.showToast(fmt.Sprintf("Couldn't load blocked users: %v", msg.err))
+		}
+		model.blockedUsers = msg.users
+		if model.selectedRequest >= len(model.blockedUsers) {
+			model.selectedRequest = max(len(model.blockedUsers)-1, 0)
+		}
+		return model, nil
+
 	case friendRequestActionMsg:
 		model.loading = false
 		if msg.err != nil {
 			if errors.Is(msg.err, errUnauthorized) {
-				model.appendSystemNotice("Session expired. Please log in again.")
-				model.clearSessionState()
+				model.expireSession()
 				return model, nil
 			}
-			model.appendSystemNotice(fmt.Sprintf("Friend request action failed: %v", msg.err))
-			return model, nil
+			switch msg.action {
+			case "remove":
+				return model, model.showToast(fmt.Sprintf("Couldn't remove %s: %v", msg.username, msg.err))
+			case "block":
+				return model, model.showToast(fmt.Sprintf("Couldn't block %s: %v", msg.username, msg.err))
+			case "unblock":
+				return model, model.showToast(fmt.Sprintf("Couldn't unblock %s: %v", msg.username, msg.err))
+			}
+			return model, model.showToast(fmt.Sprintf("Friend request action failed: %v", msg.err))
 		}
 		switch msg.action {
 		case "sent":
@@ -205,33 +455,92 @@ func (model *TUIModel) Update(message tea.Msg) (tea.Model, tea.Cmd) {
 			model.appendSystemNotice(fmt.Sprintf("Declined friend request from %s.", msg.username))
 		case "cancel":
 			model.appendSystemNotice(fmt.Sprintf("Canceled friend request to %s.", msg.username))
+		case "remove":
+			model.appendSystemNotice(fmt.Sprintf("Removed %s from your friends.", msg.username))
+		case "block":
+			model.appendSystemNotice(fmt.Sprintf("Blocked %s.", msg.username))
+		case "unblock":
+			// Stay on the block list with the name gone from it
+			model.appendSystemNotice(fmt.Sprintf("Unblocked %s.", msg.username))
+			model.loading = true
+			return model, model.fetchBlockedUsersCmd()
 		}
 		model.mode = modeFriends
 		model.selectedRequest = 0
 		model.loading = true
 		return model, tea.Batch(model.fetchFriendsCmd(), model.fetchFriendRequestsCmd())
 
+	case friendImportMsg:
+		model.loading = false
+		if msg.err != nil {
+			if errors.Is(msg.err, errUnauthorized) {
+				model.expireSession()
+				return model, nil
+			}
+			return model, model.showToast(fmt.Sprintf("Friend import failed: %v", msg.err))
+		}
+		model.appendSystemNotice(summarizeFriendImport(msg.results))
+		model.loading = true
+		return model, tea.Batch(model.fetchFriendsCmd(), model.fetchFriendRequestsCmd())
+
 	case logoutResultMsg:
+		model.clearSessionState()
 		if msg.err != nil {
-			model.appendSystemNotice(fmt.Sprintf("Logout error: %v", msg.err))
+			return model, model.showToast(fmt.Sprintf("Logout error: %v", msg.err))
+		}
+		return model, nil
+
+	case accountDeletedMsg:
+		model.loading = false
+		if msg.err != nil {
+			if errors.Is(msg.err, errUnauthorized) {
+				model.expireSession()
+				return model, nil
+			}
+			var statusErr *apiStatusError
+			if errors.As(msg.err, &statusErr) && statusErr.StatusCode == http.StatusForbidden {
+				return model, model.showToast("Account not deleted: password incorrect")
+			}
+			return model, model.showToast(fmt.Sprintf("Couldn't delete your account: %v", msg.err))
 		}
+		model.forgetHistory()
 		model.clearSessionState()
+		model.appendSystemNotice("Your account has been deleted.")
 		return model, nil
 
 	case fileUploadedMsg:
+		delete(model.pendingUploads, pendingUpload{room: msg.room, path: msg.path})
 		model.appendSystemNotice(fmt.Sprintf("✓ Uploaded: %s", msg.filename))
 		return model, nil
 
 	case fileUploadErrorMsg:
-		model.appendSystemNotice(fmt.Sprintf("✗ Upload failed: %v", msg.err))
-		return model, nil
+		if msg.uploadID != "" {
+			// Remember the session so retrying the same file picks up where it stopped
+			model.pendingUploads[pendingUpload{room: msg.room, path: msg.filename}] = msg.uploadID
+			model.appendSystemNotice(fmt.Sprintf("✗ Upload interrupted: %v (run /upload again to resume)", msg.err))
+			return model, nil
+		}
+		delete(model.pendingUploads, pendingUpload{room: msg.room, path: msg.filename})
+		return model, model.showToast(fmt.Sprintf("✗ Upload failed: %v", msg.err))
 
 	case fileDownloadedMsg:
 		model.appendSystemNotice(fmt.Sprintf("✓ Downloaded: %s → %s", msg.filename, msg.path))
 		return model, nil
 
 	case fileDownloadErrorMsg:
-		model.appendSystemNotice(fmt.Sprintf("✗ Download failed: %v", msg.err))
+		return model, model.showToast(fmt.Sprintf("✗ Download failed: %v", msg.err))
+
+	case fileDeleteResultMsg:
+		// On success the room's file_deleted broadcast updates the list
+		var statusErr *apiStatusError
+		if errors.As(msg.err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			model.forgetRoomFile(msg.file.ID)
+			model.appendSystemNotice(fmt.Sprintf("%s was already deleted.", msg.file.Filename))
+			return model, nil
+		}
+		if msg.err != nil {
+			return model, model.showToast(fmt.Sprintf("✗ Delete failed: %v", msg.err))
+		}
 		return model, nil
 	
 	case versionCheckMsg:
@@ -270,12 +579,18 @@ func (model *TUIModel) handleKeyMsg(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		return model.handleFriendsKeys(msg)
 	case modeAddFriend:
 		return model.handleAddFriendKeys(msg)
+	case modeImportFriends:
+		return model.handleImportFriendsKeys(msg)
+	case modeDeleteAccount:
+		return model.handleDeleteAccountKeys(msg)
 	case modeManualRoom:
 		return model.handleManualRoomKeys(msg)
 	case modeRequestsIncoming:
 		return model.handleRequestListKeys(msg, requestViewIncoming)
 	case modeRequestsOutgoing:
 		return model.handleRequestListKeys(msg, requestViewOutgoing)
+	case modeBlockedUsers:
+		return model.handleBlockedListKeys(msg)
 	case modeChat:
 		return model.handleChatKeys(msg)
 	case modeFileSelect:
@@ -301,6 +616,12 @@ func (model *TUIModel) handleAuthMenuKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 func (model *TUIModel) startAuthPrompt(intent authIntent) (tea.Model, tea.Cmd) {
 	model.authIntent = intent
 	model.mode = modeAuthUsername
+	// Cap new usernames at what signup accepts; logins stay open since older
+	// accounts predate the limit. Set before SetValue, which applies it.
+	model.textInput.CharLimit = 0
+	if intent == authIntentSignup {
+		model.textInput.CharLimit = maxUsernameLength
+	}
 	model.textInput.SetValue(model.username)
 	model.textInput.Placeholder = "Username"
 	model.textInput.Prompt = "user> "
@@ -328,6 +649,7 @@ func (model *TUIModel) handleAuthUsernameKeys(msg tea.KeyMsg) (tea.Model, tea.Cm
 		
 		model.pendingUsername = trimmed
 		model.mode = modeAuthPassword
+		model.textInput.CharLimit = maxPasswordLength
 		model.textInput.SetValue("")
 		model.textInput.Placeholder = "Password"
 		model.textInput.Prompt = "pass> "
@@ -354,6 +676,11 @@ func (model *TUIModel) handleAuthPasswordKeys(msg tea.KeyMsg) (tea.Model, tea.Cm
 			model.appendSystemNotice("Password cannot be empty.")
 			return model, nil
 		}
+		// CharLimit counts characters, but the server's limit is bytes
+		if len(password) > maxPasswordLength {
+			model.appendSystemNotice(fmt.Sprintf("Password must be at most %d bytes.", maxPasswordLength))
+			return model, nil
+		}
 		model.loading = true
 		model.textInput.SetValue("")
 		model.textInput.Blur()
@@ -372,12 +699,18 @@ func (model *TUIModel) handleAuthPasswordKeys(msg tea.KeyMsg) (tea.Model, tea.Cm
 }
 
 func (model *TUIModel) handleFriendsKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	confirmKey, confirmFriend := model.confirmKey, model.confirmFriend
+	model.confirmKey, model.confirmFriend = "", ""
 	switch msg.Type {
 	case tea.KeyEnter:
 		if len(model.friends) == 0 {
 			return model, nil
 		}
 		friend := model.friends[model.selectedFriend]
+		if strings.EqualFold(friend.Username, model.username) {
+			model.appendSystemNotice("You can't message yourself.")
+			return model, nil
+		}
 		return model.startChatWithRoom(directRoomKey(model.username, friend.Username), friend.Username)
 	case tea.KeyUp:
 		if len(model.friends) > 0 {
@@ -394,6 +727,34 @@ func (model *TUIModel) handleFriendsKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		return model, nil
 	}
 
+	// Shift+L is told apart from L before keys are folded to lower case. It
+	// signs out every device, so like X and K it has to be pressed twice.
+	if msg.String() == "L" {
+		if confirmKey != "L" {
+			model.confirmKey = "L"
+			model.appendSystemNotice("Press Shift+L again to log out on every device.")
+			return model, nil
+		}
+		return model, model.signOut(model.logoutAllCmd())
+	}
+	// Shift+K lists who we've blocked, so they can be unblocked
+	if msg.String() == "K" {
+		model.mode = modeBlockedUsers
+		model.blockedUsers = nil
+		model.selectedRequest = 0
+		model.loading = true
+		return model, model.fetchBlockedUsersCmd()
+	}
+	// Shift+D asks for the password before anything is deleted
+	if msg.String() == "D" {
+		model.mode = modeDeleteAccount
+		model.textInput.SetValue("")
+		model.textInput.Placeholder = "Password"
+		model.textInput.Prompt = "pass> "
+		model.textInput.EchoMode = textinput.EchoPassword
+		return model, model.textInput.Focus()
+	}
+
 	switch strings.ToLower(msg.String()) {
 	case "a":
 		model.mode = modeAddFriend
@@ -402,6 +763,13 @@ func (model *TUIModel) handleFriendsKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		model.textInput.Prompt = "friend> "
 		model.textInput.EchoMode = textinput.EchoNormal
 		return model, model.textInput.Focus()
+	case "b":
+		model.mode = modeImportFriends
+		model.textInput.SetValue("")
+		model.textInput.Placeholder = "alice, bob, carol  or  ~/friends.txt"
+		model.textInput.Prompt = "import> "
+		model.textInput.EchoMode = textinput.EchoNormal
+		return model, model.textInput.Focus()
 	case "i":
 		if len(model.incomingReqs) == 0 {
 			model.appendSystemNotice("No incoming requests.")
@@ -437,19 +805,36 @@ func (model *TUIModel) handleFriendsKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		model.textInput.Placeholder = "Type a message…"
 		model.textInput.Prompt = "> "
 		model.textInput.EchoMode = textinput.EchoNormal
-		model.messages = append(model.messages, ChatMessage{Room: key, User: "system", Body: inviteText(model.serverJoinURL, key), Ts: time.Now().Unix()})
+		model.messages = append(model.messages, ChatMessage{Type: systemMessageType, Room: key, User: "system", Body: inviteText(model.serverJoinURL, key), Ts: time.Now().Unix()})
 		return model, tea.Batch(model.textInput.Focus(), model.connectCmd())
+	case "p":
+		model.togglePin()
+		return model, nil
 	case "r":
 		model.loading = true
 		return model, tea.Batch(model.fetchFriendsCmd(), model.fetchFriendRequestsCmd())
 	case "l":
+		return model, model.signOut(model.logoutCmd())
+	case "x", "k":
+		if len(model.friends) == 0 {
+			return model, nil
+		}
+		key := strings.ToLower(msg.String())
+		friend := model.friends[model.selectedFriend].Username
+		if confirmKey != key || confirmFriend != friend {
+			model.confirmKey, model.confirmFriend = key, friend
+			if key == "k" {
+				model.appendSystemNotice(blockConfirmNotice(friend))
+			} else {
+				model.appendSystemNotice(fmt.Sprintf("Press X again to remove %s from your friends.", friend))
+			}
+			return model, nil
+		}
 		model.loading = true
-		cmd := model.logoutCmd()
-		model.sessionToken = ""
-		model.friends = nil
-		model.mode = modeAuthMenu
-		model.textInput.Blur()
-		return model, cmd
+		if key == "k" {
+			return model, model.blockUserCmd(friend)
+		}
+		return model, model.removeFriendCmd(friend)
 	case "q":
 		model.closeConnection()
 		return model, tea.Quit
@@ -457,6 +842,17 @@ func (model *TUIModel) handleFriendsKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	return model, nil
 }
 
+// signOut goes back to the auth menu while logout, built from the session
+// being left, ends it on the server
+func (model *TUIModel) signOut(logout tea.Cmd) tea.Cmd {
+	model.loading = true
+	model.sessionToken = ""
+	model.friends = nil
+	model.mode = modeAuthMenu
+	model.textInput.Blur()
+	return logout
+}
+
 func (model *TUIModel) handleAddFriendKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	switch msg.Type {
 	case tea.KeyEnter:
@@ -481,16 +877,105 @@ func (model *TUIModel) handleAddFriendKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd)
 	}
 }
 
-func (model *TUIModel) handleManualRoomKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+// handleDeleteAccountKeys reads the password that confirms deleting the
+// account; Esc backs out with nothing sent
+func (model *TUIModel) handleDeleteAccountKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyEnter:
+		password := model.textInput.Value()
+		if strings.TrimSpace(password) == "" {
+			model.appendSystemNotice("Password cannot be empty.")
+			return model, nil
+		}
+		model.loading = true
+		model.mode = modeFriends
+		model.textInput.Blur()
+		model.textInput.SetValue("")
+		model.textInput.EchoMode = textinput.EchoNormal
+		return model, model.deleteAccountCmd(password)
+	case tea.KeyEsc:
+		model.mode = modeFriends
+		model.textInput.Blur()
+		model.textInput.SetValue("")
+		model.textInput.EchoMode = textinput.EchoNormal
+		return model, nil
+	default:
+		var cmd tea.Cmd
+		model.textInput, cmd = model.textInput.Update(msg)
+		return model, cmd
+	}
+}
+
+func (model *TUIModel) handleImportFriendsKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	switch msg.Type {
 	case tea.KeyEnter:
 		trimmed := strings.TrimSpace(model.textInput.Value())
 		if trimmed == "" {
 			return model, nil
 		}
+		usernames, err := parseFriendImport(trimmed)
+		if err != nil {
+			model.appendSystemNotice(fmt.Sprintf("Friend import failed: %v", err))
+			return model, nil
+		}
+		model.loading = true
+		model.textInput.Blur()
+		model.mode = modeFriends
+		model.textInput.SetValue("")
+		return model, model.importFriendsCmd(usernames)
+	case tea.KeyEsc:
+		model.mode = modeFriends
+		model.textInput.Blur()
+		model.textInput.SetValue("")
+		return model, nil
+	default:
+		var cmd tea.Cmd
+		model.textInput, cmd = model.textInput.Update(msg)
+		return model, cmd
+	}
+}
+
+// summarizeFriendImport turns batch results into one notice, grouping
+// usernames by outcome
+func summarizeFriendImport(results []batchFriendResult) string {
+	labels := []struct{ status, label string }{
+		{"sent", "requested"},
+		{"accepted", "now friends"},
+		{"pending", "already requested"},
+		{"already_friends", "already friends"},
+		{"not_found", "not found"},
+		{"blocked", "blocked"},
+		{"invalid", "skipped"},
+		{"error", "failed"},
+	}
+	byStatus := make(map[string][]string)
+	for _, result := range results {
+		byStatus[result.Status] = append(byStatus[result.Status], result.Username)
+	}
+	var parts []string
+	for _, l := range labels {
+		if names := byStatus[l.status]; len(names) > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %s", l.label, strings.Join(names, ", ")))
+		}
+	}
+	if len(parts) == 0 {
+		return "Friend import: nothing to do."
+	}
+	return "Friend import — " + strings.Join(parts, "; ")
+}
+
+func (model *TUIModel) handleManualRoomKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyEnter:
+		trimmed := strings.TrimSpace(model.textInput.Value())
+		if trimmed == "" || model.checkingRoom != "" {
+			return model, nil
+		}
 		model.textInput.SetValue("")
-		return model, model.existsCmd(trimmed)
+		model.checkingRoom = trimmed
+		return model, tea.Batch(model.existsCmd(trimmed), model.roomSpinner.Tick)
 	case tea.KeyEsc:
+		model.checkingRoom = ""
 		model.mode = modeFriends
 		model.textInput.Blur()
 		model.textInput.SetValue("")
@@ -502,10 +987,49 @@ func (model *TUIModel) handleManualRoomKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd)
 	}
 }
 
+// pasteWindow is how soon after the last burst of pasted text a key still
+// counts as part of the paste. pasteKeyGap is sooner than anyone presses a
+// key after typing text, so a key that follows text that closely is part of
+// a paste too.
+const (
+	pasteWindow = 50 * time.Millisecond
+	pasteKeyGap = 5 * time.Millisecond
+)
+
 func (model *TUIModel) handleChatKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	// The terminal types a paste in for us. Keys arrive one rune at a time
+	// when typed, so several runes at once, or a key hard on the heels of
+	// text, means a paste; until it's over, Enter starts a new line of the
+	// draft and Tab at the start of a line indents instead of completing.
+	// The gap catches pastes whose first line is a single character.
+	now := time.Now()
+	pasting := now.Before(model.pastingUntil) || now.Sub(model.lastTextAt) < pasteKeyGap
+	if pasting || (msg.Type == tea.KeyRunes && len(msg.Runes) > 1) {
+		model.pastingUntil = now.Add(pasteWindow)
+	}
+	if msg.Type == tea.KeyRunes || msg.Type == tea.KeySpace {
+		model.lastTextAt = now
+	}
 	switch msg.Type {
+	case tea.KeyCtrlJ:
+		// Terminals can't report Shift+Enter, so Alt+Enter and Ctrl+J start
+		// a new line instead
+		model.composeLines = append(model.composeLines, model.textInput.Value())
+		model.textInput.SetValue("")
+		return model, nil
 	case tea.KeyEnter:
+		if msg.Alt || pasting {
+			model.composeLines = append(model.composeLines, model.textInput.Value())
+			model.textInput.SetValue("")
+			return model, nil
+		}
+		if len(model.composeLines) > 0 {
+			return model, model.sendComposedCmd()
+		}
 		trimmed := strings.TrimSpace(model.textInput.Value())
+		if trimmed != "" {
+			model.rememberInput(trimmed)
+		}
 		if strings.HasPrefix(trimmed, "/") {
 			parts := strings.Fields(trimmed)
 			if len(parts) == 0 {
@@ -514,7 +1038,8 @@ func (model *TUIModel) handleChatKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 
 			command := strings.ToLower(parts[0])
 			switch command {
-			case "/leave":
+			case "/leave", "/quit", "/exit":
+				// /quit and /exit are what older clients used
 				model.leaveChat()
 				return model, nil
 
@@ -522,6 +1047,7 @@ func (model *TUIModel) handleChatKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 				if len(parts) < 2 {
 					// No file path provided, open file picker
 					model.mode = modeFileSelect
+					model.pickerError = ""
 					model.textInput.Blur()
 					model.textInput.SetValue("")
 					return model, model.filePicker.Init()
@@ -543,6 +1069,108 @@ func (model *TUIModel) handleChatKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 				model.textInput.SetValue("")
 				return model, model.uploadFileCmd(filePath)
 
+			case "/edit":
+				body := strings.TrimSpace(trimmed[len(parts[0]):])
+				model.textInput.SetValue("")
+				if body == "" {
+					model.appendSystemNotice("Usage: /edit [message id] <new text>")
+					return model, nil
+				}
+				target := model.lastOwnMessage()
+				if len(parts) > 2 {
+					// "/edit <id> <text>" targets a specific message
+					if chat := model.messageByIDPrefix(strings.TrimPrefix(parts[1], "#")); chat != nil {
+						if chat.User != model.username || chat.Deleted {
+							model.appendSystemNotice("You can only edit your own messages.")
+							return model, nil
+						}
+						target = chat
+						body = strings.TrimSpace(body[len(parts[1]):])
+					}
+				}
+				if target == nil {
+					model.appendSystemNotice("You have no message to edit.")
+					return model, nil
+				}
+				if !model.isConnected {
+					return model, nil
+				}
+				return model, model.sendEditCmd(target.ID, body)
+
+			case "/delete":
+				model.textInput.SetValue("")
+				if len(parts) > 1 {
+					filename := strings.Join(parts[1:], " ")
+					file := model.findRoomFile(filename)
+					if file == nil {
+						model.appendSystemNotice(fmt.Sprintf("File not found: %s", filename))
+						return model, nil
+					}
+					if file.UploadedBy != model.username {
+						model.appendSystemNotice("You can only delete files you uploaded.")
+						return model, nil
+					}
+					return model, model.deleteFileCmd(*file)
+				}
+				last := model.lastOwnMessage()
+				if last == nil {
+					model.appendSystemNotice("You have no message to delete.")
+					return model, nil
+				}
+				if !model.isConnected {
+					return model, nil
+				}
+				return model, model.sendDeleteCmd(last.ID)
+
+			case "/clear":
+				model.textInput.SetValue("")
+				switch {
+				case len(parts) == 1:
+					model.clearChatLog(false)
+				case len(parts) == 2 && strings.EqualFold(parts[1], "messages"):
+					model.clearChatLog(true)
+				default:
+					model.appendSystemNotice("Usage: /clear [messages]")
+				}
+				return model, nil
+
+			case "/help":
+				model.appendSystemNotice("Commands:\n" + strings.Join(chatCommandHelp, "\n"))
+				model.textInput.SetValue("")
+				return model, nil
+
+			case "/me":
+				body := strings.TrimSpace(trimmed[len(parts[0]):])
+				if body == "" {
+					model.appendSystemNotice("Usage: /me <action>, e.g. /me waves")
+					model.textInput.SetValue("")
+					return model, nil
+				}
+				if len(body) > maxMessageBodyBytes {
+					return model, model.showToast(fmt.Sprintf("Message is too long (%d of %d bytes).", len(body), maxMessageBodyBytes))
+				}
+				if !model.isConnected {
+					return model, nil
+				}
+				chat := ChatMessage{Kind: actionMessageKind, Room: model.roomKey, User: model.username, Body: body, Ts: time.Now().Unix()}
+				return model, model.sendCmd(chat)
+
+			case "/react":
+				model.textInput.SetValue("")
+				if len(parts) != 2 {
+					model.appendSystemNotice("Usage: /react <emoji> (Ctrl+R cycles through common reactions)")
+					return model, nil
+				}
+				target := model.lastReactableMessage()
+				if target == nil {
+					model.appendSystemNotice("There is no message to react to.")
+					return model, nil
+				}
+				if !model.isConnected {
+					return model, nil
+				}
+				return model, model.sendReactionCmd(target.ID, parts[1])
+
 			case "/download":
 				if len(parts) < 2 {
 					model.appendSystemNotice("Usage: /download <filename>")
@@ -550,14 +1178,7 @@ func (model *TUIModel) handleChatKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 					return model, nil
 				}
 				filename := strings.Join(parts[1:], " ")
-				// Find file in roomFiles
-				var fileToDownload *FileMetadata
-				for i := range model.roomFiles {
-					if model.roomFiles[i].Filename == filename {
-						fileToDownload = &model.roomFiles[i]
-						break
-					}
-				}
+				fileToDownload := model.findRoomFile(filename)
 				if fileToDownload == nil {
 					model.appendSystemNotice(fmt.Sprintf("File not found: %s", filename))
 					model.textInput.SetValue("")
@@ -565,27 +1186,343 @@ func (model *TUIModel) handleChatKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 				}
 				model.appendSystemNotice(fmt.Sprintf("Downloading %s...", filename))
 				model.textInput.SetValue("")
-				return model, model.downloadFileCmd(fileToDownload.ID, filename)
+				return model, model.downloadFileCmd(*fileToDownload)
 
 			default:
-				model.appendSystemNotice(fmt.Sprintf("Unknown command: %s", command))
+				model.appendSystemNotice(fmt.Sprintf("Unknown command: %s. Commands are %s; /help explains them.", command, strings.Join(chatCommands, ", ")))
 				model.textInput.SetValue("")
 				return model, nil
 			}
 		}
+		if len(trimmed) > maxMessageBodyBytes {
+			return model, model.showToast(fmt.Sprintf("Message is too long (%d of %d bytes).", len(trimmed), maxMessageBodyBytes))
+		}
 		if trimmed != "" && model.isConnected {
 			chat := ChatMessage{Room: model.roomKey, User: model.username, Body: trimmed, Ts: time.Now().Unix()}
 			return model, model.sendCmd(chat)
 		}
+	case tea.KeyBackspace:
+		// Backspace at the start of an empty line goes back to the one above
+		if model.textInput.Value() == "" && len(model.composeLines) > 0 {
+			last := len(model.composeLines) - 1
+			model.textInput.SetValue(model.composeLines[last])
+			model.textInput.CursorEnd()
+			model.composeLines = model.composeLines[:last]
+			return model, nil
+		}
+	case tea.KeyPgUp:
+		model.chatViewport.ViewUp()
+		return model, nil
+	case tea.KeyPgDown:
+		model.chatViewport.ViewDown()
+		return model, nil
+	case tea.KeyHome, tea.KeyEnd:
+		// With nothing typed they jump through the log; otherwise they still
+		// move the cursor
+		if model.textInput.Value() == "" && len(model.composeLines) == 0 {
+			if msg.Type == tea.KeyHome {
+				model.chatViewport.GotoTop()
+			} else {
+				model.chatViewport.GotoBottom()
+			}
+			return model, nil
+		}
+	case tea.KeyTab:
+		if pasting && strings.TrimSpace(string([]rune(model.textInput.Value())[:model.textInput.Position()])) == "" {
+			model.textInput, _ = model.textInput.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("    ")})
+			return model, nil
+		}
+		model.completeInput()
+		return model, nil
+	case tea.KeyCtrlR:
+		model.textInput.SetValue("/react " + nextReaction(model.textInput.Value()))
+		model.textInput.CursorEnd()
+		return model, nil
+	case tea.KeyUp:
+		if msg.Alt {
+			model.recallInput(-1)
+			return model, nil
+		}
+		// Up on an empty input recalls the last message for editing
+		if model.textInput.Value() == "" {
+			if last := model.lastOwnMessage(); last != nil {
+				model.textInput.SetValue("/edit " + last.Body)
+				model.textInput.CursorEnd()
+				return model, nil
+			}
+		}
+	case tea.KeyDown:
+		if msg.Alt {
+			model.recallInput(1)
+			return model, nil
+		}
 	case tea.KeyEsc:
+		if len(model.composeLines) > 0 {
+			// Throw away the draft before leaving the room
+			model.composeLines = nil
+			model.textInput.SetValue("")
+			return model, nil
+		}
 		model.leaveChat()
 		return model, nil
 	}
+	before := model.textInput.Value()
 	var cmd tea.Cmd
 	model.textInput, cmd = model.textInput.Update(msg)
+	value := model.textInput.Value()
+	if value != before && value != "" && !strings.HasPrefix(value, "/") {
+		// Commands aren't messages, so they don't count as typing
+		return model, tea.Batch(cmd, model.sendTypingCmd())
+	}
+	if value != before && value == "" {
+		// Erased rather than sent
+		return model, tea.Batch(cmd, model.stopTypingCmd())
+	}
 	return model, cmd
 }
 
+// sendComposedCmd sends the multi-line message being composed. Lines are
+// kept as typed, blank ones included; only the message as a whole is
+// trimmed. Commands are single-line, so a draft is always sent as text.
+func (model *TUIModel) sendComposedCmd() tea.Cmd {
+	body := strings.TrimSpace(strings.Join(append(model.composeLines, model.textInput.Value()), "\n"))
+	if len(body) > maxMessageBodyBytes {
+		return model.showToast(fmt.Sprintf("Message is too long (%d of %d bytes).", len(body), maxMessageBodyBytes))
+	}
+	if !model.isConnected {
+		return nil
+	}
+	model.composeLines = nil
+	if body == "" {
+		model.textInput.SetValue("")
+		return nil
+	}
+	return model.sendCmd(ChatMessage{Room: model.roomKey, User: model.username, Body: body, Ts: time.Now().Unix()})
+}
+
+// chatCommands are the slash commands Tab completes, in the order offered.
+// /quit and /exit also work as aliases of /leave but aren't offered.
+var chatCommands = []string{"/clear", "/delete", "/download", "/edit", "/help", "/leave", "/me", "/react", "/upload"}
+
+// chatCommandHelp is what /help lists, one line per usage
+var chatCommandHelp = []string{
+	"/upload [path]       share a file; without a path, pick one",
+	"/download <file>     save a file shared in this room",
+	"/delete <file>       delete a file you shared",
+	"/edit [id] <text>    edit your last message, or the one tagged #id",
+	"/delete              delete your last message",
+	"/react <emoji>       react to the latest message or file",
+	"/me <action>         send an action, e.g. /me waves",
+	"/clear [messages]    clear the screen; \"messages\" keeps system notices",
+	"/leave               go back to your friends (/quit and /exit work too)",
+	"/help                show this list",
+}
+
+// completeInput completes the word before the cursor when it's at the end of
+// the input: a command at the start of the line, or an @mention of someone
+// in the room. Pressing Tab again cycles through the other matches.
+func (model *TUIModel) completeInput() {
+	value := model.textInput.Value()
+	if model.textInput.Position() != len([]rune(value)) {
+		return
+	}
+	if len(model.completions) > 0 && value == model.completedInput {
+		model.completionIndex = (model.completionIndex + 1) % len(model.completions)
+	} else {
+		start := strings.LastIndex(value, " ") + 1
+		word := strings.ToLower(value[start:])
+		var matches []string
+		switch {
+		case strings.HasPrefix(word, "/") && strings.TrimSpace(value[:start]) == "":
+			for _, command := range chatCommands {
+				if strings.HasPrefix(command, word) {
+					matches = append(matches, command)
+				}
+			}
+		case strings.HasPrefix(word, "@"):
+			for _, member := range model.roomMembers {
+				if member != model.username && strings.HasPrefix(strings.ToLower(member), word[1:]) {
+					matches = append(matches, "@"+member)
+				}
+			}
+		}
+		if len(matches) == 0 {
+			return
+		}
+		model.completions = matches
+		model.completionIndex = 0
+		model.completionStart = start
+	}
+	model.textInput.SetValue(value[:model.completionStart] + model.completions[model.completionIndex] + " ")
+	model.textInput.CursorEnd()
+	model.completedInput = model.textInput.Value()
+}
+
+// maxInputHistory is how many sent lines Alt+Up can go back through, and how
+// many the history file keeps
+const maxInputHistory = 100
+
+// rememberInput adds a sent line to the input history, skipping repeats of
+// the previous line and dropping the oldest once full, and stops browsing.
+// The history is saved as it changes; failing to save only costs recall after
+// a restart, so it isn't reported.
+func (model *TUIModel) rememberInput(line string) {
+	model.loadHistory()
+	if n := len(model.inputHistory); n == 0 || model.inputHistory[n-1] != line {
+		model.inputHistory = append(model.inputHistory, line)
+		if len(model.inputHistory) > maxInputHistory {
+			model.inputHistory = model.inputHistory[1:]
+		}
+		_ = saveInputHistory(model.historyPath, model.apiBaseURL, model.username, model.inputHistory)
+	}
+	model.historyPos = len(model.inputHistory)
+	model.historyDraft = ""
+}
+
+// recallInput moves step entries through the input history like a shell.
+// Going past the newest entry brings back what was being typed.
+func (model *TUIModel) recallInput(step int) {
+	model.loadHistory()
+	pos := model.historyPos + step
+	if pos < 0 || pos > len(model.inputHistory) {
+		return
+	}
+	if model.historyPos == len(model.inputHistory) {
+		model.historyDraft = model.textInput.Value()
+	}
+	model.historyPos = pos
+	if pos == len(model.inputHistory) {
+		model.textInput.SetValue(model.historyDraft)
+	} else {
+		model.textInput.SetValue(model.inputHistory[pos])
+	}
+	model.textInput.CursorEnd()
+}
+
+// lastOwnMessage returns the most recent message we sent in this room that
+// the server assigned an ID to
+func (model *TUIModel) lastOwnMessage() *ChatMessage {
+	for i := len(model.messages) - 1; i >= 0; i-- {
+		chat := &model.messages[i]
+		if chat.ID != "" && !chat.Deleted && chat.User == model.username && chat.Room == model.roomKey {
+			return chat
+		}
+	}
+	return nil
+}
+
+// findRoomFile returns the room file with that name, if any
+func (model *TUIModel) findRoomFile(filename string) *FileMetadata {
+	for i := range model.roomFiles {
+		if model.roomFiles[i].Filename == filename {
+			return &model.roomFiles[i]
+		}
+	}
+	return nil
+}
+
+// forgetRoomFile drops a deleted file from the room's file list
+func (model *TUIModel) forgetRoomFile(fileID string) {
+	for i, file := range model.roomFiles {
+		if file.ID == fileID {
+			model.roomFiles = append(model.roomFiles[:i], model.roomFiles[i+1:]...)
+			return
+		}
+	}
+}
+
+// minMessageIDPrefix is the shortest ID prefix /edit accepts, the length of
+// the first group of a UUID
+const minMessageIDPrefix = 8
+
+// messageByIDPrefix returns the chat message in this room whose ID is prefix,
+// or starts with it when that's long enough to pick out a single message
+func (model *TUIModel) messageByIDPrefix(prefix string) *ChatMessage {
+	var match *ChatMessage
+	for i := range model.messages {
+		chat := &model.messages[i]
+		if chat.ID == "" || chat.Room != model.roomKey || chat.isSystem() {
+			continue
+		}
+		if chat.ID == prefix {
+			return chat
+		}
+		if len(prefix) >= minMessageIDPrefix && strings.HasPrefix(chat.ID, prefix) {
+			if match != nil {
+				return nil // ambiguous
+			}
+			match = chat
+		}
+	}
+	return match
+}
+
+// lastReactableMessage returns the most recent chat message or shared file in
+// this room that reactions can target
+func (model *TUIModel) lastReactableMessage() *ChatMessage {
+	for i := len(model.messages) - 1; i >= 0; i-- {
+		chat := &model.messages[i]
+		if chat.ID != "" && !chat.Deleted && (!chat.isSystem() || chat.isFile()) && chat.Room == model.roomKey {
+			return chat
+		}
+	}
+	return nil
+}
+
+// nextReaction cycles through reactionPalette based on the current input
+func nextReaction(input string) string {
+	current := strings.TrimSpace(strings.TrimPrefix(input, "/react"))
+	for i, emoji := range reactionPalette {
+		if emoji == current {
+			return reactionPalette[(i+1)%len(reactionPalette)]
+		}
+	}
+	return reactionPalette[0]
+}
+
+// findMessage returns the index of the message with the given ID, or -1
+func (model *TUIModel) findMessage(id string) int {
+	for i := range model.messages {
+		if model.messages[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// insertMessage adds a message in server time order. Live messages arrive in
+// order and just go on the end; a backfilled one can be older than what's
+// already shown. Messages without millisecond stamps (local notices, older
+// servers) stay where they arrived.
+func (model *TUIModel) insertMessage(chat ChatMessage) {
+	i := len(model.messages)
+	for chat.TsMs > 0 && i > 0 {
+		prev := model.messages[i-1]
+		if prev.TsMs <= chat.TsMs || prev.Room != chat.Room {
+			break
+		}
+		i--
+	}
+	model.messages = append(model.messages, ChatMessage{})
+	copy(model.messages[i+1:], model.messages[i:])
+	model.messages[i] = chat
+}
+
+// applyMessageUpdate edits or blanks out an already displayed message
+func (model *TUIModel) applyMessageUpdate(update MessageUpdate) {
+	i := model.findMessage(update.ID)
+	if update.ID == "" || i < 0 {
+		return
+	}
+	if update.Type == "message_deleted" {
+		model.messages[i].Body = deletedMessageBody
+		model.messages[i].Deleted = true
+	} else {
+		model.messages[i].Body = update.Body
+		model.messages[i].Edited = true
+	}
+}
+
 func (model *TUIModel) handleFileSelectKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	switch msg.Type {
 	case tea.KeyEsc:
@@ -595,8 +1532,19 @@ func (model *TUIModel) handleFileSelectKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd)
 		return model, nil
 	}
 	// Pass all other keys to the filepicker for navigation
+	previous := model.filePicker
 	var cmd tea.Cmd
 	model.filePicker, cmd = model.filePicker.Update(msg)
+	if dir := model.filePicker.CurrentDirectory; dir != previous.CurrentDirectory {
+		if err := browseDirectory(dir); err != nil {
+			// The picker drops its own read errors and would be left pointing at
+			// a directory it can't list, so stay where we were
+			model.filePicker = previous
+			model.pickerError = err.Error()
+			return model, nil
+		}
+		model.pickerError = ""
+	}
 	
 	// Check if user selected a file
 	if didSelect, path := model.filePicker.DidSelectFile(msg); didSelect {
@@ -615,6 +1563,20 @@ func (model *TUIModel) handleFileSelectKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd)
 	return model, cmd
 }
 
+// readDirectory is os.ReadDir, swappable in tests
+var readDirectory = os.ReadDir
+
+// browseDirectory checks the file picker can list dir before moving into it
+func browseDirectory(dir string) error {
+	if _, err := readDirectory(dir); err != nil {
+		if errors.Is(err, fs.ErrPermission) {
+			return fmt.Errorf("permission denied: %s", dir)
+		}
+		return fmt.Errorf("can't open %s: %w", dir, err)
+	}
+	return nil
+}
+
 func (model *TUIModel) startChatWithRoom(roomKey, friend string) (tea.Model, tea.Cmd) {
 	model.resetChatLog()
 	model.roomKey = roomKey
@@ -629,9 +1591,18 @@ func (model *TUIModel) startChatWithRoom(roomKey, friend string) (tea.Model, tea
 }
 
 func (model *TUIModel) handleExistsMsg(msg existsMsg) (tea.Model, tea.Cmd) {
+	model.checkingRoom = ""
+	if model.mode != modeManualRoom {
+		return model, nil // gave up on joining while we were checking
+	}
+	if errors.Is(msg.err, errExistsTimedOut) {
+		// Put the code back so Enter simply tries again
+		model.textInput.SetValue(msg.key)
+		model.textInput.CursorEnd()
+		return model, model.showToast(fmt.Sprintf("%v. Press Enter to try again.", msg.err))
+	}
 	if msg.err != nil {
-		model.appendSystemNotice(fmt.Sprintf("Error checking room: %v", msg.err))
-		return model, nil
+		return model, model.showToast(fmt.Sprintf("Couldn't check room, try again: %v", msg.err))
 	}
 	if !msg.exists {
 		model.appendSystemNotice("Room not found. Try again or create one.")
@@ -639,6 +1610,9 @@ func (model *TUIModel) handleExistsMsg(msg existsMsg) (tea.Model, tea.Cmd) {
 	}
 	model.mode = modeChat
 	model.resetChatLog()
+	if msg.saved {
+		model.appendSystemNotice("Nobody is in this room right now; its earlier messages will load when you join.")
+	}
 	model.roomKey = msg.key
 	model.currentFriend = ""
 	model.textInput.Placeholder = "Type a message…"
@@ -648,6 +1622,17 @@ func (model *TUIModel) handleExistsMsg(msg existsMsg) (tea.Model, tea.Cmd) {
 	return model, tea.Batch(model.textInput.Focus(), model.connectCmd())
 }
 
+// expireSession signs out after the server rejected our token. Friends and
+// requests are fetched together, so two rejections can arrive back to back;
+// only the first one clears the session and says so.
+func (model *TUIModel) expireSession() {
+	if model.sessionToken == "" {
+		return
+	}
+	model.appendSystemNotice("Session expired. Please log in again.")
+	model.clearSessionState()
+}
+
 func (model *TUIModel) clearSessionState() {
 	model.sessionToken = ""
 	model.friends = nil
@@ -658,12 +1643,17 @@ func (model *TUIModel) clearSessionState() {
 	model.loading = false
 	model.textInput.Blur()
 	model.textInput.SetValue("")
+	model.incomingReqs = nil
+	model.outgoingReqs = nil
+	model.backOnline()
 	_ = model.removeSessionFile()
+	_ = deleteFriendsCache(model.friendsCachePath, model.apiBaseURL)
 	model.closeConnection()
 }
 
 func (model *TUIModel) leaveChat() {
 	model.closeConnection()
+	model.reconnectAttempts = 0
 	model.mode = modeFriends
 	model.roomKey = ""
 	model.currentFriend = ""
@@ -681,6 +1671,8 @@ func (model *TUIModel) closeConnection() {
 }
 
 func (model *TUIModel) handleRequestListKeys(msg tea.KeyMsg, view requestViewType) (tea.Model, tea.Cmd) {
+	confirmKey, confirmFriend := model.confirmKey, model.confirmFriend
+	model.confirmKey, model.confirmFriend = "", ""
 	var list []string
 	switch view {
 	case requestViewIncoming:
@@ -719,6 +1711,52 @@ func (model *TUIModel) handleRequestListKeys(msg tea.KeyMsg, view requestViewTyp
 			return model, model.friendRequestActionCmd(list[model.selectedRequest], "decline")
 		}
 		return model, model.friendRequestActionCmd(list[model.selectedRequest], "cancel")
+	case "k":
+		// Blocking a requester declines them too, so it's confirmed like K on
+		// the friends screen
+		if view != requestViewIncoming {
+			return model, nil
+		}
+		requester := list[model.selectedRequest]
+		if confirmKey != "k" || confirmFriend != requester {
+			model.confirmKey, model.confirmFriend = "k", requester
+			model.appendSystemNotice(blockConfirmNotice(requester))
+			return model, nil
+		}
+		model.loading = true
+		return model, model.blockUserCmd(requester)
+	}
+	return model, nil
+}
+
+// blockConfirmNotice asks for the second K press that blocks username
+func blockConfirmNotice(username string) string {
+	return fmt.Sprintf("Press K again to block %s. Neither of you will be able to friend or message the other.", username)
+}
+
+func (model *TUIModel) handleBlockedListKeys(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyEsc:
+		model.mode = modeFriends
+		model.selectedRequest = 0
+		return model, nil
+	case tea.KeyUp:
+		if len(model.blockedUsers) > 0 {
+			model.selectedRequest--
+			if model.selectedRequest < 0 {
+				model.selectedRequest = len(model.blockedUsers) - 1
+			}
+		}
+		return model, nil
+	case tea.KeyDown:
+		if len(model.blockedUsers) > 0 {
+			model.selectedRequest = (model.selectedRequest + 1) % len(model.blockedUsers)
+		}
+		return model, nil
+	}
+	if strings.ToLower(msg.String()) == "u" && len(model.blockedUsers) > 0 && !model.loading {
+		model.loading = true
+		return model, model.unblockUserCmd(model.blockedUsers[model.selectedRequest])
 	}
 	return model, nil
 }
@@ -1,11 +1,17 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/charmbracelet/bubbles/viewport"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/mattn/go-runewidth"
 )
 
 // pre styled colors// all from lipglpss
@@ -28,10 +34,13 @@ var (
 	usernameStyle       = lipgloss.NewStyle().Bold(true)
 	activeUserStyle     = usernameStyle.Copy().Foreground(lipgloss.Color("213"))
 	systemMessageStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("214")).Italic(true)
+	actionMessageStyle  = messageBodyStyle.Copy().Italic(true)
 	errorStyle          = statusStyle.Copy().Foreground(lipgloss.Color("196")).Bold(true)
+	toastStyle          = lipgloss.NewStyle().Foreground(lipgloss.Color("231")).Background(lipgloss.Color("160")).Bold(true).Padding(0, 1)
 	dividerStyle        = lipgloss.NewStyle().Foreground(lipgloss.Color("237")).Render(" ┃ ")
 	friendSelectedStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("213")).Bold(true)
 	friendItemStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("252"))
+	typingStyle         = lipgloss.NewStyle().Foreground(lipgloss.Color("244")).Italic(true).PaddingLeft(1)
 	userColorPalette    = []lipgloss.Color{
 		lipgloss.Color("45"),
 		lipgloss.Color("81"),
@@ -41,9 +50,20 @@ var (
 		lipgloss.Color("135"),
 		lipgloss.Color("32"),
 	}
+	// reactionPalette is what Ctrl+R cycles through in chat
+	reactionPalette = []string{"👍", "❤️", "😂", "🎉", "👀"}
 )
 
-func (model TUIModel) View() string {
+func (model *TUIModel) View() string {
+	view := model.renderModeView()
+	if model.toast == "" {
+		return view
+	}
+	// Errors float above whatever screen is showing until their tick clears them
+	return lipgloss.JoinVertical(lipgloss.Left, toastStyle.Render(model.toast), view)
+}
+
+func (model *TUIModel) renderModeView() string {
 	switch model.mode {
 	case modeAuthMenu:
 		return model.renderAuthMenuView()
@@ -53,12 +73,18 @@ func (model TUIModel) View() string {
 		return model.renderFriendsView()
 	case modeAddFriend:
 		return model.renderInputView("Add a friend", "Enter the username you want to add.")
+	case modeImportFriends:
+		return model.renderInputView("Import friends", "Paste usernames separated by commas or spaces, or enter the path to a file listing them.")
 	case modeManualRoom:
 		return model.renderInputView("Join a room", "Enter a room code and press Enter.")
+	case modeDeleteAccount:
+		return model.renderInputView("Delete your account", "This permanently deletes your account, friends and requests. Enter your password to confirm, or Esc to cancel.")
 	case modeRequestsIncoming:
 		return model.renderRequestsView(requestViewIncoming)
 	case modeRequestsOutgoing:
 		return model.renderRequestsView(requestViewOutgoing)
+	case modeBlockedUsers:
+		return model.renderBlockedView()
 	case modeFileSelect:
 		return model.renderFileSelectView()
 	default:
@@ -66,7 +92,7 @@ func (model TUIModel) View() string {
 	}
 }
 
-func (model TUIModel) renderAuthMenuView() string {
+func (model *TUIModel) renderAuthMenuView() string {
 	title := appTitleStyle.Render("TermChat")
 	subtitle := subtitleStyle.Render("Chat with trusted friends from your terminal")
 
@@ -78,7 +104,7 @@ func (model TUIModel) renderAuthMenuView() string {
 
 	viewSections := []string{
 		lipgloss.JoinVertical(lipgloss.Left, title, subtitle),
-		menuBoxStyle.Render(lipgloss.JoinVertical(lipgloss.Left, options...)),
+		model.renderFitted(menuBoxStyle, lipgloss.JoinVertical(lipgloss.Left, options...)),
 	}
 
 	if model.loading {
@@ -94,7 +120,7 @@ func (model TUIModel) renderAuthMenuView() string {
 	return lipgloss.JoinVertical(lipgloss.Left, viewSections...)
 }
 
-func (model TUIModel) renderAuthPromptView() string {
+func (model *TUIModel) renderAuthPromptView() string {
 	title := "Log in"
 	if model.authIntent == authIntentSignup {
 		title = "Create an account"
@@ -103,42 +129,56 @@ func (model TUIModel) renderAuthPromptView() string {
 	if model.mode == modeAuthPassword {
 		hint = "Enter your password"
 	}
+	if model.mode == modeAuthPassword {
+		if len(model.textInput.Value()) >= maxPasswordLength {
+			hint += fmt.Sprintf(" (%d bytes max)", maxPasswordLength)
+		}
+	} else if limit := model.textInput.CharLimit; limit > 0 && len([]rune(model.textInput.Value())) >= limit {
+		hint += fmt.Sprintf(" (%d characters max)", limit)
+	}
 
 	return model.renderPrompt(title, hint)
 }
 
-func (model TUIModel) renderInputView(title, hint string) string {
+func (model *TUIModel) renderInputView(title, hint string) string {
 	return model.renderPrompt(title, hint)
 }
 
-func (model TUIModel) renderPrompt(title, hint string) string {
+func (model *TUIModel) renderPrompt(title, hint string) string {
 	header := appTitleStyle.Render(title)
-	hintText := menuHintStyle.Render(hint)
+	hintText := model.renderFitted(menuHintStyle, hint)
 
 	viewSections := []string{header, hintText}
 
 	if model.loading {
 		viewSections = append(viewSections, connectingStyle.Render("Working…"))
 	}
+	if model.checkingRoom != "" {
+		viewSections = append(viewSections, model.roomSpinner.View()+connectingStyle.Render("Checking room…"))
+	}
 
 	if notices := model.renderSystemNotices(); notices != "" {
 		viewSections = append(viewSections, notices)
 	}
 
-	viewSections = append(viewSections, inputBoxStyle.Render(model.textInput.View()))
+	model.fitInput()
+	viewSections = append(viewSections, model.fillWidth(inputBoxStyle).Render(model.textInput.View()))
 
 	return lipgloss.JoinVertical(lipgloss.Left, viewSections...)
 }
 
-func (model TUIModel) renderFriendsView() string {
-	title := appTitleStyle.Render(fmt.Sprintf("Welcome, %s", model.username))
-	subtitle := subtitleStyle.Render(fmt.Sprintf("Friends online: %d  |  Incoming requests: %d  |  Outgoing requests: %d", model.countOnlineFriends(), len(model.incomingReqs), len(model.outgoingReqs)))
+func (model *TUIModel) renderFriendsView() string {
+	title := appTitleStyle.Render(fmt.Sprintf("Welcome, %s", escapeName(model.username)))
+	subtitle := model.renderFitted(subtitleStyle, fmt.Sprintf("Friends online: %d  |  Incoming requests: %d  |  Outgoing requests: %d", model.countOnlineFriends(), len(model.incomingReqs), len(model.outgoingReqs)))
 
 	viewSections := []string{title, subtitle}
 
 	if model.loading {
 		viewSections = append(viewSections, connectingStyle.Render("Loading friends…"))
 	}
+	if status := model.renderOfflineStatus(); status != "" {
+		viewSections = append(viewSections, status)
+	}
 
 	if notices := model.renderSystemNotices(); notices != "" {
 		viewSections = append(viewSections, notices)
@@ -148,23 +188,42 @@ func (model TUIModel) renderFriendsView() string {
 	if len(model.friends) == 0 {
 		friendLines = append(friendLines, menuHintStyle.Render("No friends yet. Press A to add someone."))
 	} else {
+		pinned := model.pinnedCount()
 		for idx, friend := range model.friends {
+			// Pinned friends get their own section above everyone else
+			if pinned > 0 && idx == 0 {
+				friendLines = append(friendLines, menuHintStyle.Render("Pinned"))
+			} else if pinned > 0 && idx == pinned {
+				friendLines = append(friendLines, "", menuHintStyle.Render("Friends"))
+			}
 			if idx == model.selectedFriend {
-				friendLines = append(friendLines, friendSelectedStyle.Render(fmt.Sprintf("➤ %s %s", presenceDot(friend.Online), friend.Username)))
+				friendLines = append(friendLines, friendSelectedStyle.Render(fmt.Sprintf("➤ %s %s%s", presenceDot(friend.Online), escapeName(friend.Username), lastSeenSuffix(friend, time.Now()))))
 			} else {
-				friendLines = append(friendLines, friendItemStyle.Render(fmt.Sprintf("  %s %s", presenceDot(friend.Online), friend.Username)))
+				friendLines = append(friendLines, friendItemStyle.Render(fmt.Sprintf("  %s %s%s", presenceDot(friend.Online), model.displayName(friend.Username), lastSeenSuffix(friend, time.Now()))))
 			}
 		}
 	}
-	viewSections = append(viewSections, menuBoxStyle.Render(lipgloss.JoinVertical(lipgloss.Left, friendLines...)))
+	viewSections = append(viewSections, model.renderFitted(menuBoxStyle, lipgloss.JoinVertical(lipgloss.Left, friendLines...)))
 
-	hints := menuHintStyle.Render("↑/↓ select • Enter chat • A add friend • I incoming requests • O outgoing requests • M join room • N new room • R refresh • L logout • Q quit")
+	hints := model.renderFitted(menuHintStyle, "↑/↓ select • Enter chat • A add friend • X remove friend • K block • Shift+K blocked users • P pin • B bulk import • I incoming requests • O outgoing requests • M join room • N new room • R refresh • L logout • Shift+L logout everywhere • Shift+D delete account • Q quit")
 	viewSections = append(viewSections, hints)
 
 	return lipgloss.JoinVertical(lipgloss.Left, viewSections...)
 }
 
-func (model TUIModel) renderRequestsView(view requestViewType) string {
+// renderOfflineStatus marks the friends and request lists as stale while the
+// server can't be reached
+func (model *TUIModel) renderOfflineStatus() string {
+	if !model.friendsOffline {
+		return ""
+	}
+	if model.friendsCachedAt.IsZero() {
+		return errorStyle.Render("Offline: showing the last known lists, retrying…")
+	}
+	return errorStyle.Render(fmt.Sprintf("Offline: showing lists cached %s, retrying…", model.friendsCachedAt.Local().Format("Jan 2 15:04")))
+}
+
+func (model *TUIModel) renderRequestsView(view requestViewType) string {
 	title := "Incoming friend requests"
 	list := model.incomingReqs
 	if view == requestViewOutgoing {
@@ -172,7 +231,14 @@ func (model TUIModel) renderRequestsView(view requestViewType) string {
 		list = model.outgoingReqs
 	}
 	header := appTitleStyle.Render(title)
-	viewSections := []string{header, menuHintStyle.Render("Enter to accept (incoming only) • D decline/cancel • Esc back")}
+	hint := "Enter accept • D decline • K block • Esc back"
+	if view == requestViewOutgoing {
+		hint = "D cancel • Esc back"
+	}
+	viewSections := []string{header, model.renderFitted(menuHintStyle, hint)}
+	if status := model.renderOfflineStatus(); status != "" {
+		viewSections = append(viewSections, status)
+	}
 	if notices := model.renderSystemNotices(); notices != "" {
 		viewSections = append(viewSections, notices)
 	}
@@ -184,28 +250,78 @@ func (model TUIModel) renderRequestsView(view requestViewType) string {
 			prefix := "  "
 			if idx == model.selectedRequest {
 				prefix = "➤ "
-				lines = append(lines, friendSelectedStyle.Render(prefix+name))
+				lines = append(lines, friendSelectedStyle.Render(prefix+escapeName(name)))
 			} else {
-				lines = append(lines, friendItemStyle.Render(prefix+name))
+				lines = append(lines, friendItemStyle.Render(prefix+model.displayName(name)))
 			}
 		}
 	}
-	viewSections = append(viewSections, menuBoxStyle.Render(lipgloss.JoinVertical(lipgloss.Left, lines...)))
+	viewSections = append(viewSections, model.renderFitted(menuBoxStyle, lipgloss.JoinVertical(lipgloss.Left, lines...)))
 	return lipgloss.JoinVertical(lipgloss.Left, viewSections...)
 }
 
-func (model TUIModel) renderChatView() string {
+func (model *TUIModel) renderBlockedView() string {
+	header := appTitleStyle.Render("Blocked users")
+	viewSections := []string{header, model.renderFitted(menuHintStyle, "↑/↓ select • U unblock • Esc back")}
+	if notices := model.renderSystemNotices(); notices != "" {
+		viewSections = append(viewSections, notices)
+	}
+	var lines []string
+	switch {
+	case model.loading && len(model.blockedUsers) == 0:
+		lines = append(lines, menuHintStyle.Render("Loading…"))
+	case len(model.blockedUsers) == 0:
+		lines = append(lines, menuHintStyle.Render("You haven't blocked anyone."))
+	default:
+		for idx, name := range model.blockedUsers {
+			if idx == model.selectedRequest {
+				lines = append(lines, friendSelectedStyle.Render("➤ "+escapeName(name)))
+			} else {
+				lines = append(lines, friendItemStyle.Render("  "+model.displayName(name)))
+			}
+		}
+	}
+	viewSections = append(viewSections, model.renderFitted(menuBoxStyle, lipgloss.JoinVertical(lipgloss.Left, lines...)))
+	return lipgloss.JoinVertical(lipgloss.Left, viewSections...)
+}
+
+func (model *TUIModel) renderChatView() string {
+	top, bottom := model.chatChrome()
+	messageLog := model.messageLog()
+	if model.chatViewport.Height > 0 {
+		messageLog = model.chatViewport.View()
+	}
+	messagesView := model.fillWidth(messageBoxStyle).Render(messageLog)
+	if !model.chatViewport.AtBottom() {
+		bottom[len(bottom)-1] = model.renderFitted(menuHintStyle, "Scrolled back • PgDn for newer messages • End for the latest")
+	}
+
+	sections := append(append(top, messagesView), bottom...)
+	return lipgloss.JoinVertical(lipgloss.Left, sections...)
+}
+
+// chatChrome renders what the chat screen shows above and below the message
+// log: the header and connection status, then the input box and its hint
+func (model *TUIModel) chatChrome() (top, bottom []string) {
 	headerSegments := []string{"TermChat"}
 	if model.currentFriend != "" {
-		headerSegments = append(headerSegments, fmt.Sprintf("Chat with %s", model.currentFriend))
+		headerSegments = append(headerSegments, fmt.Sprintf("Chat with %s", model.displayName(model.currentFriend)))
 	} else if model.roomKey != "" {
 		headerSegments = append(headerSegments, fmt.Sprintf("Room %s", model.roomKey))
 	}
-	headerSegments = append(headerSegments, fmt.Sprintf("User %s", model.username))
-	header := chatHeaderStyle.Render(strings.Join(headerSegments, dividerStyle))
+	headerSegments = append(headerSegments, fmt.Sprintf("User %s", escapeName(model.username)))
+	if online := model.membersSegment(); online != "" {
+		headerSegments = append(headerSegments, online)
+	}
+	if model.relayName != "" {
+		headerSegments = append(headerSegments, fmt.Sprintf("relay: %s, skew %+.1fs", model.relayName, model.clockSkew.Seconds()))
+	}
+	header := model.fillWidth(chatHeaderStyle).Render(model.fitHeader(headerSegments))
 
 	var statusLine string
 	switch {
+	case errors.Is(model.connectionError, errConnectionLost):
+		statusLine = errorStyle.Render("Connection lost, reconnecting…")
 	case model.connectionError != nil:
 		statusLine = errorStyle.Render("Connection error: " + model.connectionError.Error())
 	case model.isConnected:
@@ -214,6 +330,31 @@ func (model TUIModel) renderChatView() string {
 		statusLine = connectingStyle.Render("Connecting…")
 	}
 
+	inputLines := make([]string, 0, len(model.composeLines)+1)
+	for _, line := range model.composeLines {
+		inputLines = append(inputLines, "  "+line)
+	}
+	model.fitInput()
+	inputLines = append(inputLines, model.textInput.View())
+	inputView := model.fillWidth(inputBoxStyle).Render(lipgloss.JoinVertical(lipgloss.Left, inputLines...))
+	footerHint := model.renderFitted(menuHintStyle, "Alt+Enter new line • Alt+↑/↓ history • PgUp/PgDn scroll • Esc or /leave to return to menu")
+	if len(model.composeLines) > 0 {
+		footerHint = model.renderFitted(menuHintStyle, "Enter send • Alt+Enter new line • Backspace on an empty line goes back • Esc discard")
+	}
+
+	top = []string{header}
+	if statusLine != "" {
+		top = append(top, statusLine)
+	}
+	if typing := model.typingLine(); typing != "" {
+		bottom = append(bottom, model.renderFitted(typingStyle, typing))
+	}
+	bottom = append(bottom, inputView, footerHint)
+	return top, bottom
+}
+
+// messageLog renders every message in the room, oldest first
+func (model *TUIModel) messageLog() string {
 	var messageLines []string
 	for _, chat := range model.messages {
 		messageLines = append(messageLines, model.renderChatMessage(chat))
@@ -221,19 +362,120 @@ func (model TUIModel) renderChatView() string {
 	if len(messageLines) == 0 {
 		messageLines = append(messageLines, systemMessageStyle.Render("No messages yet. Say hi and start the conversation."))
 	}
+	return lipgloss.JoinVertical(lipgloss.Left, messageLines...)
+}
 
-	messagesView := messageBoxStyle.Render(lipgloss.JoinVertical(lipgloss.Left, messageLines...))
-	inputView := inputBoxStyle.Render(model.textInput.View())
-	footerHint := menuHintStyle.Render("Esc or /leave to return to menu")
+// fitHeader joins the chat header's segments, cutting it short with an
+// ellipsis rather than letting it wrap when the terminal is too narrow. The
+// later segments, like the relay, go first.
+func (model *TUIModel) fitHeader(segments []string) string {
+	room := model.width - lipgloss.Width(chatHeaderStyle.Render(""))
+	if model.width <= 0 || room <= 0 {
+		return strings.Join(segments, dividerStyle)
+	}
+	used := 0
+	for i, segment := range segments {
+		if i > 0 {
+			used += lipgloss.Width(dividerStyle)
+		}
+		if width := runewidth.StringWidth(segment); used+width <= room {
+			used += width
+			continue
+		}
+		if left := room - used; left > 1 || i == 0 {
+			segments[i] = runewidth.Truncate(segment, max(left, 1), "…")
+			return strings.Join(segments[:i+1], dividerStyle)
+		}
+		return strings.Join(segments[:i], dividerStyle)
+	}
+	return strings.Join(segments, dividerStyle)
+}
 
-	sections := []string{header}
-	if statusLine != "" {
-		sections = append(sections, statusLine)
+// minScrollHeight is the fewest message lines worth scrolling; a terminal
+// smaller than that just gets the whole log
+const minScrollHeight = 3
+
+// layoutMessages fits the message log into the rows the rest of the chat
+// screen leaves free. The view stays on the newest messages unless the user
+// has scrolled back. Until the terminal size is known, or when it's too small
+// to scroll, the viewport is left empty and the whole log is shown.
+func (model *TUIModel) layoutMessages() {
+	top, bottom := model.chatChrome()
+	fixedHeight := lipgloss.Height(lipgloss.JoinVertical(lipgloss.Left, append(top, bottom...)...))
+	if model.toast != "" {
+		fixedHeight += lipgloss.Height(toastStyle.Render(model.toast))
+	}
+	height := model.height - fixedHeight - (lipgloss.Height(messageBoxStyle.Render("")) - 1)
+	if model.height <= 0 || height < minScrollHeight {
+		model.chatViewport = viewport.Model{}
+		return
+	}
+	content := model.messageLog()
+	following := model.chatViewport.Height == 0 || model.chatViewport.AtBottom()
+	model.chatViewport.Width = model.messageContentWidth()
+	if model.chatViewport.Width <= 0 {
+		model.chatViewport.Width = lipgloss.Width(content)
+	}
+	model.chatViewport.Height = height
+	model.chatViewport.SetContent(content)
+	if following {
+		model.chatViewport.GotoBottom()
 	}
-	sections = append(sections, messagesView)
-	sections = append(sections, inputView, footerHint)
+}
 
-	return lipgloss.JoinVertical(lipgloss.Left, sections...)
+// maxMemberNames is how many members the chat header names before it
+// summarises the rest as "+N"
+const maxMemberNames = 4
+
+// membersSegment lists who's in the room, e.g. "Online: alice, bob +3"
+func (model *TUIModel) membersSegment() string {
+	if len(model.roomMembers) == 0 {
+		return ""
+	}
+	names := model.roomMembers
+	extra := ""
+	if len(names) > maxMemberNames {
+		extra = fmt.Sprintf(" +%d", len(names)-maxMemberNames)
+		names = names[:maxMemberNames]
+	}
+	shown := make([]string, len(names))
+	for i, name := range names {
+		shown[i] = model.displayName(name)
+	}
+	return "Online: " + strings.Join(shown, ", ") + extra
+}
+
+// displayName cuts a username to the configured width with an ellipsis, so
+// one long name can't push a list or the chat out of shape. The selected
+// friend or request keeps its full name.
+func (model *TUIModel) displayName(name string) string {
+	width := model.nameWidth
+	if width <= 0 {
+		width = DefaultNameWidth
+	}
+	return runewidth.Truncate(escapeName(name), width, "…")
+}
+
+// typingLine names who is typing, e.g. "alice and bob are typing…"
+func (model *TUIModel) typingLine() string {
+	now := time.Now()
+	var names []string
+	for user, expiry := range model.typingUsers {
+		if now.Before(expiry) {
+			names = append(names, model.displayName(user))
+		}
+	}
+	sort.Strings(names)
+	switch len(names) {
+	case 0:
+		return ""
+	case 1:
+		return names[0] + " is typing…"
+	case 2:
+		return names[0] + " and " + names[1] + " are typing…"
+	default:
+		return fmt.Sprintf("%d people are typing…", len(names))
+	}
 }
 
 func renderMenuOption(hotkey string, label string) string {
@@ -241,11 +483,11 @@ func renderMenuOption(hotkey string, label string) string {
 	return lipgloss.JoinHorizontal(lipgloss.Left, key, menuItemStyle.Render(label))
 }
 
-func (model TUIModel) renderSystemNotices() string {
+func (model *TUIModel) renderSystemNotices() string {
 	var notices []string
 	for _, msg := range model.messages {
-		if msg.User == "system" && msg.Room == "" {
-			notices = append(notices, systemMessageStyle.Render(msg.Body))
+		if msg.isSystem() && msg.Room == "" {
+			notices = append(notices, systemMessageStyle.Render(escapeControlChars(msg.Body)))
 		}
 	}
 	if len(notices) == 0 {
@@ -256,11 +498,20 @@ func (model TUIModel) renderSystemNotices() string {
 
 // renderChatMessage renders a single log line. It stamps the timestamp, picks
 // a color for the sender, and indents multi-line messages so they stay legible.
-func (model TUIModel) renderChatMessage(chat ChatMessage) string {
-	timestamp := timestampStyle.Render(fmt.Sprintf("[%s]", time.Unix(chat.Ts, 0).Format("15:04:05")))
-	if chat.User == "system" {
+func (model *TUIModel) renderChatMessage(chat ChatMessage) string {
+	timestamp := timestampStyle.Render(fmt.Sprintf("[%s]", formatMessageTime(chat)))
+	// Bodies and names come from other users; never let them reach the
+	// terminal as escape sequences
+	chat.User = escapeName(chat.User)
+	chat.Body = escapeControlChars(chat.Body)
+	if chat.isSystem() {
 		body := systemMessageStyle.Render(chat.Body)
-		return lipgloss.JoinHorizontal(lipgloss.Left, timestamp, " ", body)
+		line := lipgloss.JoinHorizontal(lipgloss.Left, timestamp, " ", body)
+		if len(chat.Reactions) == 0 {
+			return line
+		}
+		// Only file notices collect reactions
+		return lipgloss.JoinVertical(lipgloss.Left, line, "   "+timestampStyle.Render(formatReactions(chat.Reactions)))
 	}
 
 	var nameStyle lipgloss.Style
@@ -270,10 +521,222 @@ func (model TUIModel) renderChatMessage(chat ChatMessage) string {
 		nameStyle = usernameStyle.Copy().Foreground(colorForUser(chat.User))
 	}
 
-	name := nameStyle.Render(chat.User)
-	bodyText := messageBodyStyle.Render(strings.ReplaceAll(chat.Body, "\n", "\n   "))
+	// Our own messages carry the ID /edit takes, after the timestamp
+	if tag := shortMessageID(chat.ID); tag != "" && chat.User == model.username && !chat.Deleted {
+		timestamp = lipgloss.JoinHorizontal(lipgloss.Left, timestamp, " ", timestampStyle.Render("#"+tag))
+	}
+	shownName := model.displayName(chat.User)
+	name := nameStyle.Render(shownName)
+	body := chat.Body
+	width := 0
+	if available := model.messageContentWidth(); available > 0 {
+		// timestamp, space, name, colon and space come before the body; an
+		// action's "* name " takes one more cell
+		prefix := lipgloss.Width(timestamp) + 1 + displayWidth(shownName) + 2
+		if chat.isAction() {
+			prefix++
+		}
+		width = max(available-prefix-3, minWrapWidth)
+	}
+	// Fenced code blocks keep their layout and get highlighted
+	bodyText := strings.ReplaceAll(renderMessageBody(body, width), "\n", "\n   ")
+	var line string
+	if chat.isAction() && !chat.Deleted {
+		// "* alice waves", with no colon
+		actor := nameStyle.Copy().Italic(true).Render("* " + shownName)
+		if width > 0 {
+			body = wrapText(body, width)
+		}
+		bodyText = actionMessageStyle.Render(strings.ReplaceAll(body, "\n", "\n   "))
+		line = lipgloss.JoinHorizontal(lipgloss.Left, timestamp, " ", actor, " ", bodyText)
+		if chat.Edited {
+			line = lipgloss.JoinHorizontal(lipgloss.Left, line, " ", timestampStyle.Render("(edited)"))
+		}
+	} else if chat.Deleted {
+		bodyText = timestampStyle.Render(deletedMessageBody)
+		line = lipgloss.JoinHorizontal(lipgloss.Left, timestamp, " ", name, ": ", bodyText)
+	} else if chat.Edited {
+		line = lipgloss.JoinHorizontal(lipgloss.Left, timestamp, " ", name, ": ", bodyText, " ", timestampStyle.Render("(edited)"))
+	} else {
+		line = lipgloss.JoinHorizontal(lipgloss.Left, timestamp, " ", name, ": ", bodyText)
+	}
+
+	if len(chat.Reactions) == 0 || chat.Deleted {
+		return line
+	}
+	return lipgloss.JoinVertical(lipgloss.Left, line, "   "+timestampStyle.Render(formatReactions(chat.Reactions)))
+}
+
+// shortMessageID is the part of a message ID shown next to our own messages:
+// just long enough for messageByIDPrefix to find the message again
+func shortMessageID(id string) string {
+	if len(id) > minMessageIDPrefix {
+		return id[:minMessageIDPrefix]
+	}
+	return id
+}
+
+// minWrapWidth keeps very narrow terminals from wrapping a character per line
+const minWrapWidth = 10
+
+// messageContentWidth is the room for text inside the message box, or 0 when
+// the terminal size isn't known yet
+func (model *TUIModel) messageContentWidth() int {
+	if model.width <= 0 {
+		return 0
+	}
+	// Measure the frame by rendering an empty box; GetHorizontalFrameSize
+	// ignores borders that are enabled implicitly via BorderStyle
+	return model.width - lipgloss.Width(messageBoxStyle.Render(""))
+}
+
+// fillWidth stretches a box style across the terminal so the chat's boxes
+// line up and long lines wrap inside them. Until the size is known the style
+// is left alone.
+func (model *TUIModel) fillWidth(style lipgloss.Style) lipgloss.Style {
+	if model.width <= 0 {
+		return style
+	}
+	// Width covers the padding but not the border, so only the border is
+	// taken off
+	border := lipgloss.Width(style.Render("")) - style.GetHorizontalPadding()
+	return style.Copy().Width(max(model.width-border, 1))
+}
+
+// renderFitted renders content with style at its natural size, wrapping it
+// to the terminal only when it would run past the edge. Menus and hints stay
+// compact on wide terminals this way.
+func (model *TUIModel) renderFitted(style lipgloss.Style, content string) string {
+	rendered := style.Render(content)
+	if model.width <= 0 || lipgloss.Width(rendered) <= model.width {
+		return rendered
+	}
+	return model.fillWidth(style).Render(content)
+}
+
+// fitInput scrolls the text input sideways once its value fills the input
+// box, instead of letting the box grow past the terminal
+func (model *TUIModel) fitInput() {
+	if model.width <= 0 {
+		model.textInput.Width = 0
+		return
+	}
+	// One cell is kept for the cursor
+	available := model.width - lipgloss.Width(inputBoxStyle.Render("")) - displayWidth(model.textInput.Prompt) - 1
+	model.textInput.Width = max(available, 1)
+}
+
+// formatMessageTime shows milliseconds when the server sent them, so bursts
+// of messages within one second can still be told apart
+func formatMessageTime(chat ChatMessage) string {
+	if chat.TsMs > 0 {
+		return chat.sentAt().Format("15:04:05.000")
+	}
+	return chat.sentAt().Format("15:04:05")
+}
+
+// displayWidth measures how many terminal cells s occupies, counting emoji and
+// CJK characters as two
+func displayWidth(s string) int {
+	return runewidth.StringWidth(s)
+}
+
+// escapeControlChars makes text from other users safe to print. Control
+// characters other than newline and tab are shown in caret notation (ESC
+// becomes "^["), so an embedded escape sequence reads as literal text instead
+// of moving the cursor, clearing the screen or restyling the UI.
+func escapeControlChars(s string) string {
+	if !strings.ContainsFunc(s, isUnsafeControl) {
+		return s
+	}
+	var sb strings.Builder
+	for _, r := range s {
+		switch {
+		case !isUnsafeControl(r):
+			sb.WriteRune(r)
+		case r < 0x20:
+			sb.WriteByte('^')
+			sb.WriteRune(r + '@')
+		case r == 0x7f:
+			sb.WriteString("^?")
+		default:
+			// C1 controls such as the single-byte CSI
+			sb.WriteRune(utf8.RuneError)
+		}
+	}
+	return sb.String()
+}
+
+// escapeName is escapeControlChars for usernames, which must stay on one
+// line: newlines and tabs are escaped too, so a name can't fake a message
+// line of its own. Signup already refuses such names; this covers older
+// accounts and other servers.
+func escapeName(name string) string {
+	return nameLineEscaper.Replace(escapeControlChars(name))
+}
+
+var nameLineEscaper = strings.NewReplacer("\n", "^J", "\t", "^I")
 
-	return lipgloss.JoinHorizontal(lipgloss.Left, timestamp, " ", name, ": ", bodyText)
+func isUnsafeControl(r rune) bool {
+	return r != '\n' && r != '\t' && unicode.IsControl(r)
+}
+
+// wrapText breaks text into lines of at most width terminal cells. Words are
+// kept together where possible; longer words are split between characters so
+// a wide rune is never cut in half.
+func wrapText(text string, width int) string {
+	if width <= 0 {
+		return text
+	}
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		var line strings.Builder
+		lineWidth := 0
+		flush := func() {
+			lines = append(lines, line.String())
+			line.Reset()
+			lineWidth = 0
+		}
+		for _, word := range strings.Fields(paragraph) {
+			wordWidth := displayWidth(word)
+			if lineWidth > 0 && lineWidth+1+wordWidth > width {
+				flush()
+			}
+			if lineWidth > 0 {
+				line.WriteByte(' ')
+				lineWidth++
+			}
+			for _, r := range word {
+				runeWidth := runewidth.RuneWidth(r)
+				if lineWidth+runeWidth > width {
+					flush()
+				}
+				line.WriteRune(r)
+				lineWidth += runeWidth
+			}
+		}
+		flush()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatReactions renders counts as "👍 3  ❤️ 1", most popular first
+func formatReactions(reactions map[string]int) string {
+	emojis := make([]string, 0, len(reactions))
+	for emoji := range reactions {
+		emojis = append(emojis, emoji)
+	}
+	sort.Slice(emojis, func(i, j int) bool {
+		if reactions[emojis[i]] != reactions[emojis[j]] {
+			return reactions[emojis[i]] > reactions[emojis[j]]
+		}
+		return emojis[i] < emojis[j]
+	})
+	parts := make([]string, len(emojis))
+	for i, emoji := range emojis {
+		parts[i] = fmt.Sprintf("%s %d", escapeControlChars(emoji), reactions[emoji])
+	}
+	return strings.Join(parts, "  ")
 }
 
 func presenceDot(online bool) string {
@@ -283,7 +746,32 @@ func presenceDot(online bool) string {
 	return lipgloss.NewStyle().Foreground(lipgloss.Color("240")).Render("○")
 }
 
-func (model TUIModel) countOnlineFriends() int {
+// lastSeenSuffix notes when an offline friend was last around, e.g.
+// " · last seen 2h ago"
+func lastSeenSuffix(friend Friend, now time.Time) string {
+	if friend.Online || friend.LastSeen.IsZero() {
+		return ""
+	}
+	return " · last seen " + humanizeSince(friend.LastSeen, now)
+}
+
+// humanizeSince describes how long ago then was in the largest whole unit
+func humanizeSince(then, now time.Time) string {
+	elapsed := now.Sub(then)
+	switch {
+	case elapsed < time.Minute:
+		return "just now"
+	case elapsed < time.Hour:
+		return fmt.Sprintf("%dm ago", int(elapsed/time.Minute))
+	case elapsed < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(elapsed/time.Hour))
+	case elapsed < 30*24*time.Hour:
+		return fmt.Sprintf("%dd ago", int(elapsed/(24*time.Hour)))
+	}
+	return "on " + then.Local().Format("Jan 2")
+}
+
+func (model *TUIModel) countOnlineFriends() int {
 	count := 0
 	for _, f := range model.friends {
 		if f.Online {
@@ -308,7 +796,7 @@ func colorForUser(name string) lipgloss.Color {
 	return userColorPalette[sum%len(userColorPalette)]
 }
 
-func (model TUIModel) renderFileSelectView() string {
+func (model *TUIModel) renderFileSelectView() string {
 	header := appTitleStyle.Render("Select a file to upload")
 	hint := menuHintStyle.Render("↑/↓ navigate • Enter select file • Esc cancel")
 	
@@ -318,6 +806,10 @@ func (model TUIModel) renderFileSelectView() string {
 		viewSections = append(viewSections, notices)
 	}
 	
+	if model.pickerError != "" {
+		viewSections = append(viewSections, errorStyle.Render(model.pickerError))
+	}
+	
 	// Render the filepicker
 	viewSections = append(viewSections, "\n"+model.filePicker.View())
 	
@@ -0,0 +1,507 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// TestChatViewAlignsWideCharacters verifies emoji and CJK messages wrap to the
+// terminal and every line of the message box has the same display width
+func TestChatViewAlignsWideCharacters(t *testing.T) {
+	model := NewTUIModel("ws://localhost:8080/join", "wide", "alice")
+	model.mode = modeChat
+	model.isConnected = true
+	model.width = 48
+	now := time.Now().Unix()
+	for _, body := range []string{
+		"🎉🎉 party time 🎉",
+		"你好世界你好世界你好世界你好世界你好世界你好世界",
+		"mixed 日本語 text with an emoji 🚀 and enough words to need wrapping",
+		"plain ascii",
+	} {
+		model.messages = append(model.messages, ChatMessage{ID: body, Room: "wide", User: "bob", Body: body, Ts: now})
+	}
+
+	var boxWidth int
+	for _, line := range strings.Split(model.View(), "\n") {
+		trimmed := strings.TrimRight(line, " ")
+		if !strings.HasPrefix(trimmed, "│") && !strings.HasPrefix(trimmed, "╭") && !strings.HasPrefix(trimmed, "╰") {
+			continue
+		}
+		// The input box uses the same border; only compare the message box,
+		// which is the first and widest
+		width := displayWidth(trimmed)
+		if boxWidth == 0 {
+			boxWidth = width
+		}
+		if width > model.width {
+			t.Errorf("line wider than terminal (%d > %d): %q", width, model.width, trimmed)
+		}
+		if strings.HasPrefix(trimmed, "╰") {
+			break
+		}
+		if width != boxWidth {
+			t.Errorf("misaligned box line (width %d, want %d): %q", width, boxWidth, trimmed)
+		}
+	}
+	if boxWidth == 0 {
+		t.Fatal("message box not found in view")
+	}
+}
+
+// TestWrapTextNeverSplitsWideRunes verifies wrapping counts terminal cells
+func TestWrapTextNeverSplitsWideRunes(t *testing.T) {
+	for _, line := range strings.Split(wrapText("你好世界你好 abc 🚀🚀🚀🚀", 5), "\n") {
+		if displayWidth(line) > 5 {
+			t.Errorf("wrapped line %q is %d cells wide", line, displayWidth(line))
+		}
+	}
+}
+
+// TestFormatMessageTimeUsesMilliseconds verifies the millisecond timestamp is
+// shown when present and plain seconds otherwise
+func TestFormatMessageTimeUsesMilliseconds(t *testing.T) {
+	sent := time.Date(2024, 5, 1, 13, 4, 5, 678*int(time.Millisecond), time.Local)
+	if got := formatMessageTime(ChatMessage{Ts: sent.Unix(), TsMs: sent.UnixMilli()}); got != "13:04:05.678" {
+		t.Errorf("expected 13:04:05.678, got %q", got)
+	}
+	if got := formatMessageTime(ChatMessage{Ts: sent.Unix()}); got != "13:04:05" {
+		t.Errorf("expected 13:04:05 without ts_ms, got %q", got)
+	}
+}
+
+// TestMessagesStayInMillisecondOrder verifies a message that arrives late is
+// placed by its ts_ms rather than appended after newer ones
+func TestMessagesStayInMillisecondOrder(t *testing.T) {
+	model := NewTUIModel("ws://localhost:8080/join", "", "alice")
+	model.insertMessage(ChatMessage{Room: "r", Body: "first", TsMs: 1000})
+	model.insertMessage(ChatMessage{Room: "r", Body: "third", TsMs: 1002})
+	model.insertMessage(ChatMessage{Room: "r", Body: "second", TsMs: 1001})
+	model.insertMessage(ChatMessage{Room: "r", Body: "no ts_ms"})
+
+	var bodies []string
+	for _, chat := range model.messages {
+		bodies = append(bodies, chat.Body)
+	}
+	if got := strings.Join(bodies, ","); got != "first,second,third,no ts_ms" {
+		t.Errorf("unexpected order %q", got)
+	}
+}
+
+// TestErrorToastIsTransient verifies errors show as a toast instead of a
+// notice and that only the latest toast's expiry clears it
+func TestErrorToastIsTransient(t *testing.T) {
+	model := NewTUIModel("ws://localhost:8080/join", "", "alice")
+	model.mode = modeFriends
+	notices := len(model.messages)
+
+	_, cmd := model.Update(friendRequestActionMsg{username: "bob", err: errors.New("boom")})
+	if cmd == nil {
+		t.Fatal("expected a dismiss tick for the toast")
+	}
+	if len(model.messages) != notices {
+		t.Errorf("expected the error to stay out of the notice list, got %+v", model.messages[notices:])
+	}
+	if !strings.Contains(model.View(), "Friend request action failed: boom") {
+		t.Fatal("expected the toast in the view")
+	}
+
+	// A tick that arrives before the expiry (e.g. from an earlier toast) is ignored
+	model.Update(toastExpiredMsg{})
+	if model.toast == "" {
+		t.Fatal("expected the toast to outlive an early tick")
+	}
+	model.toastExpiry = time.Now().Add(-time.Second)
+	model.Update(toastExpiredMsg{})
+	if model.toast != "" || strings.Contains(model.View(), "boom") {
+		t.Error("expected the toast dismissed after it expired")
+	}
+}
+
+// TestAuthPromptLimitsInputLength verifies the signup prompts stop at the
+// server's limits and say so, passwords counted in bytes like the server
+// counts them, while the chat input stays unlimited
+func TestAuthPromptLimitsInputLength(t *testing.T) {
+	t.Setenv("HOME", t.TempDir()) // logging in saves a session
+	model := NewTUIModel("ws://localhost:8080/join", "", "alice")
+	model.startAuthPrompt(authIntentSignup)
+	model.textInput.SetValue("")
+	for i := 0; i < maxUsernameLength+10; i++ {
+		model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'a'}})
+	}
+	if got := len(model.textInput.Value()); got != maxUsernameLength {
+		t.Fatalf("expected the username capped at %d, got %d", maxUsernameLength, got)
+	}
+	if !strings.Contains(model.View(), "characters max") {
+		t.Error("expected a hint once the limit is reached")
+	}
+
+	model.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if model.mode != modeAuthPassword || model.textInput.CharLimit != maxPasswordLength {
+		t.Fatalf("expected the password prompt capped at %d, got mode %v limit %d", maxPasswordLength, model.mode, model.textInput.CharLimit)
+	}
+
+	// Fewer characters than the limit can still be too many bytes
+	for i := 0; i < maxPasswordLength/2+1; i++ {
+		model.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{'é'}})
+	}
+	if !strings.Contains(model.View(), "bytes max") {
+		t.Error("expected a hint once the password reaches the byte limit")
+	}
+	model.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if model.mode != modeAuthPassword || model.loading {
+		t.Fatalf("expected an over-long password kept back, got mode %v loading %v", model.mode, model.loading)
+	}
+	if last := model.messages[len(model.messages)-1]; !strings.Contains(last.Body, "bytes") {
+		t.Fatalf("expected a notice about the byte limit, got %+v", last)
+	}
+
+	model.Update(authResultMsg{token: "token", username: "alice"})
+	if model.textInput.CharLimit != 0 {
+		t.Errorf("expected the limit lifted after login, got %d", model.textInput.CharLimit)
+	}
+}
+
+// TestFriendsViewShowsLastSeen verifies offline friends say how long ago they
+// were around, and online friends or unknown times say nothing
+func TestFriendsViewShowsLastSeen(t *testing.T) {
+	now := time.Now()
+	for elapsed, want := range map[time.Duration]string{
+		10 * time.Second:             "just now",
+		5 * time.Minute:              "5m ago",
+		2*time.Hour + 59*time.Minute: "2h ago",
+		3 * 24 * time.Hour:           "3d ago",
+	} {
+		if got := humanizeSince(now.Add(-elapsed), now); got != want {
+			t.Errorf("%v: expected %q, got %q", elapsed, want, got)
+		}
+	}
+
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws://localhost:8080/join", "", "alice")
+	model.sessionToken = "token"
+	model.mode = modeFriends
+	model.Update(friendsLoadedMsg{friends: []Friend{
+		{Username: "bob", LastSeen: now.Add(-2 * time.Hour)},
+		{Username: "carol", Online: true, LastSeen: now.Add(-time.Hour)},
+		{Username: "dave"},
+	}})
+	view := model.View()
+	if !strings.Contains(view, "bob · last seen 2h ago") {
+		t.Fatalf("expected bob's last seen, got:\n%s", view)
+	}
+	if strings.Count(view, "last seen") != 1 {
+		t.Fatalf("expected only bob to have a last seen, got:\n%s", view)
+	}
+}
+
+// TestActionMessagesRender verifies /me sends an action and it reads as
+// "* alice waves", without the "name:" of ordinary messages
+func TestActionMessagesRender(t *testing.T) {
+	frames := make(chan ChatMessage, 1)
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var chat ChatMessage
+		if err := conn.ReadJSON(&chat); err == nil {
+			frames <- chat
+		}
+	}))
+	defer httpServer.Close()
+
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/join", "lobby", "alice")
+	model.mode = modeChat
+	model.connectCmd()()
+	defer model.closeConnection()
+	model.isConnected = true
+
+	model.textInput.SetValue("/me waves hello")
+	_, cmd := model.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	if cmd == nil {
+		t.Fatal("expected the action to be sent")
+	}
+	cmd()
+	select {
+	case chat := <-frames:
+		if chat.Kind != actionMessageKind || chat.Body != "waves hello" {
+			t.Fatalf("expected an action saying %q, got %+v", "waves hello", chat)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the action never reached the server")
+	}
+
+	now := time.Now().Unix()
+	model.messages = append(model.messages,
+		ChatMessage{ID: "1", Room: "lobby", User: "bob", Kind: actionMessageKind, Body: "waves", Ts: now},
+		ChatMessage{ID: "2", Room: "lobby", User: "bob", Body: "plain words", Ts: now},
+	)
+	view := model.View()
+	if !strings.Contains(view, "* bob waves") || strings.Contains(view, "bob: waves") {
+		t.Fatalf("expected the action as \"* bob waves\", got:\n%s", view)
+	}
+	if !strings.Contains(view, "bob: plain words") {
+		t.Fatalf("expected ordinary messages unchanged, got:\n%s", view)
+	}
+}
+
+// TestChatScrollback verifies the message log fits the terminal, scrolls back
+// with PgUp and only follows new messages while it's showing the latest
+func TestChatScrollback(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws://localhost:8080/join", "lobby", "alice")
+	model.mode = modeChat
+	model.isConnected = true
+	model.textInput.Prompt = "> "
+	model.textInput.Focus()
+	model.Update(tea.WindowSizeMsg{Width: 60, Height: 24})
+	now := time.Now().Unix()
+	add := func(i int) {
+		body := fmt.Sprintf("message %02d", i)
+		model.Update(incomingMsg{ID: body, Room: "lobby", User: "bob", Body: body, Ts: now})
+	}
+	for i := 0; i < 40; i++ {
+		add(i)
+	}
+
+	view := model.View()
+	if lines := strings.Count(view, "\n") + 1; lines > 24 {
+		t.Fatalf("expected the chat screen to fit 24 rows, got %d", lines)
+	}
+	if !strings.Contains(view, "message 39") || strings.Contains(view, "message 00") {
+		t.Fatalf("expected only the latest messages shown, got %q", view)
+	}
+	if !strings.Contains(view, "> ") {
+		t.Fatalf("expected the input box kept on screen, got %q", view)
+	}
+
+	model.Update(tea.KeyMsg{Type: tea.KeyPgUp})
+	add(40)
+	view = model.View()
+	if strings.Contains(view, "message 39") || strings.Contains(view, "message 40") || !strings.Contains(view, "Scrolled back") {
+		t.Fatalf("expected to stay scrolled back as a message arrives, got %q", view)
+	}
+	model.Update(tea.KeyMsg{Type: tea.KeyHome})
+	if view = model.View(); !strings.Contains(view, "message 00") {
+		t.Fatalf("expected Home to reach the oldest message, got %q", view)
+	}
+
+	model.Update(tea.KeyMsg{Type: tea.KeyEnd})
+	add(41)
+	if view = model.View(); !strings.Contains(view, "message 41") {
+		t.Fatalf("expected to follow new messages again after End, got %q", view)
+	}
+}
+
+// TestCodeBlocksRender verifies fenced code keeps its indentation and loses
+// its fences, known languages are tokenized for highlighting, and an
+// unclosed fence is left as text
+func TestCodeBlocksRender(t *testing.T) {
+	model := NewTUIModel("ws://localhost:8080/join", "lobby", "alice")
+	model.mode = modeChat
+	model.width = 80
+	now := time.Now().Unix()
+	model.messages = append(model.messages,
+		ChatMessage{ID: "1", Room: "lobby", User: "bob", Body: "look:\n```go\nfunc main() {\n\treturn \"hi\" // done\n}\n```\nthoughts?", Ts: now},
+		ChatMessage{ID: "2", Room: "lobby", User: "bob", Body: "```brainfuck\n++[>+<-]\n```", Ts: now},
+		ChatMessage{ID: "3", Room: "lobby", User: "bob", Body: "```never closed", Ts: now},
+	)
+	view := model.View()
+	for _, want := range []string{"╭ go", "│ func main() {", "│     return \"hi\" // done", "thoughts?", "╭ brainfuck", "│ ++[>+<-]", "```never closed"} {
+		if !strings.Contains(view, want) {
+			t.Errorf("expected %q in %q", want, view)
+		}
+	}
+	if strings.Contains(view, "```go") {
+		t.Errorf("expected the closed fence hidden, got %q", view)
+	}
+
+	var kinds []string
+	for _, token := range tokenizeCodeLine(codeLanguages["go"], `	return "hi", 42 // done`) {
+		if strings.TrimSpace(token.text) != "" {
+			kinds = append(kinds, fmt.Sprintf("%d:%s", token.kind, strings.TrimSpace(token.text)))
+		}
+	}
+	want := fmt.Sprintf("[%d:return %d:\"hi\" %d:, %d:42 %d:// done]", codeKeyword, codeString, codeText, codeNumber, codeComment)
+	if fmt.Sprint(kinds) != want {
+		t.Errorf("expected tokens %s, got %v", want, kinds)
+	}
+}
+
+// TestLongUsernamesAreTruncated verifies a very long name is cut with an
+// ellipsis in the friends list and chat, while the selected friend keeps
+// the full name
+func TestLongUsernamesAreTruncated(t *testing.T) {
+	long := strings.Repeat("verylongname", 3)[:32]
+	t.Setenv("HOME", t.TempDir())
+	friends := NewTUIModel("ws://localhost:8080/join", "", "alice")
+	short := friends.displayName(long)
+	if short != long[:DefaultNameWidth-1]+"…" || displayWidth(short) != DefaultNameWidth {
+		t.Fatalf("expected %d cells ending in an ellipsis, got %q", DefaultNameWidth, short)
+	}
+
+	friends.sessionToken = "token"
+	friends.mode = modeFriends
+	friends.Update(friendsLoadedMsg{friends: []Friend{{Username: "bob"}, {Username: long}}})
+	view := friends.View()
+	if strings.Contains(view, long) || !strings.Contains(view, short) {
+		t.Fatalf("expected the unselected name truncated, got:\n%s", view)
+	}
+	friends.selectedFriend = 1
+	if view := friends.View(); !strings.Contains(view, long) {
+		t.Fatalf("expected the selected friend's full name, got:\n%s", view)
+	}
+
+	chat := NewTUIModel("ws://localhost:8080/join", "long", "alice")
+	chat.mode = modeChat
+	chat.isConnected = true
+	chat.width = 48
+	chat.nameWidth = 8
+	chat.messages = append(chat.messages, ChatMessage{ID: "1", Room: "long", User: long, Body: "hello there", Ts: time.Now().Unix()})
+	view = chat.View()
+	if !strings.Contains(view, long[:7]+"…: hello there") {
+		t.Fatalf("expected the sender truncated to 8 cells, got:\n%s", view)
+	}
+	for _, line := range strings.Split(view, "\n") {
+		if !strings.HasPrefix(line, "│") {
+			continue
+		}
+		if width := displayWidth(strings.TrimRight(line, " ")); width > chat.width {
+			t.Errorf("line wider than terminal (%d > %d): %q", width, chat.width, line)
+		}
+	}
+}
+
+// TestEscapeSequencesRenderAsText verifies a message laced with terminal
+// escapes is shown literally, in the chat view and in transcripts, instead of
+// clearing the screen or retitling the window
+func TestEscapeSequencesRenderAsText(t *testing.T) {
+	body := "\x1b[2J\x1b[H\x1b]0;pwned\x07hi\x9b31m\rthere"
+	want := "^[[2J^[[H^[]0;pwned^Ghi�31m^Mthere"
+
+	model := NewTUIModel("ws://localhost:8080/join", "inject", "alice")
+	model.mode = modeChat
+	model.isConnected = true
+	model.messages = append(model.messages, ChatMessage{ID: "1", Room: "inject", User: "mallory\x1b[0m", Body: body, Ts: time.Now().Unix()})
+	model.messages = append(model.messages, ChatMessage{ID: "2", Room: "inject", Type: systemMessageType, User: "system", Body: "file \x1b[8mhidden", Ts: time.Now().Unix()})
+	view := model.View()
+	for _, raw := range []string{"\x1b[2J", "\x1b]0;", "\x07", "\x9b", "\r", "\x1b[8m"} {
+		if strings.Contains(view, raw) {
+			t.Errorf("view contains raw control sequence %q", raw)
+		}
+	}
+	for _, literal := range []string{"mallory^[[0m: " + want, "file ^[[8mhidden"} {
+		if !strings.Contains(view, literal) {
+			t.Errorf("expected %q in view, got:\n%s", literal, view)
+		}
+	}
+
+	var out strings.Builder
+	newTranscriptWriter(&out).write("inject", ChatMessage{User: "mallory", Body: body})
+	if strings.Contains(out.String(), "\x1b[2J") || !strings.Contains(out.String(), want) {
+		t.Errorf("expected the transcript to escape the body, got %q", out.String())
+	}
+}
+
+// TestViewsFollowTerminalWidth verifies the chat boxes span the terminal after
+// a resize, and that no screen runs past the edge of a narrow terminal
+func TestViewsFollowTerminalWidth(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws://localhost:8080/join", "resize", "alice")
+	model.sessionToken = "token"
+	model.isConnected = true
+	model.Update(friendsLoadedMsg{friends: []Friend{{Username: "bob"}, {Username: "carol", Online: true}}})
+	model.incomingReqs = []string{"dave"}
+	model.messages = append(model.messages, ChatMessage{ID: "1", Room: "resize", User: "bob", Body: strings.Repeat("a long line that has to wrap ", 8), Ts: time.Now().Unix()})
+
+	widest := func(view string) int {
+		widest := 0
+		for _, line := range strings.Split(view, "\n") {
+			widest = max(widest, displayWidth(strings.TrimRight(line, " ")))
+		}
+		return widest
+	}
+
+	model.Update(tea.WindowSizeMsg{Width: 120, Height: 40})
+	model.mode = modeChat
+	edges := 0
+	for _, line := range strings.Split(model.View(), "\n") {
+		if strings.HasPrefix(line, "╭") || strings.HasPrefix(line, "╰") {
+			edges++
+			if width := displayWidth(line); width != 120 {
+				t.Errorf("expected boxes to span 120 columns, got %d: %q", width, line)
+			}
+		}
+	}
+	if edges != 4 {
+		t.Fatalf("expected the message and input boxes, found %d box edges", edges)
+	}
+
+	model.Update(tea.WindowSizeMsg{Width: 40, Height: 40})
+	for _, mode := range []appMode{modeChat, modeFriends, modeRequestsIncoming, modeAddFriend} {
+		model.mode = mode
+		model.textInput.SetValue(strings.Repeat("x", 60))
+		if width := widest(model.View()); width > 40 {
+			t.Errorf("mode %v: view is %d columns wide on a 40 column terminal:\n%s", mode, width, model.View())
+		}
+	}
+
+	// the chat header is cut short rather than wrapped, losing the relay first
+	model.Update(tea.WindowSizeMsg{Width: 50, Height: 40})
+	model.mode = modeChat
+	model.relayName = "fly-iad.internal.example.com"
+	lines := strings.Split(model.View(), "\n")
+	if header := strings.TrimSpace(lines[0]); header != "TermChat ┃ Room resize ┃ User alice ┃ relay: fl…" {
+		t.Errorf("expected the header cut short with an ellipsis, got %q", header)
+	}
+	if !strings.HasPrefix(lines[1], "─") {
+		t.Errorf("expected the header on one line, got %q then %q", lines[0], lines[1])
+	}
+}
+
+// TestUsernamesCantSpoofLines verifies a name carrying a line break or escape
+// sequence stays on its own line, escaped, wherever names are shown
+func TestUsernamesCantSpoofLines(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	spoof := "mallory\n[09:00:00] alice\x1b[0m"
+	model := NewTUIModel("ws://localhost:8080/join", "spoof", "carol")
+	model.nameWidth = 40
+	model.sessionToken = "token"
+	model.isConnected = true
+	model.roomMembers = []string{spoof}
+	model.messages = append(model.messages, ChatMessage{ID: "1", Room: "spoof", User: spoof, Body: "send me the keys", Ts: time.Now().Unix()})
+	model.Update(friendsLoadedMsg{friends: []Friend{{Username: spoof}, {Username: "bob"}}})
+
+	check := func(view string, want ...string) {
+		t.Helper()
+		for _, line := range strings.Split(view, "\n") {
+			if strings.HasPrefix(strings.Trim(line, "│ "), "[09:00:00] alice") {
+				t.Errorf("name spoofed a line of its own: %q", line)
+			}
+		}
+		if strings.Contains(view, "\x1b[0m") {
+			t.Errorf("view contains the raw escape sequence")
+		}
+		for _, literal := range want {
+			if !strings.Contains(view, literal) {
+				t.Errorf("expected %q in view, got:\n%s", literal, view)
+			}
+		}
+	}
+	model.mode = modeChat
+	check(model.View(), "mallory^J[09:00:00] alice^[[0m: send me the keys")
+	model.mode = modeFriends
+	check(model.View(), "➤ "+presenceDot(false)+" mallory^J[09:00:00] alice^[[0m")
+	model.selectedFriend = 1
+	check(model.View(), "mallory^J[09:00:00]")
+}
@@ -7,10 +7,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -27,24 +30,74 @@ type UploadedFile struct {
 	SHA256      string    // File hash for integrity
 }
 
+// roomFileInfo is one entry in a room's file listing
+type roomFileInfo struct {
+	ID           string `json:"id"`
+	Filename     string `json:"filename"`
+	SizeBytes    int64  `json:"size"`
+	UploadedBy   string `json:"uploaded_by"`
+	UploadedAt   int64  `json:"uploaded_at"`
+	SHA256       string `json:"sha256"`
+	DownloadPath string `json:"download_path"`
+}
+
+type roomFilesResponse struct {
+	Files []roomFileInfo `json:"files"`
+}
+
 // FileUploadHandler manages file upload/download operations
 type FileUploadHandler struct {
 	hub         *Hub
 	uploadDir   string // Base directory for uploads (e.g., /data/uploads)
 	maxFileSize int64  // Maximum file size in bytes
+	// Maximum bytes of files one room may hold; zero means no limit
+	maxRoomBytes int64
+	// How long announcing an upload or deletion may wait on a swamped room
+	// before the announcement is dropped; the file is kept either way
+	broadcastTimeout time.Duration
+
+	// roomAccess reports whether a user may share files in a room; nil lets
+	// everyone in, for handlers used without a server
+	roomAccess func(r *http.Request, roomKey string, authCtx *AuthContext) (bool, error)
+
+	uploadsMutex sync.Mutex             // guards uploadLocks
+	uploadLocks  map[string]*uploadLock // per resumable upload, see lockUpload
 }
 
 // NewFileUploadHandler creates a new file upload handler
 func NewFileUploadHandler(hub *Hub, uploadDir string, maxFileSize int64) *FileUploadHandler {
 	return &FileUploadHandler{
-		hub:         hub,
-		uploadDir:   uploadDir,
-		maxFileSize: maxFileSize,
+		hub:              hub,
+		uploadDir:        uploadDir,
+		maxFileSize:      maxFileSize,
+		broadcastTimeout: defaultFileBroadcastTimeout,
+	}
+}
+
+// defaultFileBroadcastTimeout bounds how long a file upload or deletion
+// waits to be announced before answering anyway
+const defaultFileBroadcastTimeout = time.Second
+
+// checkRoomAccess writes a 403 and reports false if user may not share files
+// in roomKey
+func (h *FileUploadHandler) checkRoomAccess(w http.ResponseWriter, r *http.Request, roomKey string, user *AuthContext) bool {
+	if h.roomAccess == nil {
+		return true
+	}
+	allowed, err := h.roomAccess(r, roomKey, user)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return false
 	}
+	if !allowed {
+		writeError(w, http.StatusForbidden, errors.New("you don't have access to this room"))
+		return false
+	}
+	return true
 }
 
-// HandleUpload processes multipart file uploads
-func (h *FileUploadHandler) HandleUpload(w http.ResponseWriter, r *http.Request) {
+// HandleUpload processes a multipart file upload by uploader
+func (h *FileUploadHandler) HandleUpload(w http.ResponseWriter, r *http.Request, uploader *AuthContext) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w, http.MethodPost)
 		return
@@ -69,6 +122,9 @@ func (h *FileUploadHandler) HandleUpload(w http.ResponseWriter, r *http.Request)
 		writeError(w, http.StatusNotFound, errors.New("room not found"))
 		return
 	}
+	if !h.checkRoomAccess(w, r, roomKey, uploader) {
+		return
+	}
 
 	// Get uploaded file
 	file, header, err := r.FormFile("file")
@@ -90,12 +146,12 @@ func (h *FileUploadHandler) HandleUpload(w http.ResponseWriter, r *http.Request)
 		writeError(w, http.StatusRequestEntityTooLarge, errors.New("file too large"))
 		return
 	}
-
-	// Get username from context (assuming authentication middleware sets this)
-	username := r.FormValue("username")
-	if username == "" {
-		username = "anonymous"
+	release, err := h.reserveRoomQuota(roomKey, header.Size)
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
 	}
+	defer release()
 
 	// Generate unique file ID and storage path
 	fileID := uuid.NewString()
@@ -131,7 +187,7 @@ func (h *FileUploadHandler) HandleUpload(w http.ResponseWriter, r *http.Request)
 		ID:          fileID,
 		Filename:    filename,
 		SizeBytes:   written,
-		UploadedBy:  username,
+		UploadedBy:  uploader.Username,
 		StoragePath: filepath.Join(sanitizePathComponent(roomKey), fmt.Sprintf("%s-%s", fileID, filename)),
 		UploadedAt:  time.Now(),
 		SHA256:      hex.EncodeToString(hasher.Sum(nil)),
@@ -145,27 +201,85 @@ func (h *FileUploadHandler) HandleUpload(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	room.addFile(uploadedFile)
+	h.hub.recordFile(r.Context(), roomKey, uploadedFile)
 
 	// Broadcast file upload event to room
+	h.broadcastUpload(room, roomKey, uploadedFile)
+
+	// Return success response
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"file_id":       fileID,
+		"filename":      filename,
+		"size":          written,
+		"status":        "uploaded",
+		"download_path": fileDownloadPath(fileID, roomKey),
+	})
+}
+
+// checkRoomQuota refuses a file of size bytes that would take the room past
+// its storage quota. It only looks; reserveRoomQuota is what holds the space.
+func (h *FileUploadHandler) checkRoomQuota(roomKey string, size int64) error {
+	if h.maxRoomBytes <= 0 {
+		return nil
+	}
+	room := h.hub.getRoom(roomKey)
+	if room == nil {
+		return nil
+	}
+	if used := room.filesSize(); used+size > h.maxRoomBytes {
+		return h.roomFullError(used, size)
+	}
+	return nil
+}
+
+// reserveRoomQuota sets size bytes of the room's quota aside while a file is
+// saved, so uploads running at once can't all fit in the same space. The
+// returned release gives it back and must be called once the file has been
+// added to the room or given up on.
+func (h *FileUploadHandler) reserveRoomQuota(roomKey string, size int64) (func(), error) {
+	if h.maxRoomBytes <= 0 {
+		return func() {}, nil
+	}
+	room := h.hub.getRoom(roomKey)
+	if room == nil {
+		return func() {}, nil
+	}
+	if used, ok := room.reserveFileSpace(size, h.maxRoomBytes); !ok {
+		return nil, h.roomFullError(used, size)
+	}
+	return func() { room.releaseFileSpace(size) }, nil
+}
+
+func (h *FileUploadHandler) roomFullError(used, size int64) error {
+	return fmt.Errorf("room storage is full: %s of %s used, this file needs %s",
+		formatFileSize(used), formatFileSize(h.maxRoomBytes), formatFileSize(size))
+}
+
+// broadcastUpload announces a newly registered file to everyone in the room
+func (h *FileUploadHandler) broadcastUpload(room *Room, roomKey string, file UploadedFile) {
 	fileMsg := FileUploadMessage{
-		Type:       "file_uploaded",
-		FileID:     fileID,
-		Filename:   filename,
-		SizeBytes:  written,
-		UploadedBy: username,
-		UploadedAt: uploadedFile.UploadedAt.Unix(),
+		Type:         "file_uploaded",
+		FileID:       file.ID,
+		Filename:     file.Filename,
+		SizeBytes:    file.SizeBytes,
+		UploadedBy:   file.UploadedBy,
+		UploadedAt:   file.UploadedAt.Unix(),
+		DownloadPath: fileDownloadPath(file.ID, roomKey),
 	}
+	// Uploads take reactions like messages do, keyed by file ID
+	room.trackFile(file.ID)
 	if encoded, err := marshalJSON(fileMsg); err == nil {
-		room.broadcast <- encoded
+		h.announce(room, encoded)
 	}
+}
 
-	// Return success response
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"file_id":  fileID,
-		"filename": filename,
-		"size":     written,
-		"status":   "uploaded",
-	})
+// announce queues a file event for the room without holding up the request
+// behind a room that isn't keeping up. Clients that miss it still see the
+// file listed for the room.
+func (h *FileUploadHandler) announce(room *Room, payload []byte) {
+	if !room.publishWithin(payload, h.broadcastTimeout) {
+		log.Printf("room %s: dropped a file announcement, the room isn't keeping up", room.key)
+	}
 }
 
 // HandleDownload serves file downloads
@@ -175,13 +289,11 @@ func (h *FileUploadHandler) HandleDownload(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Extract file ID from URL path (e.g., /api/files/{fileId})
-	pathParts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/files/"), "/")
-	if len(pathParts) == 0 || pathParts[0] == "" {
+	fileID := fileIDFromPath(r)
+	if fileID == "" {
 		http.Error(w, "file ID required", http.StatusBadRequest)
 		return
 	}
-	fileID := pathParts[0]
 
 	// Get room key from query params
 	roomKey := r.URL.Query().Get("room")
@@ -203,12 +315,8 @@ func (h *FileUploadHandler) HandleDownload(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Construct full file path
-	filePath := filepath.Join(h.uploadDir, fileInfo.StoragePath)
-
-	// Security check: ensure path is within upload directory
-	absPath, err := filepath.Abs(filePath)
-	if err != nil || !strings.HasPrefix(absPath, filepath.Clean(h.uploadDir)) {
+	filePath, ok := h.storedFilePath(fileInfo)
+	if !ok {
 		http.Error(w, "invalid file path", http.StatusForbidden)
 		return
 	}
@@ -241,6 +349,111 @@ func (h *FileUploadHandler) HandleDownload(w http.ResponseWriter, r *http.Reques
 	http.ServeContent(w, r, fileInfo.Filename, fileInfo.UploadedAt, file)
 }
 
+// HandleDeleteFile removes a file its uploader posted by mistake and tells the
+// room. The caller must already be authenticated as username.
+func (h *FileUploadHandler) HandleDeleteFile(w http.ResponseWriter, r *http.Request, username string) {
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodDelete)
+		return
+	}
+	fileID := fileIDFromPath(r)
+	if fileID == "" {
+		http.Error(w, "file ID required", http.StatusBadRequest)
+		return
+	}
+	roomKey := r.URL.Query().Get("room")
+	if roomKey == "" {
+		writeError(w, http.StatusBadRequest, errors.New("room parameter required"))
+		return
+	}
+	room := h.hub.getRoom(roomKey)
+	if room == nil {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+	fileInfo := room.getFile(fileID)
+	if fileInfo == nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	if fileInfo.UploadedBy != username {
+		http.Error(w, "you can only delete files you uploaded", http.StatusForbidden)
+		return
+	}
+	filePath, ok := h.storedFilePath(fileInfo)
+	if !ok {
+		http.Error(w, "invalid file path", http.StatusForbidden)
+		return
+	}
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	filename := fileInfo.Filename
+	if room.removeFile(fileID) {
+		room.forgetMessage(fileID)
+		h.hub.forgetFile(r.Context(), roomKey, fileID)
+		if encoded, err := marshalJSON(FileDeletedMessage{Type: "file_deleted", FileID: fileID, Filename: filename, DeletedBy: username}); err == nil {
+			h.announce(room, encoded)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"file_id": fileID, "status": "deleted"})
+}
+
+// fileIDFromPath extracts the file ID from /api/files/{fileId}
+func fileIDFromPath(r *http.Request) string {
+	return strings.Split(strings.TrimPrefix(r.URL.Path, "/api/files/"), "/")[0]
+}
+
+// storedFilePath returns where a file lives on disk, refusing any storage
+// path that would escape the upload directory
+func (h *FileUploadHandler) storedFilePath(file *UploadedFile) (string, bool) {
+	filePath := filepath.Join(h.uploadDir, file.StoragePath)
+	absPath, err := filepath.Abs(filePath)
+	if err != nil || !strings.HasPrefix(absPath, filepath.Clean(h.uploadDir)) {
+		return "", false
+	}
+	return filePath, true
+}
+
+// HandleListFiles serves GET /api/files?room=KEY with the files uploaded to a
+// live room, oldest first, so clients can see what was shared before they joined
+func (h *FileUploadHandler) HandleListFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	roomKey := r.URL.Query().Get("room")
+	if roomKey == "" {
+		writeError(w, http.StatusBadRequest, errors.New("room parameter required"))
+		return
+	}
+	room := h.hub.getRoom(roomKey)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errors.New("room not found"))
+		return
+	}
+	files := room.listFiles()
+	resp := roomFilesResponse{Files: make([]roomFileInfo, 0, len(files))}
+	for _, file := range files {
+		resp.Files = append(resp.Files, roomFileInfo{
+			ID:           file.ID,
+			Filename:     file.Filename,
+			SizeBytes:    file.SizeBytes,
+			UploadedBy:   file.UploadedBy,
+			UploadedAt:   file.UploadedAt.Unix(),
+			SHA256:       file.SHA256,
+			DownloadPath: fileDownloadPath(file.ID, roomKey),
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// fileDownloadPath builds the relative URL clients use to fetch a room file
+func fileDownloadPath(fileID, roomKey string) string {
+	return fmt.Sprintf("/api/files/%s?room=%s", url.PathEscape(fileID), url.QueryEscape(roomKey))
+}
+
 // sanitizePathComponent removes dangerous characters from path components
 func sanitizePathComponent(s string) string {
 	// Remove any path separators and null bytes
@@ -0,0 +1,412 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// partialUploadDir holds in-progress resumable uploads under the upload base dir
+const partialUploadDir = ".partial"
+
+// uploadSessionTTL is how long a resumable upload may go without a chunk
+// before it's abandoned and its partial file deleted
+const uploadSessionTTL = 24 * time.Hour
+
+// uploadSession is the on-disk state of a resumable upload, keyed by upload ID
+type uploadSession struct {
+	ID         string    `json:"id"`
+	RoomKey    string    `json:"room_key"`
+	Filename   string    `json:"filename"`
+	SizeBytes  int64     `json:"size_bytes"`
+	SHA256     string    `json:"sha256"`
+	UploadedBy string    `json:"uploaded_by"`
+	UploaderID int64     `json:"uploader_id"` // only they may add chunks or finalize
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type createUploadRequest struct {
+	RoomKey   string `json:"room_key"`
+	Filename  string `json:"filename"`
+	SizeBytes int64  `json:"size_bytes"`
+	SHA256    string `json:"sha256"`
+	// Username is ignored; the uploader is whoever the session token names.
+	// It's still accepted so older clients' requests decode.
+	Username string `json:"username,omitempty"`
+}
+
+// uploadLock serializes requests for one resumable upload. refs counts the
+// requests holding or waiting for it, guarded by uploadsMutex.
+type uploadLock struct {
+	mutex sync.Mutex
+	refs  int
+}
+
+// lockUpload takes the lock for one upload, so a slow chunk only holds up
+// later requests for the same upload. Call the returned func to release it.
+func (h *FileUploadHandler) lockUpload(uploadID string) func() {
+	h.uploadsMutex.Lock()
+	if h.uploadLocks == nil {
+		h.uploadLocks = make(map[string]*uploadLock)
+	}
+	lock := h.uploadLocks[uploadID]
+	if lock == nil {
+		lock = &uploadLock{}
+		h.uploadLocks[uploadID] = lock
+	}
+	lock.refs++
+	h.uploadsMutex.Unlock()
+
+	lock.mutex.Lock()
+	return func() {
+		lock.mutex.Unlock()
+		h.uploadsMutex.Lock()
+		defer h.uploadsMutex.Unlock()
+		if lock.refs--; lock.refs == 0 {
+			delete(h.uploadLocks, uploadID)
+		}
+	}
+}
+
+type uploadOffsetResponse struct {
+	UploadID string `json:"upload_id"`
+	Offset   int64  `json:"offset"`
+}
+
+// HandleCreateUpload starts a resumable upload by uploader and returns its
+// upload ID
+func (h *FileUploadHandler) HandleCreateUpload(w http.ResponseWriter, r *http.Request, uploader *AuthContext) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req createUploadRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.RoomKey == "" {
+		writeError(w, http.StatusBadRequest, errors.New("room_key required"))
+		return
+	}
+	if !h.hub.Exists(req.RoomKey) {
+		writeError(w, http.StatusNotFound, errors.New("room not found"))
+		return
+	}
+	if !h.checkRoomAccess(w, r, req.RoomKey, uploader) {
+		return
+	}
+	filename := filepath.Base(req.Filename)
+	if filename == "" || filename == "." || filename == ".." {
+		writeError(w, http.StatusBadRequest, errors.New("invalid filename"))
+		return
+	}
+	if req.SizeBytes < 0 || req.SizeBytes > h.maxFileSize {
+		writeError(w, http.StatusRequestEntityTooLarge, errors.New("file too large"))
+		return
+	}
+	if err := h.checkRoomQuota(req.RoomKey, req.SizeBytes); err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if _, err := hex.DecodeString(req.SHA256); err != nil || len(req.SHA256) != sha256.Size*2 {
+		writeError(w, http.StatusBadRequest, errors.New("sha256 must be a hex digest"))
+		return
+	}
+
+	session := uploadSession{
+		ID:         uuid.NewString(),
+		RoomKey:    req.RoomKey,
+		Filename:   filename,
+		SizeBytes:  req.SizeBytes,
+		SHA256:     strings.ToLower(req.SHA256),
+		UploadedBy: uploader.Username,
+		UploaderID: uploader.UserID,
+		CreatedAt:  time.Now(),
+	}
+	if err := os.MkdirAll(filepath.Join(h.uploadDir, partialUploadDir), 0755); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to create upload directory: %w", err))
+		return
+	}
+	if err := os.WriteFile(h.partialDataPath(session.ID), nil, 0644); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to create file: %w", err))
+		return
+	}
+	if err := h.saveUploadSession(session); err != nil {
+		os.Remove(h.partialDataPath(session.ID))
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, uploadOffsetResponse{UploadID: session.ID, Offset: 0})
+}
+
+// HandleUploadChunk appends a chunk at ?offset=N. A mismatched offset returns
+// 409 with the server's current offset so the client can resume from there.
+func (h *FileUploadHandler) HandleUploadChunk(w http.ResponseWriter, r *http.Request, uploader *AuthContext) {
+	if r.Method != http.MethodPut {
+		methodNotAllowed(w, http.MethodPut)
+		return
+	}
+
+	uploadID := strings.TrimPrefix(r.URL.Path, "/api/uploads/")
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("offset parameter required"))
+		return
+	}
+
+	defer h.lockUpload(uploadID)()
+
+	session, err := h.loadUploadSession(uploadID, uploader)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errors.New("upload not found"))
+		return
+	}
+	// Access is checked again on every chunk in case the uploader has been
+	// banned from the room since starting
+	if !h.checkRoomAccess(w, r, session.RoomKey, uploader) {
+		return
+	}
+	dataPath := h.partialDataPath(session.ID)
+	stat, err := os.Stat(dataPath)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errors.New("upload not found"))
+		return
+	}
+	if offset != stat.Size() {
+		writeJSON(w, http.StatusConflict, uploadOffsetResponse{UploadID: session.ID, Offset: stat.Size()})
+		return
+	}
+
+	remaining := session.SizeBytes - offset
+	r.Body = http.MaxBytesReader(w, r.Body, remaining)
+	dataFile, err := os.OpenFile(dataPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	written, copyErr := io.Copy(dataFile, r.Body)
+	closeErr := dataFile.Close()
+	if copyErr != nil || closeErr != nil {
+		// Drop whatever part of the chunk landed so the acked offset stays valid
+		_ = os.Truncate(dataPath, offset)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(copyErr, &maxBytesErr) {
+			writeError(w, http.StatusRequestEntityTooLarge, errors.New("chunk exceeds declared file size"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, errors.New("failed to save chunk"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, uploadOffsetResponse{UploadID: session.ID, Offset: offset + written})
+}
+
+// HandleFinalizeUpload verifies size and SHA-256, then registers the file with
+// the room exactly like a single-shot upload
+func (h *FileUploadHandler) HandleFinalizeUpload(w http.ResponseWriter, r *http.Request, uploader *AuthContext) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	uploadID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/uploads/"), "/finalize")
+
+	defer h.lockUpload(uploadID)()
+
+	session, err := h.loadUploadSession(uploadID, uploader)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errors.New("upload not found"))
+		return
+	}
+	if !h.checkRoomAccess(w, r, session.RoomKey, uploader) {
+		return
+	}
+	dataPath := h.partialDataPath(session.ID)
+	dataFile, err := os.Open(dataPath)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errors.New("upload not found"))
+		return
+	}
+	hasher := sha256.New()
+	written, err := io.Copy(hasher, dataFile)
+	dataFile.Close()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if written != session.SizeBytes {
+		writeJSON(w, http.StatusConflict, uploadOffsetResponse{UploadID: session.ID, Offset: written})
+		return
+	}
+	if hex.EncodeToString(hasher.Sum(nil)) != session.SHA256 {
+		h.discardUploadSession(session.ID)
+		writeError(w, http.StatusUnprocessableEntity, errors.New("checksum mismatch"))
+		return
+	}
+
+	// The upload is kept while nobody's in the room, so it can be finalized
+	// once someone is again
+	room := h.hub.getRoom(session.RoomKey)
+	if room == nil {
+		writeError(w, http.StatusNotFound, errors.New("room no longer exists"))
+		return
+	}
+	// Other uploads may have filled the room since this one started
+	release, err := h.reserveRoomQuota(session.RoomKey, written)
+	if err != nil {
+		h.discardUploadSession(session.ID)
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	defer release()
+
+	roomDir := filepath.Join(h.uploadDir, sanitizePathComponent(session.RoomKey))
+	if err := os.MkdirAll(roomDir, 0755); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to create upload directory: %w", err))
+		return
+	}
+	fileID := uuid.NewString()
+	storageName := fmt.Sprintf("%s-%s", fileID, session.Filename)
+	if err := os.Rename(dataPath, filepath.Join(roomDir, storageName)); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to save file: %w", err))
+		return
+	}
+	h.discardUploadSession(session.ID)
+
+	uploadedFile := UploadedFile{
+		ID:          fileID,
+		Filename:    session.Filename,
+		SizeBytes:   written,
+		UploadedBy:  session.UploadedBy,
+		StoragePath: filepath.Join(sanitizePathComponent(session.RoomKey), storageName),
+		UploadedAt:  time.Now(),
+		SHA256:      session.SHA256,
+	}
+	room.addFile(uploadedFile)
+	h.hub.recordFile(r.Context(), session.RoomKey, uploadedFile)
+	h.broadcastUpload(room, session.RoomKey, uploadedFile)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"file_id":       fileID,
+		"filename":      session.Filename,
+		"size":          written,
+		"status":        "uploaded",
+		"download_path": fileDownloadPath(fileID, session.RoomKey),
+	})
+}
+
+func (h *FileUploadHandler) partialDataPath(uploadID string) string {
+	return filepath.Join(h.uploadDir, partialUploadDir, uploadID+".part")
+}
+
+func (h *FileUploadHandler) partialMetaPath(uploadID string) string {
+	return filepath.Join(h.uploadDir, partialUploadDir, uploadID+".json")
+}
+
+func (h *FileUploadHandler) saveUploadSession(session uploadSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(h.partialMetaPath(session.ID), data, 0644)
+}
+
+// errNotUploader hides someone else's upload as if it didn't exist
+var errNotUploader = errors.New("upload belongs to someone else")
+
+// loadUploadSession reads upload state from disk for the user who started
+// it. IDs must be UUIDs so they can't be used to escape the partial upload
+// directory.
+func (h *FileUploadHandler) loadUploadSession(uploadID string, uploader *AuthContext) (*uploadSession, error) {
+	session, err := h.readUploadSession(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if session.UploaderID != uploader.UserID {
+		return nil, errNotUploader
+	}
+	return session, nil
+}
+
+func (h *FileUploadHandler) readUploadSession(uploadID string) (*uploadSession, error) {
+	if _, err := uuid.Parse(uploadID); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(h.partialMetaPath(uploadID))
+	if err != nil {
+		return nil, err
+	}
+	var session uploadSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (h *FileUploadHandler) discardUploadSession(uploadID string) {
+	_ = os.Remove(h.partialDataPath(uploadID))
+	_ = os.Remove(h.partialMetaPath(uploadID))
+}
+
+// expireUploads deletes resumable uploads that haven't had a chunk for
+// uploadSessionTTL, along with partial files whose session is gone. It
+// returns how many uploads went.
+func (h *FileUploadHandler) expireUploads(now time.Time) int {
+	entries, err := os.ReadDir(filepath.Join(h.uploadDir, partialUploadDir))
+	if err != nil {
+		return 0
+	}
+	expired := 0
+	for _, entry := range entries {
+		uploadID, ok := strings.CutSuffix(entry.Name(), ".part")
+		if !ok {
+			uploadID, ok = strings.CutSuffix(entry.Name(), ".json")
+		}
+		if !ok {
+			continue
+		}
+		if h.expireUpload(uploadID, now) {
+			expired++
+		}
+	}
+	return expired
+}
+
+// expireUpload discards one upload if it has gone quiet. Its data and session
+// file are both listed, so an upload already discarded is skipped.
+func (h *FileUploadHandler) expireUpload(uploadID string, now time.Time) bool {
+	defer h.lockUpload(uploadID)()
+	lastActive := time.Time{}
+	if session, err := h.readUploadSession(uploadID); err == nil {
+		lastActive = session.CreatedAt
+	} else if !os.IsNotExist(err) {
+		return false
+	}
+	info, err := os.Stat(h.partialDataPath(uploadID))
+	if err == nil && info.ModTime().After(lastActive) {
+		lastActive = info.ModTime()
+	}
+	if lastActive.IsZero() && os.IsNotExist(err) {
+		return false // already gone
+	}
+	if now.Sub(lastActive) < uploadSessionTTL {
+		return false
+	}
+	h.discardUploadSession(uploadID)
+	return true
+}
@@ -0,0 +1,374 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestResumableUploadFlow verifies chunks can be resent from the server's
+// acknowledged offset and the finalized file lands in the room
+func TestResumableUploadFlow(t *testing.T) {
+	tmpDir := t.TempDir()
+	hub := NewHub()
+	handler := NewFileUploadHandler(hub, tmpDir, 10*1024*1024)
+	room := hub.getOrCreateRoom("testroom")
+
+	content := []byte("first half|second half")
+	uploadID := createTestUpload(t, handler, "testroom", "notes.txt", content)
+
+	// First chunk lands
+	rec := putTestChunk(handler, uploadID, 0, content[:11])
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected chunk accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// A retry of the wrong offset is told where to resume
+	rec = putTestChunk(handler, uploadID, 0, content[:11])
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for stale offset, got %d", rec.Code)
+	}
+	var resp uploadOffsetResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Offset != 11 {
+		t.Fatalf("expected resume offset 11, got %+v (err=%v)", resp, err)
+	}
+
+	rec = putTestChunk(handler, uploadID, 11, content[11:])
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected second chunk accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/uploads/"+uploadID+"/finalize", nil)
+	rec = httptest.NewRecorder()
+	handler.HandleFinalizeUpload(rec, req, testUploader)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected finalize OK, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if len(room.files) != 1 {
+		t.Fatalf("expected 1 file in room, got %d", len(room.files))
+	}
+	saved, err := os.ReadFile(filepath.Join(tmpDir, room.files[0].StoragePath))
+	if err != nil {
+		t.Fatalf("read finalized file: %v", err)
+	}
+	if !bytes.Equal(saved, content) {
+		t.Errorf("expected %q on disk, got %q", content, saved)
+	}
+	if _, err := os.Stat(handler.partialMetaPath(uploadID)); !os.IsNotExist(err) {
+		t.Error("expected partial upload state to be removed after finalize")
+	}
+}
+
+// TestResumableUploadChecksumMismatch verifies corrupted uploads are rejected
+func TestResumableUploadChecksumMismatch(t *testing.T) {
+	tmpDir := t.TempDir()
+	hub := NewHub()
+	handler := NewFileUploadHandler(hub, tmpDir, 10*1024*1024)
+	room := hub.getOrCreateRoom("testroom")
+
+	uploadID := createTestUpload(t, handler, "testroom", "notes.txt", []byte("expected"))
+	if rec := putTestChunk(handler, uploadID, 0, []byte("tampered")); rec.Code != http.StatusOK {
+		t.Fatalf("expected chunk accepted, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/uploads/"+uploadID+"/finalize", nil)
+	rec := httptest.NewRecorder()
+	handler.HandleFinalizeUpload(rec, req, testUploader)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422 for checksum mismatch, got %d", rec.Code)
+	}
+	if len(room.files) != 0 {
+		t.Errorf("expected no files registered, got %d", len(room.files))
+	}
+}
+
+// TestClientResumesInterruptedUpload verifies apiResumableUpload continues
+// from the server's offset instead of starting over
+func TestClientResumesInterruptedUpload(t *testing.T) {
+	tmpDir := t.TempDir()
+	hub := NewHub()
+	handler := NewFileUploadHandler(hub, filepath.Join(tmpDir, "uploads"), 10*1024*1024)
+	room := hub.getOrCreateRoom("testroom")
+
+	content := bytes.Repeat([]byte("x"), uploadChunkSize+100)
+	localPath := filepath.Join(tmpDir, "big.bin")
+	if err := os.WriteFile(localPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate an earlier attempt that got the first chunk through
+	uploadID := createTestUpload(t, handler, "testroom", "big.bin", content)
+	if rec := putTestChunk(handler, uploadID, 0, content[:uploadChunkSize]); rec.Code != http.StatusOK {
+		t.Fatalf("expected chunk accepted, got %d", rec.Code)
+	}
+
+	var resentFromZero bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/uploads/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/finalize") {
+			handler.HandleFinalizeUpload(w, r, testUploader)
+			return
+		}
+		if r.ContentLength > 0 && r.URL.Query().Get("offset") == "0" {
+			resentFromZero = true
+		}
+		handler.HandleUploadChunk(w, r, testUploader)
+	})
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	fileID, pendingID, err := apiResumableUpload(httpServer.URL, "token", localPath, "testroom", uploadID, nil)
+	if err != nil {
+		t.Fatalf("apiResumableUpload: %v", err)
+	}
+	if fileID == "" || pendingID != "" {
+		t.Fatalf("expected completed upload, got fileID=%q pending=%q", fileID, pendingID)
+	}
+	if resentFromZero {
+		t.Error("expected upload to resume instead of resending the first chunk")
+	}
+	if len(room.files) != 1 || room.files[0].SizeBytes != int64(len(content)) {
+		t.Fatalf("unexpected room files: %+v", room.files)
+	}
+}
+
+// TestUploadAfterSwitchingRoomsStartsAfresh verifies an upload interrupted in
+// one room isn't resumed when the same file is sent to another, which would
+// publish it in the first room instead
+func TestUploadAfterSwitchingRoomsStartsAfresh(t *testing.T) {
+	tmpDir := t.TempDir()
+	hub := NewHub()
+	handler := NewFileUploadHandler(hub, filepath.Join(tmpDir, "uploads"), 10*1024*1024)
+	first := hub.getOrCreateRoom("first")
+	second := hub.getOrCreateRoom("second")
+
+	content := []byte("half of it|the rest")
+	localPath := filepath.Join(tmpDir, "notes.txt")
+	if err := os.WriteFile(localPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	uploadID := createTestUpload(t, handler, "first", "notes.txt", content)
+	if rec := putTestChunk(handler, uploadID, 0, content[:10]); rec.Code != http.StatusOK {
+		t.Fatalf("chunk: %d %s", rec.Code, rec.Body.String())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/uploads", func(w http.ResponseWriter, r *http.Request) {
+		handler.HandleCreateUpload(w, r, testUploader)
+	})
+	mux.HandleFunc("/api/uploads/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/finalize") {
+			handler.HandleFinalizeUpload(w, r, testUploader)
+			return
+		}
+		handler.HandleUploadChunk(w, r, testUploader)
+	})
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/join", "first", "alice")
+	model.sessionToken = "token"
+	model.mode = modeChat
+	model.Update(fileUploadErrorMsg{err: fmt.Errorf("connection reset"), filename: localPath, uploadID: uploadID, room: "first"})
+
+	model.leaveChat()
+	model.roomKey = "second"
+	msg := model.uploadFileCmd(localPath)()
+	if _, ok := msg.(fileUploadedMsg); !ok {
+		t.Fatalf("expected the upload to complete, got %#v", msg)
+	}
+	model.Update(msg)
+	if files := second.listFiles(); len(files) != 1 || files[0].SizeBytes != int64(len(content)) {
+		t.Fatalf("expected the file in the second room, got %+v", files)
+	}
+	if files := first.listFiles(); len(files) != 0 {
+		t.Fatalf("expected nothing published in the first room, got %+v", files)
+	}
+	if model.pendingUploads[pendingUpload{room: "first", path: localPath}] != uploadID {
+		t.Error("expected the first room's upload still there to resume")
+	}
+}
+
+// TestResumableUploadBelongsToUploader verifies another user can neither add
+// to nor finalize someone else's upload
+func TestResumableUploadBelongsToUploader(t *testing.T) {
+	tmpDir := t.TempDir()
+	hub := NewHub()
+	handler := NewFileUploadHandler(hub, tmpDir, 10*1024*1024)
+	room := hub.getOrCreateRoom("testroom")
+
+	content := []byte("alice's notes")
+	uploadID := createTestUpload(t, handler, "testroom", "notes.txt", content)
+	mallory := &AuthContext{UserID: 2, Username: "mallory"}
+
+	req := httptest.NewRequest(http.MethodPut, "/api/uploads/"+uploadID+"?offset=0", bytes.NewReader(content))
+	rec := httptest.NewRecorder()
+	handler.HandleUploadChunk(rec, req, mallory)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for another user's chunk, got %d", rec.Code)
+	}
+
+	if rec := putTestChunk(handler, uploadID, 0, content); rec.Code != http.StatusOK {
+		t.Fatalf("expected uploader's chunk accepted, got %d", rec.Code)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/api/uploads/"+uploadID+"/finalize", nil)
+	rec = httptest.NewRecorder()
+	handler.HandleFinalizeUpload(rec, req, mallory)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for another user's finalize, got %d", rec.Code)
+	}
+	if len(room.files) != 0 {
+		t.Errorf("expected no files registered, got %d", len(room.files))
+	}
+}
+
+// TestFinalizeKeepsUploadWhileRoomIsGone verifies a finished upload survives
+// its room emptying out and can be finalized once the room is back
+func TestFinalizeKeepsUploadWhileRoomIsGone(t *testing.T) {
+	tmpDir := t.TempDir()
+	hub := NewHub()
+	handler := NewFileUploadHandler(hub, tmpDir, 10*1024*1024)
+	hub.getOrCreateRoom("testroom")
+
+	content := []byte("finished before the room emptied")
+	uploadID := createTestUpload(t, handler, "testroom", "notes.txt", content)
+	if rec := putTestChunk(handler, uploadID, 0, content); rec.Code != http.StatusOK {
+		t.Fatalf("expected chunk accepted, got %d", rec.Code)
+	}
+	hub.deleteRoomIfEmpty("testroom")
+
+	req := httptest.NewRequest(http.MethodPost, "/api/uploads/"+uploadID+"/finalize", nil)
+	rec := httptest.NewRecorder()
+	handler.HandleFinalizeUpload(rec, req, testUploader)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 while the room is gone, got %d", rec.Code)
+	}
+	if _, err := handler.readUploadSession(uploadID); err != nil {
+		t.Fatalf("expected upload kept, got %v", err)
+	}
+
+	room := hub.getOrCreateRoom("testroom")
+	req = httptest.NewRequest(http.MethodPost, "/api/uploads/"+uploadID+"/finalize", nil)
+	rec = httptest.NewRecorder()
+	handler.HandleFinalizeUpload(rec, req, testUploader)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected finalize once the room is back, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(room.files) != 1 {
+		t.Errorf("expected 1 file registered, got %d", len(room.files))
+	}
+}
+
+// TestResumableUploadRechecksRoomAccess verifies an uploader who loses access
+// to the room partway through can neither add to nor finalize the upload
+func TestResumableUploadRechecksRoomAccess(t *testing.T) {
+	tmpDir := t.TempDir()
+	hub := NewHub()
+	handler := NewFileUploadHandler(hub, tmpDir, 10*1024*1024)
+	room := hub.getOrCreateRoom("testroom")
+
+	content := []byte("sent before the ban")
+	uploadID := createTestUpload(t, handler, "testroom", "notes.txt", content)
+	if rec := putTestChunk(handler, uploadID, 0, content[:5]); rec.Code != http.StatusOK {
+		t.Fatalf("expected chunk accepted, got %d", rec.Code)
+	}
+
+	handler.roomAccess = func(r *http.Request, roomKey string, authCtx *AuthContext) (bool, error) {
+		return roomKey != "testroom", nil
+	}
+	if rec := putTestChunk(handler, uploadID, 5, content[5:]); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a chunk after the ban, got %d", rec.Code)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/uploads/"+uploadID+"/finalize", nil)
+	rec := httptest.NewRecorder()
+	handler.HandleFinalizeUpload(rec, req, testUploader)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for finalize after the ban, got %d", rec.Code)
+	}
+	if len(room.files) != 0 {
+		t.Errorf("expected no files registered, got %d", len(room.files))
+	}
+}
+
+// TestExpireUploadsRemovesStaleSessions verifies abandoned uploads and their
+// partial data are deleted once they outlive uploadSessionTTL
+func TestExpireUploadsRemovesStaleSessions(t *testing.T) {
+	tmpDir := t.TempDir()
+	hub := NewHub()
+	handler := NewFileUploadHandler(hub, tmpDir, 10*1024*1024)
+	hub.getOrCreateRoom("testroom")
+
+	stale := createTestUpload(t, handler, "testroom", "old.txt", []byte("old"))
+	if rec := putTestChunk(handler, stale, 0, []byte("ol")); rec.Code != http.StatusOK {
+		t.Fatalf("expected chunk accepted, got %d", rec.Code)
+	}
+	fresh := createTestUpload(t, handler, "testroom", "new.txt", []byte("new"))
+
+	old := time.Now().Add(-2 * uploadSessionTTL)
+	if err := os.Chtimes(handler.partialDataPath(stale), old, old); err != nil {
+		t.Fatal(err)
+	}
+	session, err := handler.readUploadSession(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.CreatedAt = old
+	if err := handler.saveUploadSession(*session); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed := handler.expireUploads(time.Now()); removed != 1 {
+		t.Fatalf("expected 1 upload removed, got %d", removed)
+	}
+	for _, path := range []string{handler.partialDataPath(stale), handler.partialMetaPath(stale)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s removed", filepath.Base(path))
+		}
+	}
+	if _, err := os.Stat(handler.partialMetaPath(fresh)); err != nil {
+		t.Errorf("expected the fresh upload kept: %v", err)
+	}
+}
+
+// testUploader is who the resumable upload tests are signed in as
+var testUploader = &AuthContext{UserID: 1, Username: "alice"}
+
+func createTestUpload(t *testing.T, handler *FileUploadHandler, roomKey, filename string, content []byte) string {
+	t.Helper()
+	sum := sha256.Sum256(content)
+	payload, _ := json.Marshal(createUploadRequest{
+		RoomKey:   roomKey,
+		Filename:  filename,
+		SizeBytes: int64(len(content)),
+		SHA256:    hex.EncodeToString(sum[:]),
+	})
+	req := httptest.NewRequest(http.MethodPost, "/api/uploads", bytes.NewReader(payload))
+	rec := httptest.NewRecorder()
+	handler.HandleCreateUpload(rec, req, testUploader)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected upload created, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp uploadOffsetResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode create response: %v", err)
+	}
+	return resp.UploadID
+}
+
+func putTestChunk(handler *FileUploadHandler, uploadID string, offset int, chunk []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/api/uploads/%s?offset=%d", uploadID, offset), bytes.NewReader(chunk))
+	rec := httptest.NewRecorder()
+	handler.HandleUploadChunk(rec, req, testUploader)
+	return rec
+}
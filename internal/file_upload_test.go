@@ -2,13 +2,19 @@ package internal
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 // TestFileUploadHandler verifies the basic file upload flow
@@ -45,11 +51,6 @@ func TestFileUploadHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Add username field
-	if err := writer.WriteField("username", "testuser"); err != nil {
-		t.Fatal(err)
-	}
-
 	writer.Close()
 
 	// Create HTTP request
@@ -58,7 +59,7 @@ func TestFileUploadHandler(t *testing.T) {
 	rec := httptest.NewRecorder()
 
 	// Call handler
-	handler.HandleUpload(rec, req)
+	handler.HandleUpload(rec, req, &AuthContext{UserID: 1, Username: "testuser"})
 
 	// Verify response
 	if rec.Code != http.StatusOK {
@@ -152,17 +153,621 @@ func TestFileSizeLimit(t *testing.T) {
 	part, _ := writer.CreateFormFile("file", "large.txt")
 	io.Copy(part, bytes.NewReader(largeContent))
 	writer.WriteField("room_key", "testroom")
-	writer.WriteField("username", "testuser")
 	writer.Close()
 
 	req := httptest.NewRequest("POST", "/api/upload", body)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 	rec := httptest.NewRecorder()
 
-	handler.HandleUpload(rec, req)
+	handler.HandleUpload(rec, req, &AuthContext{UserID: 1, Username: "testuser"})
 
 	// Should be rejected
 	if rec.Code != http.StatusRequestEntityTooLarge {
 		t.Errorf("expected status 413, got %d", rec.Code)
 	}
 }
+
+// TestRoomStorageQuota verifies uploads are refused with 413 once a room's
+// files would pass the quota, including a resumable upload that was started
+// while there was still room
+func TestRoomStorageQuota(t *testing.T) {
+	tmpDir := t.TempDir()
+	hub := NewHub()
+	handler := NewFileUploadHandler(hub, tmpDir, 1024)
+	handler.maxRoomBytes = 250
+	_ = hub.getOrCreateRoom("quotaroom")
+
+	upload := func(filename string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", filename)
+		part.Write(bytes.Repeat([]byte("a"), 100))
+		writer.WriteField("room_key", "quotaroom")
+		writer.Close()
+		req := httptest.NewRequest("POST", "/api/upload", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		rec := httptest.NewRecorder()
+		handler.HandleUpload(rec, req, testUploader)
+		return rec
+	}
+
+	content := bytes.Repeat([]byte("b"), 100)
+	uploadID := createTestUpload(t, handler, "quotaroom", "late.txt", content)
+	if rec := putTestChunk(handler, uploadID, 0, content); rec.Code != http.StatusOK {
+		t.Fatalf("chunk: %d %s", rec.Code, rec.Body.String())
+	}
+
+	var accepted int
+	for i := 0; i < 5; i++ {
+		rec := upload(fmt.Sprintf("file%d.txt", i))
+		if rec.Code == http.StatusRequestEntityTooLarge {
+			if !strings.Contains(rec.Body.String(), "room storage is full") {
+				t.Errorf("expected a quota message, got %s", rec.Body.String())
+			}
+			break
+		}
+		if rec.Code != http.StatusOK {
+			t.Fatalf("upload %d: %d %s", i, rec.Code, rec.Body.String())
+		}
+		accepted++
+	}
+	if accepted != 2 {
+		t.Fatalf("expected 2 uploads to fit in the quota, got %d", accepted)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.HandleFinalizeUpload(rec, httptest.NewRequest(http.MethodPost, "/api/uploads/"+uploadID+"/finalize", nil), testUploader)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected the resumable upload refused at finalize, got %d", rec.Code)
+	}
+	if used := hub.getRoom("quotaroom").filesSize(); used != 200 {
+		t.Errorf("expected 200 bytes stored, got %d", used)
+	}
+}
+
+// TestRoomQuotaReservedDuringUpload verifies uploads running at once can't
+// share the same free space, and space given up is there for the next one
+func TestRoomQuotaReservedDuringUpload(t *testing.T) {
+	hub := NewHub()
+	handler := NewFileUploadHandler(hub, t.TempDir(), 1024)
+	handler.maxRoomBytes = 250
+	room := hub.getOrCreateRoom("quotaroom")
+	room.addFile(UploadedFile{ID: "f1", SizeBytes: 50})
+
+	results := make(chan func(), 5)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			release, err := handler.reserveRoomQuota("quotaroom", 100)
+			if err != nil {
+				release = nil
+			}
+			results <- release
+		}()
+	}
+	var held []func()
+	for i := 0; i < cap(results); i++ {
+		if release := <-results; release != nil {
+			held = append(held, release)
+		}
+	}
+	if len(held) != 2 || room.filesSize() != 250 {
+		t.Fatalf("expected 2 uploads to get space, got %d with %d bytes in use", len(held), room.filesSize())
+	}
+	if err := handler.checkRoomQuota("quotaroom", 1); err == nil {
+		t.Fatal("expected reserved space to count against the quota")
+	}
+
+	held[0]()
+	if _, err := handler.reserveRoomQuota("quotaroom", 100); err != nil {
+		t.Fatalf("expected released space to be reusable, got %v", err)
+	}
+}
+
+// TestFileUploadBroadcastIncludesDownloadPath verifies the broadcast carries a
+// ready-to-use download path alongside the file ID
+func TestFileUploadBroadcastIncludesDownloadPath(t *testing.T) {
+	tmpDir := t.TempDir()
+	hub := NewHub()
+	handler := NewFileUploadHandler(hub, tmpDir, 10*1024*1024)
+
+	room := hub.getOrCreateRoom("chat:alice:bob")
+	listener := &Client{room: room, send: make(chan []byte, 1)}
+	_ = room.join(listener)
+	<-listener.send // presence update
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "notes.txt")
+	io.Copy(part, bytes.NewReader([]byte("hello")))
+	writer.WriteField("room_key", "chat:alice:bob")
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/api/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+
+	handler.HandleUpload(rec, req, testUploader)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status OK, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var fileMsg FileUploadMessage
+	select {
+	case payload := <-listener.send:
+		if err := json.Unmarshal(payload, &fileMsg); err != nil {
+			t.Fatalf("decode broadcast: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected file_uploaded broadcast")
+	}
+
+	if fileMsg.FileID == "" {
+		t.Fatal("expected file ID to be kept in broadcast")
+	}
+	expected := "/api/files/" + fileMsg.FileID + "?room=chat%3Aalice%3Abob"
+	if fileMsg.DownloadPath != expected {
+		t.Errorf("expected download path %q, got %q", expected, fileMsg.DownloadPath)
+	}
+}
+
+// TestUploadToSwampedRoom verifies an upload still succeeds, promptly, when
+// the room's queue is full and nothing is draining it; only the announcement
+// is lost
+func TestUploadToSwampedRoom(t *testing.T) {
+	tmpDir := t.TempDir()
+	hub := NewHub()
+	handler := NewFileUploadHandler(hub, tmpDir, 10*1024*1024)
+	handler.broadcastTimeout = 50 * time.Millisecond
+
+	// a room whose run loop never started, with its queue already full
+	room := newRoom("swamped")
+	hub.rooms["swamped"] = room
+	for len(room.broadcast) < cap(room.broadcast) {
+		room.broadcast <- []byte(`{"type":"message"}`)
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "late.txt")
+	part.Write([]byte("still here"))
+	writer.WriteField("room_key", "swamped")
+	writer.Close()
+	req := httptest.NewRequest("POST", "/api/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		handler.HandleUpload(rec, req, testUploader)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the upload to answer despite the full room queue")
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status OK, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(room.files) != 1 {
+		t.Fatalf("expected the file kept in the room, got %d", len(room.files))
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "swamped", room.files[0].ID+"-late.txt")); err != nil {
+		t.Errorf("expected the file on disk: %v", err)
+	}
+}
+
+// TestReactToFileUpload verifies a shared file can be reacted to by its file
+// ID, like a message, and the client shows the counts under its notice
+func TestReactToFileUpload(t *testing.T) {
+	hub := NewHub()
+	handler := NewFileUploadHandler(hub, t.TempDir(), 10*1024*1024)
+	room := hub.getOrCreateRoom("lobby")
+	listener := &Client{room: room, send: make(chan []byte, 4)}
+	_ = room.join(listener)
+	<-listener.send // presence update
+	next := func() []byte {
+		t.Helper()
+		select {
+		case payload := <-listener.send:
+			return payload
+		case <-time.After(time.Second):
+			t.Fatal("expected a broadcast")
+			return nil
+		}
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "notes.txt")
+	io.Copy(part, strings.NewReader("hello"))
+	writer.WriteField("room_key", "lobby")
+	writer.Close()
+	req := httptest.NewRequest("POST", "/api/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rec := httptest.NewRecorder()
+	handler.HandleUpload(rec, req, testUploader)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status OK, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var fileMsg FileUploadMessage
+	if err := json.Unmarshal(next(), &fileMsg); err != nil || fileMsg.FileID == "" {
+		t.Fatalf("expected a file_uploaded broadcast, got %+v %v", fileMsg, err)
+	}
+
+	bob := &Client{room: room, userID: 2, username: "bob", send: make(chan []byte, 4)}
+	payload, _ := json.Marshal(MessageReaction{Type: "react", ID: fileMsg.FileID, Emoji: "👍"})
+	bob.applyReaction(payload, time.Now())
+	var reaction MessageReaction
+	if err := json.Unmarshal(next(), &reaction); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if reaction.Type != "reactions" || reaction.ID != fileMsg.FileID || reaction.Reactions["👍"] != 1 {
+		t.Fatalf("expected one 👍 on the file, got %+v", reaction)
+	}
+
+	// The uploader still can't edit the file as though it were a message
+	alice := &Client{room: room, userID: 1, username: "alice", send: make(chan []byte, 4)}
+	update, _ := json.Marshal(MessageUpdate{Type: "edit", ID: fileMsg.FileID, Body: "renamed"})
+	alice.applyUpdate(update, time.Now())
+	select {
+	case payload := <-listener.send:
+		t.Fatalf("expected no broadcast for editing a file, got %s", payload)
+	case <-alice.send:
+	case <-time.After(time.Second):
+		t.Fatal("expected alice to be told the edit was refused")
+	}
+
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws://127.0.0.1:0/join", "lobby", "bob")
+	model.mode = modeChat
+	model.messages = append(model.messages, ChatMessage{ID: fileMsg.FileID, Room: "lobby", Type: systemMessageType, Kind: fileMessageKind, User: "system", Body: "📎 alice uploaded: notes.txt (5 B)", Ts: time.Now().Unix()})
+	if target := model.lastReactableMessage(); target == nil || target.ID != fileMsg.FileID {
+		t.Fatalf("expected the file notice to be reactable, got %+v", target)
+	}
+	model.Update(reactionsMsg(reaction))
+	if view := model.View(); !strings.Contains(view, "👍 1") {
+		t.Fatalf("expected the reaction count under the file notice, got:\n%s", view)
+	}
+}
+
+// TestPersistedFilesSurviveEmptyRoom verifies group room files are kept and
+// re-attached when persistence is on, while DM files stay ephemeral
+func TestPersistedFilesSurviveEmptyRoom(t *testing.T) {
+	tmpDir := t.TempDir()
+	hub := NewHub()
+	hub.uploadDir = tmpDir
+	hub.fileStore = newTestStore(t)
+
+	for _, roomKey := range []string{"team", directRoomKey("alice", "bob")} {
+		room := hub.getOrCreateRoom(roomKey)
+		roomDir := filepath.Join(tmpDir, sanitizePathComponent(roomKey))
+		if err := os.MkdirAll(roomDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(roomDir, "id-1-notes.txt"), []byte("test"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		file := UploadedFile{
+			ID:          roomKey + "-id-1",
+			Filename:    "notes.txt",
+			SizeBytes:   4,
+			UploadedBy:  "alice",
+			StoragePath: filepath.Join(sanitizePathComponent(roomKey), "id-1-notes.txt"),
+			UploadedAt:  time.Now(),
+		}
+		room.addFile(file)
+		hub.recordFile(context.Background(), roomKey, file)
+
+		// Last client leaves
+		hub.deleteRoomIfEmpty(roomKey)
+		if hub.Exists(roomKey) {
+			t.Fatalf("expected room %s to be removed once empty", roomKey)
+		}
+	}
+
+	rejoined := hub.getOrCreateRoom("team")
+	if len(rejoined.files) != 1 || rejoined.files[0].Filename != "notes.txt" {
+		t.Fatalf("expected persisted file to be re-attached, got %+v", rejoined.files)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, rejoined.files[0].StoragePath)); err != nil {
+		t.Errorf("expected persisted file to remain on disk: %v", err)
+	}
+
+	dm := hub.getOrCreateRoom(directRoomKey("alice", "bob"))
+	if len(dm.files) != 0 {
+		t.Errorf("expected DM files to stay ephemeral, got %+v", dm.files)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, sanitizePathComponent(directRoomKey("alice", "bob")))); !os.IsNotExist(err) {
+		t.Error("expected DM room directory to be deleted")
+	}
+}
+
+// TestListRoomFiles verifies signed-in users can list a room's files, which
+// the client then loads into its file list
+func TestListRoomFiles(t *testing.T) {
+	server, _ := newTestServer(t)
+	token := createTestSession(t, server, "alice")
+	room := server.hub.getOrCreateRoom("filesroom")
+	room.addFile(UploadedFile{ID: "f1", Filename: "notes.txt", SizeBytes: 42, UploadedBy: "bob", UploadedAt: time.Unix(1700000000, 0), SHA256: "abc"})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/files", server.HandleListFiles)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	if _, err := apiListRoomFiles(httpServer.URL, "bogus", "filesroom"); !errors.Is(err, errUnauthorized) {
+		t.Fatalf("expected unauthorized without a valid session, got %v", err)
+	}
+	var statusErr *apiStatusError
+	if _, err := apiListRoomFiles(httpServer.URL, token, "nosuchroom"); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for a missing room, got %v", err)
+	}
+
+	files, err := apiListRoomFiles(httpServer.URL, token, "filesroom")
+	if err != nil {
+		t.Fatalf("apiListRoomFiles: %v", err)
+	}
+	if len(files) != 1 || files[0].ID != "f1" || files[0].Filename != "notes.txt" || files[0].SizeBytes != 42 ||
+		files[0].UploadedBy != "bob" || files[0].UploadedAt != 1700000000 || files[0].DownloadPath != fileDownloadPath("f1", "filesroom") {
+		t.Fatalf("unexpected files %+v", files)
+	}
+
+	// A file announced live while the listing was in flight is kept
+	model := &TUIModel{roomKey: "filesroom", roomFiles: []FileMetadata{{ID: "f2", Filename: "live.txt"}}}
+	model.Update(roomFilesMsg{room: "filesroom", files: files})
+	if len(model.roomFiles) != 2 || model.roomFiles[0].ID != "f1" || model.roomFiles[1].ID != "f2" {
+		t.Fatalf("unexpected room files after load: %+v", model.roomFiles)
+	}
+}
+
+// TestFileDownloadRequiresRoomAccess verifies files are only served to
+// signed-in users, and only the participants of a DM or users not banned from
+// a group room get them
+func TestFileDownloadRequiresRoomAccess(t *testing.T) {
+	server, _ := newTestServer(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/files/", server.HandleFileDownload)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	aliceToken := createTestSession(t, server, "alice")
+	carolToken := createTestSession(t, server, "carol")
+	dmKey := directRoomKey("alice", "bob")
+	for _, roomKey := range []string{"downloadroom", dmKey} {
+		dir := filepath.Join(server.uploadBaseDir, sanitizePathComponent(roomKey))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hello"), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		room := server.hub.getOrCreateRoom(roomKey)
+		room.addFile(UploadedFile{ID: "f1", Filename: "notes.txt", StoragePath: filepath.Join(sanitizePathComponent(roomKey), "notes.txt"), UploadedAt: time.Now()})
+	}
+	carol, err := server.store.GetUserByUsername(context.Background(), "carol")
+	if err != nil || carol == nil {
+		t.Fatalf("GetUserByUsername: %v", err)
+	}
+	if err := server.store.BanFromRoom(context.Background(), "downloadroom", carol.ID); err != nil {
+		t.Fatalf("BanFromRoom: %v", err)
+	}
+
+	status := func(token, roomKey string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, httpServer.URL+fileDownloadPath("f1", roomKey), nil)
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("download: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := status("", "downloadroom"); got != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", got)
+	}
+	if got := status("bogus", "downloadroom"); got != http.StatusUnauthorized {
+		t.Errorf("expected 401 for an unknown token, got %d", got)
+	}
+	if got := status(carolToken, "downloadroom"); got != http.StatusForbidden {
+		t.Errorf("expected 403 for a banned user, got %d", got)
+	}
+	if got := status(carolToken, dmKey); got != http.StatusForbidden {
+		t.Errorf("expected 403 for someone else's DM, got %d", got)
+	}
+
+	for _, roomKey := range []string{"downloadroom", dmKey} {
+		dest := filepath.Join(t.TempDir(), "notes.txt")
+		if err := apiDownloadFile(httpServer.URL, aliceToken, fileDownloadPath("f1", roomKey), dest); err != nil {
+			t.Fatalf("%s: apiDownloadFile: %v", roomKey, err)
+		}
+		if data, _ := os.ReadFile(dest); string(data) != "hello" {
+			t.Fatalf("%s: unexpected contents %q", roomKey, data)
+		}
+	}
+}
+
+// TestListFilesRequiresRoomAccess verifies a room's file list is only shown
+// to people who may join the room, so nobody can browse another pair's DM
+func TestListFilesRequiresRoomAccess(t *testing.T) {
+	server, _ := newTestServer(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/files", server.HandleListFiles)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	dmKey := directRoomKey("alice", "bob")
+	server.hub.getOrCreateRoom(dmKey).addFile(UploadedFile{ID: "f1", Filename: "secret.txt", UploadedBy: "alice", UploadedAt: time.Now()})
+
+	var statusErr *apiStatusError
+	if _, err := apiListRoomFiles(httpServer.URL, createTestSession(t, server, "carol"), dmKey); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected carol refused with a 403, got %v", err)
+	}
+	files, err := apiListRoomFiles(httpServer.URL, createTestSession(t, server, "bob"), dmKey)
+	if err != nil || len(files) != 1 || files[0].Filename != "secret.txt" {
+		t.Fatalf("expected bob to see the file, got %+v %v", files, err)
+	}
+}
+
+// TestDeleteFileOnlyByUploader verifies only the uploader can delete a file,
+// and that deleting it removes it from disk, the room and the store and tells
+// everyone in the room
+func TestDeleteFileOnlyByUploader(t *testing.T) {
+	server, wsServer := newTestServer(t)
+	server.hub.fileStore = server.store
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/files/", server.HandleDeleteFile)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	roomKey := "deleteroom"
+	aliceToken := createTestSession(t, server, "alice")
+	bobConn, _, err := dialTestRoom(wsServer, createTestSession(t, server, "bob"), roomKey)
+	if err != nil {
+		t.Fatalf("bob dial: %v", err)
+	}
+	defer bobConn.Close()
+	waitForRoomSize(t, server.hub, roomKey, 1)
+
+	dir := filepath.Join(server.uploadBaseDir, sanitizePathComponent(roomKey))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	diskPath := filepath.Join(dir, "f1-notes.txt")
+	if err := os.WriteFile(diskPath, []byte("hello"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	file := UploadedFile{ID: "f1", Filename: "notes.txt", UploadedBy: "alice", StoragePath: filepath.Join(sanitizePathComponent(roomKey), "f1-notes.txt"), UploadedAt: time.Now()}
+	room := server.hub.getRoom(roomKey)
+	room.addFile(file)
+	server.hub.recordFile(context.Background(), roomKey, file)
+
+	remove := func(token, fileID string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodDelete, httpServer.URL+fileDownloadPath(fileID, roomKey), nil)
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := remove("", "f1"); got != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", got)
+	}
+	if got := remove(createTestSession(t, server, "bob"), "f1"); got != http.StatusForbidden {
+		t.Errorf("expected 403 for someone else's file, got %d", got)
+	}
+	if got := remove(aliceToken, "nosuchfile"); got != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing file, got %d", got)
+	}
+	if _, err := os.Stat(diskPath); err != nil {
+		t.Fatalf("expected the file kept after refused deletes: %v", err)
+	}
+
+	if got := remove(aliceToken, "f1"); got != http.StatusOK {
+		t.Fatalf("expected 200 for the uploader, got %d", got)
+	}
+	if _, err := os.Stat(diskPath); !os.IsNotExist(err) {
+		t.Errorf("expected the file removed from disk, got %v", err)
+	}
+	if room.getFile("f1") != nil {
+		t.Error("expected the file removed from the room")
+	}
+	if stored, err := server.store.ListRoomFiles(context.Background(), roomKey); err != nil || len(stored) != 0 {
+		t.Errorf("expected the saved metadata removed, got %+v %v", stored, err)
+	}
+
+	var deleted FileDeletedMessage
+	readTestJSON(t, bobConn, &deleted)
+	if deleted.Type != "file_deleted" || deleted.FileID != "f1" || deleted.DeletedBy != "alice" {
+		t.Fatalf("unexpected broadcast %+v", deleted)
+	}
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws://127.0.0.1:0/join", roomKey, "bob")
+	model.roomFiles = []FileMetadata{{ID: "f1", Filename: "notes.txt"}, {ID: "f2", Filename: "other.txt"}}
+	model.Update(fileDeletedMsg(deleted))
+	if len(model.roomFiles) != 1 || model.roomFiles[0].ID != "f2" {
+		t.Fatalf("expected only f2 left, got %+v", model.roomFiles)
+	}
+}
+
+// TestFileUploadTrustsTokenNotForm verifies a multipart upload needs a
+// signed-in user and is credited to them whatever username the form claims,
+// so nobody can upload as someone else or delete another user's file
+func TestFileUploadTrustsTokenNotForm(t *testing.T) {
+	server, _ := newTestServer(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/upload", server.HandleFileUpload)
+	mux.HandleFunc("/api/files/", server.HandleDeleteFile)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	roomKey := "uploadroom"
+	room := server.hub.getOrCreateRoom(roomKey)
+	aliceToken := createTestSession(t, server, "alice")
+	bobToken := createTestSession(t, server, "bob")
+
+	upload := func(token string) *http.Response {
+		t.Helper()
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", "notes.txt")
+		part.Write([]byte("hello"))
+		writer.WriteField("room_key", roomKey)
+		writer.WriteField("username", "alice")
+		writer.Close()
+		req, err := http.NewRequest(http.MethodPost, httpServer.URL+"/api/upload", body)
+		if err != nil {
+			t.Fatalf("new request: %v", err)
+		}
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("upload: %v", err)
+		}
+		return resp
+	}
+	resp := upload("")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", resp.StatusCode)
+	}
+	resp = upload(bobToken)
+	var result struct {
+		FileID string `json:"file_id"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected bob's upload accepted, got %d", resp.StatusCode)
+	}
+	file := room.getFile(result.FileID)
+	if file == nil || file.UploadedBy != "bob" {
+		t.Fatalf("expected the file credited to bob, got %+v", file)
+	}
+
+	var statusErr *apiStatusError
+	if err := apiDeleteFile(httpServer.URL, aliceToken, result.FileID, roomKey); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected alice refused with a 403, got %v", err)
+	}
+	if err := apiDeleteFile(httpServer.URL, bobToken, result.FileID, roomKey); err != nil {
+		t.Fatalf("expected bob to delete his upload: %v", err)
+	}
+}
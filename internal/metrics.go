@@ -2,7 +2,9 @@ package internal
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
 	"sync/atomic"
 )
 
@@ -10,6 +12,8 @@ type Metrics struct {
 	signups     atomic.Uint64
 	logins      atomic.Uint64
 	activeConns atomic.Int64
+	broadcasts  atomic.Uint64
+	activeRooms func() int // live rooms, read from the hub; nil reports 0
 }
 
 func NewMetrics() *Metrics {
@@ -32,11 +36,53 @@ func (m *Metrics) DecConn() {
 	m.activeConns.Add(-1)
 }
 
-func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
-	payload := map[string]any{
-		"signups_total":      m.signups.Load(),
-		"logins_total":       m.logins.Load(),
-		"active_connections": m.activeConns.Load(),
+// IncBroadcast counts a payload fanned out to a room. Rooms built without a
+// server have no metrics, so a nil Metrics is allowed here.
+func (m *Metrics) IncBroadcast() {
+	if m != nil {
+		m.broadcasts.Add(1)
+	}
+}
+
+// metricSample is one value in the Prometheus exposition
+type metricSample struct {
+	name  string
+	kind  string // "counter" or "gauge"
+	help  string
+	value int64
+}
+
+func (m *Metrics) samples() []metricSample {
+	rooms := 0
+	if m.activeRooms != nil {
+		rooms = m.activeRooms()
+	}
+	return []metricSample{
+		{"signups_total", "counter", "Accounts created.", int64(m.signups.Load())},
+		{"logins_total", "counter", "Successful logins.", int64(m.logins.Load())},
+		{"active_connections", "gauge", "Open websocket connections.", m.activeConns.Load()},
+		{"messages_broadcast_total", "counter", "Messages and other events fanned out to rooms.", int64(m.broadcasts.Load())},
+		{"rooms_active", "gauge", "Rooms currently live.", int64(rooms)},
+	}
+}
+
+// ServeHTTP answers with JSON unless the caller asks for the Prometheus text
+// format, either with ?format=prometheus or an Accept header naming
+// text/plain as Prometheus scrapers send
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	samples := m.samples()
+	if r.URL.Query().Get("format") == "prometheus" || strings.Contains(r.Header.Get("Accept"), "text/plain") {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		for _, sample := range samples {
+			fmt.Fprintf(w, "# HELP termchat_%s %s\n", sample.name, sample.help)
+			fmt.Fprintf(w, "# TYPE termchat_%s %s\n", sample.name, sample.kind)
+			fmt.Fprintf(w, "termchat_%s %d\n", sample.name, sample.value)
+		}
+		return
+	}
+	payload := make(map[string]any, len(samples))
+	for _, sample := range samples {
+		payload[sample.name] = sample.value
 	}
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(payload)
@@ -0,0 +1,186 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestMetricsFormats verifies /metrics stays JSON by default and speaks the
+// Prometheus text format when asked, with the same values either way,
+// including broadcasts counted by rooms
+func TestMetricsFormats(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	server.metrics.IncSignup()
+	server.metrics.IncLogin()
+	server.metrics.IncLogin()
+	conn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), "lobby")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	waitForRoomSize(t, server.hub, "lobby", 1)
+	// alice hearing her own join means that broadcast has been counted
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for the join announcement: %v", err)
+		}
+		if strings.Contains(string(data), "alice joined") {
+			break
+		}
+	}
+	server.hub.getOrCreateRoom("empty").publish([]byte(`{"type":"message"}`))
+	deadline := time.Now().Add(2 * time.Second)
+	for server.metrics.broadcasts.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	want := map[string]int64{"signups_total": 1, "logins_total": 2, "active_connections": 1, "rooms_active": 2, "messages_broadcast_total": 2}
+
+	rec := httptest.NewRecorder()
+	server.MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected JSON by default, got %q", ct)
+	}
+	var payload map[string]int64
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode %s: %v", rec.Body.String(), err)
+	}
+	for name, value := range want {
+		if payload[name] != value {
+			t.Errorf("JSON %s: expected %d, got %d", name, value, payload[name])
+		}
+	}
+
+	byQuery := httptest.NewRequest(http.MethodGet, "/metrics?format=prometheus", nil)
+	byAccept := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	byAccept.Header.Set("Accept", "application/openmetrics-text;version=1.0.0;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1")
+	for _, req := range []*http.Request{byQuery, byAccept} {
+		rec := httptest.NewRecorder()
+		server.MetricsHandler().ServeHTTP(rec, req)
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+			t.Fatalf("expected the text format, got %q", ct)
+		}
+		values := make(map[string]int64)
+		types := make(map[string]string)
+		for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+			fields := strings.Fields(line)
+			switch {
+			case len(fields) == 4 && fields[0] == "#" && fields[1] == "TYPE":
+				types[fields[2]] = fields[3]
+			case strings.HasPrefix(line, "# HELP "):
+			case len(fields) == 2:
+				value, err := strconv.ParseInt(fields[1], 10, 64)
+				if err != nil {
+					t.Fatalf("unparseable sample %q", line)
+				}
+				values[fields[0]] = value
+			default:
+				t.Fatalf("unexpected line %q", line)
+			}
+		}
+		for name, value := range want {
+			metric := "termchat_" + name
+			if values[metric] != value {
+				t.Errorf("%s: expected %d, got %d", metric, value, values[metric])
+			}
+			kind := "gauge"
+			if strings.HasSuffix(name, "_total") {
+				kind = "counter"
+			}
+			if types[metric] != kind {
+				t.Errorf("%s: expected TYPE %s, got %q", metric, kind, types[metric])
+			}
+		}
+	}
+}
+
+// TestRoomCountTracksHub verifies the lock-free room gauge follows rooms as
+// they're created and torn down
+func TestRoomCountTracksHub(t *testing.T) {
+	hub := NewHub()
+	hub.getOrCreateRoom("a")
+	hub.getOrCreateRoom("b")
+	hub.getOrCreateRoom("a")
+	if got := hub.roomCount(); got != 2 {
+		t.Fatalf("expected 2 rooms, got %d", got)
+	}
+	hub.deleteRoomIfEmpty("a")
+	if got := hub.roomCount(); got != 1 {
+		t.Fatalf("expected 1 room after teardown, got %d", got)
+	}
+}
+
+// BenchmarkBroadcastWhileScraping measures room fan-out with and without
+// scrapers hammering /metrics, to show scraping stays off the broadcast path
+func BenchmarkBroadcastWhileScraping(b *testing.B) {
+	for _, scrapers := range []int{0, 4} {
+		name := "idle"
+		if scrapers > 0 {
+			name = "scraping"
+		}
+		b.Run(name, func(b *testing.B) {
+			hub := NewHub()
+			metrics := NewMetrics()
+			metrics.activeRooms = hub.roomCount
+			room := hub.getOrCreateRoom("bench")
+			defer room.stop()
+
+			// every client acknowledges each broadcast, so an iteration times
+			// delivery to the whole room
+			const clients = 50
+			payload := []byte(`{"type":"message","user":"bench","body":"hello"}`)
+			var delivered sync.WaitGroup
+			for i := 0; i < clients; i++ {
+				client := &Client{room: room, send: make(chan []byte, 256)}
+				go func() {
+					for message := range client.send {
+						if string(message) == string(payload) {
+							delivered.Done()
+						}
+					}
+				}()
+				_ = room.join(client)
+				defer client.closeSend()
+			}
+
+			stop := make(chan struct{})
+			var scraping sync.WaitGroup
+			for i := 0; i < scrapers; i++ {
+				scraping.Add(1)
+				go func() {
+					defer scraping.Done()
+					req := httptest.NewRequest(http.MethodGet, "/metrics?format=prometheus", nil)
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+							metrics.ServeHTTP(httptest.NewRecorder(), req)
+							// yield so scrapers contend for locks rather than
+							// simply starving the broadcaster of CPU
+							runtime.Gosched()
+						}
+					}
+				}()
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				delivered.Add(clients)
+				room.publish(payload)
+				delivered.Wait()
+			}
+			b.StopTimer()
+			close(stop)
+			scraping.Wait()
+		})
+	}
+}
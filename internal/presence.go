@@ -1,15 +1,21 @@
 package internal
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
-// PresenceTracker keeps counts of active websocket connections per user.
+// PresenceTracker keeps counts of active websocket connections per user, and
+// when each user who has gone offline was last connected. Nothing is
+// persisted, so last-seen times start over when the server restarts.
 type PresenceTracker struct {
-	mu     sync.Mutex
-	online map[int64]int
+	mu       sync.Mutex
+	online   map[int64]int
+	lastSeen map[int64]time.Time
 }
 
 func NewPresenceTracker() *PresenceTracker {
-	return &PresenceTracker{online: make(map[int64]int)}
+	return &PresenceTracker{online: make(map[int64]int), lastSeen: make(map[int64]time.Time)}
 }
 
 func (p *PresenceTracker) Increment(userID int64) int {
@@ -25,6 +31,7 @@ func (p *PresenceTracker) Decrement(userID int64) int {
 	if count, ok := p.online[userID]; ok {
 		if count <= 1 {
 			delete(p.online, userID)
+			p.lastSeen[userID] = time.Now()
 			return 0
 		}
 		p.online[userID] = count - 1
@@ -39,6 +46,15 @@ func (p *PresenceTracker) Online(userID int64) bool {
 	return p.online[userID] > 0
 }
 
+// LastSeen returns when the user's last connection closed. It reports false
+// if they haven't disconnected since the server started.
+func (p *PresenceTracker) LastSeen(userID int64) (time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	seen, ok := p.lastSeen[userID]
+	return seen, ok
+}
+
 func (p *PresenceTracker) ActiveCount() int {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -1,26 +1,23 @@
 package internal
 
 import (
+	"context"
+	"crypto/subtle"
 	"errors"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
 
 	"termchat/internal/storage"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
-
 // Server bundles the hub with the persistent store and exposes HTTP handlers.
 type Server struct {
 	store         *storage.Store
@@ -31,6 +28,24 @@ type Server struct {
 	authLimiter   *RateLimiter
 	fileHandler   *FileUploadHandler
 	uploadBaseDir string
+	reserved      map[string]struct{}
+	historyLimit  int
+	adminToken    string
+	region        string
+	messageLimit  rateLimit
+	auditLog      bool
+	auditWriter   io.Writer  // also gets each audit event as a JSON line; may be nil
+	auditMutex    sync.Mutex // keeps concurrent audit lines from interleaving
+	bcryptCost    int
+	upgrader      websocket.Upgrader
+
+	// pumps counts live connections so Shutdown can wait for their last
+	// messages to be saved; closing turns new ones away once it has begun
+	pumps        sync.WaitGroup
+	pumpMutex    sync.Mutex
+	closing      bool
+	shutdownOnce sync.Once
+	shutdownErr  error
 }
 
 // AuthContext represents the authenticated user resolved from a session token.
@@ -40,6 +55,71 @@ type AuthContext struct {
 	Username string
 }
 
+// ServerOptions tunes optional server behaviour beyond the store.
+type ServerOptions struct {
+	UploadDir    string
+	MaxFileSize  int64
+	PersistFiles bool // keep group room files (and their metadata) after the room empties
+	// MaxRoomBytes caps the total size of the files one room holds. Zero
+	// means no cap beyond MaxFileSize per file.
+	MaxRoomBytes int64
+	// MaxRoomSize caps how many connections one room holds at once, to keep
+	// the broadcast fan-out bounded. Zero means no limit.
+	MaxRoomSize int
+	// ReservedUsernames can't be used at signup. Nil means DefaultReservedUsernames.
+	ReservedUsernames []string
+	// HistoryLimit is how many recent messages a joining client is sent. Zero
+	// means DefaultHistoryLimit; a negative value turns replay off.
+	HistoryLimit int
+	// AdminToken is the bearer token operators use for the /admin endpoints.
+	// Empty leaves those endpoints switched off.
+	AdminToken string
+	// Region names this server in /ping replies, e.g. "fly-iad", so clients
+	// can show which relay they're talking through.
+	Region string
+	// RateLimitWindow and RateLimitBurst cap each connection at RateLimitBurst
+	// messages per RateLimitWindow. Zero keeps DefaultRateLimitWindow and
+	// DefaultRateLimitBurst.
+	RateLimitWindow time.Duration
+	RateLimitBurst  int
+	// AuditLog records logins, signups, password changes and other account
+	// security events in the database for operators to review.
+	AuditLog bool
+	// AuditWriter, when set, also receives every audit event as one JSON line,
+	// for shipping to a file or log collector. Setting it turns AuditLog on.
+	AuditWriter io.Writer
+	// AllowedOrigins lists the Origin values browsers may open websockets
+	// from. An entry may contain one "*" wildcard, e.g. https://*.example.com,
+	// and "*" alone allows everything. Empty allows any origin.
+	AllowedOrigins []string
+	// IdleRoomTimeout is how long an empty room may sit before it's torn
+	// down and its goroutine stopped. Zero means DefaultIdleRoomTimeout; a
+	// negative value turns the sweep off.
+	IdleRoomTimeout time.Duration
+	// BcryptCost is the work factor for new password hashes. Zero, or
+	// anything outside bcrypt's 4-31, means bcrypt.DefaultCost.
+	BcryptCost int
+}
+
+// DefaultHistoryLimit is how many recent messages are replayed on join unless
+// ServerOptions says otherwise.
+const DefaultHistoryLimit = 50
+
+// DefaultRateLimitWindow and DefaultRateLimitBurst allow five messages every
+// three seconds per connection unless ServerOptions says otherwise.
+const (
+	DefaultRateLimitWindow = 3 * time.Second
+	DefaultRateLimitBurst  = 5
+)
+
+// DefaultIdleRoomTimeout is how long an empty room lingers before it's reaped
+// unless ServerOptions says otherwise.
+const DefaultIdleRoomTimeout = 10 * time.Minute
+
+// DefaultReservedUsernames covers the senders the client renders specially, so
+// nobody can sign up and impersonate them.
+var DefaultReservedUsernames = []string{"admin", "system", "server"}
+
 // NewServer wires the hub and store together.
 func NewServer(store *storage.Store) *Server {
 	return NewServerWithConfig(store, "/data/uploads", 10*1024*1024)
@@ -47,19 +127,119 @@ func NewServer(store *storage.Store) *Server {
 
 // NewServerWithConfig creates a server with file upload configuration
 func NewServerWithConfig(store *storage.Store, uploadDir string, maxFileSize int64) *Server {
+	return NewServerWithOptions(store, ServerOptions{UploadDir: uploadDir, MaxFileSize: maxFileSize})
+}
+
+// NewServerWithOptions creates a server from the full set of options
+func NewServerWithOptions(store *storage.Store, opts ServerOptions) *Server {
 	hub := NewHub()
-	fileHandler := NewFileUploadHandler(hub, uploadDir, maxFileSize)
+	hub.uploadDir = opts.UploadDir
+	hub.messageStore = store
+	hub.maxRoomSize = opts.MaxRoomSize
+	if opts.PersistFiles {
+		hub.fileStore = store
+	}
+	fileHandler := NewFileUploadHandler(hub, opts.UploadDir, opts.MaxFileSize)
+	fileHandler.maxRoomBytes = opts.MaxRoomBytes
+	reservedNames := opts.ReservedUsernames
+	if reservedNames == nil {
+		reservedNames = DefaultReservedUsernames
+	}
+	historyLimit := opts.HistoryLimit
+	if historyLimit == 0 {
+		historyLimit = DefaultHistoryLimit
+	}
+	messageLimit := rateLimit{window: opts.RateLimitWindow, burst: opts.RateLimitBurst}
+	if messageLimit.window <= 0 {
+		messageLimit.window = DefaultRateLimitWindow
+	}
+	if messageLimit.burst <= 0 {
+		messageLimit.burst = DefaultRateLimitBurst
+	}
+	hub.idleRoomTimeout = opts.IdleRoomTimeout
+	if hub.idleRoomTimeout == 0 {
+		hub.idleRoomTimeout = DefaultIdleRoomTimeout
+	}
+	bcryptCost := opts.BcryptCost
+	if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+		bcryptCost = bcrypt.DefaultCost
+	}
+	metrics := NewMetrics()
+	metrics.activeRooms = hub.roomCount
+	hub.metrics = metrics
+	reserved := make(map[string]struct{}, len(reservedNames))
+	for _, name := range reservedNames {
+		reserved[strings.ToLower(strings.TrimSpace(name))] = struct{}{}
+	}
 
-	return &Server{
+	server := &Server{
 		store:         store,
 		hub:           hub,
 		tokenTTL:      30 * 24 * time.Hour,
 		presence:      NewPresenceTracker(),
-		metrics:       NewMetrics(),
+		metrics:       metrics,
 		authLimiter:   NewRateLimiter(10, time.Minute),
 		fileHandler:   fileHandler,
-		uploadBaseDir: uploadDir,
+		uploadBaseDir: opts.UploadDir,
+		reserved:      reserved,
+		historyLimit:  historyLimit,
+		adminToken:    opts.AdminToken,
+		region:        opts.Region,
+		messageLimit:  messageLimit,
+		auditLog:      opts.AuditLog || opts.AuditWriter != nil,
+		auditWriter:   opts.AuditWriter,
+		bcryptCost:    bcryptCost,
+		upgrader:      newUpgrader(opts.AllowedOrigins),
 	}
+	fileHandler.roomAccess = server.canAccessRoom
+	return server
+}
+
+// newUpgrader builds the websocket upgrader for a server that accepts
+// browser connections from the allowed origins. Requests without an Origin
+// header don't come from a browser, like our own client's, and are let in.
+func newUpgrader(allowedOrigins []string) websocket.Upgrader {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+	if len(allowedOrigins) > 0 {
+		upgrader.CheckOrigin = func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || originAllowed(origin, allowedOrigins)
+		}
+	}
+	return upgrader
+}
+
+// originAllowed matches origin against the allowlist, ignoring case. A "*"
+// in an entry stands for any run of characters.
+func originAllowed(origin string, allowed []string) bool {
+	origin = strings.ToLower(origin)
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		prefix, suffix, wildcard := strings.Cut(pattern, "*")
+		if !wildcard {
+			if origin == pattern {
+				return true
+			}
+			continue
+		}
+		if len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isReservedUsername reports whether signup should refuse the name. Matching
+// is case-insensitive so "System" can't slip through either.
+func (s *Server) isReservedUsername(username string) bool {
+	_, ok := s.reserved[strings.ToLower(username)]
+	return ok
 }
 
 // ServeWS upgrades the HTTP connection after verifying the bearer token.
@@ -69,6 +249,16 @@ func (s *Server) ServeWS(writer http.ResponseWriter, request *http.Request) {
 		http.Error(writer, "missing room query param", http.StatusBadRequest)
 		return
 	}
+	if !s.trackPump() {
+		http.Error(writer, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	pumping := false
+	defer func() {
+		if !pumping {
+			s.pumps.Done()
+		}
+	}()
 	authCtx, err := s.authenticateRequest(request)
 	if err != nil {
 		status := http.StatusInternalServerError
@@ -78,28 +268,222 @@ func (s *Server) ServeWS(writer http.ResponseWriter, request *http.Request) {
 		http.Error(writer, http.StatusText(status), status)
 		return
 	}
+	// Direct message rooms are only for the two people they're between, and
+	// their history must never reach anyone else
+	allowed, err := s.canAccessRoom(request, roomKey, authCtx)
+	if err != nil {
+		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		// 403 tells the client to stop reconnecting
+		http.Error(writer, "you don't have access to this room", http.StatusForbidden)
+		return
+	}
+	if isSelfDirectRoom(roomKey) {
+		http.Error(writer, "can't start a direct message with yourself", http.StatusBadRequest)
+		return
+	}
+	if peer := directRoomPeer(roomKey, authCtx.Username); peer != "" {
+		blocked, err := s.isBlockedWith(request.Context(), authCtx.UserID, peer)
+		if err != nil {
+			http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if blocked {
+			http.Error(writer, "you can't message this user", http.StatusForbidden)
+			return
+		}
+	}
+	if isDirectRoom(roomKey) {
+		room := s.hub.getRoom(roomKey)
+		if room != nil && !room.hasUser(authCtx.UserID) && room.userCount() >= directRoomCapacity {
+			http.Error(writer, "direct message room is full", http.StatusForbidden)
+			return
+		}
+	}
 
-	websocketConn, err := upgrader.Upgrade(writer, request, nil)
+	websocketConn, err := s.upgrader.Upgrade(writer, request, nil)
 	if err != nil {
 		log.Printf("upgrade error: %v", err)
 		return
 	}
 
 	room := s.hub.getOrCreateRoom(roomKey)
-	s.presence.Increment(authCtx.UserID)
-	s.metrics.IncConn()
-	client := newClient(room, websocketConn, authCtx.Username, authCtx.UserID, func() {
+	if room.full() {
+		// Spare the history when the room is plainly full
+		refuseFullRoom(websocketConn)
+		_ = websocketConn.Close()
+		return
+	}
+	client := newClient(room, websocketConn, authCtx.Username, authCtx.UserID, s.messageLimit, func() {
 		s.presence.Decrement(authCtx.UserID)
 		s.metrics.DecConn()
 	})
-	room.register <- client
-
+	// History goes out before the client is registered so it can't interleave
+	// with live messages
 	go client.writePump()
-	go client.readPump(s.hub, roomKey)
+	room.replayHistory(client, s.historyLimit)
+	for {
+		err := room.join(client)
+		if err == nil {
+			break
+		}
+		if errors.Is(err, errRoomFull) {
+			// Someone took the last place since the check above
+			refuseFullRoom(websocketConn)
+			client.closeSend()
+			return
+		}
+		// the room was torn down between lookup and join; its history lives
+		// in the store, so a fresh room picks up where it left off
+		room = s.hub.getOrCreateRoom(roomKey)
+		client.room = room
+	}
+	s.presence.Increment(authCtx.UserID)
+	s.metrics.IncConn()
+	room.announceJoin(authCtx.UserID, authCtx.Username)
+
+	pumping = true
+	go func() {
+		defer s.pumps.Done()
+		client.readPump(s.hub, roomKey)
+	}()
+}
+
+// refuseFullRoom tells a client the room is full. It's sent after the upgrade
+// so the client gets a reason it can show.
+func refuseFullRoom(conn *websocket.Conn) {
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "room full"), time.Now().Add(writeWait))
+}
+
+// trackPump counts a new connection, or reports false once Shutdown has begun
+func (s *Server) trackPump() bool {
+	s.pumpMutex.Lock()
+	defer s.pumpMutex.Unlock()
+	if s.closing {
+		return false
+	}
+	s.pumps.Add(1)
+	return true
+}
+
+// Shutdown tells every connected client the server is going away, waits for
+// their connections to wind down so anything they sent is saved, then closes
+// the store. Connections still open when ctx ends are cut off. Later calls
+// return the first result.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		s.pumpMutex.Lock()
+		s.closing = true
+		s.pumpMutex.Unlock()
+		s.hub.closeAll("The server is shutting down.")
+		drained := make(chan struct{})
+		go func() {
+			s.pumps.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			s.hub.dropAll()
+			<-drained
+		}
+		s.shutdownErr = s.store.Close()
+	})
+	return s.shutdownErr
+}
+
+// ReapIdleRooms tears down rooms that have sat empty past the idle timeout
+// until stop is closed. It returns straight away when the sweep is off.
+func (s *Server) ReapIdleRooms(stop <-chan struct{}) {
+	timeout := s.hub.idleRoomTimeout
+	if timeout <= 0 {
+		return
+	}
+	interval := timeout / 2
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if reaped := s.hub.reapIdleRooms(now); reaped > 0 {
+				log.Printf("reaped %d idle room(s)", reaped)
+			}
+		case <-stop:
+			return
+		}
+	}
 }
 
 var errUnauthorized = errors.New("unauthorized")
 
+// direct message rooms (chat:a:b) only ever hold the two named users; extra
+// connections from either of them (e.g. a second device) are still allowed
+const directRoomCapacity = 2
+
+func isDirectRoom(key string) bool {
+	return strings.HasPrefix(key, "chat:")
+}
+
+// isSelfDirectRoom reports a direct message room between a user and
+// themselves (chat:a:a), which nobody should ever be able to open
+func isSelfDirectRoom(key string) bool {
+	parts := strings.Split(key, ":")
+	return len(parts) == 3 && parts[0] == "chat" && strings.EqualFold(parts[1], parts[2])
+}
+
+// isDirectRoomMember reports whether username is one of the two people a
+// direct message room is between. Usernames are only unique as written, so
+// "ALICE" is someone else entirely and the match must be exact.
+func isDirectRoomMember(key, username string) bool {
+	parts := strings.Split(key, ":")
+	return len(parts) == 3 && (parts[1] == username || parts[2] == username)
+}
+
+// directRoomPeer returns the other person in a direct message room username
+// is part of, or "" for any other room
+func directRoomPeer(key, username string) string {
+	parts := strings.Split(key, ":")
+	if len(parts) != 3 || parts[0] != "chat" {
+		return ""
+	}
+	switch {
+	case parts[1] == username:
+		return parts[2]
+	case parts[2] == username:
+		return parts[1]
+	}
+	return ""
+}
+
+// isBlockedWith reports whether the user and the named account have blocked
+// one another. Unknown names aren't blocked.
+func (s *Server) isBlockedWith(ctx context.Context, userID int64, username string) (bool, error) {
+	other, err := s.store.GetUserByUsername(ctx, username)
+	if err != nil || other == nil {
+		return false, err
+	}
+	return s.store.IsBlocked(ctx, userID, other.ID)
+}
+
+// canAccessRoom reports whether the user may see a room's contents outside
+// the websocket: anyone not banned for group rooms, and only the two
+// participants for direct messages
+func (s *Server) canAccessRoom(r *http.Request, roomKey string, authCtx *AuthContext) (bool, error) {
+	if isDirectRoom(roomKey) && !isDirectRoomMember(roomKey, authCtx.Username) {
+		return false, nil
+	}
+	banned, err := s.store.IsBannedFromRoom(r.Context(), roomKey, authCtx.UserID)
+	if err != nil {
+		return false, err
+	}
+	return !banned, nil
+}
+
 func (s *Server) authenticateRequest(r *http.Request) (*AuthContext, error) {
 	header := r.Header.Get("Authorization")
 	if header == "" {
@@ -129,12 +513,25 @@ func (s *Server) authenticateRequest(r *http.Request) (*AuthContext, error) {
 	if err != nil {
 		return nil, err
 	}
-	if user == nil {
+	if user == nil || user.Disabled {
 		return nil, errUnauthorized
 	}
 	return &AuthContext{UserID: user.ID, Username: user.Username, Token: token}, nil
 }
 
+// isAdminRequest reports whether the request carries the operator token
+func (s *Server) isAdminRequest(r *http.Request) bool {
+	if s.adminToken == "" {
+		return false
+	}
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return false
+	}
+	token := strings.TrimSpace(parts[1])
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1
+}
+
 func (s *Server) clientIP(r *http.Request) string {
 	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
 		parts := strings.Split(ip, ",")
@@ -151,12 +548,106 @@ func (s *Server) MetricsHandler() http.Handler {
 	return s.metrics
 }
 
-// HandleFileUpload delegates to the file upload handler
+// HandleFileUpload takes a multipart upload from a signed-in user
 func (s *Server) HandleFileUpload(w http.ResponseWriter, r *http.Request) {
-	s.fileHandler.HandleUpload(w, r)
+	if authCtx, ok := s.authorizeRoomFileRequest(w, r); ok {
+		s.fileHandler.HandleUpload(w, r, authCtx)
+	}
+}
+
+// HandleListFiles lists a room's files for signed-in users who have access
+// to that room
+func (s *Server) HandleListFiles(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authorizeRoomFileRequest(w, r); !ok {
+		return
+	}
+	s.fileHandler.HandleListFiles(w, r)
 }
 
-// HandleFileDownload delegates to the file download handler
+// HandleFileDownload serves a room's file to signed-in users who have access
+// to that room
 func (s *Server) HandleFileDownload(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.authorizeRoomFileRequest(w, r); !ok {
+		return
+	}
 	s.fileHandler.HandleDownload(w, r)
 }
+
+// HandleDeleteFile lets a signed-in uploader delete their file from a room
+// they have access to
+func (s *Server) HandleDeleteFile(w http.ResponseWriter, r *http.Request) {
+	authCtx, ok := s.authorizeRoomFileRequest(w, r)
+	if !ok {
+		return
+	}
+	s.fileHandler.HandleDeleteFile(w, r, authCtx.Username)
+}
+
+// authorizeRoomFileRequest authenticates a request for one of a room's files
+// and checks the user has access to the ?room= it names, writing a 401 or 403
+// if not
+func (s *Server) authorizeRoomFileRequest(w http.ResponseWriter, r *http.Request) (*AuthContext, bool) {
+	authCtx, err := s.authenticateRequest(r)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errUnauthorized) {
+			status = http.StatusUnauthorized
+		}
+		http.Error(w, http.StatusText(status), status)
+		return nil, false
+	}
+	if roomKey := r.URL.Query().Get("room"); roomKey != "" {
+		allowed, err := s.canAccessRoom(r, roomKey, authCtx)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return nil, false
+		}
+		if !allowed {
+			http.Error(w, "you don't have access to this room", http.StatusForbidden)
+			return nil, false
+		}
+	}
+	return authCtx, true
+}
+
+// HandleCreateUpload starts a resumable upload for a signed-in user
+func (s *Server) HandleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	if authCtx, ok := s.authorizeRoomFileRequest(w, r); ok {
+		s.fileHandler.HandleCreateUpload(w, r, authCtx)
+	}
+}
+
+// HandleUploadChunk adds to a resumable upload its uploader started
+func (s *Server) HandleUploadChunk(w http.ResponseWriter, r *http.Request) {
+	if authCtx, ok := s.authorizeRoomFileRequest(w, r); ok {
+		s.fileHandler.HandleUploadChunk(w, r, authCtx)
+	}
+}
+
+// HandleFinalizeUpload publishes a resumable upload its uploader started
+func (s *Server) HandleFinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	if authCtx, ok := s.authorizeRoomFileRequest(w, r); ok {
+		s.fileHandler.HandleFinalizeUpload(w, r, authCtx)
+	}
+}
+
+// ExpireUploads deletes abandoned resumable uploads now and then every
+// uploadSweepInterval until stop is closed
+func (s *Server) ExpireUploads(stop <-chan struct{}) {
+	ticker := time.NewTicker(uploadSweepInterval)
+	defer ticker.Stop()
+	now := time.Now()
+	for {
+		if expired := s.fileHandler.expireUploads(now); expired > 0 {
+			log.Printf("removed %d abandoned upload(s)", expired)
+		}
+		select {
+		case now = <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// uploadSweepInterval is how often abandoned resumable uploads are looked for
+const uploadSweepInterval = time.Hour
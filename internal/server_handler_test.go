@@ -0,0 +1,1352 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"termchat/internal/storage"
+)
+
+// TestDirectRoomRejectsThirdUser verifies a chat:a:b room never holds more
+// than its two participants
+func TestDirectRoomRejectsThirdUser(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	roomKey := directRoomKey("alice", "bob")
+
+	aliceConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), roomKey)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	defer aliceConn.Close()
+	bobConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "bob"), roomKey)
+	if err != nil {
+		t.Fatalf("bob dial: %v", err)
+	}
+	defer bobConn.Close()
+	waitForRoomSize(t, server.hub, roomKey, 2)
+
+	conn, resp, err := dialTestRoom(httpServer, createTestSession(t, server, "carol"), roomKey)
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected third connection to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403, got %+v", resp)
+	}
+}
+
+// TestSelfDirectRoomRejected verifies nobody can open a direct message room
+// with themselves
+func TestSelfDirectRoomRejected(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	token := createTestSession(t, server, "alice")
+	for _, roomKey := range []string{"chat:alice:alice", "chat:alice:Alice"} {
+		conn, resp, err := dialTestRoom(httpServer, token, roomKey)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("%s: expected the connection to be refused", roomKey)
+		}
+		if resp == nil || resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %+v", roomKey, resp)
+		}
+	}
+	if server.hub.Exists("chat:alice:alice") {
+		t.Fatal("expected no room to be created")
+	}
+	conn, _, err := dialTestRoom(httpServer, token, directRoomKey("alice", "bob"))
+	if err != nil {
+		t.Fatalf("expected a DM with someone else to work: %v", err)
+	}
+	conn.Close()
+}
+
+// upgrader accepts any origin, for tests that stand in for the server
+var upgrader = newUpgrader(nil)
+
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	server := NewServerWithConfig(newTestStore(t), t.TempDir(), 1024*1024)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/join", server.ServeWS)
+	httpServer := httptest.NewServer(mux)
+	t.Cleanup(httpServer.Close)
+	return server, httpServer
+}
+
+// newTestStore opens a migrated in-memory store scoped to the test
+func newTestStore(t *testing.T) *storage.Store {
+	t.Helper()
+	name := strings.ReplaceAll(t.Name(), "/", "_")
+	store, err := storage.NewStore("sqlite://file:" + name + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	if err := store.Migrate(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return store
+}
+
+// createTestSession inserts a user with a live session and returns its token
+func createTestSession(t *testing.T, server *Server, username string) string {
+	t.Helper()
+	ctx := context.Background()
+	user, err := server.store.GetUserByUsername(ctx, username)
+	if err != nil {
+		t.Fatalf("GetUserByUsername: %v", err)
+	}
+	userID := int64(0)
+	if user != nil {
+		userID = user.ID
+	} else if userID, err = server.store.CreateUser(ctx, username, []byte("hash")); err != nil {
+		t.Fatalf("CreateUser %s: %v", username, err)
+	}
+	token := uuid.NewString()
+	if err := server.store.CreateSession(ctx, userID, token, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	return token
+}
+
+func dialTestRoom(httpServer *httptest.Server, token, roomKey string) (*websocket.Conn, *http.Response, error) {
+	wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/join?room=" + url.QueryEscape(roomKey)
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer "+token)
+	return websocket.DefaultDialer.Dial(wsURL, headers)
+}
+
+// waitForRoomSize blocks until the room run loop has registered n clients
+func waitForRoomSize(t *testing.T, hub *Hub, roomKey string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if room := hub.getRoom(roomKey); room != nil && room.size() == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("room %s never reached %d clients", roomKey, n)
+}
+
+// TestDirectRoomCountsDistinctUsers verifies a second device for the same user
+// doesn't use up the other participant's slot
+func TestDirectRoomCountsDistinctUsers(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	roomKey := directRoomKey("alice", "bob")
+
+	for i := 0; i < 2; i++ {
+		conn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), roomKey)
+		if err != nil {
+			t.Fatalf("alice dial %d: %v", i, err)
+		}
+		defer conn.Close()
+	}
+	waitForRoomSize(t, server.hub, roomKey, 2)
+
+	bobConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "bob"), roomKey)
+	if err != nil {
+		t.Fatalf("expected bob to join alongside both alice devices: %v", err)
+	}
+	defer bobConn.Close()
+	waitForRoomSize(t, server.hub, roomKey, 3)
+
+	room := server.hub.getRoom(roomKey)
+	if got := room.userCount(); got != 2 {
+		t.Errorf("expected 2 distinct users, got %d", got)
+	}
+
+	conn, resp, err := dialTestRoom(httpServer, createTestSession(t, server, "carol"), roomKey)
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected carol to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403, got %+v", resp)
+	}
+}
+
+// TestDirectRoomRefusesOutsiders verifies someone who isn't one of the two
+// people in a direct message room can't open it, even while it has room for
+// another connection or their name differs from a member's only in case, and
+// so never sees its history
+func TestDirectRoomRefusesOutsiders(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	roomKey := directRoomKey("alice", "bob")
+	aliceConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), roomKey)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	defer aliceConn.Close()
+	waitForRoomSize(t, server.hub, roomKey, 1)
+
+	conn, resp, err := dialTestRoom(httpServer, createTestSession(t, server, "carol"), roomKey)
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected carol to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403, got %+v", resp)
+	}
+	if got := server.hub.getRoom(roomKey).size(); got != 1 {
+		t.Errorf("expected only alice in the room, got %d connections", got)
+	}
+
+	// A separate account whose name only differs in case is an outsider too
+	conn, resp, err = dialTestRoom(httpServer, createTestSession(t, server, "ALICE"), roomKey)
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected ALICE to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for ALICE, got %+v", resp)
+	}
+}
+
+// TestMessageEditOnlyByAuthor verifies the server rejects edits from anyone
+// but the author and broadcasts accepted edits to the room
+func TestMessageEditOnlyByAuthor(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	roomKey := "editroom"
+
+	aliceConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), roomKey)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	defer aliceConn.Close()
+	bobConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "bob"), roomKey)
+	if err != nil {
+		t.Fatalf("bob dial: %v", err)
+	}
+	defer bobConn.Close()
+	waitForRoomSize(t, server.hub, roomKey, 2)
+
+	if err := aliceConn.WriteJSON(ChatMessage{Body: "helo"}); err != nil {
+		t.Fatalf("alice send: %v", err)
+	}
+	var original ChatMessage
+	readTestJSON(t, bobConn, &original)
+	if original.ID == "" || original.User != "alice" {
+		t.Fatalf("expected alice's message with an ID, got %+v", original)
+	}
+
+	if err := bobConn.WriteJSON(MessageUpdate{Type: "edit", ID: original.ID, Body: "hijacked"}); err != nil {
+		t.Fatalf("bob edit: %v", err)
+	}
+	var notice ChatMessage
+	readTestJSON(t, bobConn, &notice)
+	if notice.User != "system" || !strings.Contains(notice.Body, "your own messages") {
+		t.Fatalf("expected rejection notice, got %+v", notice)
+	}
+
+	if err := aliceConn.WriteJSON(MessageUpdate{Type: "edit", ID: original.ID, Body: "hello"}); err != nil {
+		t.Fatalf("alice edit: %v", err)
+	}
+	var edited MessageUpdate
+	readTestJSON(t, bobConn, &edited)
+	if edited.Type != "message_edited" || edited.ID != original.ID || edited.Body != "hello" || edited.User != "alice" {
+		t.Fatalf("unexpected edit broadcast: %+v", edited)
+	}
+}
+
+// TestHistoryReplayedOnJoin verifies messages outlive an empty room and are
+// replayed, edits included, to whoever joins next, and that the author can
+// still change them afterwards
+func TestHistoryReplayedOnJoin(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	roomKey := "historyroom"
+	aliceToken := createTestSession(t, server, "alice")
+
+	conn, _, err := dialTestRoom(httpServer, aliceToken, roomKey)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	waitForRoomSize(t, server.hub, roomKey, 1)
+	var sent []ChatMessage
+	for _, body := range []string{"first", "secnd"} {
+		if err := conn.WriteJSON(ChatMessage{Body: body}); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		var chat ChatMessage
+		readTestJSON(t, conn, &chat)
+		sent = append(sent, chat)
+	}
+	if err := conn.WriteJSON(MessageUpdate{Type: "edit", ID: sent[1].ID, Body: "second"}); err != nil {
+		t.Fatalf("edit: %v", err)
+	}
+	var edited MessageUpdate
+	readTestJSON(t, conn, &edited)
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for server.hub.getRoom(roomKey) != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.hub.getRoom(roomKey) != nil {
+		t.Fatal("expected the empty room to be removed")
+	}
+
+	bobConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "bob"), roomKey)
+	if err != nil {
+		t.Fatalf("bob dial: %v", err)
+	}
+	defer bobConn.Close()
+	for i, want := range []string{"first", "second"} {
+		var chat ChatMessage
+		readTestJSON(t, bobConn, &chat)
+		if chat.ID != sent[i].ID || chat.Body != want || chat.User != "alice" || chat.Edited != (i == 1) {
+			t.Fatalf("replay %d: unexpected message %+v", i, chat)
+		}
+		if chat.TsMs != sent[i].TsMs {
+			t.Errorf("replay %d: expected ts_ms %d, got %d", i, sent[i].TsMs, chat.TsMs)
+		}
+	}
+
+	aliceConn, _, err := dialTestRoom(httpServer, aliceToken, roomKey)
+	if err != nil {
+		t.Fatalf("alice redial: %v", err)
+	}
+	defer aliceConn.Close()
+	waitForRoomSize(t, server.hub, roomKey, 2)
+	if err := aliceConn.WriteJSON(MessageUpdate{Type: "delete", ID: sent[0].ID}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	var deleted MessageUpdate
+	readTestJSON(t, bobConn, &deleted)
+	if deleted.Type != "message_deleted" || deleted.ID != sent[0].ID {
+		t.Fatalf("expected alice to delete a replayed message, got %+v", deleted)
+	}
+}
+
+// TestActionMessagesKeepTheirKind verifies /me actions are broadcast and
+// replayed as actions, and any other kind a client invents is dropped
+func TestActionMessagesKeepTheirKind(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	roomKey := "actionroom"
+	conn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), roomKey)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	waitForRoomSize(t, server.hub, roomKey, 1)
+	for _, kind := range []string{actionMessageKind, "shout", ""} {
+		if err := conn.WriteJSON(ChatMessage{Kind: kind, Body: "waves"}); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		var chat ChatMessage
+		readTestJSON(t, conn, &chat)
+		if want := map[string]string{actionMessageKind: actionMessageKind}[kind]; chat.Kind != want {
+			t.Fatalf("sent kind %q: expected %q broadcast, got %+v", kind, want, chat)
+		}
+	}
+	conn.Close()
+
+	bobConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "bob"), roomKey)
+	if err != nil {
+		t.Fatalf("bob dial: %v", err)
+	}
+	defer bobConn.Close()
+	for i, want := range []string{actionMessageKind, "", ""} {
+		var chat ChatMessage
+		readTestJSON(t, bobConn, &chat)
+		if chat.Kind != want || chat.Body != "waves" {
+			t.Fatalf("replay %d: expected kind %q, got %+v", i, want, chat)
+		}
+	}
+}
+
+// TestHistoryLimitIsConfigurable verifies only the configured number of recent
+// messages is replayed, and that a negative limit disables replay
+func TestHistoryLimitIsConfigurable(t *testing.T) {
+	for _, tc := range []struct {
+		limit int
+		want  []string
+	}{
+		{limit: 2, want: []string{"two", "three"}},
+		{limit: -1, want: nil},
+	} {
+		t.Run(fmt.Sprint(tc.limit), func(t *testing.T) {
+			store := newTestStore(t)
+			server := NewServerWithOptions(store, ServerOptions{UploadDir: t.TempDir(), MaxFileSize: 1024, HistoryLimit: tc.limit})
+			mux := http.NewServeMux()
+			mux.HandleFunc("/join", server.ServeWS)
+			httpServer := httptest.NewServer(mux)
+			defer httpServer.Close()
+
+			userID, _ := store.CreateUser(context.Background(), "alice", []byte("hash"))
+			for i, body := range []string{"one", "two", "three"} {
+				_ = store.InsertMessage(context.Background(), storage.Message{
+					ID: uuid.NewString(), RoomKey: "limitroom", UserID: userID, Username: "alice", Body: body,
+					Ts: time.Now().Add(time.Duration(i-3) * time.Second),
+				})
+			}
+			conn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "bob"), "limitroom")
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+			for _, want := range tc.want {
+				var chat ChatMessage
+				readTestJSON(t, conn, &chat)
+				if chat.Body != want {
+					t.Fatalf("expected %q, got %+v", want, chat)
+				}
+			}
+			if extra, err := readTestMessage(conn, 200*time.Millisecond); err == nil {
+				t.Errorf("expected no more history, got %s", extra)
+			}
+		})
+	}
+}
+
+// readTestJSON decodes the next message, skipping join/leave announcements
+// and presence updates so tests about other traffic don't depend on who came
+// and went
+func readTestJSON(t *testing.T, conn *websocket.Conn, v interface{}) {
+	t.Helper()
+	payload, err := readTestMessage(conn, 2*time.Second)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		t.Fatalf("decode %s: %v", payload, err)
+	}
+}
+
+// readTestMessage returns the next message that isn't a join/leave
+// announcement or presence update
+func readTestMessage(conn *websocket.Conn, wait time.Duration) ([]byte, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(wait))
+	for {
+		_, payload, err := conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if envelopeType(payload) == "presence" {
+			continue
+		}
+		var chat ChatMessage
+		if json.Unmarshal(payload, &chat) == nil && chat.isSystem() &&
+			(strings.HasSuffix(chat.Body, " joined") || strings.HasSuffix(chat.Body, " left")) {
+			continue
+		}
+		return payload, nil
+	}
+}
+
+// TestMessageDeleteOnlyByAuthor verifies deletes are authorized by author and
+// a deleted message can't be edited afterwards
+func TestMessageDeleteOnlyByAuthor(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	roomKey := "deleteroom"
+
+	aliceConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), roomKey)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	defer aliceConn.Close()
+	bobConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "bob"), roomKey)
+	if err != nil {
+		t.Fatalf("bob dial: %v", err)
+	}
+	defer bobConn.Close()
+	waitForRoomSize(t, server.hub, roomKey, 2)
+
+	if err := aliceConn.WriteJSON(ChatMessage{Body: "oops"}); err != nil {
+		t.Fatalf("alice send: %v", err)
+	}
+	var original ChatMessage
+	readTestJSON(t, aliceConn, &original)
+
+	if err := bobConn.WriteJSON(MessageUpdate{Type: "delete", ID: original.ID}); err != nil {
+		t.Fatalf("bob delete: %v", err)
+	}
+	var notice ChatMessage
+	readTestJSON(t, bobConn, &notice) // alice's original message
+	readTestJSON(t, bobConn, &notice)
+	if notice.User != "system" {
+		t.Fatalf("expected rejection notice, got %+v", notice)
+	}
+
+	if err := aliceConn.WriteJSON(MessageUpdate{Type: "delete", ID: original.ID}); err != nil {
+		t.Fatalf("alice delete: %v", err)
+	}
+	var deleted MessageUpdate
+	readTestJSON(t, bobConn, &deleted)
+	if deleted.Type != "message_deleted" || deleted.ID != original.ID || deleted.Body != "" {
+		t.Fatalf("unexpected delete broadcast: %+v", deleted)
+	}
+
+	readTestJSON(t, aliceConn, &deleted)
+	if err := aliceConn.WriteJSON(MessageUpdate{Type: "edit", ID: original.ID, Body: "back"}); err != nil {
+		t.Fatalf("alice edit: %v", err)
+	}
+	readTestJSON(t, aliceConn, &notice)
+	if notice.User != "system" {
+		t.Fatalf("expected edit of deleted message to be refused, got %+v", notice)
+	}
+}
+
+// TestChatMessageIDsAreServerAssigned verifies every broadcast gets a fresh ID
+// regardless of what the sender put in the payload
+func TestChatMessageIDsAreServerAssigned(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	roomKey := "idroom"
+
+	conn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), roomKey)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	defer conn.Close()
+	waitForRoomSize(t, server.hub, roomKey, 1)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		if err := conn.WriteJSON(ChatMessage{ID: "spoofed", Body: "hi"}); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		var chat ChatMessage
+		readTestJSON(t, conn, &chat)
+		if chat.ID == "" || chat.ID == "spoofed" || seen[chat.ID] {
+			t.Fatalf("expected a fresh server-assigned ID, got %q", chat.ID)
+		}
+		seen[chat.ID] = true
+	}
+
+	// Payloads from clients that predate IDs still decode and encode cleanly
+	var legacy ChatMessage
+	if err := json.Unmarshal([]byte(`{"room":"r","user":"bob","body":"hey","ts":1}`), &legacy); err != nil {
+		t.Fatalf("decode legacy message: %v", err)
+	}
+	encoded, _ := json.Marshal(legacy)
+	if strings.Contains(string(encoded), `"id"`) {
+		t.Errorf("expected empty ID to be omitted, got %s", encoded)
+	}
+}
+
+// TestChatMessagesCarryMillisecondTimestamps verifies the server stamps each
+// message in milliseconds, overriding whatever the client sent, so messages
+// from one burst keep their order
+func TestChatMessagesCarryMillisecondTimestamps(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	roomKey := "msroom"
+
+	conn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), roomKey)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	defer conn.Close()
+	waitForRoomSize(t, server.hub, roomKey, 1)
+
+	var previous int64
+	for i := 0; i < 3; i++ {
+		if err := conn.WriteJSON(ChatMessage{Body: "burst", TsMs: 1}); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		var chat ChatMessage
+		readTestJSON(t, conn, &chat)
+		if chat.TsMs <= 1 || chat.TsMs < previous {
+			t.Fatalf("expected a non-decreasing server timestamp, got %d after %d", chat.TsMs, previous)
+		}
+		if chat.TsMs/1000 != chat.Ts {
+			t.Errorf("expected ts_ms %d to fall within ts %d", chat.TsMs, chat.Ts)
+		}
+		previous = chat.TsMs
+	}
+}
+
+// TestReactionsAggregatePerMessage verifies reactions are counted per emoji
+// across users and that reacting again removes your reaction
+func TestReactionsAggregatePerMessage(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	roomKey := "reactroom"
+
+	aliceConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), roomKey)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	defer aliceConn.Close()
+	bobConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "bob"), roomKey)
+	if err != nil {
+		t.Fatalf("bob dial: %v", err)
+	}
+	defer bobConn.Close()
+	waitForRoomSize(t, server.hub, roomKey, 2)
+
+	if err := aliceConn.WriteJSON(ChatMessage{Body: "ship it?"}); err != nil {
+		t.Fatalf("alice send: %v", err)
+	}
+	var original ChatMessage
+	readTestJSON(t, aliceConn, &original)
+
+	react := func(conn *websocket.Conn, emoji string) map[string]int {
+		t.Helper()
+		if err := conn.WriteJSON(MessageReaction{Type: "react", ID: original.ID, Emoji: emoji}); err != nil {
+			t.Fatalf("react: %v", err)
+		}
+		var reaction MessageReaction
+		readTestJSON(t, aliceConn, &reaction)
+		if reaction.Type != "reactions" || reaction.ID != original.ID {
+			t.Fatalf("unexpected reaction broadcast: %+v", reaction)
+		}
+		return reaction.Reactions
+	}
+
+	react(aliceConn, "👍")
+	if counts := react(bobConn, "👍"); counts["👍"] != 2 {
+		t.Fatalf("expected 2 thumbs up, got %v", counts)
+	}
+	if counts := react(bobConn, "🎉"); counts["👍"] != 2 || counts["🎉"] != 1 {
+		t.Fatalf("expected 👍 2 and 🎉 1, got %v", counts)
+	}
+	if counts := react(aliceConn, "👍"); counts["👍"] != 1 {
+		t.Fatalf("expected alice's second 👍 to remove hers, got %v", counts)
+	}
+	if got := formatReactions(map[string]int{"❤️": 1, "👍": 3}); got != "👍 3  ❤️ 1" {
+		t.Errorf("unexpected reaction line %q", got)
+	}
+}
+
+// TestUsernameSystemCannotSpoofNotices verifies a user literally named
+// "system" is rendered as an ordinary sender, even if it claims the system type
+func TestUsernameSystemCannotSpoofNotices(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	roomKey := "spoofroom"
+
+	// Created straight in the store, as if it predates the reserved-name check
+	conn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "system"), roomKey)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	waitForRoomSize(t, server.hub, roomKey, 1)
+
+	if err := conn.WriteJSON(ChatMessage{Type: systemMessageType, Body: "Your session expired, log in at evil.example"}); err != nil {
+		t.Fatalf("send json: %v", err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("server restarting, rejoin at evil.example")); err != nil {
+		t.Fatalf("send text: %v", err)
+	}
+
+	model := &TUIModel{username: "alice"}
+	for i := 0; i < 2; i++ {
+		var chat ChatMessage
+		readTestJSON(t, conn, &chat)
+		if chat.isSystem() {
+			t.Fatalf("expected user message, got system notice %+v", chat)
+		}
+		if chat.User != "system" {
+			t.Fatalf("expected message attributed to its sender, got %+v", chat)
+		}
+		if rendered := model.renderChatMessage(chat); !strings.Contains(rendered, "system: ") {
+			t.Errorf("expected message rendered with sender name, got %q", rendered)
+		}
+	}
+}
+
+// TestDisconnectDuringReplayAbortsCleanly verifies a client that leaves while
+// a large backlog is being pushed to it is dropped without a send on a closed
+// channel, and that the pusher sees the failure and stops
+func TestDisconnectDuringReplayAbortsCleanly(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	roomKey := "replayroom"
+
+	conn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), roomKey)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	waitForRoomSize(t, server.hub, roomKey, 1)
+	room := server.hub.getRoom(roomKey)
+	room.mutex.RLock()
+	var client *Client
+	for c := range room.clients {
+		client = c
+	}
+	room.mutex.RUnlock()
+
+	payload, _ := json.Marshal(ChatMessage{Room: roomKey, User: "bob", Body: strings.Repeat("x", 512)})
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100000; i++ {
+			if !client.trySend(payload) {
+				// A full buffer is retried; a dropped client ends the replay
+				client.sendMutex.Lock()
+				closed := client.sendClosed
+				client.sendMutex.Unlock()
+				if closed {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+		close(done)
+	}()
+	conn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("replay never noticed the disconnect")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for server.hub.getRoom(roomKey) != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if server.hub.getRoom(roomKey) != nil {
+		t.Error("expected the empty room to be removed")
+	}
+	if client.trySend(payload) {
+		t.Error("expected sends to a departed client to be refused")
+	}
+}
+
+// TestTypingNoticesAreRelayedNotStored verifies typing notices reach the room
+// at most once a second per client and never end up in the history
+func TestTypingNoticesAreRelayedNotStored(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	roomKey := "typingroom"
+	aliceConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), roomKey)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	defer aliceConn.Close()
+	bobConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "bob"), roomKey)
+	if err != nil {
+		t.Fatalf("bob dial: %v", err)
+	}
+	defer bobConn.Close()
+	waitForRoomSize(t, server.hub, roomKey, 2)
+
+	for i := 0; i < 3; i++ {
+		if err := aliceConn.WriteJSON(TypingNotice{Type: "typing", User: "mallory"}); err != nil {
+			t.Fatalf("send typing: %v", err)
+		}
+	}
+	if err := aliceConn.WriteJSON(ChatMessage{Body: "hello"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	var typing TypingNotice
+	readTestJSON(t, bobConn, &typing)
+	if typing.Type != "typing" || typing.User != "alice" || typing.Room != roomKey {
+		t.Fatalf("unexpected typing notice %+v", typing)
+	}
+	// The repeats inside the interval were dropped, and the typing notices
+	// didn't use up alice's chat rate limit
+	var chat ChatMessage
+	readTestJSON(t, bobConn, &chat)
+	if chat.Type != "" || chat.Body != "hello" {
+		t.Fatalf("expected the chat message next, got %+v", chat)
+	}
+
+	history, err := server.store.ListMessages(context.Background(), roomKey, 10, time.Time{})
+	if err != nil {
+		t.Fatalf("ListMessages: %v", err)
+	}
+	var stored []storage.Message
+	for _, m := range history {
+		if m.Username != "system" { // join announcements are saved too
+			stored = append(stored, m)
+		}
+	}
+	if len(stored) != 1 || stored[0].Body != "hello" {
+		t.Fatalf("expected only the chat message stored, got %+v", history)
+	}
+}
+
+// TestTypingStoppedFollowsTyping verifies a stop notice is only relayed after
+// a typing notice, and doesn't let the next typing notice skip the throttle
+func TestTypingStoppedFollowsTyping(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	roomKey := "typingstoproom"
+	aliceConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), roomKey)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	defer aliceConn.Close()
+	bobConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "bob"), roomKey)
+	if err != nil {
+		t.Fatalf("bob dial: %v", err)
+	}
+	defer bobConn.Close()
+	waitForRoomSize(t, server.hub, roomKey, 2)
+
+	for _, notice := range []string{"typing_stopped", "typing", "typing_stopped", "typing_stopped", "typing"} {
+		if err := aliceConn.WriteJSON(TypingNotice{Type: notice}); err != nil {
+			t.Fatalf("send %s: %v", notice, err)
+		}
+	}
+	if err := aliceConn.WriteJSON(ChatMessage{Body: "done"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	for _, want := range []string{"typing", "typing_stopped"} {
+		var notice TypingNotice
+		readTestJSON(t, bobConn, &notice)
+		if notice.Type != want || notice.User != "alice" {
+			t.Fatalf("expected %s from alice, got %+v", want, notice)
+		}
+	}
+	var chat ChatMessage
+	readTestJSON(t, bobConn, &chat)
+	if chat.Body != "done" {
+		t.Fatalf("expected the chat message next, got %+v", chat)
+	}
+}
+
+// TestTypingAlternationIsThrottled verifies a client flipping between typing
+// and stopped as fast as it can gets no more than one of each relayed per
+// typingRelayInterval
+func TestTypingAlternationIsThrottled(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	roomKey := "typingfloodroom"
+	aliceConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), roomKey)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	defer aliceConn.Close()
+	bobConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "bob"), roomKey)
+	if err != nil {
+		t.Fatalf("bob dial: %v", err)
+	}
+	defer bobConn.Close()
+	waitForRoomSize(t, server.hub, roomKey, 2)
+
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		for _, notice := range []string{"typing", "typing_stopped"} {
+			if err := aliceConn.WriteJSON(TypingNotice{Type: notice}); err != nil {
+				t.Fatalf("send %s: %v", notice, err)
+			}
+		}
+	}
+	if err := aliceConn.WriteJSON(ChatMessage{Body: "done"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	allowed := 2 * (int(time.Since(start)/typingRelayInterval) + 1)
+
+	relayed := 0
+	for {
+		var frame struct {
+			Type string `json:"type"`
+			Body string `json:"body"`
+		}
+		readTestJSON(t, bobConn, &frame)
+		if frame.Body == "done" {
+			break
+		}
+		if frame.Type == "typing" || frame.Type == "typing_stopped" {
+			relayed++
+		}
+	}
+	if relayed > allowed {
+		t.Fatalf("expected at most %d typing notices relayed, got %d", allowed, relayed)
+	}
+}
+
+// TestConfiguredRateLimit verifies the server's own burst and window are
+// applied per connection, and that unset options fall back to the defaults
+func TestConfiguredRateLimit(t *testing.T) {
+	defaults := NewServerWithOptions(newTestStore(t), ServerOptions{})
+	if defaults.messageLimit.window != DefaultRateLimitWindow || defaults.messageLimit.burst != DefaultRateLimitBurst {
+		t.Fatalf("expected the default rate limit, got %+v", defaults.messageLimit)
+	}
+
+	server, httpServer := newTestServer(t)
+	server.messageLimit = rateLimit{window: time.Minute, burst: 2}
+	conn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), "ratelimitroom")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	waitForRoomSize(t, server.hub, "ratelimitroom", 1)
+
+	for i := 0; i < 3; i++ {
+		if err := conn.WriteJSON(ChatMessage{Body: fmt.Sprintf("message %d", i)}); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	// The notice goes straight to alice while her messages go through the
+	// room, so they can arrive in either order
+	var accepted []string
+	notices := 0
+	for i := 0; i < 3; i++ {
+		var chat ChatMessage
+		readTestJSON(t, conn, &chat)
+		if chat.isSystem() && strings.Contains(chat.Body, "too quickly") {
+			notices++
+		} else {
+			accepted = append(accepted, chat.Body)
+		}
+	}
+	if notices != 1 || strings.Join(accepted, ",") != "message 0,message 1" {
+		t.Fatalf("expected two messages and one rate limit notice, got %v and %d notices", accepted, notices)
+	}
+}
+
+// TestLongMessagesRejected verifies the body limit counts every line of a
+// multi-line message and that going over it earns a notice, not a dropped
+// connection
+func TestLongMessagesRejected(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	conn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), "longroom")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	waitForRoomSize(t, server.hub, "longroom", 1)
+
+	line := strings.Repeat("x", 99) + "\n"
+	tooLong := strings.Repeat(line, maxMessageBodyBytes/len(line)+1)
+	if err := conn.WriteJSON(ChatMessage{Body: tooLong}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	var notice ChatMessage
+	readTestJSON(t, conn, &notice)
+	if !notice.isSystem() || !strings.Contains(notice.Body, "at most") {
+		t.Fatalf("expected a too long notice, got %+v", notice)
+	}
+
+	justRight := strings.Repeat(line, maxMessageBodyBytes/len(line))
+	if err := conn.WriteJSON(ChatMessage{Body: justRight}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	var chat ChatMessage
+	readTestJSON(t, conn, &chat)
+	if chat.isSystem() || chat.Body != justRight {
+		t.Fatalf("expected the multi-line message relayed intact, got %d bytes %+v", len(chat.Body), chat.Type)
+	}
+
+	// Every < is escaped to six bytes on the wire, which mustn't trip the
+	// read limit either way
+	escaped := strings.Repeat("<", maxMessageBodyBytes)
+	if err := conn.WriteJSON(ChatMessage{Body: escaped + "<"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	readTestJSON(t, conn, &notice)
+	if !notice.isSystem() || !strings.Contains(notice.Body, "at most") {
+		t.Fatalf("expected a too long notice for the escaped message, got %+v", notice)
+	}
+	if err := conn.WriteJSON(ChatMessage{Body: escaped}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	readTestJSON(t, conn, &chat)
+	if chat.isSystem() || chat.Body != escaped {
+		t.Fatalf("expected the escaped message relayed intact, got %d bytes %+v", len(chat.Body), chat.Type)
+	}
+}
+
+// TestJoinLeaveAnnouncements verifies the room hears when someone joins or
+// leaves, but not when they open a second connection or briefly reconnect,
+// and that the announcements are replayed to later arrivals
+func TestJoinLeaveAnnouncements(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	server.hub.joinLeaveDebounce = 300 * time.Millisecond
+	roomKey := "presenceroom"
+	bobToken := createTestSession(t, server, "bob")
+	aliceConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), roomKey)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	defer aliceConn.Close()
+	next := func() ChatMessage {
+		t.Helper()
+		_ = aliceConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			_, payload, err := aliceConn.ReadMessage()
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if envelopeType(payload) == "presence" {
+				continue
+			}
+			var chat ChatMessage
+			if err := json.Unmarshal(payload, &chat); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			return chat
+		}
+	}
+	if chat := next(); !chat.isSystem() || chat.Body != "alice joined" {
+		t.Fatalf("expected alice's own join, got %+v", chat)
+	}
+	if err := aliceConn.WriteJSON(ChatMessage{Body: "hi"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if chat := next(); chat.Body != "hi" {
+		t.Fatalf("expected alice's message, got %+v", chat)
+	}
+
+	dialBob := func() *websocket.Conn {
+		t.Helper()
+		conn, _, err := dialTestRoom(httpServer, bobToken, roomKey)
+		if err != nil {
+			t.Fatalf("bob dial: %v", err)
+		}
+		return conn
+	}
+	bob := dialBob()
+	if chat := next(); !chat.isSystem() || chat.Body != "bob joined" {
+		t.Fatalf("expected bob's join, got %+v", chat)
+	}
+
+	// A second device, then a quick reconnect, stay quiet
+	bobPhone := dialBob()
+	defer bobPhone.Close()
+	waitForRoomSize(t, server.hub, roomKey, 3)
+	bob.Close()
+	waitForRoomSize(t, server.hub, roomKey, 2)
+	bob = dialBob()
+	defer bob.Close()
+	waitForRoomSize(t, server.hub, roomKey, 3)
+	bobPhone.Close()
+	waitForRoomSize(t, server.hub, roomKey, 2)
+	bob.Close()
+	bob = dialBob()
+	if err := bob.WriteJSON(ChatMessage{Body: "back"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if chat := next(); chat.isSystem() || chat.Body != "back" {
+		t.Fatalf("expected no announcements for bob's reconnects, got %+v", chat)
+	}
+
+	bob.Close()
+	if chat := next(); !chat.isSystem() || chat.Body != "bob left" {
+		t.Fatalf("expected bob's departure, got %+v", chat)
+	}
+
+	carol, _, err := dialTestRoom(httpServer, createTestSession(t, server, "carol"), roomKey)
+	if err != nil {
+		t.Fatalf("carol dial: %v", err)
+	}
+	defer carol.Close()
+	// Announcements come back among the messages they were made between;
+	// alice's join predates the oldest message so it may be left out
+	var replayed []string
+	for len(replayed) == 0 || replayed[len(replayed)-1] != "carol joined" {
+		var chat ChatMessage
+		_ = carol.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if err := carol.ReadJSON(&chat); err != nil {
+			t.Fatalf("read replay: %v", err)
+		}
+		if chat.Body != "" {
+			replayed = append(replayed, chat.Body)
+		}
+	}
+	if got := strings.Join(replayed, ", "); !strings.HasSuffix(got, "hi, bob joined, back, bob left, carol joined") {
+		t.Fatalf("unexpected replay: %s", got)
+	}
+}
+
+// TestRoomPresence verifies everyone in a room is sent the updated member list
+// when someone joins or leaves, with each user listed once
+func TestRoomPresence(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	roomKey := "membersroom"
+	bobToken := createTestSession(t, server, "bob")
+	aliceConn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), roomKey)
+	if err != nil {
+		t.Fatalf("alice dial: %v", err)
+	}
+	defer aliceConn.Close()
+	// waitForMembers reads alice's presence updates until one matches want
+	waitForMembers := func(want string) {
+		t.Helper()
+		_ = aliceConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			_, payload, err := aliceConn.ReadMessage()
+			if err != nil {
+				t.Fatalf("waiting for members %q: %v", want, err)
+			}
+			if envelopeType(payload) != "presence" {
+				continue
+			}
+			var presence RoomPresence
+			if err := json.Unmarshal(payload, &presence); err != nil {
+				t.Fatalf("decode presence: %v", err)
+			}
+			if presence.Room != roomKey {
+				t.Fatalf("presence for the wrong room: %+v", presence)
+			}
+			if strings.Join(presence.Members, ",") == want {
+				return
+			}
+		}
+	}
+	waitForMembers("alice")
+
+	bobPhone, _, err := dialTestRoom(httpServer, bobToken, roomKey)
+	if err != nil {
+		t.Fatalf("bob dial: %v", err)
+	}
+	bobLaptop, _, err := dialTestRoom(httpServer, bobToken, roomKey)
+	if err != nil {
+		t.Fatalf("bob second dial: %v", err)
+	}
+	waitForRoomSize(t, server.hub, roomKey, 3)
+	if got := strings.Join(server.hub.getRoom(roomKey).members(), ","); got != "alice,bob" {
+		t.Fatalf("expected bob listed once, got %q", got)
+	}
+	waitForMembers("alice,bob")
+
+	bobPhone.Close()
+	waitForRoomSize(t, server.hub, roomKey, 2)
+	bobLaptop.Close()
+	waitForMembers("alice")
+}
+
+// TestAllowedOriginsGateWebsockets verifies browsers are only let in from
+// the configured origins, while clients sending no Origin always are and an
+// empty allowlist keeps accepting everyone
+func TestAllowedOriginsGateWebsockets(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	token := createTestSession(t, server, "alice")
+	dial := func(origin string) int {
+		t.Helper()
+		wsURL := "ws" + strings.TrimPrefix(httpServer.URL, "http") + "/join?room=originroom"
+		headers := http.Header{}
+		headers.Set("Authorization", "Bearer "+token)
+		if origin != "" {
+			headers.Set("Origin", origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, headers)
+		if err == nil {
+			conn.Close()
+			return http.StatusSwitchingProtocols
+		}
+		if resp == nil {
+			t.Fatalf("dial from %q: %v", origin, err)
+		}
+		return resp.StatusCode
+	}
+
+	if status := dial("https://evil.example.net"); status != http.StatusSwitchingProtocols {
+		t.Fatalf("expected any origin allowed by default, got %d", status)
+	}
+
+	server.upgrader = newUpgrader([]string{"https://chat.example.com", "https://*.example.org"})
+	for origin, want := range map[string]int{
+		"":                            http.StatusSwitchingProtocols,
+		"https://chat.example.com":    http.StatusSwitchingProtocols,
+		"HTTPS://Chat.Example.com":    http.StatusSwitchingProtocols,
+		"https://team.example.org":    http.StatusSwitchingProtocols,
+		"https://evil.example.net":    http.StatusForbidden,
+		"http://chat.example.com":     http.StatusForbidden,
+		"https://example.org.evil.io": http.StatusForbidden,
+	} {
+		if status := dial(origin); status != want {
+			t.Errorf("origin %q: expected %d, got %d", origin, want, status)
+		}
+	}
+}
+
+// TestIdleRoomsAreReaped verifies a room left empty past the idle timeout is
+// torn down and stopped, while one with members stays put
+func TestIdleRoomsAreReaped(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	server.hub.idleRoomTimeout = time.Minute
+	idle := server.hub.getOrCreateRoom("idleroom")
+
+	conn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), "busyroom")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	waitForRoomSize(t, server.hub, "busyroom", 1)
+
+	if reaped := server.hub.reapIdleRooms(time.Now()); reaped != 0 {
+		t.Fatalf("expected nothing reaped before the timeout, got %d", reaped)
+	}
+	if reaped := server.hub.reapIdleRooms(time.Now().Add(2 * time.Minute)); reaped != 1 {
+		t.Fatalf("expected only the idle room reaped, got %d", reaped)
+	}
+	if server.hub.getRoom("idleroom") != nil {
+		t.Fatalf("expected the idle room removed from the hub")
+	}
+	if server.hub.getRoom("busyroom") == nil {
+		t.Fatalf("expected the occupied room kept")
+	}
+	select {
+	case <-idle.done:
+	default:
+		t.Fatalf("expected the idle room stopped")
+	}
+	// Nothing is listening any more, so this must not block
+	idle.publish([]byte(`{}`))
+
+	// The room comes back fresh for the next arrival
+	again, _, err := dialTestRoom(httpServer, createTestSession(t, server, "bob"), "idleroom")
+	if err != nil {
+		t.Fatalf("redial: %v", err)
+	}
+	defer again.Close()
+	waitForRoomSize(t, server.hub, "idleroom", 1)
+	if server.hub.getRoom("idleroom") == idle {
+		t.Fatalf("expected a new room after the reap")
+	}
+}
+
+// TestShutdownPersistsInFlightMessages verifies a message sent just before
+// shutdown is still saved, and that clients are told the server is going
+func TestShutdownPersistsInFlightMessages(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	// a second handle keeps the in-memory database readable after Shutdown
+	// closes the server's
+	history := newTestStore(t)
+	conn, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), "lobby")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	waitForRoomSize(t, server.hub, "lobby", 1)
+
+	goodbye := make(chan bool, 1)
+	go func() {
+		said := false
+		for {
+			_, payload, err := conn.ReadMessage()
+			if err != nil {
+				goodbye <- said
+				return
+			}
+			var chat ChatMessage
+			if json.Unmarshal(payload, &chat) == nil && chat.isSystem() && strings.Contains(chat.Body, "shutting down") {
+				said = true
+			}
+		}
+	}()
+	if err := conn.WriteJSON(ChatMessage{Body: "last words"}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if !<-goodbye {
+		t.Fatalf("expected a shutdown notice before the connection closed")
+	}
+
+	messages, err := history.ListMessages(context.Background(), "lobby", 10, time.Time{})
+	if err != nil {
+		t.Fatalf("ListMessages: %v", err)
+	}
+	found := false
+	for _, msg := range messages {
+		found = found || msg.Body == "last words"
+	}
+	if !found {
+		t.Fatalf("expected the in-flight message saved, got %+v", messages)
+	}
+	if _, resp, err := dialTestRoom(httpServer, "any", "lobby"); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected new connections refused after shutdown, got %v", err)
+	}
+}
+
+// TestConcurrentRoomCreation verifies rooms opened at once all share one live
+// room, with its saved files attached once
+func TestConcurrentRoomCreation(t *testing.T) {
+	server, _ := newTestServer(t)
+	server.hub.fileStore = server.store
+	saved := storage.RoomFile{ID: "f1", RoomKey: "busyroom", Filename: "a.txt", UploadedBy: "alice", StoragePath: "/tmp/a.txt", UploadedAt: time.Now()}
+	if err := server.store.AddRoomFile(context.Background(), saved); err != nil {
+		t.Fatalf("AddRoomFile: %v", err)
+	}
+	rooms := make([]*Room, 8)
+	var wg sync.WaitGroup
+	for i := range rooms {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rooms[i] = server.hub.getOrCreateRoom("busyroom")
+		}(i)
+	}
+	wg.Wait()
+	for _, room := range rooms[1:] {
+		if room != rooms[0] {
+			t.Fatalf("expected one room for every caller")
+		}
+	}
+	if count := server.hub.roomCount(); count != 1 {
+		t.Fatalf("expected one live room, got %d", count)
+	}
+	if files := rooms[0].listFiles(); len(files) != 1 || files[0].ID != "f1" {
+		t.Fatalf("expected the saved file attached once, got %+v", files)
+	}
+}
+
+// TestRoomCapacity verifies a client joining a full room is closed with a
+// "room full" reason and never counted, while other rooms still take people
+func TestRoomCapacity(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	server.hub.maxRoomSize = 1
+
+	first, _, err := dialTestRoom(httpServer, createTestSession(t, server, "alice"), "lobby")
+	if err != nil {
+		t.Fatalf("dial alice: %v", err)
+	}
+	defer first.Close()
+	waitForRoomSize(t, server.hub, "lobby", 1)
+
+	second, _, err := dialTestRoom(httpServer, createTestSession(t, server, "bob"), "lobby")
+	if err != nil {
+		t.Fatalf("dial bob: %v", err)
+	}
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = second.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseTryAgainLater || closeErr.Text != "room full" {
+		t.Fatalf("expected a room full close, got %v", err)
+	}
+	if size := server.hub.getRoom("lobby").size(); size != 1 {
+		t.Fatalf("expected only alice in the room, got %d", size)
+	}
+
+	other, _, err := dialTestRoom(httpServer, createTestSession(t, server, "bob"), "other")
+	if err != nil {
+		t.Fatalf("dial other room: %v", err)
+	}
+	defer other.Close()
+	waitForRoomSize(t, server.hub, "other", 1)
+}
+
+// TestRoomCapacityUnderRacingJoins verifies joins racing for the last places
+// can't push a room past its capacity
+func TestRoomCapacityUnderRacingJoins(t *testing.T) {
+	hub := NewHub()
+	hub.maxRoomSize = 2
+	room := hub.getOrCreateRoom("racey")
+	defer room.stop()
+
+	results := make(chan error, 10)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			results <- room.join(&Client{room: room, send: make(chan []byte, 16)})
+		}()
+	}
+	joined := 0
+	for i := 0; i < cap(results); i++ {
+		switch err := <-results; {
+		case err == nil:
+			joined++
+		case !errors.Is(err, errRoomFull):
+			t.Fatalf("expected joins past capacity to find the room full, got %v", err)
+		}
+	}
+	if joined != 2 || room.size() != 2 {
+		t.Fatalf("expected exactly 2 joins admitted, got %d with %d in the room", joined, room.size())
+	}
+}
@@ -1,12 +1,17 @@
 package internal
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
@@ -14,6 +19,12 @@ import (
 	"termchat/internal/storage"
 )
 
+// Signup limits, shared with the client's prompts so it can stop typing early
+const (
+	maxUsernameLength = 32 // characters
+	maxPasswordLength = 72 // bytes; bcrypt can't hash anything longer
+)
+
 type signupRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -32,6 +43,7 @@ type friendsResponse struct {
 type friendDTO struct {
 	Username string `json:"username"`
 	Online   bool   `json:"online"`
+	LastSeen int64  `json:"last_seen,omitempty"` // unix seconds; offline friends only, when known
 }
 
 type friendRequestsResponse struct {
@@ -39,11 +51,135 @@ type friendRequestsResponse struct {
 	Outgoing []string `json:"outgoing"`
 }
 
+// blocksResponse lists who the caller has blocked
+type blocksResponse struct {
+	Blocked []string `json:"blocked"`
+}
+
+// bootstrapResponse is the friends screen's initial load in one payload
+type bootstrapResponse struct {
+	Username     string                 `json:"username"`
+	Friends      []friendDTO            `json:"friends"`
+	Requests     friendRequestsResponse `json:"requests"`
+	Capabilities capabilitiesDTO        `json:"capabilities"`
+}
+
+// capabilitiesDTO tells a client the limits this server enforces
+type capabilitiesDTO struct {
+	MaxFileSize     int64  `json:"max_file_size"`
+	MaxMessageBytes int    `json:"max_message_bytes"`
+	HistoryLimit    int    `json:"history_limit"` // messages replayed on join; 0 when replay is off
+	Region          string `json:"region,omitempty"`
+}
+
+// friendRequestResult is returned when sending a request made the users friends
+type friendRequestResult struct {
+	Status string `json:"status"`
+}
+
+// maxFriendBatchSize caps how many usernames one batch request may name
+const maxFriendBatchSize = 50
+
+type batchFriendRequest struct {
+	Usernames []string `json:"usernames"`
+}
+
+// batchFriendResult reports the outcome for one username in a batch:
+// sent, accepted, pending, already_friends, not_found, invalid or error
+type batchFriendResult struct {
+	Username string `json:"username"`
+	Status   string `json:"status"`
+}
+
+type batchFriendResponse struct {
+	Results []batchFriendResult `json:"results"`
+}
+
+// banRequest names the user to disconnect; Disable also stops them logging
+// back in
+type banRequest struct {
+	Username string `json:"username"`
+	Disable  bool   `json:"disable"`
+}
+
+// pingResponse tells a client which relay it reached and the relay's clock,
+// so it can work out its own clock skew
+type pingResponse struct {
+	ServerTimeMs int64  `json:"server_time_ms"`
+	Region       string `json:"region,omitempty"`
+}
+
+type banResponse struct {
+	Username          string `json:"username"`
+	SessionsRevoked   int64  `json:"sessions_revoked"`
+	ConnectionsClosed int    `json:"connections_closed"`
+	Disabled          bool   `json:"disabled"`
+}
+
+// roomBanRequest names a user to ban from (POST) or let back into (DELETE)
+// a room
+type roomBanRequest struct {
+	Room     string `json:"room"`
+	Username string `json:"username"`
+}
+
+// accountStatusRequest disables or re-enables an account. Users may leave
+// Username empty to mean themselves.
+type accountStatusRequest struct {
+	Username string `json:"username"`
+	Disabled bool   `json:"disabled"`
+}
+
+type accountStatusResponse struct {
+	Username string `json:"username"`
+	Disabled bool   `json:"disabled"`
+}
+
+// Audit log events
+const (
+	auditSignup             = "signup"
+	auditLogin              = "login"
+	auditLoginFailed        = "login_failed"
+	auditLogout             = "logout"
+	auditLogoutAll          = "logout_all"
+	auditPasswordChanged    = "password_changed"
+	auditAccountDeleted     = "account_deleted"
+	auditAccountDisabled    = "account_disabled"
+	auditAccountEnabled     = "account_enabled"
+	auditUserBlocked        = "user_blocked"
+	auditUserUnblocked      = "user_unblocked"
+	auditOperatorDisconnect = "operator_disconnect"
+)
+
+// defaultAuditLimit and maxAuditLimit bound how many entries /admin/audit
+// returns
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+type auditEventDTO struct {
+	Event    string    `json:"event"`
+	UserID   int64     `json:"user_id"`
+	Username string    `json:"username"`
+	Target   string    `json:"target,omitempty"`
+	IP       string    `json:"ip"`
+	Time     time.Time `json:"time"`
+}
+
+type auditLogResponse struct {
+	Events []auditEventDTO `json:"events"`
+}
+
 type passwordChangeRequest struct {
 	Current string `json:"current_password"`
 	New     string `json:"new_password"`
 }
 
+type accountDeleteRequest struct {
+	Password string `json:"password"`
+}
+
 func (s *Server) HandleSignup(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		methodNotAllowed(w, http.MethodPost)
@@ -64,12 +200,29 @@ func (s *Server) HandleSignup(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, errors.New("username and password are required"))
 		return
 	}
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if utf8.RuneCountInString(username) > maxUsernameLength {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("username must be at most %d characters", maxUsernameLength))
+		return
+	}
+	if !validUsernameChars(username) {
+		writeError(w, http.StatusBadRequest, errors.New("username can only contain letters and numbers"))
+		return
+	}
+	if len(password) > maxPasswordLength {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("password must be at most %d bytes", maxPasswordLength))
+		return
+	}
+	if s.isReservedUsername(username) {
+		writeError(w, http.StatusBadRequest, errors.New("username is reserved"))
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), s.bcryptCost)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	if _, err := s.store.CreateUser(r.Context(), username, hash); err != nil {
+	userID, err := s.store.CreateUser(r.Context(), username, hash)
+	if err != nil {
 		if errors.Is(err, storage.ErrUserExists) {
 			writeError(w, http.StatusConflict, errors.New("username already taken"))
 			return
@@ -77,6 +230,7 @@ func (s *Server) HandleSignup(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	s.audit(r, auditSignup, userID, username)
 	s.metrics.IncSignup()
 	writeJSON(w, http.StatusCreated, map[string]string{"username": username})
 }
@@ -107,9 +261,19 @@ func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if user == nil || bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password)) != nil {
+		userID := int64(0)
+		if user != nil {
+			userID = user.ID
+		}
+		s.audit(r, auditLoginFailed, userID, username)
 		writeError(w, http.StatusUnauthorized, errors.New("invalid credentials"))
 		return
 	}
+	if user.Disabled {
+		s.audit(r, auditLoginFailed, user.ID, user.Username)
+		writeError(w, http.StatusForbidden, errors.New("account disabled"))
+		return
+	}
 
 	token := uuid.NewString()
 	expiresAt := time.Now().Add(s.tokenTTL)
@@ -117,6 +281,7 @@ func (s *Server) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	s.audit(r, auditLogin, user.ID, user.Username)
 	s.metrics.IncLogin()
 	writeJSON(w, http.StatusOK, loginResponse{Token: token, Username: user.Username, ExpiresAt: expiresAt})
 }
@@ -139,6 +304,32 @@ func (s *Server) HandleLogout(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	s.audit(r, auditLogout, authCtx.UserID, authCtx.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleLogoutAll revokes every session the caller holds, this one included,
+// and closes their open connections, e.g. after a token has leaked.
+func (s *Server) HandleLogoutAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	authCtx, err := s.authenticateRequest(r)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errUnauthorized) {
+			status = http.StatusUnauthorized
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if _, err := s.store.DeleteUserSessions(r.Context(), authCtx.UserID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.hub.disconnectUser(authCtx.UserID, "You have been signed out everywhere.")
+	s.audit(r, auditLogoutAll, authCtx.UserID, authCtx.Username)
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -161,24 +352,39 @@ func (s *Server) handleListFriends(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(status), status)
 		return
 	}
-	friends, err := s.store.ListFriends(r.Context(), authCtx.UserID)
+	friends, err := s.friendList(r.Context(), authCtx.UserID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	writeJSON(w, http.StatusOK, friendsResponse{Friends: friends})
+}
+
+// friendList returns a user's friends with their presence
+func (s *Server) friendList(ctx context.Context, userID int64) ([]friendDTO, error) {
+	friends, err := s.store.ListFriends(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
 	names := make([]friendDTO, 0, len(friends))
 	for _, friend := range friends {
-		names = append(names, friendDTO{
+		dto := friendDTO{
 			Username: friend.Username,
 			Online:   s.presence.Online(friend.ID),
-		})
+		}
+		if seen, ok := s.presence.LastSeen(friend.ID); ok && !dto.Online {
+			dto.LastSeen = seen.Unix()
+		}
+		names = append(names, dto)
 	}
-	writeJSON(w, http.StatusOK, friendsResponse{Friends: names})
+	return names, nil
 }
 
+// HandleAddFriend serves /friends/{username}: POST befriends them outright and
+// DELETE ends the friendship for both sides.
 func (s *Server) HandleAddFriend(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		methodNotAllowed(w, http.MethodPost)
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		methodNotAllowed(w, "POST, DELETE")
 		return
 	}
 	authCtx, err := s.authenticateRequest(r)
@@ -209,6 +415,27 @@ func (s *Server) HandleAddFriend(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
+	if r.Method == http.MethodDelete {
+		// Only the friendship goes; presence and any open direct chat are left alone
+		removed, err := s.store.RemoveFriendship(r.Context(), authCtx.UserID, friend.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if !removed {
+			writeError(w, http.StatusNotFound, errors.New("not friends"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if blocked, err := s.store.IsBlocked(r.Context(), authCtx.UserID, friend.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if blocked {
+		writeError(w, http.StatusForbidden, errBlocked)
+		return
+	}
 	if err := s.store.AddFriendship(r.Context(), authCtx.UserID, friend.ID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -216,16 +443,109 @@ func (s *Server) HandleAddFriend(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// errBlocked doesn't say which of the two set the block
+var errBlocked = errors.New("you can't befriend or message this user")
+
+// HandleBlock serves /blocks/{username}: POST blocks them, which also ends any
+// friendship or pending request and closes a direct message in progress, and
+// DELETE lifts our block. GET /blocks lists who we've blocked.
+func (s *Server) HandleBlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && strings.Trim(strings.TrimPrefix(r.URL.Path, "/blocks"), "/") == "" {
+		s.handleListBlocks(w, r)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		methodNotAllowed(w, "POST, DELETE")
+		return
+	}
+	authCtx, err := s.authenticateRequest(r)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errUnauthorized) {
+			status = http.StatusUnauthorized
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	username := strings.TrimSpace(strings.TrimPrefix(r.URL.Path, "/blocks/"))
+	if username == "" {
+		writeError(w, http.StatusBadRequest, errors.New("username required"))
+		return
+	}
+	if strings.EqualFold(username, authCtx.Username) {
+		writeError(w, http.StatusBadRequest, errors.New("cannot block yourself"))
+		return
+	}
+	user, err := s.store.GetUserByUsername(r.Context(), username)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if user == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if err := s.store.UnblockUser(r.Context(), authCtx.UserID, user.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.recordAudit(r, storage.AuditEvent{Event: auditUserUnblocked, UserID: authCtx.UserID, Username: authCtx.Username, Target: user.Username})
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := s.store.BlockUser(r.Context(), authCtx.UserID, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.recordAudit(r, storage.AuditEvent{Event: auditUserBlocked, UserID: authCtx.UserID, Username: authCtx.Username, Target: user.Username})
+	if room := s.hub.getRoom(directRoomKey(authCtx.Username, user.Username)); room != nil {
+		room.disconnectUser(user.ID, "This conversation is no longer available.")
+		room.disconnectUser(authCtx.UserID, "This conversation is no longer available.")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleListBlocks(w http.ResponseWriter, r *http.Request) {
+	authCtx, err := s.authenticateRequest(r)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errUnauthorized) {
+			status = http.StatusUnauthorized
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	users, err := s.store.ListBlockedUsers(r.Context(), authCtx.UserID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	resp := blocksResponse{Blocked: make([]string, 0, len(users))}
+	for _, user := range users {
+		resp.Blocked = append(resp.Blocked, user.Username)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
 func (s *Server) HandleFriendRequests(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		s.listFriendRequests(w, r)
+	case http.MethodPost:
+		s.HandleBatchFriendRequests(w, r)
 	default:
-		methodNotAllowed(w, http.MethodGet)
+		methodNotAllowed(w, http.MethodGet+", "+http.MethodPost)
 	}
 }
 
-func (s *Server) listFriendRequests(w http.ResponseWriter, r *http.Request) {
+// HandleBatchFriendRequests sends friend requests to a list of usernames.
+// Each username gets its own result so one bad name doesn't fail the batch.
+func (s *Server) HandleBatchFriendRequests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
 	authCtx, err := s.authenticateRequest(r)
 	if err != nil {
 		status := http.StatusInternalServerError
@@ -235,16 +555,96 @@ func (s *Server) listFriendRequests(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(status), status)
 		return
 	}
-	incoming, err := s.store.ListIncomingFriendRequests(r.Context(), authCtx.UserID)
+	var req batchFriendRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Usernames) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("usernames required"))
+		return
+	}
+	if len(req.Usernames) > maxFriendBatchSize {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("too many usernames (max %d)", maxFriendBatchSize))
+		return
+	}
+
+	resp := batchFriendResponse{Results: make([]batchFriendResult, 0, len(req.Usernames))}
+	seen := make(map[string]bool, len(req.Usernames))
+	for _, username := range req.Usernames {
+		username = strings.TrimSpace(username)
+		if username == "" || seen[username] {
+			continue
+		}
+		seen[username] = true
+		resp.Results = append(resp.Results, batchFriendResult{
+			Username: username,
+			Status:   s.batchFriendRequestStatus(r.Context(), authCtx.UserID, username),
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) batchFriendRequestStatus(ctx context.Context, userID int64, username string) string {
+	friend, err := s.store.GetUserByUsername(ctx, username)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		return "error"
+	}
+	if friend == nil {
+		return "not_found"
+	}
+	if friend.ID == userID {
+		return "invalid"
+	}
+	if blocked, err := s.store.IsBlocked(ctx, userID, friend.ID); err != nil {
+		return "error"
+	} else if blocked {
+		return "blocked"
+	}
+	accepted, err := s.store.CreateFriendRequest(ctx, userID, friend.ID)
+	if errors.Is(err, storage.ErrFriendRequestExists) {
+		if areFriends, _ := s.store.AreFriends(ctx, userID, friend.ID); areFriends {
+			return "already_friends"
+		}
+		return "pending"
+	}
+	if err != nil {
+		return "error"
+	}
+	if accepted {
+		return "accepted"
+	}
+	return "sent"
+}
+
+func (s *Server) listFriendRequests(w http.ResponseWriter, r *http.Request) {
+	authCtx, err := s.authenticateRequest(r)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errUnauthorized) {
+			status = http.StatusUnauthorized
+		}
+		http.Error(w, http.StatusText(status), status)
 		return
 	}
-	outgoing, err := s.store.ListOutgoingFriendRequests(r.Context(), authCtx.UserID)
+	resp, err := s.pendingFriendRequests(r.Context(), authCtx.UserID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// pendingFriendRequests lists who a user has requests from and to
+func (s *Server) pendingFriendRequests(ctx context.Context, userID int64) (friendRequestsResponse, error) {
+	incoming, err := s.store.ListIncomingFriendRequests(ctx, userID)
+	if err != nil {
+		return friendRequestsResponse{}, err
+	}
+	outgoing, err := s.store.ListOutgoingFriendRequests(ctx, userID)
+	if err != nil {
+		return friendRequestsResponse{}, err
+	}
 	resp := friendRequestsResponse{
 		Incoming: make([]string, 0, len(incoming)),
 		Outgoing: make([]string, 0, len(outgoing)),
@@ -255,7 +655,48 @@ func (s *Server) listFriendRequests(w http.ResponseWriter, r *http.Request) {
 	for _, u := range outgoing {
 		resp.Outgoing = append(resp.Outgoing, u.Username)
 	}
-	writeJSON(w, http.StatusOK, resp)
+	return resp, nil
+}
+
+// HandleBootstrap returns everything the friends screen needs after login in
+// one response: who the session belongs to, their friends and presence, their
+// pending requests and what this server allows. The individual endpoints
+// remain for refreshes.
+func (s *Server) HandleBootstrap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	authCtx, err := s.authenticateRequest(r)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errUnauthorized) {
+			status = http.StatusUnauthorized
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	friends, err := s.friendList(r.Context(), authCtx.UserID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	requests, err := s.pendingFriendRequests(r.Context(), authCtx.UserID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, bootstrapResponse{
+		Username: authCtx.Username,
+		Friends:  friends,
+		Requests: requests,
+		Capabilities: capabilitiesDTO{
+			MaxFileSize:     s.fileHandler.maxFileSize,
+			MaxMessageBytes: maxMessageBodyBytes,
+			HistoryLimit:    max(s.historyLimit, 0),
+			Region:          s.region,
+		},
+	})
 }
 
 func (s *Server) HandleCreateFriendRequest(w http.ResponseWriter, r *http.Request) {
@@ -286,7 +727,15 @@ func (s *Server) HandleCreateFriendRequest(w http.ResponseWriter, r *http.Reques
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
-	if err := s.store.CreateFriendRequest(r.Context(), authCtx.UserID, friend.ID); err != nil {
+	if blocked, err := s.store.IsBlocked(r.Context(), authCtx.UserID, friend.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if blocked {
+		writeError(w, http.StatusForbidden, errBlocked)
+		return
+	}
+	accepted, err := s.store.CreateFriendRequest(r.Context(), authCtx.UserID, friend.ID)
+	if err != nil {
 		if errors.Is(err, storage.ErrFriendRequestExists) {
 			writeError(w, http.StatusConflict, err)
 			return
@@ -294,6 +743,11 @@ func (s *Server) HandleCreateFriendRequest(w http.ResponseWriter, r *http.Reques
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if accepted {
+		// They had already asked us, so the request was accepted on the spot
+		writeJSON(w, http.StatusOK, friendRequestResult{Status: "accepted"})
+		return
+	}
 	w.WriteHeader(http.StatusAccepted)
 }
 
@@ -374,6 +828,10 @@ func (s *Server) HandlePasswordChange(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, errors.New("both current and new passwords required"))
 		return
 	}
+	if len(req.New) > maxPasswordLength {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("password must be at most %d bytes", maxPasswordLength))
+		return
+	}
 	user, err := s.store.GetUserByID(r.Context(), authCtx.UserID)
 	if err != nil || user == nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -383,7 +841,7 @@ func (s *Server) HandlePasswordChange(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusUnauthorized, errors.New("current password incorrect"))
 		return
 	}
-	hash, err := bcrypt.GenerateFromPassword([]byte(req.New), bcrypt.DefaultCost)
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.New), s.bcryptCost)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -392,23 +850,386 @@ func (s *Server) HandlePasswordChange(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	s.audit(r, auditPasswordChanged, authCtx.UserID, authCtx.Username)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// HandleDeleteAccount deletes the caller's account once they confirm their
+// password. Sessions, friendships, requests and blocks go with it; messages
+// and files they shared stay in their rooms, and the username can't be signed
+// up again, so nobody inherits their DMs. A wrong password is 403 rather than
+// 401 so clients don't mistake it for an expired session.
+func (s *Server) HandleDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	authCtx, err := s.authenticateRequest(r)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errUnauthorized) {
+			status = http.StatusUnauthorized
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	var req accountDeleteRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if strings.TrimSpace(req.Password) == "" {
+		writeError(w, http.StatusBadRequest, errors.New("password required"))
+		return
+	}
+	user, err := s.store.GetUserByID(r.Context(), authCtx.UserID)
+	if err != nil || user == nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(req.Password)) != nil {
+		writeError(w, http.StatusForbidden, errors.New("password incorrect"))
+		return
+	}
+	if err := s.store.DeleteUser(r.Context(), authCtx.UserID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.hub.disconnectUser(authCtx.UserID, "Your account has been deleted.")
+	s.audit(r, auditAccountDeleted, authCtx.UserID, authCtx.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleBanUser lets an operator sign a user out everywhere: every session is
+// revoked and every open connection closed. With disable set the account is
+// also locked so they can't log back in.
+func (s *Server) HandleBanUser(w http.ResponseWriter, r *http.Request) {
+	if s.adminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if !s.isAdminRequest(r) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	var req banRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	username := strings.TrimSpace(req.Username)
+	if username == "" {
+		writeError(w, http.StatusBadRequest, errors.New("username is required"))
+		return
+	}
+	ctx := r.Context()
+	user, err := s.store.GetUserByUsername(ctx, username)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if user == nil {
+		writeError(w, http.StatusNotFound, errors.New("user not found"))
+		return
+	}
+	// Disable first so a login racing the ban can't slip a new session in
+	if req.Disable {
+		if err := s.store.SetUserDisabled(ctx, user.ID, true); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.audit(r, auditAccountDisabled, user.ID, user.Username)
+	}
+	revoked, err := s.store.DeleteUserSessions(ctx, user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	closed := s.hub.disconnectUser(user.ID, "You have been disconnected by an operator.")
+	s.audit(r, auditOperatorDisconnect, user.ID, user.Username)
+	log.Printf("operator disconnected %s: %d sessions revoked, %d connections closed, disabled=%t", user.Username, revoked, closed, req.Disable || user.Disabled)
+	writeJSON(w, http.StatusOK, banResponse{
+		Username:          user.Username,
+		SessionsRevoked:   revoked,
+		ConnectionsClosed: closed,
+		Disabled:          req.Disable || user.Disabled,
+	})
+}
+
+// HandleRoomBan lets an operator remove a user from a room for good (POST),
+// closing their connections there, or lift the ban again (DELETE). Banned
+// users are refused when they try to rejoin.
+func (s *Server) HandleRoomBan(w http.ResponseWriter, r *http.Request) {
+	if s.adminToken == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		methodNotAllowed(w, "POST, DELETE")
+		return
+	}
+	if !s.isAdminRequest(r) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	var req roomBanRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	roomKey := strings.TrimSpace(req.Room)
+	username := strings.TrimSpace(req.Username)
+	if roomKey == "" || username == "" {
+		writeError(w, http.StatusBadRequest, errors.New("room and username are required"))
+		return
+	}
+	ctx := r.Context()
+	user, err := s.store.GetUserByUsername(ctx, username)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if user == nil {
+		writeError(w, http.StatusNotFound, errors.New("user not found"))
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if err := s.store.UnbanFromRoom(ctx, roomKey, user.ID); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := s.store.BanFromRoom(ctx, roomKey, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if room := s.hub.getRoom(roomKey); room != nil {
+		room.disconnectUser(user.ID, "You have been removed from this room.")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleSetAccountStatus disables or re-enables an account without deleting
+// anything. Operators can change any account; a signed-in user can only
+// deactivate their own. Disabled accounts can't log in or connect, and their
+// open connections are closed, but sessions are kept so re-enabling restores
+// access.
+func (s *Server) HandleSetAccountStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	isAdmin := s.isAdminRequest(r)
+	var authCtx *AuthContext
+	if !isAdmin {
+		var err error
+		authCtx, err = s.authenticateRequest(r)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errUnauthorized) {
+				status = http.StatusUnauthorized
+			}
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+	}
+	var req accountStatusRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	username := strings.TrimSpace(req.Username)
+	if !isAdmin {
+		if username != "" && username != authCtx.Username {
+			writeError(w, http.StatusForbidden, errors.New("you can only change your own account"))
+			return
+		}
+		if !req.Disabled {
+			// can't happen in practice: a disabled user can't authenticate
+			writeError(w, http.StatusForbidden, errors.New("only an operator can re-enable an account"))
+			return
+		}
+		username = authCtx.Username
+	}
+	if username == "" {
+		writeError(w, http.StatusBadRequest, errors.New("username is required"))
+		return
+	}
+	ctx := r.Context()
+	user, err := s.store.GetUserByUsername(ctx, username)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if user == nil {
+		writeError(w, http.StatusNotFound, errors.New("user not found"))
+		return
+	}
+	if err := s.store.SetUserDisabled(ctx, user.ID, req.Disabled); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	event := auditAccountEnabled
+	if req.Disabled {
+		event = auditAccountDisabled
+	}
+	s.audit(r, event, user.ID, user.Username)
+	if req.Disabled {
+		reason := "Your account has been deactivated."
+		if isAdmin {
+			reason = "Your account has been disabled by an operator."
+		}
+		s.hub.disconnectUser(user.ID, reason)
+	}
+	writeJSON(w, http.StatusOK, accountStatusResponse{Username: user.Username, Disabled: req.Disabled})
+}
+
+// audit records an account security event when the audit log is on. A failed
+// write is logged rather than failing the request.
+func (s *Server) audit(r *http.Request, event string, userID int64, username string) {
+	s.recordAudit(r, storage.AuditEvent{Event: event, UserID: userID, Username: username})
+}
+
+// recordAudit is audit for events that need more than the acting user, such
+// as a block's target. The IP and time are filled in here.
+func (s *Server) recordAudit(r *http.Request, event storage.AuditEvent) {
+	if !s.auditLog {
+		return
+	}
+	event.IP = s.clientIP(r)
+	event.CreatedAt = time.Now()
+	if err := s.store.AddAuditEvent(r.Context(), event); err != nil {
+		log.Printf("audit %s for %q: %v", event.Event, event.Username, err)
+	}
+	if s.auditWriter == nil {
+		return
+	}
+	line, err := json.Marshal(auditEventDTO{Event: event.Event, UserID: event.UserID, Username: event.Username, Target: event.Target, IP: event.IP, Time: event.CreatedAt})
+	if err != nil {
+		return
+	}
+	s.auditMutex.Lock()
+	defer s.auditMutex.Unlock()
+	if _, err := s.auditWriter.Write(append(line, '\n')); err != nil {
+		log.Printf("audit %s for %q: %v", event.Event, event.Username, err)
+	}
+}
+
+// HandleAuditLog lets an operator read the most recent audit entries, newest
+// first. ?limit= asks for more or fewer than the default 100.
+func (s *Server) HandleAuditLog(w http.ResponseWriter, r *http.Request) {
+	if s.adminToken == "" || !s.auditLog {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	if !s.isAdminRequest(r) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	limit := defaultAuditLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("limit must be a positive number"))
+			return
+		}
+		limit = min(parsed, maxAuditLimit)
+	}
+	events, err := s.store.ListAuditEvents(r.Context(), limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	response := auditLogResponse{Events: make([]auditEventDTO, 0, len(events))}
+	for _, e := range events {
+		response.Events = append(response.Events, auditEventDTO{Event: e.Event, UserID: e.UserID, Username: e.Username, Target: e.Target, IP: e.IP, Time: e.CreatedAt})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Bodies of a 200 from /exists. A room is active while someone is connected;
+// a saved room is empty right now but has history to come back to.
+const (
+	roomStatusActive = "active"
+	roomStatusSaved  = "saved"
+)
+
+// HandlePing reports the server's time and region. It needs no session and
+// no websocket, so clients can call it at any time.
+func (s *Server) HandlePing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, "GET, HEAD")
+		return
+	}
+	writeJSON(w, http.StatusOK, pingResponse{ServerTimeMs: time.Now().UnixMilli(), Region: s.region})
+}
+
+// HandleRoomExists answers 200 for a room worth joining and 404 otherwise,
+// with the body saying whether the room is active or only saved. Clients
+// treat any other status as a failed check rather than a missing room. A
+// direct room is only ever found by its two members, so nobody else can
+// learn whether a pair have talked.
 func (s *Server) HandleRoomExists(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, "GET, HEAD")
+		return
+	}
 	room := r.URL.Query().Get("room")
 	if room == "" {
 		http.Error(w, "missing room", http.StatusBadRequest)
 		return
 	}
+	if isDirectRoom(room) {
+		authCtx, err := s.authenticateRequest(r)
+		if err != nil && !errors.Is(err, errUnauthorized) {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if authCtx == nil || !isDirectRoomMember(room, authCtx.Username) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+	}
 	if s.hub.Exists(room) {
 		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ok"))
+		_, _ = w.Write([]byte(roomStatusActive))
+		return
+	}
+	saved, err := s.store.RoomHasHistory(r.Context(), room)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if saved {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(roomStatusSaved))
 		return
 	}
 	http.Error(w, "not found", http.StatusNotFound)
 }
 
+// validUsernameChars holds signup to the client's rule of ASCII letters and
+// digits, so a name can't carry escape sequences, line breaks or look-alike
+// characters into other users' terminals
+func validUsernameChars(username string) bool {
+	for _, r := range username {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
 func decodeJSON(r *http.Request, out interface{}) error {
 	defer r.Body.Close()
 	decoder := json.NewDecoder(r.Body)
@@ -0,0 +1,902 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestSignupRejectsReservedUsernames verifies names the client renders as
+// special senders can't be registered
+func TestSignupRejectsReservedUsernames(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	for _, username := range []string{"system", "Server", "admin"} {
+		rec := postTestSignup(server, username)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 signing up as %q, got %d", username, rec.Code)
+		}
+	}
+	if rec := postTestSignup(server, "alice"); rec.Code != http.StatusCreated {
+		t.Fatalf("expected alice to sign up, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+// TestSignupCustomReservedUsernames verifies operators can replace the list
+func TestSignupCustomReservedUsernames(t *testing.T) {
+	server := NewServerWithOptions(newTestStore(t), ServerOptions{
+		UploadDir:         t.TempDir(),
+		ReservedUsernames: []string{"support"},
+	})
+	if rec := postTestSignup(server, "support"); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for custom reserved name, got %d", rec.Code)
+	}
+	if rec := postTestSignup(server, "admin"); rec.Code != http.StatusCreated {
+		t.Errorf("expected admin to be allowed with a custom list, got %d", rec.Code)
+	}
+}
+
+// TestSignupRejectsUnsafeUsernames verifies names with escape sequences,
+// line breaks, spaces or punctuation are refused at signup
+func TestSignupRejectsUnsafeUsernames(t *testing.T) {
+	server, _ := newTestServer(t)
+	for _, username := range []string{"bob\u001b[2J", "alice\nsystem", "bob smith", "bob\u202e", "al-ice", "аlice"} {
+		body, _ := json.Marshal(signupRequest{Username: username, Password: "hunter22"})
+		rec := httptest.NewRecorder()
+		server.HandleSignup(rec, httptest.NewRequest(http.MethodPost, "/signup", bytes.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 signing up as %q, got %d", username, rec.Code)
+		}
+	}
+	if rec := postTestSignup(server, "Alice42"); rec.Code != http.StatusCreated {
+		t.Fatalf("expected letters and digits to be accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+// TestSignupEnforcesLengthLimits verifies overlong usernames and passwords
+// get a 400 rather than reaching bcrypt
+func TestSignupEnforcesLengthLimits(t *testing.T) {
+	server, _ := newTestServer(t)
+	if rec := postTestSignup(server, strings.Repeat("a", maxUsernameLength+1)); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a long username, got %d", rec.Code)
+	}
+	if rec := postTestSignup(server, strings.Repeat("a", maxUsernameLength)); rec.Code != http.StatusCreated {
+		t.Errorf("expected a username at the limit to be accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := []byte(`{"username":"bobby","password":"` + strings.Repeat("p", maxPasswordLength+1) + `"}`)
+	rec := httptest.NewRecorder()
+	server.HandleSignup(rec, httptest.NewRequest(http.MethodPost, "/signup", bytes.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a long password, got %d", rec.Code)
+	}
+}
+
+func postTestSignup(server *Server, username string) *httptest.ResponseRecorder {
+	body := []byte(`{"username":"` + username + `","password":"hunter22"}`)
+	req := httptest.NewRequest(http.MethodPost, "/signup", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	server.HandleSignup(rec, req)
+	return rec
+}
+
+// TestBatchFriendRequestsMixedResults verifies each username in a batch gets
+// its own outcome and valid names still go through alongside invalid ones
+func TestBatchFriendRequestsMixedResults(t *testing.T) {
+	server, _ := newTestServer(t)
+	ctx := context.Background()
+	token := createTestSession(t, server, "alice")
+	createTestSession(t, server, "bob")
+	createTestSession(t, server, "carol")
+	dave := createTestSession(t, server, "dave")
+	createTestSession(t, server, "erin")
+
+	alice, _ := server.store.GetUserByUsername(ctx, "alice")
+	carol, _ := server.store.GetUserByUsername(ctx, "carol")
+	erin, _ := server.store.GetUserByUsername(ctx, "erin")
+	if err := server.store.AddFriendship(ctx, alice.ID, carol.ID); err != nil {
+		t.Fatalf("AddFriendship: %v", err)
+	}
+	if _, err := server.store.CreateFriendRequest(ctx, alice.ID, erin.ID); err != nil {
+		t.Fatalf("CreateFriendRequest: %v", err)
+	}
+	// dave already asked alice, so importing him makes them friends
+	daveAuth, _ := server.store.GetSession(ctx, dave)
+	if _, err := server.store.CreateFriendRequest(ctx, daveAuth.UserID, alice.ID); err != nil {
+		t.Fatalf("CreateFriendRequest: %v", err)
+	}
+
+	rec := postTestBatch(server, token, `{"usernames":["bob","carol","dave","erin","ghost","alice","bob"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp batchFriendResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	want := map[string]string{
+		"bob":   "sent",
+		"carol": "already_friends",
+		"dave":  "accepted",
+		"erin":  "pending",
+		"ghost": "not_found",
+		"alice": "invalid",
+	}
+	if len(resp.Results) != len(want) {
+		t.Fatalf("expected %d results (duplicates collapsed), got %+v", len(want), resp.Results)
+	}
+	for _, result := range resp.Results {
+		if want[result.Username] != result.Status {
+			t.Errorf("%s: expected %q, got %q", result.Username, want[result.Username], result.Status)
+		}
+	}
+}
+
+// TestFriendsListReportsLastSeen verifies a friend who has disconnected is
+// listed with when they were last connected, and online friends without it
+func TestFriendsListReportsLastSeen(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	ctx := context.Background()
+	aliceToken := createTestSession(t, server, "alice")
+	bobToken := createTestSession(t, server, "bob")
+	alice, _ := server.store.GetUserByUsername(ctx, "alice")
+	bob, _ := server.store.GetUserByUsername(ctx, "bob")
+	if err := server.store.AddFriendship(ctx, alice.ID, bob.ID); err != nil {
+		t.Fatalf("AddFriendship: %v", err)
+	}
+	listFriends := func() friendDTO {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/friends", nil)
+		req.Header.Set("Authorization", "Bearer "+aliceToken)
+		rec := httptest.NewRecorder()
+		server.HandleFriends(rec, req)
+		var resp friendsResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.Friends) != 1 {
+			t.Fatalf("expected bob listed, got %d: %s", rec.Code, rec.Body.String())
+		}
+		return resp.Friends[0]
+	}
+
+	if friend := listFriends(); friend.Online || friend.LastSeen != 0 {
+		t.Fatalf("expected no last seen before bob ever connected, got %+v", friend)
+	}
+	conn, _, err := dialTestRoom(httpServer, bobToken, "lobby")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	waitForRoomSize(t, server.hub, "lobby", 1)
+	if friend := listFriends(); !friend.Online || friend.LastSeen != 0 {
+		t.Fatalf("expected bob online with no last seen, got %+v", friend)
+	}
+
+	before := time.Now().Unix()
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for server.presence.Online(bob.ID) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if friend := listFriends(); friend.Online || friend.LastSeen < before || friend.LastSeen > time.Now().Unix() {
+		t.Fatalf("expected bob offline and last seen just now, got %+v", friend)
+	}
+}
+
+// TestRemoveFriend verifies DELETE /friends/{username} ends the friendship for
+// both sides while leaving the other person connected
+func TestRemoveFriend(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	ctx := context.Background()
+	aliceToken := createTestSession(t, server, "alice")
+	bobToken := createTestSession(t, server, "bob")
+	alice, _ := server.store.GetUserByUsername(ctx, "alice")
+	bob, _ := server.store.GetUserByUsername(ctx, "bob")
+	if err := server.store.AddFriendship(ctx, alice.ID, bob.ID); err != nil {
+		t.Fatalf("AddFriendship: %v", err)
+	}
+	conn, _, err := dialTestRoom(httpServer, bobToken, directRoomKey("alice", "bob"))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	waitForRoomSize(t, server.hub, directRoomKey("alice", "bob"), 1)
+
+	removeFriend := func(username string) int {
+		req := httptest.NewRequest(http.MethodDelete, "/friends/"+username, nil)
+		req.Header.Set("Authorization", "Bearer "+aliceToken)
+		rec := httptest.NewRecorder()
+		server.HandleAddFriend(rec, req)
+		return rec.Code
+	}
+	if code := removeFriend("bob"); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	if ok, _ := server.store.AreFriends(ctx, bob.ID, alice.ID); ok {
+		t.Fatal("expected the friendship gone for bob too")
+	}
+	if !server.presence.Online(bob.ID) || server.hub.getRoom(directRoomKey("alice", "bob")).size() != 1 {
+		t.Fatal("expected bob to stay connected to the direct room")
+	}
+	if code := removeFriend("bob"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 once no longer friends, got %d", code)
+	}
+	if code := removeFriend("ghost"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown user, got %d", code)
+	}
+}
+
+// TestBatchFriendRequestsSizeLimit verifies oversized batches are refused
+func TestBatchFriendRequestsSizeLimit(t *testing.T) {
+	server, _ := newTestServer(t)
+	token := createTestSession(t, server, "alice")
+	names := make([]string, maxFriendBatchSize+1)
+	for i := range names {
+		names[i] = fmt.Sprintf("user%d", i)
+	}
+	payload, _ := json.Marshal(batchFriendRequest{Usernames: names})
+	if rec := postTestBatch(server, token, string(payload)); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for oversized batch, got %d", rec.Code)
+	}
+}
+
+func postTestBatch(server *Server, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/friend-requests", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	server.HandleFriendRequests(rec, req)
+	return rec
+}
+
+// TestBlockedUsersCantBefriendOrMessage verifies a block ends the friendship,
+// closes and refuses the direct room, and rejects friend requests either way
+// until it's lifted
+func TestBlockedUsersCantBefriendOrMessage(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	ctx := context.Background()
+	aliceToken := createTestSession(t, server, "alice")
+	bobToken := createTestSession(t, server, "bob")
+	alice, _ := server.store.GetUserByUsername(ctx, "alice")
+	bob, _ := server.store.GetUserByUsername(ctx, "bob")
+	if err := server.store.AddFriendship(ctx, alice.ID, bob.ID); err != nil {
+		t.Fatalf("AddFriendship: %v", err)
+	}
+	roomKey := directRoomKey("alice", "bob")
+	bobConn, _, err := dialTestRoom(httpServer, bobToken, roomKey)
+	if err != nil {
+		t.Fatalf("bob dial: %v", err)
+	}
+	defer bobConn.Close()
+	waitForRoomSize(t, server.hub, roomKey, 1)
+
+	do := func(method, path, token string, handler http.HandlerFunc) int {
+		t.Helper()
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+	if code := do(http.MethodPost, "/blocks/alice", aliceToken, server.HandleBlock); code != http.StatusBadRequest {
+		t.Fatalf("expected blocking yourself to be refused, got %d", code)
+	}
+	if code := do(http.MethodPost, "/blocks/bob", aliceToken, server.HandleBlock); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", code)
+	}
+	if ok, _ := server.store.AreFriends(ctx, alice.ID, bob.ID); ok {
+		t.Fatal("expected the block to end the friendship")
+	}
+	listBlocked := func(token string) []string {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/blocks", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		server.HandleBlock(rec, req)
+		var resp blocksResponse
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil {
+			t.Fatalf("list blocks: %d %s", rec.Code, rec.Body.String())
+		}
+		return resp.Blocked
+	}
+	if blocked := listBlocked(aliceToken); len(blocked) != 1 || blocked[0] != "bob" {
+		t.Fatalf("expected alice's block list to be [bob], got %v", blocked)
+	}
+	if blocked := listBlocked(bobToken); len(blocked) != 0 {
+		t.Fatalf("expected bob's block list empty, got %v", blocked)
+	}
+	if _, err := readTestMessage(bobConn, 2*time.Second); err != nil {
+		t.Fatalf("expected bob told why he was disconnected: %v", err)
+	}
+	if _, err := readTestMessage(bobConn, 2*time.Second); err == nil {
+		t.Fatal("expected bob's direct room connection closed")
+	}
+	for _, token := range []string{aliceToken, bobToken} {
+		if _, resp, err := dialTestRoom(httpServer, token, roomKey); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected the direct room refused with 403, got %v", err)
+		}
+	}
+	if code := do(http.MethodPost, "/friend-requests/alice", bobToken, server.HandleCreateFriendRequest); code != http.StatusForbidden {
+		t.Fatalf("expected bob's friend request refused, got %d", code)
+	}
+	if code := do(http.MethodPost, "/friends/bob", aliceToken, server.HandleAddFriend); code != http.StatusForbidden {
+		t.Fatalf("expected befriending a blocked user refused, got %d", code)
+	}
+	rec := postTestBatch(server, bobToken, `{"usernames":["alice"]}`)
+	var resp batchFriendResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.Results) != 1 || resp.Results[0].Status != "blocked" {
+		t.Fatalf("expected alice reported blocked in a batch, got %s", rec.Body.String())
+	}
+	// Group rooms are unaffected
+	if conn, _, err := dialTestRoom(httpServer, bobToken, "lobby"); err != nil {
+		t.Fatalf("expected bob still able to join group rooms: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	if code := do(http.MethodDelete, "/blocks/bob", aliceToken, server.HandleBlock); code != http.StatusNoContent {
+		t.Fatalf("expected 204 unblocking, got %d", code)
+	}
+	if blocked := listBlocked(aliceToken); len(blocked) != 0 {
+		t.Fatalf("expected alice's block list empty after unblocking, got %v", blocked)
+	}
+	conn, _, err := dialTestRoom(httpServer, bobToken, roomKey)
+	if err != nil {
+		t.Fatalf("expected the direct room open again: %v", err)
+	}
+	conn.Close()
+}
+
+// TestBanUserDisconnectsEverywhereAndBlocksLogin verifies an operator ban
+// closes the user's connections in every room, revokes their sessions and,
+// when asked, stops them logging back in
+func TestBanUserDisconnectsEverywhereAndBlocksLogin(t *testing.T) {
+	server := NewServerWithOptions(newTestStore(t), ServerOptions{UploadDir: t.TempDir(), MaxFileSize: 1024 * 1024, AdminToken: "op-secret", AuditLog: true})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/join", server.ServeWS)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	if rec := postTestSignup(server, "mallory"); rec.Code != http.StatusCreated {
+		t.Fatalf("signup: %d %s", rec.Code, rec.Body.String())
+	}
+	malloryToken := createTestSession(t, server, "mallory")
+	bobToken := createTestSession(t, server, "bob")
+
+	var malloryConns []*websocket.Conn
+	for _, roomKey := range []string{"lobby", "other"} {
+		conn, _, err := dialTestRoom(httpServer, malloryToken, roomKey)
+		if err != nil {
+			t.Fatalf("dial %s: %v", roomKey, err)
+		}
+		defer conn.Close()
+		malloryConns = append(malloryConns, conn)
+	}
+	bobConn, _, err := dialTestRoom(httpServer, bobToken, "lobby")
+	if err != nil {
+		t.Fatalf("dial bob: %v", err)
+	}
+	defer bobConn.Close()
+	waitForRoomSize(t, server.hub, "lobby", 2)
+	waitForRoomSize(t, server.hub, "other", 1)
+
+	if rec := postTestBan(server, "wrong", `{"username":"mallory","disable":true}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with a bad operator token, got %d", rec.Code)
+	}
+	rec := postTestBan(server, "op-secret", `{"username":"mallory","disable":true}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ban: %d %s", rec.Code, rec.Body.String())
+	}
+	var resp banResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.ConnectionsClosed != 2 || resp.SessionsRevoked != 1 || !resp.Disabled {
+		t.Fatalf("unexpected ban response %+v", resp)
+	}
+
+	for _, conn := range malloryConns {
+		var notice ChatMessage
+		readTestJSON(t, conn, &notice)
+		if notice.Type != systemMessageType {
+			t.Fatalf("expected a system notice before disconnect, got %+v", notice)
+		}
+		if _, err := readTestMessage(conn, 2*time.Second); err == nil {
+			t.Fatalf("expected mallory's connection to be closed")
+		}
+	}
+	waitForRoomSize(t, server.hub, "lobby", 1)
+
+	if _, httpResp, err := dialTestRoom(httpServer, malloryToken, "lobby"); err == nil || httpResp == nil || httpResp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the revoked session to be rejected, got %v", err)
+	}
+	if rec := postTestLogin(server, "mallory"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected a disabled account to be refused login, got %d", rec.Code)
+	}
+	events, err := server.store.ListAuditEvents(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("ListAuditEvents: %v", err)
+	}
+	var kicked, disabled bool
+	for _, event := range events {
+		kicked = kicked || event.Event == auditOperatorDisconnect && event.Username == "mallory"
+		disabled = disabled || event.Event == auditAccountDisabled && event.Username == "mallory"
+	}
+	if !kicked || !disabled {
+		t.Fatalf("expected the disconnect and the disable audited, got %+v", events)
+	}
+}
+
+// TestBanUserDisabledWithoutAdminToken verifies the endpoint doesn't exist
+// unless the operator configured a token
+func TestBanUserDisabledWithoutAdminToken(t *testing.T) {
+	server, _ := newTestServer(t)
+	if rec := postTestBan(server, "", `{"username":"mallory"}`); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without an admin token, got %d", rec.Code)
+	}
+}
+
+func postTestBan(server *Server, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/admin/ban", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	server.HandleBanUser(rec, req)
+	return rec
+}
+
+// TestAccountStatusDisablesAndReenables verifies a disabled account can't log
+// in or connect, that re-enabling restores its existing sessions, and that
+// users can only deactivate themselves
+func TestAccountStatusDisablesAndReenables(t *testing.T) {
+	server := NewServerWithOptions(newTestStore(t), ServerOptions{UploadDir: t.TempDir(), MaxFileSize: 1024 * 1024, AdminToken: "op-secret"})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/join", server.ServeWS)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	if rec := postTestSignup(server, "alice"); rec.Code != http.StatusCreated {
+		t.Fatalf("signup: %d %s", rec.Code, rec.Body.String())
+	}
+	aliceToken := createTestSession(t, server, "alice")
+	bobToken := createTestSession(t, server, "bob")
+	conn, _, err := dialTestRoom(httpServer, aliceToken, "lobby")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	waitForRoomSize(t, server.hub, "lobby", 1)
+
+	if rec := postTestAccountStatus(server, bobToken, `{"username":"alice","disabled":true}`); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected bob to be refused changing alice's account, got %d", rec.Code)
+	}
+	if rec := postTestAccountStatus(server, "op-secret", `{"username":"alice","disabled":true}`); rec.Code != http.StatusOK {
+		t.Fatalf("disable: %d %s", rec.Code, rec.Body.String())
+	}
+	var notice ChatMessage
+	readTestJSON(t, conn, &notice)
+	if notice.Type != systemMessageType || !strings.Contains(notice.Body, "disabled") {
+		t.Fatalf("expected a notice before disconnect, got %+v", notice)
+	}
+	if rec := postTestLogin(server, "alice"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected login to be refused while disabled, got %d", rec.Code)
+	}
+	if _, resp, err := dialTestRoom(httpServer, aliceToken, "lobby"); err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the websocket to be refused while disabled, got %v", err)
+	}
+
+	if rec := postTestAccountStatus(server, "op-secret", `{"username":"alice","disabled":false}`); rec.Code != http.StatusOK {
+		t.Fatalf("re-enable: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := postTestLogin(server, "alice"); rec.Code != http.StatusOK {
+		t.Fatalf("expected login after re-enabling, got %d", rec.Code)
+	}
+	conn2, _, err := dialTestRoom(httpServer, aliceToken, "lobby")
+	if err != nil {
+		t.Fatalf("expected the old session to work again: %v", err)
+	}
+	conn2.Close()
+
+	// Self-deactivation
+	if rec := postTestAccountStatus(server, bobToken, `{"disabled":true}`); rec.Code != http.StatusOK {
+		t.Fatalf("self-deactivate: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := postTestAccountStatus(server, bobToken, `{"disabled":false}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a deactivated user to be signed out, got %d", rec.Code)
+	}
+}
+
+func postTestAccountStatus(server *Server, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/account/status", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	server.HandleSetAccountStatus(rec, req)
+	return rec
+}
+
+func postTestLogin(server *Server, username string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"`+username+`","password":"hunter22"}`))
+	rec := httptest.NewRecorder()
+	server.HandleLogin(rec, req)
+	return rec
+}
+
+// TestAuditLogRecordsAccountEvents verifies each account security event is
+// written with the user and client IP when the audit log is on, and that
+// operators can read them back newest first
+func TestAuditLogRecordsAccountEvents(t *testing.T) {
+	server := NewServerWithOptions(newTestStore(t), ServerOptions{UploadDir: t.TempDir(), AdminToken: "op-secret", AuditLog: true})
+	send := func(handler http.HandlerFunc, path, token, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	if rec := send(server.HandleSignup, "/signup", "", `{"username":"alice","password":"hunter22"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("signup: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := send(server.HandleLogin, "/login", "", `{"username":"alice","password":"wrong"}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a failed login, got %d", rec.Code)
+	}
+	rec := send(server.HandleLogin, "/login", "", `{"username":"alice","password":"hunter22"}`)
+	var login loginResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &login); err != nil || login.Token == "" {
+		t.Fatalf("login: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := send(server.HandlePasswordChange, "/password/change", login.Token, `{"current_password":"hunter22","new_password":"hunter33"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("password change: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := send(server.HandleLogout, "/logout", login.Token, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("logout: %d", rec.Code)
+	}
+	if rec := send(server.HandleSetAccountStatus, "/account/status", "op-secret", `{"username":"alice","disabled":true}`); rec.Code != http.StatusOK {
+		t.Fatalf("disable: %d %s", rec.Code, rec.Body.String())
+	}
+
+	read := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/admin/audit?limit=10", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		server.HandleAuditLog(rec, req)
+		return rec
+	}
+	if rec := read("wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with a bad operator token, got %d", rec.Code)
+	}
+	rec = read("op-secret")
+	var audit auditLogResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &audit); err != nil {
+		t.Fatalf("decode %s: %v", rec.Body.String(), err)
+	}
+	want := []string{auditAccountDisabled, auditLogout, auditPasswordChanged, auditLogin, auditLoginFailed, auditSignup}
+	if len(audit.Events) != len(want) {
+		t.Fatalf("expected %d events, got %+v", len(want), audit.Events)
+	}
+	for i, event := range audit.Events {
+		if event.Event != want[i] || event.Username != "alice" || event.UserID == 0 || event.IP != "203.0.113.7" || event.Time.IsZero() {
+			t.Errorf("event %d: expected %s for alice from 203.0.113.7, got %+v", i, want[i], event)
+		}
+	}
+}
+
+// TestAuditWriterGetsBlockEvents verifies blocks are audited with who was
+// blocked, and that an audit writer gets each event as a JSON line on top of
+// the database without AuditLog being set too
+func TestAuditWriterGetsBlockEvents(t *testing.T) {
+	var lines bytes.Buffer
+	server := NewServerWithOptions(newTestStore(t), ServerOptions{UploadDir: t.TempDir(), AuditWriter: &lines})
+	token := createTestSession(t, server, "alice")
+	createTestSession(t, server, "bob")
+	for _, method := range []string{http.MethodPost, http.MethodDelete} {
+		req := httptest.NewRequest(method, "/blocks/bob", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		server.HandleBlock(rec, req)
+		if rec.Code != http.StatusNoContent {
+			t.Fatalf("%s /blocks/bob: %d %s", method, rec.Code, rec.Body.String())
+		}
+	}
+
+	want := []string{auditUserBlocked, auditUserUnblocked}
+	written := strings.Split(strings.TrimSpace(lines.String()), "\n")
+	if len(written) != len(want) {
+		t.Fatalf("expected %d audit lines, got %q", len(want), lines.String())
+	}
+	for i, line := range written {
+		var event auditEventDTO
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("decode %q: %v", line, err)
+		}
+		if event.Event != want[i] || event.Username != "alice" || event.UserID == 0 || event.Target != "bob" || event.Time.IsZero() {
+			t.Errorf("line %d: expected %s of bob by alice, got %+v", i, want[i], event)
+		}
+	}
+	stored, err := server.store.ListAuditEvents(context.Background(), 10)
+	if err != nil || len(stored) != len(want) || stored[0].Event != auditUserUnblocked || stored[0].Target != "bob" {
+		t.Fatalf("expected the events in the database too, got %+v %v", stored, err)
+	}
+}
+
+// TestAuditLogOffByDefault verifies nothing is recorded, and the endpoint
+// doesn't exist, unless the operator turns the audit log on
+func TestAuditLogOffByDefault(t *testing.T) {
+	quiet := NewServerWithOptions(newTestStore(t), ServerOptions{UploadDir: t.TempDir(), AdminToken: "op-secret"})
+	if rec := postTestSignup(quiet, "bob"); rec.Code != http.StatusCreated {
+		t.Fatalf("signup: %d", rec.Code)
+	}
+	if events, err := quiet.store.ListAuditEvents(context.Background(), 10); err != nil || len(events) != 0 {
+		t.Fatalf("expected nothing recorded with the audit log off, got %+v %v", events, err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/admin/audit", nil)
+	req.Header.Set("Authorization", "Bearer op-secret")
+	rec := httptest.NewRecorder()
+	quiet.HandleAuditLog(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 with the audit log off, got %d", rec.Code)
+	}
+}
+
+// TestHandlePing verifies /ping reports the server clock and region without
+// needing a session, and that the client turns it into its relay header
+func TestHandlePing(t *testing.T) {
+	server := NewServerWithOptions(newTestStore(t), ServerOptions{UploadDir: t.TempDir(), Region: "fly-iad"})
+	before := time.Now().UnixMilli()
+	rec := httptest.NewRecorder()
+	server.HandlePing(rec, httptest.NewRequest(http.MethodGet, "/ping", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp pingResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.Region != "fly-iad" || resp.ServerTimeMs < before || resp.ServerTimeMs > time.Now().UnixMilli() {
+		t.Fatalf("unexpected ping reply %+v", resp)
+	}
+	rec = httptest.NewRecorder()
+	server.HandlePing(rec, httptest.NewRequest(http.MethodPost, "/ping", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 for POST, got %d", rec.Code)
+	}
+
+	// A server clock 2s behind ours shows as +2.0s of skew
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, pingResponse{ServerTimeMs: time.Now().Add(-2 * time.Second).UnixMilli(), Region: "fly-iad"})
+	}))
+	defer httpServer.Close()
+	t.Setenv("HOME", t.TempDir())
+	model := NewTUIModel("ws"+strings.TrimPrefix(httpServer.URL, "http")+"/join", "lobby", "alice")
+	model.mode = modeChat
+	model.Update(model.relayInfoCmd()())
+	if view := model.View(); !strings.Contains(view, "relay: fly-iad, skew +2.0s") {
+		t.Fatalf("expected the relay in the header, got:\n%s", view)
+	}
+}
+
+// TestLogoutAll verifies signing out everywhere revokes every one of the
+// caller's sessions and connections but leaves other users alone
+func TestLogoutAll(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	laptop := createTestSession(t, server, "alice")
+	phone := createTestSession(t, server, "alice")
+	bob := createTestSession(t, server, "bob")
+	conn, _, err := dialTestRoom(httpServer, phone, "lobby")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	bobConn, _, err := dialTestRoom(httpServer, bob, "lobby")
+	if err != nil {
+		t.Fatalf("dial bob: %v", err)
+	}
+	defer bobConn.Close()
+	waitForRoomSize(t, server.hub, "lobby", 2)
+
+	req := httptest.NewRequest(http.MethodPost, "/logout-all", nil)
+	req.Header.Set("Authorization", "Bearer "+laptop)
+	rec := httptest.NewRecorder()
+	server.HandleLogoutAll(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("logout-all: %d %s", rec.Code, rec.Body.String())
+	}
+
+	ctx := context.Background()
+	for _, token := range []string{laptop, phone} {
+		if session, err := server.store.GetSession(ctx, token); err != nil || session != nil {
+			t.Fatalf("expected %s revoked, got %+v (%v)", token, session, err)
+		}
+	}
+	if session, err := server.store.GetSession(ctx, bob); err != nil || session == nil {
+		t.Fatalf("expected bob's session kept, got %+v (%v)", session, err)
+	}
+	waitForRoomSize(t, server.hub, "lobby", 1)
+	if _, httpResp, err := dialTestRoom(httpServer, phone, "lobby"); err == nil || httpResp == nil || httpResp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the revoked session to be rejected, got %v", err)
+	}
+	// The token that asked is gone too
+	rec = httptest.NewRecorder()
+	server.HandleLogoutAll(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the caller's own token rejected afterwards, got %d", rec.Code)
+	}
+}
+
+// TestDeleteAccount verifies deleting an account needs the password, then
+// removes the user with their friendships and closes their connections, and
+// retires the username so a later signup can't take over their DMs
+func TestDeleteAccount(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	ctx := context.Background()
+	if rec := postTestSignup(server, "alice"); rec.Code != http.StatusCreated {
+		t.Fatalf("signup: %d %s", rec.Code, rec.Body.String())
+	}
+	var login loginResponse
+	if rec := postTestLogin(server, "alice"); json.Unmarshal(rec.Body.Bytes(), &login) != nil || login.Token == "" {
+		t.Fatalf("login: %d %s", rec.Code, rec.Body.String())
+	}
+	bob := createTestSession(t, server, "bob")
+	alice, _ := server.store.GetUserByUsername(ctx, "alice")
+	bobUser, _ := server.store.GetUserByUsername(ctx, "bob")
+	if err := server.store.AddFriendship(ctx, alice.ID, bobUser.ID); err != nil {
+		t.Fatalf("AddFriendship: %v", err)
+	}
+	conn, _, err := dialTestRoom(httpServer, login.Token, "lobby")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	bobConn, _, err := dialTestRoom(httpServer, bob, "lobby")
+	if err != nil {
+		t.Fatalf("dial bob: %v", err)
+	}
+	defer bobConn.Close()
+	waitForRoomSize(t, server.hub, "lobby", 2)
+
+	deleteAccount := func(password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/account/delete", strings.NewReader(`{"password":"`+password+`"}`))
+		req.Header.Set("Authorization", "Bearer "+login.Token)
+		rec := httptest.NewRecorder()
+		server.HandleDeleteAccount(rec, req)
+		return rec
+	}
+	if rec := deleteAccount("wrong"); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a wrong password, got %d %s", rec.Code, rec.Body.String())
+	}
+	if user, _ := server.store.GetUserByID(ctx, alice.ID); user == nil {
+		t.Fatal("expected alice kept after a wrong password")
+	}
+	if rec := deleteAccount("hunter22"); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", rec.Code, rec.Body.String())
+	}
+
+	if user, err := server.store.GetUserByID(ctx, alice.ID); err != nil || user != nil {
+		t.Fatalf("expected alice deleted, got %+v (%v)", user, err)
+	}
+	if friends, err := server.store.ListFriends(ctx, bobUser.ID); err != nil || len(friends) != 0 {
+		t.Fatalf("expected bob's friendship with alice gone, got %v (%v)", friends, err)
+	}
+	waitForRoomSize(t, server.hub, "lobby", 1)
+	if rec := deleteAccount("hunter22"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected the deleted account's token rejected, got %d", rec.Code)
+	}
+	if rec := postTestLogin(server, "alice"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected login to fail after deletion, got %d", rec.Code)
+	}
+	// Signing up as alice again would hand over her DMs with bob
+	if rec := postTestSignup(server, "alice"); rec.Code != http.StatusConflict {
+		t.Fatalf("expected alice's name kept from a new signup, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := postTestSignup(server, "Alice"); rec.Code != http.StatusConflict {
+		t.Fatalf("expected alice's name kept whatever the case, got %d %s", rec.Code, rec.Body.String())
+	}
+	dmConn, _, err := dialTestRoom(httpServer, bob, directRoomKey("alice", "bob"))
+	if err != nil {
+		t.Fatalf("expected bob to keep his DM history: %v", err)
+	}
+	dmConn.Close()
+}
+
+// TestBootstrap verifies /bootstrap returns who's signed in, their friends
+// with presence, their pending requests and the server's limits together
+func TestBootstrap(t *testing.T) {
+	server, httpServer := newTestServer(t)
+	ctx := context.Background()
+	aliceToken := createTestSession(t, server, "alice")
+	bobToken := createTestSession(t, server, "bob")
+	createTestSession(t, server, "carol")
+	createTestSession(t, server, "dave")
+	ids := map[string]int64{}
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		user, _ := server.store.GetUserByUsername(ctx, name)
+		ids[name] = user.ID
+	}
+	if err := server.store.AddFriendship(ctx, ids["alice"], ids["bob"]); err != nil {
+		t.Fatalf("AddFriendship: %v", err)
+	}
+	if _, err := server.store.CreateFriendRequest(ctx, ids["carol"], ids["alice"]); err != nil {
+		t.Fatalf("CreateFriendRequest: %v", err)
+	}
+	if _, err := server.store.CreateFriendRequest(ctx, ids["alice"], ids["dave"]); err != nil {
+		t.Fatalf("CreateFriendRequest: %v", err)
+	}
+	conn, _, err := dialTestRoom(httpServer, bobToken, "lobby")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	waitForRoomSize(t, server.hub, "lobby", 1)
+
+	req := httptest.NewRequest(http.MethodGet, "/bootstrap", nil)
+	req.Header.Set("Authorization", "Bearer "+aliceToken)
+	rec := httptest.NewRecorder()
+	server.HandleBootstrap(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("bootstrap: %d %s", rec.Code, rec.Body.String())
+	}
+	var shape map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &shape); err != nil {
+		t.Fatalf("decode %s: %v", rec.Body.String(), err)
+	}
+	for _, key := range []string{"username", "friends", "requests", "capabilities"} {
+		if _, ok := shape[key]; !ok {
+			t.Fatalf("expected %q in %s", key, rec.Body.String())
+		}
+	}
+	var resp bootstrapResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if resp.Username != "alice" {
+		t.Fatalf("expected alice, got %q", resp.Username)
+	}
+	if len(resp.Friends) != 1 || resp.Friends[0].Username != "bob" || !resp.Friends[0].Online {
+		t.Fatalf("expected bob listed online, got %+v", resp.Friends)
+	}
+	if fmt.Sprint(resp.Requests.Incoming) != "[carol]" || fmt.Sprint(resp.Requests.Outgoing) != "[dave]" {
+		t.Fatalf("unexpected requests %+v", resp.Requests)
+	}
+	if resp.Capabilities.MaxFileSize != 1024*1024 || resp.Capabilities.MaxMessageBytes != maxMessageBodyBytes || resp.Capabilities.HistoryLimit != DefaultHistoryLimit {
+		t.Fatalf("unexpected capabilities %+v", resp.Capabilities)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/bootstrap", nil)
+	rec = httptest.NewRecorder()
+	server.HandleBootstrap(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a session, got %d", rec.Code)
+	}
+}
+
+// TestBcryptCostIsConfigurable verifies new password hashes use the
+// configured cost, and that an out-of-range cost falls back to the default
+func TestBcryptCostIsConfigurable(t *testing.T) {
+	for _, tc := range []struct {
+		cost, want int
+	}{
+		{0, bcrypt.DefaultCost},
+		{5, 5},
+		{99, bcrypt.DefaultCost},
+	} {
+		server := NewServerWithOptions(newTestStore(t), ServerOptions{UploadDir: t.TempDir(), BcryptCost: tc.cost})
+		username := fmt.Sprintf("cost%d", tc.cost)
+		if rec := postTestSignup(server, username); rec.Code != http.StatusCreated {
+			t.Fatalf("signup: %d %s", rec.Code, rec.Body.String())
+		}
+		user, err := server.store.GetUserByUsername(context.Background(), username)
+		if err != nil || user == nil {
+			t.Fatalf("GetUserByUsername: %v", err)
+		}
+		if cost, err := bcrypt.Cost(user.PasswordHash); err != nil || cost != tc.want {
+			t.Errorf("cost %d: expected hashes at cost %d, got %d (%v)", tc.cost, tc.want, cost, err)
+		}
+	}
+}
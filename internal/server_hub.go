@@ -1,16 +1,39 @@
 package internal
 
-import "sync"
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"termchat/internal/storage"
+)
 
 // all active rooms state
 type Hub struct {
 	mutex sync.RWMutex
 	rooms map[string]*Room
+
+	uploadDir         string         // room files are removed from here once a room empties
+	fileStore         *storage.Store // when set, group room files survive an empty room
+	messageStore      *storage.Store // when set, chat history is saved and replayed on join
+	joinLeaveDebounce time.Duration  // how long a departure waits before it's announced
+	idleRoomTimeout   time.Duration  // empty rooms quiet for this long are torn down; 0 never
+	maxRoomSize       int            // connections a room takes at once; 0 is no limit
+	metrics           *Metrics       // counts each room's broadcasts; may be nil
+
+	// liveRooms mirrors len(rooms) so metrics can read it without the lock
+	liveRooms atomic.Int64
 }
 
+// defaultJoinLeaveDebounce hides reconnects: someone who drops and comes
+// back within it is neither announced as leaving nor as joining
+const defaultJoinLeaveDebounce = 2 * time.Second
+
 // builds an empty hub ready to serve websocket requests
 func NewHub() *Hub {
-	return &Hub{rooms: make(map[string]*Room)}
+	return &Hub{rooms: make(map[string]*Room), joinLeaveDebounce: defaultJoinLeaveDebounce}
 }
 
 // takes a peek into the room map. We use it for the lightweight /exists
@@ -21,29 +44,102 @@ func (hub *Hub) Exists(key string) bool {
 	return ok
 }
 
-// ensures there is a live Room for the given ke
+// ensures there is a live Room for the given key. Saved files are read
+// before the hub lock is taken so a slow store doesn't hold up every other
+// room; if someone else creates the room meanwhile, theirs wins.
 func (hub *Hub) getOrCreateRoom(key string) *Room {
+	if room := hub.getRoom(key); room != nil {
+		return room
+	}
+	files := hub.loadRoomFiles(key)
 	hub.mutex.Lock()
 	defer hub.mutex.Unlock()
 	if room, exists := hub.rooms[key]; exists {
 		return room
 	}
 	room := newRoom(key)
+	room.history = hub.messageStore
+	room.joinLeaveDebounce = hub.joinLeaveDebounce
+	room.metrics = hub.metrics
+	room.capacity = hub.maxRoomSize
+	room.files = files
 	hub.rooms[key] = room
+	hub.liveRooms.Add(1)
 	go room.run()
 	return room
 }
 
+// loadRoomFiles re-attaches files uploaded before the room last emptied
+func (hub *Hub) loadRoomFiles(key string) []UploadedFile {
+	if !hub.persistsFiles(key) {
+		return nil
+	}
+	saved, err := hub.fileStore.ListRoomFiles(context.Background(), key)
+	if err != nil {
+		log.Printf("load files for room %s: %v", key, err)
+	}
+	var files []UploadedFile
+	for _, f := range saved {
+		files = append(files, UploadedFile{
+			ID:          f.ID,
+			Filename:    f.Filename,
+			SizeBytes:   f.SizeBytes,
+			UploadedBy:  f.UploadedBy,
+			StoragePath: f.StoragePath,
+			UploadedAt:  f.UploadedAt,
+			SHA256:      f.SHA256,
+		})
+	}
+	return files
+}
+
+// deleteRoomIfEmpty removes the room once the last client leaves. Its files
+// are cleaned up too unless the hub persists them for this room.
 func (hub *Hub) deleteRoomIfEmpty(key string) {
 	hub.mutex.Lock()
 	defer hub.mutex.Unlock()
 	if room, exists := hub.rooms[key]; exists {
 		if room.size() == 0 {
-			delete(hub.rooms, key)
+			hub.removeRoomLocked(key, room)
 		}
 	}
 }
 
+// removeRoomLocked tears a room down and stops its run loop; hub.mutex must be
+// held
+func (hub *Hub) removeRoomLocked(key string, room *Room) {
+	if hub.uploadDir != "" && !hub.persistsFiles(key) {
+		room.deleteAllFiles(hub.uploadDir)
+	}
+	delete(hub.rooms, key)
+	hub.liveRooms.Add(-1)
+	room.stop()
+}
+
+// reapIdleRooms tears down rooms that have sat empty for idleRoomTimeout, in
+// case one was missed when its last client left. It returns how many went.
+func (hub *Hub) reapIdleRooms(now time.Time) int {
+	if hub.idleRoomTimeout <= 0 {
+		return 0
+	}
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	reaped := 0
+	for key, room := range hub.rooms {
+		if idle := room.idleFor(now); idle > 0 && idle >= hub.idleRoomTimeout {
+			hub.removeRoomLocked(key, room)
+			reaped++
+		}
+	}
+	return reaped
+}
+
+// roomCount reports how many rooms are live. It doesn't take the hub lock,
+// so a metrics scrape never waits behind a room being created.
+func (hub *Hub) roomCount() int {
+	return int(hub.liveRooms.Load())
+}
+
 // getRoom retrieves a room by key (may return nil)
 func (hub *Hub) getRoom(key string) *Room {
 	hub.mutex.RLock()
@@ -51,15 +147,73 @@ func (hub *Hub) getRoom(key string) *Room {
 	return hub.rooms[key]
 }
 
-// deleteRoomIfEmptyWithCleanup removes room and cleans up files
-func (hub *Hub) deleteRoomIfEmptyWithCleanup(key string, uploadDir string) {
-	hub.mutex.Lock()
-	defer hub.mutex.Unlock()
-	if room, exists := hub.rooms[key]; exists {
-		if room.size() == 0 {
-			// Clean up files before deleting room
-			room.deleteAllFiles(uploadDir)
-			delete(hub.rooms, key)
-		}
+// disconnectUser closes every connection the user has open, in any room,
+// telling each why, and returns how many were closed
+func (hub *Hub) disconnectUser(userID int64, reason string) int {
+	closed := 0
+	for _, room := range hub.snapshotRooms() {
+		closed += room.disconnectUser(userID, reason)
+	}
+	return closed
+}
+
+// closeAll says goodbye to every connected client and starts closing their
+// connections; each leaves its room as its read loop ends
+func (hub *Hub) closeAll(reason string) {
+	for _, room := range hub.snapshotRooms() {
+		room.closeAll(reason)
+	}
+}
+
+// dropAll cuts every connection off without waiting for a goodbye
+func (hub *Hub) dropAll() {
+	for _, room := range hub.snapshotRooms() {
+		room.dropAll()
+	}
+}
+
+func (hub *Hub) snapshotRooms() []*Room {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+	rooms := make([]*Room, 0, len(hub.rooms))
+	for _, room := range hub.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// persistsFiles reports whether files in this room outlive it. DMs always
+// stay ephemeral.
+func (hub *Hub) persistsFiles(key string) bool {
+	return hub.fileStore != nil && !isDirectRoom(key)
+}
+
+// recordFile saves file metadata so it can be re-attached to a recreated room
+func (hub *Hub) recordFile(ctx context.Context, roomKey string, file UploadedFile) {
+	if !hub.persistsFiles(roomKey) {
+		return
+	}
+	err := hub.fileStore.AddRoomFile(ctx, storage.RoomFile{
+		ID:          file.ID,
+		RoomKey:     roomKey,
+		Filename:    file.Filename,
+		SizeBytes:   file.SizeBytes,
+		UploadedBy:  file.UploadedBy,
+		StoragePath: file.StoragePath,
+		SHA256:      file.SHA256,
+		UploadedAt:  file.UploadedAt,
+	})
+	if err != nil {
+		log.Printf("persist file %s for room %s: %v", file.ID, roomKey, err)
+	}
+}
+
+// forgetFile drops a deleted file's saved metadata so it isn't re-attached
+func (hub *Hub) forgetFile(ctx context.Context, roomKey, fileID string) {
+	if !hub.persistsFiles(roomKey) {
+		return
+	}
+	if err := hub.fileStore.DeleteRoomFile(ctx, roomKey, fileID); err != nil {
+		log.Printf("forget file %s for room %s: %v", fileID, roomKey, err)
 	}
 }
@@ -0,0 +1,322 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"termchat/internal/storage"
+)
+
+// maxTrackedMessages bounds how far back a message can still be edited,
+// deleted or reacted to
+const maxTrackedMessages = 512
+
+// maxReactionRunes keeps reactions to a single emoji (with modifiers)
+const maxReactionRunes = 8
+
+// trackedMessage is what a room remembers about a recent message
+type trackedMessage struct {
+	authorID  int64
+	reactions map[string]map[int64]struct{} // emoji -> user IDs
+}
+
+// applyUpdate validates that the client wrote the message being edited or
+// deleted and broadcasts the change to the room
+func (client *Client) applyUpdate(payload []byte, now time.Time) {
+	var update MessageUpdate
+	if err := json.Unmarshal(payload, &update); err != nil || update.ID == "" {
+		return
+	}
+	if update.Type == "edit" && strings.TrimSpace(update.Body) == "" {
+		client.notify("Edited message can't be empty.", now)
+		return
+	}
+	if update.Type == "edit" && client.rejectLongBody(update.Body, now) {
+		return
+	}
+	authorID, ok := client.room.messageAuthor(update.ID)
+	if !ok {
+		client.notify("That message can no longer be changed.", now)
+		return
+	}
+	if authorID != client.userID {
+		client.notify("You can only change your own messages.", now)
+		return
+	}
+	if update.Type == "delete" {
+		client.room.forgetMessage(update.ID)
+		client.room.saveDelete(update.ID)
+		update.Type = "message_deleted"
+		update.Body = ""
+	} else {
+		client.room.saveEdit(update.ID, update.Body)
+		update.Type = "message_edited"
+	}
+	update.Room = client.room.key
+	update.User = client.username
+	update.Ts = now.Unix()
+	encoded, err := json.Marshal(update)
+	if err != nil {
+		return
+	}
+	client.room.publish(encoded)
+}
+
+// applyReaction toggles the client's reaction on a message and broadcasts the
+// message's new reaction counts
+func (client *Client) applyReaction(payload []byte, now time.Time) {
+	var reaction MessageReaction
+	if err := json.Unmarshal(payload, &reaction); err != nil || reaction.ID == "" {
+		return
+	}
+	if !validReaction(reaction.Emoji) {
+		client.notify("Reactions must be a single emoji.", now)
+		return
+	}
+	counts, ok := client.room.toggleReaction(reaction.ID, reaction.Emoji, client.userID)
+	if !ok {
+		client.notify("That message can no longer be reacted to.", now)
+		return
+	}
+	encoded, err := json.Marshal(MessageReaction{
+		Type:      "reactions",
+		ID:        reaction.ID,
+		Room:      client.room.key,
+		User:      client.username,
+		Emoji:     reaction.Emoji,
+		Reactions: counts,
+		Ts:        now.Unix(),
+	})
+	if err != nil {
+		return
+	}
+	client.room.publish(encoded)
+}
+
+// typingRelayInterval is the most often one client's typing notices are
+// passed on to the room
+const typingRelayInterval = time.Second
+
+// relayTyping tells the room the client's user is typing. Nothing is stored.
+func (client *Client) relayTyping(now time.Time) {
+	if now.Sub(client.lastTyping) < typingRelayInterval {
+		return
+	}
+	client.lastTyping = now
+	client.typing = true
+	encoded, err := json.Marshal(TypingNotice{Type: "typing", Room: client.room.key, User: client.username, Ts: now.Unix()})
+	if err != nil {
+		return
+	}
+	client.room.publish(encoded)
+}
+
+// relayTypingStopped tells the room the client's user stopped typing. It's
+// only passed on after a relayed typing notice and leaves that notice's
+// throttle running, so alternating the two can't be used to flood the room.
+func (client *Client) relayTypingStopped(now time.Time) {
+	if !client.typing {
+		return
+	}
+	client.typing = false
+	encoded, err := json.Marshal(TypingNotice{Type: "typing_stopped", Room: client.room.key, User: client.username, Ts: now.Unix()})
+	if err != nil {
+		return
+	}
+	client.room.publish(encoded)
+}
+
+func validReaction(emoji string) bool {
+	if emoji == "" || utf8.RuneCountInString(emoji) > maxReactionRunes {
+		return false
+	}
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// systemUserID is stored as the author of the server's own announcements; no
+// account ever gets ID 0
+const systemUserID = 0
+
+// saveMessage persists an accepted chat message. A failed write is logged
+// rather than dropping the message; it just won't be replayed later.
+func (room *Room) saveMessage(chat ChatMessage, userID int64, now time.Time) {
+	if room.history == nil {
+		return
+	}
+	err := room.history.InsertMessage(context.Background(), storage.Message{
+		ID:       chat.ID,
+		RoomKey:  room.key,
+		UserID:   userID,
+		Username: chat.User,
+		Body:     chat.Body,
+		Kind:     chat.Kind,
+		Ts:       now,
+	})
+	if err != nil {
+		log.Printf("persist message %s for room %s: %v", chat.ID, room.key, err)
+	}
+}
+
+func (room *Room) saveEdit(messageID, body string) {
+	if room.history == nil {
+		return
+	}
+	if err := room.history.EditMessage(context.Background(), messageID, body); err != nil {
+		log.Printf("persist edit of message %s: %v", messageID, err)
+	}
+}
+
+func (room *Room) saveDelete(messageID string) {
+	if room.history == nil {
+		return
+	}
+	if err := room.history.DeleteMessage(context.Background(), messageID); err != nil {
+		log.Printf("persist delete of message %s: %v", messageID, err)
+	}
+}
+
+// replayHistory sends the room's most recent saved messages to one client.
+// Replayed messages are tracked again, so they can still be edited, deleted
+// or reacted to after the room was recreated. It stops early if the client
+// can't take any more.
+func (room *Room) replayHistory(client *Client, limit int) {
+	if room.history == nil || limit <= 0 {
+		return
+	}
+	messages, err := room.history.ListMessages(context.Background(), room.key, limit, time.Time{})
+	if err != nil {
+		log.Printf("load history for room %s: %v", room.key, err)
+		return
+	}
+	for _, m := range messages {
+		chat := ChatMessage{
+			ID:      m.ID,
+			Room:    room.key,
+			User:    m.Username,
+			Body:    m.Body,
+			Kind:    m.Kind,
+			Ts:      m.Ts.Unix(),
+			TsMs:    m.Ts.UnixMilli(),
+			Edited:  m.Edited,
+			Deleted: m.Deleted,
+		}
+		if m.Kind == storage.AnnouncementKind {
+			// Announcements can't be edited or reacted to, so they aren't tracked
+			chat.Type = systemMessageType
+			chat.Kind = ""
+		} else if !m.Deleted {
+			if _, tracked := room.messageAuthor(m.ID); !tracked {
+				room.trackMessage(m.ID, m.UserID)
+			}
+			chat.Reactions = room.reactionCounts(m.ID)
+		}
+		payload, err := json.Marshal(chat)
+		if err != nil {
+			continue
+		}
+		if !client.trySend(payload) {
+			return
+		}
+	}
+}
+
+// trackMessage remembers who sent a message, forgetting the oldest entries
+// once maxTrackedMessages is reached
+func (room *Room) trackMessage(messageID string, userID int64) {
+	room.messagesMutex.Lock()
+	defer room.messagesMutex.Unlock()
+	room.trackLocked(messageID, &trackedMessage{authorID: userID})
+}
+
+// trackFile lets a shared file be reacted to. Files are credited to no user,
+// so nobody can edit or delete them as messages; /delete <file> removes them.
+func (room *Room) trackFile(fileID string) {
+	room.messagesMutex.Lock()
+	defer room.messagesMutex.Unlock()
+	room.trackLocked(fileID, &trackedMessage{authorID: systemUserID})
+}
+
+// trackLocked adds a tracked message; messagesMutex must be held
+func (room *Room) trackLocked(messageID string, message *trackedMessage) {
+	room.messages[messageID] = message
+	room.messageOrder = append(room.messageOrder, messageID)
+	if len(room.messageOrder) > maxTrackedMessages {
+		delete(room.messages, room.messageOrder[0])
+		room.messageOrder = room.messageOrder[1:]
+	}
+}
+
+// messageAuthor returns the user ID that sent a tracked message
+func (room *Room) messageAuthor(messageID string) (int64, bool) {
+	room.messagesMutex.Lock()
+	defer room.messagesMutex.Unlock()
+	message, ok := room.messages[messageID]
+	if !ok {
+		return 0, false
+	}
+	return message.authorID, true
+}
+
+// forgetMessage stops tracking a deleted message so it can't be changed again
+func (room *Room) forgetMessage(messageID string) {
+	room.messagesMutex.Lock()
+	defer room.messagesMutex.Unlock()
+	delete(room.messages, messageID)
+}
+
+// toggleReaction adds the user's reaction, or removes it if they already
+// reacted with that emoji, and returns the per-emoji counts
+func (room *Room) toggleReaction(messageID, emoji string, userID int64) (map[string]int, bool) {
+	room.messagesMutex.Lock()
+	defer room.messagesMutex.Unlock()
+	message, ok := room.messages[messageID]
+	if !ok {
+		return nil, false
+	}
+	if message.reactions == nil {
+		message.reactions = make(map[string]map[int64]struct{})
+	}
+	users := message.reactions[emoji]
+	if _, reacted := users[userID]; reacted {
+		delete(users, userID)
+		if len(users) == 0 {
+			delete(message.reactions, emoji)
+		}
+	} else {
+		if users == nil {
+			users = make(map[int64]struct{})
+			message.reactions[emoji] = users
+		}
+		users[userID] = struct{}{}
+	}
+	return message.counts(), true
+}
+
+// reactionCounts returns the per-emoji counts for a tracked message, or nil
+func (room *Room) reactionCounts(messageID string) map[string]int {
+	room.messagesMutex.Lock()
+	defer room.messagesMutex.Unlock()
+	message, ok := room.messages[messageID]
+	if !ok || len(message.reactions) == 0 {
+		return nil
+	}
+	return message.counts()
+}
+
+func (message *trackedMessage) counts() map[string]int {
+	counts := make(map[string]int, len(message.reactions))
+	for reaction, reactors := range message.reactions {
+		counts[reaction] = len(reactors)
+	}
+	return counts
+}
@@ -2,33 +2,70 @@ package internal
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+
+	"termchat/internal/storage"
 )
 
 // single room strucut
 type Room struct {
 	key        string
 	clients    map[*Client]bool
-	register   chan *Client
-	unregister chan *Client
+	register   chan joinRequest
 	broadcast  chan []byte
 	mutex      sync.RWMutex
 	files      []UploadedFile
 	filesMutex sync.RWMutex
+	// reservedBytes is set aside for uploads being saved, so they count
+	// against the quota before they're added; guarded by filesMutex
+	reservedBytes int64
+
+	// lastActive is when someone last joined, left or sent something; guarded
+	// by mutex. done stops run once the room is torn down.
+	lastActive time.Time
+	done       chan struct{}
+	stopOnce   sync.Once
+
+	// recent messages by ID, so edits, deletes and reactions can be checked
+	messages      map[string]*trackedMessage
+	messageOrder  []string
+	messagesMutex sync.Mutex
+
+	history  *storage.Store // nil when chat history isn't persisted
+	metrics  *Metrics       // nil when nobody is counting
+	capacity int            // most connections held at once; 0 is no limit
+
+	// join/leave announcements: open connections per user, and departures
+	// waiting out the debounce in case the user reconnects
+	joinLeaveDebounce time.Duration
+	userConns         map[int64]int
+	pendingLeaves     map[int64]*time.Timer
+	presenceMutex     sync.Mutex
 }
 
 func newRoom(key string) *Room {
 	return &Room{
-		key:        key,
-		clients:    make(map[*Client]bool),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		broadcast:  make(chan []byte, 256),
-		files:      make([]UploadedFile, 0),
+		key:       key,
+		clients:   make(map[*Client]bool),
+		register:  make(chan joinRequest),
+		broadcast: make(chan []byte, 256),
+		files:     make([]UploadedFile, 0),
+		messages:  make(map[string]*trackedMessage),
+
+		lastActive: time.Now(),
+		done:       make(chan struct{}),
+
+		userConns:     make(map[int64]int),
+		pendingLeaves: make(map[int64]*time.Timer),
 	}
 }
 
@@ -38,33 +75,299 @@ func (room *Room) size() int {
 	return len(room.clients)
 }
 
+// userCount reports distinct users, so one person on two devices counts once
+func (room *Room) userCount() int {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	users := make(map[int64]struct{}, len(room.clients))
+	for client := range room.clients {
+		users[client.userID] = struct{}{}
+	}
+	return len(users)
+}
+
+// hasUser reports whether the user already has a connection in the room
+func (room *Room) hasUser(userID int64) bool {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	for client := range room.clients {
+		if client.userID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// removeClient drops a client and closes its send channel. It runs on the
+// caller's goroutine rather than through run() so that once it returns the
+// room size already reflects the departure and deleteRoomIfEmpty sees it.
+func (room *Room) removeClient(client *Client) {
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	if _, exists := room.clients[client]; exists {
+		delete(room.clients, client)
+		client.closeSend()
+	}
+	room.lastActive = time.Now()
+}
+
+// idleFor reports how long the room has been empty and quiet, or zero while
+// anyone is connected
+func (room *Room) idleFor(now time.Time) time.Duration {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	if len(room.clients) > 0 {
+		return 0
+	}
+	return now.Sub(room.lastActive)
+}
+
+// joinRequest asks the run loop to add client, which answers on admitted
+type joinRequest struct {
+	client   *Client
+	admitted chan bool
+}
+
+var (
+	errRoomClosed = errors.New("room closed")
+	errRoomFull   = errors.New("room full")
+)
+
+// join hands a client to the run loop. It fails with errRoomClosed if the
+// room was torn down first, in which case the client should reconnect to a
+// fresh one, and with errRoomFull if the room is at capacity. The run loop
+// makes the capacity check, so joins racing for the last place can't both
+// get it.
+func (room *Room) join(client *Client) error {
+	request := joinRequest{client: client, admitted: make(chan bool, 1)}
+	select {
+	case room.register <- request:
+		if !<-request.admitted {
+			return errRoomFull
+		}
+		return nil
+	case <-room.done:
+		return errRoomClosed
+	}
+}
+
+// full reports whether the room is at capacity right now. It's only a hint
+// for turning people away early; join has the final say.
+func (room *Room) full() bool {
+	return room.capacity > 0 && room.size() >= room.capacity
+}
+
+// publish queues a payload for everyone in the room, dropping it if the room
+// has already been torn down
+func (room *Room) publish(payload []byte) {
+	select {
+	case room.broadcast <- payload:
+	case <-room.done:
+	}
+}
+
+// publishWithin is publish for HTTP handlers, which mustn't hang on a room
+// whose queue is full: it gives up after wait and reports whether the payload
+// was queued.
+func (room *Room) publishWithin(payload []byte, wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case room.broadcast <- payload:
+		return true
+	case <-room.done:
+		return false
+	case <-timer.C:
+		return false
+	}
+}
+
+// stop ends the run loop. Anything published afterwards is dropped with the
+// room.
+func (room *Room) stop() {
+	room.stopOnce.Do(func() { close(room.done) })
+}
+
+// disconnectUser drops all of a user's clients. Each is told why before its
+// send channel closes; writePump then hangs up and readPump cleans up as for
+// any other disconnect.
+func (room *Room) disconnectUser(userID int64, reason string) int {
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	now := time.Now()
+	closed := 0
+	for client := range room.clients {
+		if client.userID != userID {
+			continue
+		}
+		client.notify(reason, now)
+		delete(room.clients, client)
+		client.closeSend()
+		closed++
+	}
+	return closed
+}
+
+// closeAll notifies every client and drains their send queues. The clients
+// stay in the room until their read loops see the close and clean up, so
+// anything they sent first is still handled.
+func (room *Room) closeAll(reason string) {
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	now := time.Now()
+	for client := range room.clients {
+		client.notify(reason, now)
+		client.drainSend()
+	}
+}
+
+// dropAll closes every client's connection outright
+func (room *Room) dropAll() {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	for client := range room.clients {
+		client.conn.Close()
+	}
+}
+
+// announceJoin tells the room a user arrived, unless they already had a
+// connection here or are coming straight back from a drop
+func (room *Room) announceJoin(userID int64, username string) {
+	if username == "" {
+		return
+	}
+	room.presenceMutex.Lock()
+	defer room.presenceMutex.Unlock()
+	room.userConns[userID]++
+	if room.userConns[userID] > 1 {
+		return
+	}
+	if timer, ok := room.pendingLeaves[userID]; ok {
+		timer.Stop()
+		delete(room.pendingLeaves, userID)
+		return
+	}
+	room.announce(username + " joined")
+}
+
+// announceLeave tells the room a user left once their last connection is
+// gone and they haven't come back within the debounce
+func (room *Room) announceLeave(userID int64, username string) {
+	if username == "" {
+		return
+	}
+	room.presenceMutex.Lock()
+	defer room.presenceMutex.Unlock()
+	if room.userConns[userID] > 1 {
+		room.userConns[userID]--
+		return
+	}
+	delete(room.userConns, userID)
+	var timer *time.Timer
+	timer = time.AfterFunc(room.joinLeaveDebounce, func() {
+		room.presenceMutex.Lock()
+		defer room.presenceMutex.Unlock()
+		if room.pendingLeaves[userID] != timer {
+			return // they came back
+		}
+		delete(room.pendingLeaves, userID)
+		room.announce(username + " left")
+	})
+	room.pendingLeaves[userID] = timer
+}
+
+// announce sends a system line to everyone in the room and saves it with the
+// rest of the history, so people joining later see who came and went. It's
+// saved as an announcement so it doesn't take a real message's place.
+func (room *Room) announce(body string) {
+	now := time.Now()
+	chat := ChatMessage{
+		Type: systemMessageType,
+		ID:   uuid.NewString(),
+		Room: room.key,
+		User: "system",
+		Body: body,
+		Ts:   now.Unix(),
+		TsMs: now.UnixMilli(),
+	}
+	payload, err := json.Marshal(chat)
+	if err != nil {
+		return
+	}
+	stored := chat
+	stored.Kind = storage.AnnouncementKind
+	room.saveMessage(stored, systemUserID, now)
+	select {
+	case room.broadcast <- payload:
+	default:
+		// the room is swamped; a missed announcement isn't worth blocking for
+	}
+}
+
+// members returns the usernames connected to the room, once each, sorted
+func (room *Room) members() []string {
+	room.mutex.RLock()
+	defer room.mutex.RUnlock()
+	seen := make(map[string]bool, len(room.clients))
+	users := make([]string, 0, len(room.clients))
+	for client := range room.clients {
+		if !seen[client.username] {
+			seen[client.username] = true
+			users = append(users, client.username)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+func (room *Room) presencePayload() []byte {
+	payload, _ := json.Marshal(RoomPresence{Type: "presence", Room: room.key, Members: room.members()})
+	return payload
+}
+
+// broadcastPresence queues the current member list for everyone. It's used from
+// client goroutines once someone has left; run() sends its own on register.
+func (room *Room) broadcastPresence() {
+	select {
+	case room.broadcast <- room.presencePayload():
+	default:
+		// the room is swamped; the next update will catch everyone up
+	}
+}
+
 func (room *Room) run() {
 	for {
 		select {
-		case client := <-room.register:
+		case request := <-room.register:
 			room.mutex.Lock()
-			room.clients[client] = true
-			room.mutex.Unlock()
-		case client := <-room.unregister:
-			room.mutex.Lock()
-			if _, exists := room.clients[client]; exists {
-				delete(room.clients, client)
-				close(client.send)
+			admitted := room.capacity == 0 || len(room.clients) < room.capacity
+			if admitted {
+				room.clients[request.client] = true
 			}
 			room.mutex.Unlock()
-		case messagePayload := <-room.broadcast:
-			// Broadcast to every connected client. If a client can't keep up we
-			// close its send channel, which will trigger cleanup in writePump.
-			room.mutex.Lock()
-			for client := range room.clients {
-				select {
-				case client.send <- messagePayload:
-				default:
-					close(client.send)
-					delete(room.clients, client)
-				}
+			request.admitted <- admitted
+			if admitted {
+				room.sendToAll(room.presencePayload())
 			}
-			room.mutex.Unlock()
+		case messagePayload := <-room.broadcast:
+			room.metrics.IncBroadcast()
+			room.sendToAll(messagePayload)
+		case <-room.done:
+			return
+		}
+	}
+}
+
+// sendToAll delivers a payload to every connected client. If a client can't
+// keep up we close its send channel, which will trigger cleanup in writePump.
+func (room *Room) sendToAll(payload []byte) {
+	room.mutex.Lock()
+	defer room.mutex.Unlock()
+	room.lastActive = time.Now()
+	for client := range room.clients {
+		if !client.trySend(payload) {
+			client.closeSend()
+			delete(room.clients, client)
 		}
 	}
 }
@@ -73,27 +376,42 @@ type Client struct {
 	room         *Room
 	conn         *websocket.Conn
 	send         chan []byte
+	sendMutex    sync.Mutex // guards sendClosed so nothing writes to a closed send
+	sendClosed   bool
+	draining     bool // set by drainSend before send is closed
 	messageTimes []time.Time
+	rateLimit    rateLimit
+	lastTyping   time.Time // when this client's last typing notice was relayed
+	typing       bool      // the room was told this client is typing and not told otherwise
 	username     string
 	userID       int64
 	onDisconnect func()
 }
 
 const (
-	writeWait       = 10 * time.Second
-	pongWait        = 60 * time.Second
-	pingPeriod      = (pongWait * 9) / 10
-	maxMsgSize      = 8192
-	rateLimitWindow = 3 * time.Second
-	rateLimitBurst  = 5
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = (pongWait * 9) / 10
+	closeWait  = 5 * time.Second // how long the peer has to answer our close
+	// maxMsgSize is the websocket read limit. JSON may spell a body byte as
+	// six ("\u003c"), so it fits a full body written that way plus the rest
+	// of the frame.
+	maxMsgSize = maxMessageBodyBytes*6 + 2048
 )
 
-func newClient(room *Room, conn *websocket.Conn, username string, userID int64, onDisconnect func()) *Client {
+// rateLimit caps a client at burst messages in any window
+type rateLimit struct {
+	window time.Duration
+	burst  int
+}
+
+func newClient(room *Room, conn *websocket.Conn, username string, userID int64, limit rateLimit, onDisconnect func()) *Client {
 	return &Client{
 		room:         room,
 		conn:         conn,
 		send:         make(chan []byte, 256),
-		messageTimes: make([]time.Time, 0, rateLimitBurst),
+		messageTimes: make([]time.Time, 0, limit.burst),
+		rateLimit:    limit,
 		username:     username,
 		userID:       userID,
 		onDisconnect: onDisconnect,
@@ -102,8 +420,10 @@ func newClient(room *Room, conn *websocket.Conn, username string, userID int64,
 
 func (client *Client) readPump(hub *Hub, roomKey string) {
 	defer func() {
-		client.room.unregister <- client
+		client.room.removeClient(client)
 		client.conn.Close()
+		client.room.announceLeave(client.userID, client.username)
+		client.room.broadcastPresence()
 		hub.deleteRoomIfEmpty(roomKey)
 		if client.onDisconnect != nil {
 			client.onDisconnect()
@@ -122,42 +442,108 @@ func (client *Client) readPump(hub *Hub, roomKey string) {
 		}
 		var chatMessage ChatMessage
 		now := time.Now()
+		switch envelopeType(payload) {
+		case "edit", "delete":
+			if !client.allowMessage(now) {
+				client.notifyRateLimit(now)
+				continue
+			}
+			client.applyUpdate(payload, now)
+			continue
+		case "react":
+			if !client.allowMessage(now) {
+				client.notifyRateLimit(now)
+				continue
+			}
+			client.applyReaction(payload, now)
+			continue
+		case "typing":
+			// Typing notices don't count against the chat rate limit; they are
+			// throttled separately and dropped rather than answered
+			client.relayTyping(now)
+			continue
+		case "typing_stopped":
+			client.relayTypingStopped(now)
+			continue
+		}
 		if err := json.Unmarshal(payload, &chatMessage); err == nil {
 			if !client.allowMessage(now) {
 				client.notifyRateLimit(now)
 				continue
 			}
+			if client.rejectLongBody(chatMessage.Body, now) {
+				continue
+			}
 			if chatMessage.Ts == 0 {
 				chatMessage.Ts = now.Unix()
 			}
+			chatMessage.TsMs = now.UnixMilli()
 			if chatMessage.Room == "" {
 				chatMessage.Room = roomKey
 			}
 			chatMessage.User = client.username
+			chatMessage.Type = ""
+			if !chatMessage.isAction() {
+				// /me actions are the only kind there is so far
+				chatMessage.Kind = ""
+			}
+			// IDs are always server-assigned so a client can't collide with or
+			// take over another message's ID
+			chatMessage.ID = uuid.NewString()
+			chatMessage.Edited = false
+			chatMessage.Deleted = false
+			chatMessage.Reactions = nil
+			client.room.trackMessage(chatMessage.ID, client.userID)
+			client.room.saveMessage(chatMessage, client.userID, now)
 			encoded, _ := json.Marshal(chatMessage)
-			client.room.broadcast <- encoded
+			client.room.publish(encoded)
 		} else {
 			if !client.allowMessage(now) {
 				client.notifyRateLimit(now)
 				continue
 			}
-			client.room.broadcast <- payload
+			if client.rejectLongBody(string(payload), now) {
+				continue
+			}
+			// Wrap plain text so it is attributed to its sender instead of being
+			// relayed verbatim, where clients would show it as coming from the server
+			chatMessage = ChatMessage{
+				ID:   uuid.NewString(),
+				Room: roomKey,
+				User: client.username,
+				Body: string(payload),
+				Ts:   now.Unix(),
+				TsMs: now.UnixMilli(),
+			}
+			client.room.trackMessage(chatMessage.ID, client.userID)
+			client.room.saveMessage(chatMessage, client.userID, now)
+			encoded, _ := json.Marshal(chatMessage)
+			client.room.publish(encoded)
 		}
 	}
 }
 
 func (client *Client) writePump() {
 	ticker := time.NewTicker(pingPeriod)
+	closeConn := true
 	defer func() {
 		ticker.Stop()
-		client.conn.Close()
+		if closeConn {
+			client.conn.Close()
+		}
 	}()
 	for {
 		select {
 		case message, ok := <-client.send:
 			_ = client.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
-				_ = client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				err := client.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				if client.draining && err == nil {
+					// Leave the connection to the read loop so anything the
+					// peer sent before seeing our close is still handled
+					closeConn = false
+					_ = client.conn.SetReadDeadline(time.Now().Add(closeWait))
+				}
 				return
 			}
 			if err := client.conn.WriteMessage(websocket.TextMessage, message); err != nil {
@@ -175,7 +561,7 @@ func (client *Client) writePump() {
 // rate limits
 
 func (client *Client) allowMessage(now time.Time) bool {
-	cutoff := now.Add(-rateLimitWindow)
+	cutoff := now.Add(-client.rateLimit.window)
 	idx := 0
 	for _, ts := range client.messageTimes {
 		if ts.After(cutoff) {
@@ -184,27 +570,84 @@ func (client *Client) allowMessage(now time.Time) bool {
 		}
 	}
 	client.messageTimes = client.messageTimes[:idx]
-	if len(client.messageTimes) >= rateLimitBurst {
+	if len(client.messageTimes) >= client.rateLimit.burst {
 		return false
 	}
 	client.messageTimes = append(client.messageTimes, now)
 	return true
 }
 
+// rejectLongBody tells the client, and reports true, when a message body is
+// over maxMessageBodyBytes. Every line of a multi-line message counts.
+func (client *Client) rejectLongBody(body string, now time.Time) bool {
+	if len(body) <= maxMessageBodyBytes {
+		return false
+	}
+	client.notify(fmt.Sprintf("Messages can be at most %d bytes.", maxMessageBodyBytes), now)
+	return true
+}
+
 func (client *Client) notifyRateLimit(now time.Time) {
+	client.notify("You're sending messages too quickly. Please wait a moment and try again.", now)
+}
+
+// notify sends a system line to just this client
+func (client *Client) notify(body string, now time.Time) {
 	message := ChatMessage{
+		Type: systemMessageType,
+		ID:   uuid.NewString(),
 		Room: client.room.key,
 		User: "system",
-		Body: "You're sending messages too quickly. Please wait a moment and try again.",
+		Body: body,
 		Ts:   now.Unix(),
+		TsMs: now.UnixMilli(),
 	}
 	payload, err := json.Marshal(message)
 	if err != nil {
 		return
 	}
+	client.trySend(payload)
+}
+
+// trySend queues a payload for writePump without blocking. It reports false
+// if the client's buffer is full or the client has already been dropped, so
+// callers pushing many messages (such as a history replay) can stop early.
+// Every write to send must go through here; the room may close the channel
+// at any time from its own goroutine.
+func (client *Client) trySend(payload []byte) bool {
+	client.sendMutex.Lock()
+	defer client.sendMutex.Unlock()
+	if client.sendClosed {
+		return false
+	}
 	select {
 	case client.send <- payload:
+		return true
 	default:
+		return false
+	}
+}
+
+// drainSend closes the send queue like closeSend, but the connection stays
+// open briefly after the goodbye so the read loop can handle anything the peer
+// sent before it saw it
+func (client *Client) drainSend() {
+	client.sendMutex.Lock()
+	defer client.sendMutex.Unlock()
+	if !client.sendClosed {
+		client.sendClosed = true
+		client.draining = true
+		close(client.send)
+	}
+}
+
+// closeSend closes the send channel once, which tells writePump to hang up
+func (client *Client) closeSend() {
+	client.sendMutex.Lock()
+	defer client.sendMutex.Unlock()
+	if !client.sendClosed {
+		client.sendClosed = true
+		close(client.send)
 	}
 }
 
@@ -215,6 +658,50 @@ func (room *Room) addFile(file UploadedFile) {
 	room.files = append(room.files, file)
 }
 
+// listFiles returns a copy of the room's files
+func (room *Room) listFiles() []UploadedFile {
+	room.filesMutex.RLock()
+	defer room.filesMutex.RUnlock()
+	return append([]UploadedFile(nil), room.files...)
+}
+
+// filesSize returns how many bytes the room's files take up, counting space
+// reserved for uploads still being saved
+func (room *Room) filesSize() int64 {
+	room.filesMutex.RLock()
+	defer room.filesMutex.RUnlock()
+	return room.filesSizeLocked()
+}
+
+func (room *Room) filesSizeLocked() int64 {
+	total := room.reservedBytes
+	for _, file := range room.files {
+		total += file.SizeBytes
+	}
+	return total
+}
+
+// reserveFileSpace sets size bytes aside for an upload unless that would take
+// the room past quota, reporting how much was in use either way. The upload
+// is added before the space is released, so it's never counted out.
+func (room *Room) reserveFileSpace(size, quota int64) (int64, bool) {
+	room.filesMutex.Lock()
+	defer room.filesMutex.Unlock()
+	used := room.filesSizeLocked()
+	if used+size > quota {
+		return used, false
+	}
+	room.reservedBytes += size
+	return used, true
+}
+
+// releaseFileSpace gives back space set aside by reserveFileSpace
+func (room *Room) releaseFileSpace(size int64) {
+	room.filesMutex.Lock()
+	defer room.filesMutex.Unlock()
+	room.reservedBytes -= size
+}
+
 // getFile retrieves file metadata by ID
 func (room *Room) getFile(fileID string) *UploadedFile {
 	room.filesMutex.RLock()
@@ -227,6 +714,19 @@ func (room *Room) getFile(fileID string) *UploadedFile {
 	return nil
 }
 
+// removeFile drops a file from the room's list, reporting whether it was there
+func (room *Room) removeFile(fileID string) bool {
+	room.filesMutex.Lock()
+	defer room.filesMutex.Unlock()
+	for i := range room.files {
+		if room.files[i].ID == fileID {
+			room.files = append(room.files[:i], room.files[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 // deleteAllFiles removes all uploaded files from the filesystem
 func (room *Room) deleteAllFiles(uploadBaseDir string) {
 	room.filesMutex.Lock()
@@ -237,7 +737,7 @@ func (room *Room) deleteAllFiles(uploadBaseDir string) {
 	}
 
 	// Delete the entire room directory
-	roomDir := uploadBaseDir + "/" + room.key
+	roomDir := filepath.Join(uploadBaseDir, sanitizePathComponent(room.key))
 	_ = os.RemoveAll(roomDir)
 
 	// Clear files list
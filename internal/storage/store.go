@@ -28,6 +28,7 @@ type User struct {
 	Username     string
 	PasswordHash []byte
 	CreatedAt    time.Time
+	Disabled     bool // set by an operator; disabled users can't log in
 }
 
 // Session captures persisted logins.
@@ -38,6 +39,45 @@ type Session struct {
 	CreatedAt time.Time
 }
 
+// RoomFile is the persisted metadata for a file uploaded to a room.
+type RoomFile struct {
+	ID          string
+	RoomKey     string
+	Filename    string
+	SizeBytes   int64
+	UploadedBy  string
+	StoragePath string
+	SHA256      string
+	UploadedAt  time.Time
+}
+
+// Message is a persisted chat message. Deleted messages keep their row, with
+// the body cleared, so replays still show where they were.
+type Message struct {
+	ID       string
+	RoomKey  string
+	UserID   int64
+	Username string
+	Body     string
+	Kind     string // "action" for /me messages, AnnouncementKind for join/leave lines
+	Ts       time.Time
+	Edited   bool
+	Deleted  bool
+}
+
+// AuditEvent is one entry in the append-only audit log of account security
+// events. UserID is zero when the event names no known account, e.g. a failed
+// login for a username that doesn't exist.
+type AuditEvent struct {
+	ID        int64
+	Event     string
+	UserID    int64
+	Username  string
+	Target    string // the other user, for events like blocks that have one
+	IP        string
+	CreatedAt time.Time
+}
+
 // ErrUserExists is returned when attempting to insert a duplicate username.
 var ErrUserExists = errors.New("user already exists")
 
@@ -98,7 +138,8 @@ func (s *Store) Migrate(ctx context.Context) error {
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			username TEXT NOT NULL UNIQUE,
 			password_hash BLOB NOT NULL,
-			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			disabled INTEGER NOT NULL DEFAULT 0
 		);`,
 		`CREATE TABLE IF NOT EXISTS sessions (
 			token TEXT PRIMARY KEY,
@@ -123,6 +164,55 @@ func (s *Store) Migrate(ctx context.Context) error {
 			FOREIGN KEY(requester_id) REFERENCES users(id) ON DELETE CASCADE,
 			FOREIGN KEY(receiver_id) REFERENCES users(id) ON DELETE CASCADE
 		);`,
+		`CREATE TABLE IF NOT EXISTS room_files (
+			id TEXT PRIMARY KEY,
+			room_key TEXT NOT NULL,
+			filename TEXT NOT NULL,
+			size_bytes INTEGER NOT NULL,
+			uploaded_by TEXT NOT NULL,
+			storage_path TEXT NOT NULL,
+			sha256 TEXT NOT NULL,
+			uploaded_at DATETIME NOT NULL
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_room_files_room ON room_files(room_key, uploaded_at);`,
+		`CREATE TABLE IF NOT EXISTS messages (
+			id TEXT PRIMARY KEY,
+			room_key TEXT NOT NULL,
+			user_id INTEGER NOT NULL,
+			username TEXT NOT NULL,
+			body TEXT NOT NULL,
+			ts INTEGER NOT NULL,
+			edited INTEGER NOT NULL DEFAULT 0,
+			deleted INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_room_ts ON messages(room_key, ts);`,
+		`CREATE TABLE IF NOT EXISTS room_bans (
+			room_key TEXT NOT NULL,
+			user_id INTEGER NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (room_key, user_id),
+			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS blocks (
+			blocker_id INTEGER NOT NULL,
+			blocked_id INTEGER NOT NULL,
+			created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (blocker_id, blocked_id),
+			FOREIGN KEY(blocker_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY(blocked_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			event TEXT NOT NULL,
+			user_id INTEGER NOT NULL,
+			username TEXT NOT NULL,
+			ip TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS retired_usernames (
+			username TEXT PRIMARY KEY,
+			retired_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);`,
 	}
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
@@ -138,12 +228,62 @@ func (s *Store) Migrate(ctx context.Context) error {
 			return err
 		}
 	}
+	// databases created before accounts could be disabled lack the column
+	if err = addColumnIfMissing(ctx, tx, "users", "disabled", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	// and those from before /me actions lack message kinds
+	if err = addColumnIfMissing(ctx, tx, "messages", "kind", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// and audit logs from before block events recorded who was blocked
+	if err = addColumnIfMissing(ctx, tx, "audit_log", "target", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
-// CreateUser inserts a new user. ErrUserExists is returned on conflicts.
+func addColumnIfMissing(ctx context.Context, tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// CreateUser inserts a new user. ErrUserExists is returned on conflicts,
+// including with the name of a deleted account in any case.
 func (s *Store) CreateUser(ctx context.Context, username string, passwordHash []byte) (int64, error) {
-	result, err := s.db.ExecContext(ctx, `INSERT INTO users(username, password_hash) VALUES(?, ?)`, username, passwordHash)
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO users(username, password_hash)
+		SELECT ?, ? WHERE NOT EXISTS (SELECT 1 FROM retired_usernames WHERE username = lower(?))
+	`, username, passwordHash, username)
+	if err == nil {
+		if inserted, _ := result.RowsAffected(); inserted == 0 {
+			return 0, ErrUserExists
+		}
+	}
 	if err != nil {
 		if isConstraintError(err) {
 			return 0, ErrUserExists
@@ -155,9 +295,9 @@ func (s *Store) CreateUser(ctx context.Context, username string, passwordHash []
 
 // GetUserByUsername fetches a user by username.
 func (s *Store) GetUserByUsername(ctx context.Context, username string) (*User, error) {
-	row := s.db.QueryRowContext(ctx, `SELECT id, username, password_hash, created_at FROM users WHERE username = ?`, username)
+	row := s.db.QueryRowContext(ctx, `SELECT id, username, password_hash, created_at, disabled FROM users WHERE username = ?`, username)
 	var user User
-	if err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt); err != nil {
+	if err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt, &user.Disabled); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
@@ -168,9 +308,9 @@ func (s *Store) GetUserByUsername(ctx context.Context, username string) (*User,
 
 // GetUserByID fetches a user by primary key.
 func (s *Store) GetUserByID(ctx context.Context, id int64) (*User, error) {
-	row := s.db.QueryRowContext(ctx, `SELECT id, username, password_hash, created_at FROM users WHERE id = ?`, id)
+	row := s.db.QueryRowContext(ctx, `SELECT id, username, password_hash, created_at, disabled FROM users WHERE id = ?`, id)
 	var user User
-	if err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt); err != nil {
+	if err := row.Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt, &user.Disabled); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
@@ -204,6 +344,57 @@ func (s *Store) DeleteSession(ctx context.Context, token string) error {
 	return err
 }
 
+// DeleteUserSessions removes every session a user holds, signing them out
+// everywhere. It returns how many sessions were removed.
+func (s *Store) DeleteUserSessions(ctx context.Context, userID int64) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteExpiredSessions removes every session that expired before now and
+// returns how many went. Lookups already ignore them; this just keeps the
+// table small.
+func (s *Store) DeleteExpiredSessions(ctx context.Context, now time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM sessions WHERE expires_at < ?`, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// SetUserDisabled marks a user as disabled (or re-enables them).
+func (s *Store) SetUserDisabled(ctx context.Context, userID int64, disabled bool) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE users SET disabled=? WHERE id=?`, disabled, userID)
+	return err
+}
+
+// DeleteUser removes a user. Their sessions, friendships, friend requests,
+// blocks and room bans are removed with them by the foreign keys. The
+// username is retired rather than freed: DM rooms, messages and files are
+// keyed by name, so whoever took it next would inherit them. It's kept lower
+// case so "Alice" can't slip past a retired "alice" either.
+func (s *Store) DeleteUser(ctx context.Context, userID int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	if _, err = tx.ExecContext(ctx, `INSERT OR IGNORE INTO retired_usernames(username) SELECT lower(username) FROM users WHERE id=?`, userID); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM users WHERE id=?`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 // AddFriendship inserts symmetric rows for a friendship pair.
 func (s *Store) AddFriendship(ctx context.Context, userID, friendID int64) error {
 	if userID == friendID {
@@ -227,6 +418,36 @@ func (s *Store) AddFriendship(ctx context.Context, userID, friendID int64) error
 	return tx.Commit()
 }
 
+// RemoveFriendship deletes both rows of a friendship pair. It reports whether
+// the two were friends.
+func (s *Store) RemoveFriendship(ctx context.Context, userID, friendID int64) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	var removed int64
+	for _, pair := range [][2]int64{{userID, friendID}, {friendID, userID}} {
+		var result sql.Result
+		if result, err = tx.ExecContext(ctx, `DELETE FROM friendships WHERE user_id = ? AND friend_id = ?`, pair[0], pair[1]); err != nil {
+			return false, err
+		}
+		var n int64
+		if n, err = result.RowsAffected(); err != nil {
+			return false, err
+		}
+		removed += n
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	return removed > 0, nil
+}
+
 // ListFriends returns all friends for a given user (ordered by username).
 func (s *Store) ListFriends(ctx context.Context, userID int64) ([]User, error) {
 	rows, err := s.db.QueryContext(ctx, `
@@ -266,13 +487,15 @@ func (s *Store) AreFriends(ctx context.Context, userID, friendID int64) (bool, e
 }
 
 // CreateFriendRequest stores a pending request if one does not already exist.
-func (s *Store) CreateFriendRequest(ctx context.Context, requesterID, receiverID int64) error {
+// If the receiver already has a pending request to the requester, both requests
+// are accepted instead and accepted is true.
+func (s *Store) CreateFriendRequest(ctx context.Context, requesterID, receiverID int64) (accepted bool, err error) {
 	if requesterID == receiverID {
-		return fmt.Errorf("cannot send a friend request to yourself")
+		return false, fmt.Errorf("cannot send a friend request to yourself")
 	}
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer func() {
 		if err != nil {
@@ -282,27 +505,45 @@ func (s *Store) CreateFriendRequest(ctx context.Context, requesterID, receiverID
 	// Prevent duplicates or already-friends cases.
 	var existing int
 	if err = tx.QueryRowContext(ctx, `SELECT COUNT(1) FROM friendships WHERE user_id=? AND friend_id=?`, requesterID, receiverID).Scan(&existing); err != nil {
-		return err
+		return false, err
 	}
 	if existing > 0 {
-		return ErrFriendRequestExists
+		err = ErrFriendRequestExists
+		return false, err
 	}
 	if err = tx.QueryRowContext(ctx, `SELECT COUNT(1) FROM friend_requests WHERE requester_id=? AND receiver_id=?`, requesterID, receiverID).Scan(&existing); err != nil {
-		return err
+		return false, err
 	}
 	if existing > 0 {
-		return ErrFriendRequestExists
+		err = ErrFriendRequestExists
+		return false, err
 	}
-	if err = tx.QueryRowContext(ctx, `SELECT COUNT(1) FROM friend_requests WHERE requester_id=? AND receiver_id=?`, receiverID, requesterID).Scan(&existing); err != nil {
-		return err
+	// A pending request the other way means both users want this; make them friends.
+	res, err := tx.ExecContext(ctx, `DELETE FROM friend_requests WHERE requester_id=? AND receiver_id=?`, receiverID, requesterID)
+	if err != nil {
+		return false, err
 	}
-	if existing > 0 {
-		return ErrFriendRequestExists
+	reverse, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if reverse > 0 {
+		if _, err = tx.ExecContext(ctx, `INSERT OR IGNORE INTO friendships(user_id, friend_id) VALUES(?, ?)`, requesterID, receiverID); err != nil {
+			return false, err
+		}
+		if _, err = tx.ExecContext(ctx, `INSERT OR IGNORE INTO friendships(user_id, friend_id) VALUES(?, ?)`, receiverID, requesterID); err != nil {
+			return false, err
+		}
+		if err = tx.Commit(); err != nil {
+			return false, err
+		}
+		return true, nil
 	}
 	if _, err = tx.ExecContext(ctx, `INSERT INTO friend_requests(requester_id, receiver_id) VALUES(?, ?)`, requesterID, receiverID); err != nil {
-		return err
+		return false, err
 	}
-	return tx.Commit()
+	err = tx.Commit()
+	return false, err
 }
 
 // DeleteFriendRequest removes any pending request between the two users.
@@ -379,7 +620,8 @@ func (s *Store) AcceptFriendRequest(ctx context.Context, requesterID, receiverID
 		return err
 	}
 	if rows == 0 {
-		return sql.ErrNoRows
+		err = sql.ErrNoRows
+		return err
 	}
 	if _, err = tx.ExecContext(ctx, `INSERT OR IGNORE INTO friendships(user_id, friend_id) VALUES(?, ?)`, requesterID, receiverID); err != nil {
 		return err
@@ -396,6 +638,264 @@ func (s *Store) UpdatePassword(ctx context.Context, userID int64, newHash []byte
 	return err
 }
 
+// AddRoomFile records metadata for an uploaded file so it outlives the room.
+func (s *Store) AddRoomFile(ctx context.Context, file RoomFile) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO room_files(id, room_key, filename, size_bytes, uploaded_by, storage_path, sha256, uploaded_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)
+	`, file.ID, file.RoomKey, file.Filename, file.SizeBytes, file.UploadedBy, file.StoragePath, file.SHA256, file.UploadedAt.UTC())
+	return err
+}
+
+// ListRoomFiles returns persisted files for a room (oldest first).
+func (s *Store) ListRoomFiles(ctx context.Context, roomKey string) ([]RoomFile, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, room_key, filename, size_bytes, uploaded_by, storage_path, sha256, uploaded_at
+		FROM room_files
+		WHERE room_key = ?
+		ORDER BY uploaded_at ASC
+	`, roomKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var files []RoomFile
+	for rows.Next() {
+		var f RoomFile
+		if err := rows.Scan(&f.ID, &f.RoomKey, &f.Filename, &f.SizeBytes, &f.UploadedBy, &f.StoragePath, &f.SHA256, &f.UploadedAt); err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
+
+// DeleteRoomFile forgets a persisted file's metadata. Deleting a file that
+// isn't recorded is not an error.
+func (s *Store) DeleteRoomFile(ctx context.Context, roomKey, fileID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM room_files WHERE room_key = ? AND id = ?`, roomKey, fileID)
+	return err
+}
+
+// AddAuditEvent appends an entry to the audit log. Entries are never updated
+// or deleted.
+func (s *Store) AddAuditEvent(ctx context.Context, event AuditEvent) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO audit_log(event, user_id, username, target, ip, created_at)
+		VALUES(?, ?, ?, ?, ?, ?)
+	`, event.Event, event.UserID, event.Username, event.Target, event.IP, event.CreatedAt.UTC())
+	return err
+}
+
+// ListAuditEvents returns up to limit of the most recent audit entries,
+// newest first.
+func (s *Store) ListAuditEvents(ctx context.Context, limit int) ([]AuditEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, event, user_id, username, target, ip, created_at
+		FROM audit_log
+		ORDER BY id DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []AuditEvent
+	for rows.Next() {
+		var e AuditEvent
+		if err := rows.Scan(&e.ID, &e.Event, &e.UserID, &e.Username, &e.Target, &e.IP, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// InsertMessage stores a chat message. Timestamps keep millisecond precision
+// so messages sent within the same second stay in order.
+func (s *Store) InsertMessage(ctx context.Context, msg Message) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO messages(id, room_key, user_id, username, body, kind, ts)
+		VALUES(?, ?, ?, ?, ?, ?, ?)
+	`, msg.ID, msg.RoomKey, msg.UserID, msg.Username, msg.Body, msg.Kind, msg.Ts.UnixMilli())
+	return err
+}
+
+// AnnouncementKind marks the server's join/leave lines. They're kept with a
+// room's history but don't count towards it: they neither use up a page of
+// messages nor make an otherwise empty room exist.
+const AnnouncementKind = "announcement"
+
+// ListMessages returns up to limit of a room's most recent messages sent
+// before the given time (or the latest if before is zero), oldest first,
+// along with up to limit announcements made among them.
+func (s *Store) ListMessages(ctx context.Context, roomKey string, limit int, before time.Time) ([]Message, error) {
+	beforeMs := int64(0)
+	if !before.IsZero() {
+		beforeMs = before.UnixMilli()
+	}
+	// The page is counted in real messages; announcements ride along only
+	// if they fall inside it
+	rows, err := s.db.QueryContext(ctx, `
+		WITH page AS (
+			SELECT rowid AS seq, ts FROM messages
+			WHERE room_key = ? AND kind != ? AND (? = 0 OR ts < ?)
+			ORDER BY ts DESC, rowid DESC
+			LIMIT ?
+		)
+		SELECT id, room_key, user_id, username, body, kind, ts, edited, deleted
+		FROM messages
+		WHERE rowid IN (SELECT seq FROM page)
+			OR rowid IN (
+				SELECT rowid FROM messages
+				WHERE room_key = ? AND kind = ? AND ts >= (SELECT MIN(ts) FROM page) AND (? = 0 OR ts < ?)
+				ORDER BY ts DESC, rowid DESC
+				LIMIT ?
+			)
+		ORDER BY ts, rowid
+	`, roomKey, AnnouncementKind, beforeMs, beforeMs, limit,
+		roomKey, AnnouncementKind, beforeMs, beforeMs, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var messages []Message
+	for rows.Next() {
+		var m Message
+		var tsMs int64
+		if err := rows.Scan(&m.ID, &m.RoomKey, &m.UserID, &m.Username, &m.Body, &m.Kind, &tsMs, &m.Edited, &m.Deleted); err != nil {
+			return nil, err
+		}
+		m.Ts = time.UnixMilli(tsMs)
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// EditMessage replaces a message's body and marks it edited.
+func (s *Store) EditMessage(ctx context.Context, id, body string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE messages SET body = ?, edited = 1 WHERE id = ? AND deleted = 0`, body, id)
+	return err
+}
+
+// DeleteMessage clears a message's body and marks it deleted.
+func (s *Store) DeleteMessage(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE messages SET body = '', deleted = 1 WHERE id = ?`, id)
+	return err
+}
+
+// RoomHasHistory reports whether anything was saved for the room, messages
+// or kept files, so it's still there to come back to once everyone leaves.
+// Announcements alone don't count.
+func (s *Store) RoomHasHistory(ctx context.Context, roomKey string) (bool, error) {
+	var found bool
+	err := s.db.QueryRowContext(ctx, `
+		SELECT EXISTS(SELECT 1 FROM messages WHERE room_key = ? AND kind != ?)
+			OR EXISTS(SELECT 1 FROM room_files WHERE room_key = ?)
+	`, roomKey, AnnouncementKind, roomKey).Scan(&found)
+	return found, err
+}
+
+// BanFromRoom keeps a user out of a room until UnbanFromRoom. Banning twice
+// is harmless.
+func (s *Store) BanFromRoom(ctx context.Context, roomKey string, userID int64) error {
+	_, err := s.db.ExecContext(ctx, `INSERT OR IGNORE INTO room_bans(room_key, user_id) VALUES(?, ?)`, roomKey, userID)
+	return err
+}
+
+// UnbanFromRoom lets a banned user back into a room.
+func (s *Store) UnbanFromRoom(ctx context.Context, roomKey string, userID int64) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM room_bans WHERE room_key = ? AND user_id = ?`, roomKey, userID)
+	return err
+}
+
+// IsBannedFromRoom reports whether the user is banned from the room.
+func (s *Store) IsBannedFromRoom(ctx context.Context, roomKey string, userID int64) (bool, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT 1 FROM room_bans WHERE room_key = ? AND user_id = ?`, roomKey, userID)
+	var exists int
+	if err := row.Scan(&exists); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// BlockUser stops two users from befriending or messaging each other. Any
+// friendship or pending request between them goes too, in either direction.
+func (s *Store) BlockUser(ctx context.Context, blockerID, blockedID int64) error {
+	if blockerID == blockedID {
+		return fmt.Errorf("cannot block yourself")
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+	if _, err = tx.ExecContext(ctx, `INSERT OR IGNORE INTO blocks(blocker_id, blocked_id) VALUES(?, ?)`, blockerID, blockedID); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM friendships WHERE (user_id = ? AND friend_id = ?) OR (user_id = ? AND friend_id = ?)`, blockerID, blockedID, blockedID, blockerID); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM friend_requests WHERE (requester_id = ? AND receiver_id = ?) OR (requester_id = ? AND receiver_id = ?)`, blockerID, blockedID, blockedID, blockerID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UnblockUser lifts a block. It doesn't restore a friendship the block ended.
+func (s *Store) UnblockUser(ctx context.Context, blockerID, blockedID int64) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM blocks WHERE blocker_id = ? AND blocked_id = ?`, blockerID, blockedID)
+	return err
+}
+
+// ListBlockedUsers fetches the users blockerID has blocked, oldest block first.
+func (s *Store) ListBlockedUsers(ctx context.Context, blockerID int64) ([]User, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT u.id, u.username, u.password_hash, u.created_at
+		FROM blocks b
+		JOIN users u ON u.id = b.blocked_id
+		WHERE b.blocker_id = ?
+		ORDER BY b.created_at ASC, u.username ASC
+	`, blockerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// IsBlocked reports whether either user has blocked the other.
+func (s *Store) IsBlocked(ctx context.Context, userID, otherID int64) (bool, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT 1 FROM blocks
+		WHERE (blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?)
+		LIMIT 1
+	`, userID, otherID, otherID, userID)
+	var exists int
+	if err := row.Scan(&exists); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
 func isConstraintError(err error) bool {
 	var sqliteErr *sqlite.Error
 	if errors.As(err, &sqliteErr) {
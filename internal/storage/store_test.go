@@ -2,6 +2,9 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 )
@@ -66,6 +69,232 @@ func TestSessionLifecycle(t *testing.T) {
 	}
 }
 
+// TestDeleteExpiredSessions verifies only sessions past their expiry are
+// swept
+func TestDeleteExpiredSessions(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	userID, err := store.CreateUser(ctx, "bob", []byte("hash"))
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if err := store.CreateSession(ctx, userID, "stale", time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("CreateSession stale: %v", err)
+	}
+	if err := store.CreateSession(ctx, userID, "fresh", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("CreateSession fresh: %v", err)
+	}
+	if removed, err := store.DeleteExpiredSessions(ctx, time.Now().Add(-2*time.Hour)); err != nil || removed != 0 {
+		t.Fatalf("expected nothing expired two hours ago, got %d (%v)", removed, err)
+	}
+	removed, err := store.DeleteExpiredSessions(ctx, time.Now())
+	if err != nil {
+		t.Fatalf("DeleteExpiredSessions: %v", err)
+	}
+	if removed != 1 {
+		t.Fatalf("expected 1 expired session removed, got %d", removed)
+	}
+	if session, err := store.GetSession(ctx, "stale"); err != nil || session != nil {
+		t.Fatalf("expected the expired session gone, got %+v (%v)", session, err)
+	}
+	if session, err := store.GetSession(ctx, "fresh"); err != nil || session == nil {
+		t.Fatalf("expected the live session kept, got %+v (%v)", session, err)
+	}
+}
+
+func TestDisableUserAndDeleteSessions(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	// an existing database from before accounts could be disabled
+	if _, err := store.db.ExecContext(ctx, `CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE,
+		password_hash BLOB NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`); err != nil {
+		t.Fatalf("create old users table: %v", err)
+	}
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("second migrate: %v", err)
+	}
+	userID, err := store.CreateUser(ctx, "mallory", []byte("hash"))
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	otherID, err := store.CreateUser(ctx, "bob", []byte("hash"))
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	exp := time.Now().Add(time.Hour)
+	for _, token := range []string{"m1", "m2"} {
+		if err := store.CreateSession(ctx, userID, token, exp); err != nil {
+			t.Fatalf("CreateSession: %v", err)
+		}
+	}
+	if err := store.CreateSession(ctx, otherID, "b1", exp); err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+
+	removed, err := store.DeleteUserSessions(ctx, userID)
+	if err != nil {
+		t.Fatalf("DeleteUserSessions: %v", err)
+	}
+	if removed != 2 {
+		t.Fatalf("expected 2 sessions removed, got %d", removed)
+	}
+	if session, _ := store.GetSession(ctx, "m1"); session != nil {
+		t.Fatalf("expected mallory's sessions to be gone")
+	}
+	if session, _ := store.GetSession(ctx, "b1"); session == nil {
+		t.Fatalf("expected bob's session to remain")
+	}
+
+	if err := store.SetUserDisabled(ctx, userID, true); err != nil {
+		t.Fatalf("SetUserDisabled: %v", err)
+	}
+	user, err := store.GetUserByID(ctx, userID)
+	if err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+	if user == nil || !user.Disabled {
+		t.Fatalf("expected mallory to be disabled: %+v", user)
+	}
+	if other, _ := store.GetUserByUsername(ctx, "bob"); other == nil || other.Disabled {
+		t.Fatalf("expected bob to stay enabled: %+v", other)
+	}
+
+	if err := store.SetUserDisabled(ctx, userID, false); err != nil {
+		t.Fatalf("SetUserDisabled re-enable: %v", err)
+	}
+	if user, _ := store.GetUserByUsername(ctx, "mallory"); user == nil || user.Disabled {
+		t.Fatalf("expected mallory to be re-enabled: %+v", user)
+	}
+}
+
+// TestDeleteUserCascades verifies deleting a user takes their sessions,
+// friendships, friend requests and blocks with them, which relies on the
+// foreign_keys pragma being on
+func TestDeleteUserCascades(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	var enabled int
+	if err := store.db.QueryRowContext(ctx, `PRAGMA foreign_keys`).Scan(&enabled); err != nil || enabled != 1 {
+		t.Fatalf("expected foreign keys enforced, got %d (%v)", enabled, err)
+	}
+	aliceID, _ := store.CreateUser(ctx, "alice", []byte("hash"))
+	bobID, _ := store.CreateUser(ctx, "bob", []byte("hash"))
+	carolID, _ := store.CreateUser(ctx, "carol", []byte("hash"))
+	if err := store.CreateSession(ctx, aliceID, "a1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if err := store.AddFriendship(ctx, aliceID, bobID); err != nil {
+		t.Fatalf("AddFriendship: %v", err)
+	}
+	if _, err := store.CreateFriendRequest(ctx, carolID, aliceID); err != nil {
+		t.Fatalf("CreateFriendRequest: %v", err)
+	}
+	if err := store.BlockUser(ctx, aliceID, carolID); err != nil {
+		t.Fatalf("BlockUser: %v", err)
+	}
+	if err := store.BanFromRoom(ctx, "lobby", aliceID); err != nil {
+		t.Fatalf("BanFromRoom: %v", err)
+	}
+
+	if err := store.DeleteUser(ctx, aliceID); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if user, err := store.GetUserByID(ctx, aliceID); err != nil || user != nil {
+		t.Fatalf("expected alice gone, got %+v (%v)", user, err)
+	}
+	for table, column := range map[string]string{
+		"sessions":        "user_id",
+		"friendships":     "friend_id",
+		"friend_requests": "receiver_id",
+		"blocks":          "blocker_id",
+		"room_bans":       "user_id",
+	} {
+		var rows int
+		if err := store.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM `+table+` WHERE `+column+` = ?`, aliceID).Scan(&rows); err != nil {
+			t.Fatalf("count %s: %v", table, err)
+		}
+		if rows != 0 {
+			t.Errorf("expected alice's %s rows removed, found %d", table, rows)
+		}
+	}
+	if friends, err := store.ListFriends(ctx, bobID); err != nil || len(friends) != 0 {
+		t.Fatalf("expected bob to have no friends left, got %v (%v)", friends, err)
+	}
+	if outgoing, err := store.ListOutgoingFriendRequests(ctx, carolID); err != nil || len(outgoing) != 0 {
+		t.Fatalf("expected carol's request gone, got %v (%v)", outgoing, err)
+	}
+	if _, err := store.CreateUser(ctx, "alice", []byte("hash")); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("expected alice's name retired, got %v", err)
+	}
+	if _, err := store.CreateUser(ctx, "Alice", []byte("hash")); !errors.Is(err, ErrUserExists) {
+		t.Fatalf("expected alice's name retired whatever the case, got %v", err)
+	}
+}
+
+func TestRoomBans(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	userID, err := store.CreateUser(ctx, "mallory", []byte("hash"))
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.BanFromRoom(ctx, "lobby", userID); err != nil {
+			t.Fatalf("BanFromRoom: %v", err)
+		}
+	}
+	if banned, err := store.IsBannedFromRoom(ctx, "lobby", userID); err != nil || !banned {
+		t.Fatalf("expected mallory banned from lobby, got %v %v", banned, err)
+	}
+	if banned, err := store.IsBannedFromRoom(ctx, "other", userID); err != nil || banned {
+		t.Fatalf("expected the ban to cover only lobby, got %v %v", banned, err)
+	}
+	if err := store.UnbanFromRoom(ctx, "lobby", userID); err != nil {
+		t.Fatalf("UnbanFromRoom: %v", err)
+	}
+	if banned, err := store.IsBannedFromRoom(ctx, "lobby", userID); err != nil || banned {
+		t.Fatalf("expected the ban lifted, got %v %v", banned, err)
+	}
+}
+
+func TestRoomHasHistory(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if err := store.InsertMessage(ctx, Message{ID: "m1", RoomKey: "chatty", Username: "alice", Body: "hi", Ts: time.Now()}); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	if err := store.AddRoomFile(ctx, RoomFile{ID: "f1", RoomKey: "filed", Filename: "a.txt", UploadedBy: "alice", StoragePath: "/tmp/a.txt", UploadedAt: time.Now()}); err != nil {
+		t.Fatalf("AddRoomFile: %v", err)
+	}
+	if err := store.InsertMessage(ctx, Message{ID: "a1", RoomKey: "visited", Username: "alice", Body: "alice joined", Kind: AnnouncementKind, Ts: time.Now()}); err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	for room, want := range map[string]bool{"chatty": true, "filed": true, "visited": false, "never": false} {
+		if got, err := store.RoomHasHistory(ctx, room); err != nil || got != want {
+			t.Errorf("%s: expected %v, got %v %v", room, want, got, err)
+		}
+	}
+}
+
 func TestFriendships(t *testing.T) {
 	store := newTestStore(t)
 	ctx := context.Background()
@@ -95,6 +324,96 @@ func TestFriendships(t *testing.T) {
 	}
 }
 
+func TestRemoveFriendship(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	aliceID, _ := store.CreateUser(ctx, "alice", []byte("hash1"))
+	bobID, _ := store.CreateUser(ctx, "bob", []byte("hash2"))
+	carolID, _ := store.CreateUser(ctx, "carol", []byte("hash3"))
+	for _, friendID := range []int64{bobID, carolID} {
+		if err := store.AddFriendship(ctx, aliceID, friendID); err != nil {
+			t.Fatalf("AddFriendship: %v", err)
+		}
+	}
+
+	// Either side can end it, and it's gone for both
+	removed, err := store.RemoveFriendship(ctx, bobID, aliceID)
+	if err != nil || !removed {
+		t.Fatalf("RemoveFriendship: removed=%v err=%v", removed, err)
+	}
+	for _, pair := range [][2]int64{{aliceID, bobID}, {bobID, aliceID}} {
+		if ok, err := store.AreFriends(ctx, pair[0], pair[1]); err != nil || ok {
+			t.Fatalf("expected %d and %d no longer friends, got %v %v", pair[0], pair[1], ok, err)
+		}
+	}
+	friends, err := store.ListFriends(ctx, aliceID)
+	if err != nil || len(friends) != 1 || friends[0].Username != "carol" {
+		t.Fatalf("expected carol to remain alice's friend, got %+v %v", friends, err)
+	}
+
+	if removed, err := store.RemoveFriendship(ctx, aliceID, bobID); err != nil || removed {
+		t.Fatalf("expected removing again to report nothing removed, got %v %v", removed, err)
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	aliceID, _ := store.CreateUser(ctx, "alice", []byte("hash1"))
+	bobID, _ := store.CreateUser(ctx, "bob", []byte("hash2"))
+	carolID, _ := store.CreateUser(ctx, "carol", []byte("hash3"))
+	if err := store.AddFriendship(ctx, aliceID, bobID); err != nil {
+		t.Fatalf("AddFriendship: %v", err)
+	}
+	if _, err := store.CreateFriendRequest(ctx, carolID, aliceID); err != nil {
+		t.Fatalf("CreateFriendRequest: %v", err)
+	}
+
+	if err := store.BlockUser(ctx, aliceID, aliceID); err == nil {
+		t.Fatal("expected blocking yourself to fail")
+	}
+	for _, blockedID := range []int64{bobID, carolID} {
+		if err := store.BlockUser(ctx, aliceID, blockedID); err != nil {
+			t.Fatalf("BlockUser: %v", err)
+		}
+	}
+	// Blocks apply both ways, whoever asked for them
+	for _, pair := range [][2]int64{{aliceID, bobID}, {bobID, aliceID}, {carolID, aliceID}} {
+		if blocked, err := store.IsBlocked(ctx, pair[0], pair[1]); err != nil || !blocked {
+			t.Fatalf("expected %d and %d blocked, got %v %v", pair[0], pair[1], blocked, err)
+		}
+	}
+	if blocked, _ := store.IsBlocked(ctx, bobID, carolID); blocked {
+		t.Fatal("expected bob and carol unaffected")
+	}
+	if friends, _ := store.ListFriends(ctx, bobID); len(friends) != 0 {
+		t.Fatalf("expected the friendship ended, got %+v", friends)
+	}
+	if incoming, _ := store.ListIncomingFriendRequests(ctx, aliceID); len(incoming) != 0 {
+		t.Fatalf("expected carol's request dropped, got %+v", incoming)
+	}
+
+	// Only the blocker's own block is lifted
+	if err := store.UnblockUser(ctx, bobID, aliceID); err != nil {
+		t.Fatalf("UnblockUser: %v", err)
+	}
+	if blocked, _ := store.IsBlocked(ctx, aliceID, bobID); !blocked {
+		t.Fatal("expected bob unable to lift alice's block")
+	}
+	if err := store.UnblockUser(ctx, aliceID, bobID); err != nil {
+		t.Fatalf("UnblockUser: %v", err)
+	}
+	if blocked, _ := store.IsBlocked(ctx, aliceID, bobID); blocked {
+		t.Fatal("expected the block lifted")
+	}
+}
+
 func TestFriendRequests(t *testing.T) {
 	store := newTestStore(t)
 	ctx := context.Background()
@@ -103,10 +422,10 @@ func TestFriendRequests(t *testing.T) {
 	}
 	aliceID, _ := store.CreateUser(ctx, "alice", []byte("hash1"))
 	bobID, _ := store.CreateUser(ctx, "bob", []byte("hash2"))
-	if err := store.CreateFriendRequest(ctx, aliceID, bobID); err != nil {
+	if _, err := store.CreateFriendRequest(ctx, aliceID, bobID); err != nil {
 		t.Fatalf("CreateFriendRequest: %v", err)
 	}
-	if err := store.CreateFriendRequest(ctx, aliceID, bobID); err == nil {
+	if _, err := store.CreateFriendRequest(ctx, aliceID, bobID); err == nil {
 		t.Fatalf("expected duplicate friend request error")
 	}
 	incoming, err := store.ListIncomingFriendRequests(ctx, bobID)
@@ -125,6 +444,43 @@ func TestFriendRequests(t *testing.T) {
 	}
 }
 
+// TestMutualFriendRequestsBecomeFriends verifies a request back to someone who
+// already asked is accepted instead of rejected as a duplicate
+func TestMutualFriendRequestsBecomeFriends(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	aliceID, _ := store.CreateUser(ctx, "alice", []byte("hash1"))
+	bobID, _ := store.CreateUser(ctx, "bob", []byte("hash2"))
+	accepted, err := store.CreateFriendRequest(ctx, aliceID, bobID)
+	if err != nil || accepted {
+		t.Fatalf("expected pending request, got accepted=%v err=%v", accepted, err)
+	}
+	accepted, err = store.CreateFriendRequest(ctx, bobID, aliceID)
+	if err != nil {
+		t.Fatalf("reverse CreateFriendRequest: %v", err)
+	}
+	if !accepted {
+		t.Fatal("expected reverse request to be accepted")
+	}
+	for _, userID := range []int64{aliceID, bobID} {
+		friends, err := store.ListFriends(ctx, userID)
+		if err != nil || len(friends) != 1 {
+			t.Fatalf("expected one friend for user %d: %+v, err=%v", userID, friends, err)
+		}
+		incoming, _ := store.ListIncomingFriendRequests(ctx, userID)
+		outgoing, _ := store.ListOutgoingFriendRequests(ctx, userID)
+		if len(incoming) != 0 || len(outgoing) != 0 {
+			t.Fatalf("expected no pending requests for user %d, got in=%v out=%v", userID, incoming, outgoing)
+		}
+	}
+	if _, err := store.CreateFriendRequest(ctx, aliceID, bobID); !errors.Is(err, ErrFriendRequestExists) {
+		t.Fatalf("expected ErrFriendRequestExists once friends, got %v", err)
+	}
+}
+
 func TestUpdatePassword(t *testing.T) {
 	store := newTestStore(t)
 	ctx := context.Background()
@@ -141,6 +497,102 @@ func TestUpdatePassword(t *testing.T) {
 	}
 }
 
+func TestMessageHistory(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	base := time.UnixMilli(1_700_000_000_000)
+	for i, body := range []string{"one", "two", "three", "four"} {
+		err := store.InsertMessage(ctx, Message{
+			ID:       body,
+			RoomKey:  "room",
+			UserID:   1,
+			Username: "alice",
+			Body:     body,
+			// two and three land in the same second, a millisecond apart
+			Ts: base.Add(time.Duration(i) * time.Millisecond),
+		})
+		if err != nil {
+			t.Fatalf("InsertMessage: %v", err)
+		}
+	}
+	_ = store.InsertMessage(ctx, Message{ID: "other", RoomKey: "elsewhere", Username: "bob", Body: "hi", Ts: base})
+	_ = store.InsertMessage(ctx, Message{ID: "wave", RoomKey: "elsewhere", Username: "bob", Body: "waves", Kind: "action", Ts: base.Add(time.Millisecond)})
+	if elsewhere, _ := store.ListMessages(ctx, "elsewhere", 10, time.Time{}); len(elsewhere) != 2 || elsewhere[0].Kind != "" || elsewhere[1].Kind != "action" {
+		t.Fatalf("expected message kinds kept, got %+v", elsewhere)
+	}
+
+	latest, err := store.ListMessages(ctx, "room", 2, time.Time{})
+	if err != nil {
+		t.Fatalf("ListMessages: %v", err)
+	}
+	if len(latest) != 2 || latest[0].Body != "three" || latest[1].Body != "four" {
+		t.Fatalf("expected the two newest oldest-first, got %+v", latest)
+	}
+	older, _ := store.ListMessages(ctx, "room", 10, latest[0].Ts)
+	if len(older) != 2 || older[0].Body != "one" || older[1].Body != "two" {
+		t.Fatalf("expected the messages before three, got %+v", older)
+	}
+
+	if err := store.EditMessage(ctx, "one", "uno"); err != nil {
+		t.Fatalf("EditMessage: %v", err)
+	}
+	if err := store.DeleteMessage(ctx, "two"); err != nil {
+		t.Fatalf("DeleteMessage: %v", err)
+	}
+	all, _ := store.ListMessages(ctx, "room", 10, time.Time{})
+	if !all[0].Edited || all[0].Body != "uno" {
+		t.Errorf("expected an edited first message, got %+v", all[0])
+	}
+	if !all[1].Deleted || all[1].Body != "" {
+		t.Errorf("expected a deleted second message, got %+v", all[1])
+	}
+}
+
+// TestAnnouncementsDontFillThePage verifies join/leave announcements come back
+// among the messages they fall between without taking their place in the page
+func TestAnnouncementsDontFillThePage(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	base := time.UnixMilli(1_700_000_000_000)
+	at := 0
+	insert := func(id, body, kind string) {
+		t.Helper()
+		at++
+		msg := Message{ID: id, RoomKey: "room", Username: "alice", Body: body, Kind: kind, Ts: base.Add(time.Duration(at) * time.Millisecond)}
+		if err := store.InsertMessage(ctx, msg); err != nil {
+			t.Fatalf("InsertMessage: %v", err)
+		}
+	}
+	insert("early", "bob joined", AnnouncementKind)
+	insert("one", "one", "")
+	insert("two", "two", "")
+	for i := 0; i < 5; i++ {
+		insert(fmt.Sprintf("churn%d", i), "bob left", AnnouncementKind)
+	}
+	insert("three", "three", "")
+
+	page, err := store.ListMessages(ctx, "room", 2, time.Time{})
+	if err != nil {
+		t.Fatalf("ListMessages: %v", err)
+	}
+	var bodies []string
+	for _, m := range page {
+		bodies = append(bodies, m.Body)
+	}
+	if got := strings.Join(bodies, ", "); got != "two, bob left, bob left, three" {
+		t.Fatalf("expected two messages with the announcements between them, got %s", got)
+	}
+	if all, _ := store.ListMessages(ctx, "room", 10, time.Time{}); len(all) != 8 || all[0].ID != "one" {
+		t.Fatalf("expected every message with the announcements since the first, got %+v", all)
+	}
+}
+
 func newTestStore(t *testing.T) *Store {
 	t.Helper()
 	path := "sqlite://file:" + t.Name() + "?mode=memory&cache=shared"
@@ -153,3 +605,33 @@ func newTestStore(t *testing.T) *Store {
 	})
 	return store
 }
+
+func TestAuditLog(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	if err := store.Migrate(ctx); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	now := time.Now()
+	for i, event := range []string{"signup", "login_failed", "login"} {
+		if err := store.AddAuditEvent(ctx, AuditEvent{Event: event, UserID: 7, Username: "alice", IP: "10.0.0.1", CreatedAt: now.Add(time.Duration(i) * time.Second)}); err != nil {
+			t.Fatalf("AddAuditEvent %s: %v", event, err)
+		}
+	}
+	events, err := store.ListAuditEvents(ctx, 2)
+	if err != nil {
+		t.Fatalf("ListAuditEvents: %v", err)
+	}
+	if len(events) != 2 || events[0].Event != "login" || events[1].Event != "login_failed" {
+		t.Fatalf("expected the two newest events, newest first, got %+v", events)
+	}
+	if events[0].UserID != 7 || events[0].Username != "alice" || events[0].IP != "10.0.0.1" || events[0].CreatedAt.IsZero() {
+		t.Fatalf("unexpected event %+v", events[0])
+	}
+	if err := store.AddAuditEvent(ctx, AuditEvent{Event: "user_blocked", UserID: 7, Username: "alice", Target: "bob", IP: "10.0.0.1", CreatedAt: now.Add(time.Minute)}); err != nil {
+		t.Fatalf("AddAuditEvent with a target: %v", err)
+	}
+	if events, err := store.ListAuditEvents(ctx, 1); err != nil || len(events) != 1 || events[0].Target != "bob" {
+		t.Fatalf("expected the block's target back, got %+v %v", events, err)
+	}
+}
@@ -1,15 +1,25 @@
 package internal
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 )
 
+// checksumAssets are the release files listing each binary's SHA-256, tried
+// in order; releases made before SHA256SUMS only have checksums.txt
+var checksumAssets = []string{"SHA256SUMS", "checksums.txt"}
+
 // CheckForUpdate checks if a newer version is available
 func CheckForUpdate() (bool, string, error) {
 	latest, err := GetLatestVersion()
@@ -44,9 +54,15 @@ func UpdateToLatest() error {
 	// Get download URL
 	downloadURL := GetDownloadURL(latest)
 	
+	// Look up the published checksum so the download can be verified
+	expectedSum, err := fetchExpectedChecksum(GetReleaseURL(latest), GetPlatform())
+	if err != nil {
+		return fmt.Errorf("failed to get checksum: %w", err)
+	}
+	
 	// Download new binary
 	fmt.Println("Downloading...")
-	tmpFile, err := downloadBinary(downloadURL)
+	tmpFile, err := downloadBinary(downloadURL, expectedSum)
 	if err != nil {
 		return fmt.Errorf("download failed: %w", err)
 	}
@@ -81,8 +97,54 @@ func UpdateToLatest() error {
 	return nil
 }
 
-// downloadBinary downloads a binary from the given URL
-func downloadBinary(url string) (string, error) {
+// fetchExpectedChecksum finds the SHA-256 the release publishes for the named
+// binary
+func fetchExpectedChecksum(releaseURL, name string) (string, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	for _, asset := range checksumAssets {
+		resp, err := client.Get(releaseURL + "/" + asset)
+		if err != nil {
+			return "", err
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("fetching %s failed with status %d", asset, resp.StatusCode)
+		}
+		if err != nil {
+			return "", err
+		}
+		sum, ok := parseChecksums(data, name)
+		if !ok {
+			return "", fmt.Errorf("%s has no checksum for %s", asset, name)
+		}
+		return sum, nil
+	}
+	return "", fmt.Errorf("release publishes no checksums")
+}
+
+// parseChecksums reads sha256sum output ("<hex>  <file>", or "<hex> *<file>"
+// in binary mode) and returns the hash listed for name
+func parseChecksums(data []byte, name string) (string, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if path.Base(strings.TrimPrefix(fields[1], "*")) == name {
+			return strings.ToLower(fields[0]), true
+		}
+	}
+	return "", false
+}
+
+// downloadBinary downloads a binary from the given URL and checks it against
+// the expected SHA-256 before handing it over
+func downloadBinary(url, expectedSum string) (string, error) {
 	client := &http.Client{Timeout: 2 * time.Minute}
 	resp, err := client.Get(url)
 	if err != nil {
@@ -101,12 +163,19 @@ func downloadBinary(url string) (string, error) {
 	}
 	defer tmpFile.Close()
 	
-	// Download to temporary file
-	if _, err := io.Copy(tmpFile, resp.Body); err != nil {
+	// Download to temporary file, hashing as we go
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmpFile, hash), resp.Body); err != nil {
 		os.Remove(tmpFile.Name())
 		return "", err
 	}
 	
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != expectedSum {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return "", fmt.Errorf("checksum mismatch: expected %s, got %s", expectedSum, sum)
+	}
+	
 	return tmpFile.Name(), nil
 }
 
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestDownloadVerifiesChecksum verifies an update is only handed over when it
+// matches the checksum the release publishes, and is deleted when it doesn't
+func TestDownloadVerifiesChecksum(t *testing.T) {
+	binary := []byte("new termchat binary")
+	digest := sha256.Sum256(binary)
+	sum := hex.EncodeToString(digest[:])
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/SHA256SUMS":
+			_, _ = w.Write([]byte("0123  termchat-windows-amd64.exe\n" + sum + " *termchat-linux-amd64\n"))
+		case "/v1/checksums.txt":
+			_, _ = w.Write([]byte(sum + "  termchat-linux-amd64\n"))
+		case "/termchat-linux-amd64":
+			_, _ = w.Write(binary)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer httpServer.Close()
+
+	for _, release := range []string{"/v2", "/v1"} {
+		got, err := fetchExpectedChecksum(httpServer.URL+release, "termchat-linux-amd64")
+		if err != nil || got != sum {
+			t.Fatalf("%s: expected %s, got %q (%v)", release, sum, got, err)
+		}
+	}
+	if _, err := fetchExpectedChecksum(httpServer.URL+"/v2", "termchat-macos-arm64"); err == nil {
+		t.Fatal("expected an error for a platform without a checksum")
+	}
+	if _, err := fetchExpectedChecksum(httpServer.URL+"/v0", "termchat-linux-amd64"); err == nil {
+		t.Fatal("expected an error for a release without checksums")
+	}
+
+	path, err := downloadBinary(httpServer.URL+"/termchat-linux-amd64", sum)
+	if err != nil {
+		t.Fatalf("downloadBinary: %v", err)
+	}
+	os.Remove(path)
+
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+	_, err = downloadBinary(httpServer.URL+"/termchat-linux-amd64", strings.Repeat("0", 64))
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	if left, _ := os.ReadDir(tmpDir); len(left) != 0 {
+		t.Fatalf("expected the rejected download to be removed, found %v", left)
+	}
+}
@@ -68,11 +68,14 @@ func CompareVersions(v1, v2 string) int {
 	return -1
 }
 
+// GetReleaseURL returns the base URL of a release's downloadable assets
+func GetReleaseURL(version string) string {
+	return fmt.Sprintf("https://github.com/%s/%s/releases/download/v%s", GitHubOwner, GitHubRepo, version)
+}
+
 // GetDownloadURL returns the download URL for the current platform
 func GetDownloadURL(version string) string {
-	platform := GetPlatform()
-	baseURL := fmt.Sprintf("https://github.com/%s/%s/releases/download/v%s", GitHubOwner, GitHubRepo, version)
-	return fmt.Sprintf("%s/%s", baseURL, platform)
+	return fmt.Sprintf("%s/%s", GetReleaseURL(version), GetPlatform())
 }
 
 // GetPlatform returns the binary name for the current platform